@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The method of envoy's ext_authz gRPC service (envoy.service.auth.v3.Authorization).
+const extAuthzCheckPath = "/envoy.service.auth.v3.Authorization/Check"
+
+// The maximum size of a CheckRequest. Envoy only includes the request body, if with_request_body is configured.
+const maxCheckRequestSize = 4 << 20
+
+// gRPC status codes, see https://grpc.io/docs/guides/status-codes/
+const (
+	grpcStatusOk               = 0
+	grpcStatusInvalidArgument  = 3
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnimplemented    = 12
+	grpcStatusUnauthenticated  = 16
+)
+
+// Values of envoy's HeaderValueOption.HeaderAppendAction.
+const (
+	appendIfExistsOrAdd    = 0
+	overwriteIfExistsOrAdd = 2
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf message")
+
+// checkRequest contains the parts of envoy's CheckRequest, which are needed to restore the original request.
+type checkRequest struct {
+	sourceAddress string
+	sourcePort    uint64
+	method        string
+	scheme        string
+	host          string
+	path          string
+	headers       http.Header
+	body          []byte
+}
+
+// extAuthzHandler returns the handler of envoy's ext_authz gRPC service. Every Check is handled by the middleware
+// like the original request, and its response is returned as the ok_response or denied_response.
+// Only unary, uncompressed gRPC calls are supported, which is what envoy sends.
+func (server *forwardAuthServer) extAuthzHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(rw, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/grpc")
+
+		if req.URL.Path != extAuthzCheckPath {
+			writeGrpcStatus(rw, grpcStatusUnimplemented, "unknown method "+req.URL.Path)
+			return
+		}
+
+		message, err := readGrpcMessage(req.Body)
+		if err != nil {
+			writeGrpcStatus(rw, grpcStatusInvalidArgument, err.Error())
+			return
+		}
+
+		check, err := decodeCheckRequest(message)
+		if err != nil {
+			writeGrpcStatus(rw, grpcStatusInvalidArgument, err.Error())
+			return
+		}
+
+		original, err := check.toHttpRequest(req.Context())
+		if err != nil {
+			writeGrpcStatus(rw, grpcStatusInvalidArgument, err.Error())
+			return
+		}
+
+		response := &checkResponseWriter{header: http.Header{}}
+		server.authenticate(response, restoreClientAddress(original, server.trustedProxies))
+
+		writeGrpcMessage(rw, server.encodeCheckResponse(response))
+	})
+}
+
+// readGrpcMessage reads the single length-prefixed message of a unary call.
+func readGrpcMessage(body io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read the message: %w", err)
+	}
+
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages aren't supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxCheckRequestSize {
+		return nil, errors.New("the message is too large")
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, fmt.Errorf("failed to read the message: %w", err)
+	}
+
+	return message, nil
+}
+
+func writeGrpcMessage(rw http.ResponseWriter, message []byte) {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(prefix)
+	rw.Write(message)
+
+	rw.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcStatusOk))
+}
+
+// writeGrpcStatus writes a response without a message, whose status is sent in the headers.
+func writeGrpcStatus(rw http.ResponseWriter, code int, message string) {
+	rw.Header().Set("Grpc-Status", strconv.Itoa(code))
+	rw.Header().Set("Grpc-Message", message)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// decodeCheckRequest decodes the attributes of the original request from a CheckRequest.
+func decodeCheckRequest(message []byte) (*checkRequest, error) {
+	check := &checkRequest{headers: http.Header{}}
+
+	// CheckRequest.attributes
+	err := readProtoFields(message, func(number int, _ uint64, attributes []byte) error {
+		if number != 1 {
+			return nil
+		}
+
+		return readProtoFields(attributes, func(number int, _ uint64, value []byte) error {
+			switch number {
+			case 1: // AttributeContext.source
+				return check.decodeSource(value)
+			case 4: // AttributeContext.request
+				return readProtoFields(value, func(number int, _ uint64, value []byte) error {
+					if number == 2 { // Request.http
+						return check.decodeHttpRequest(value)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if check.method == "" || check.path == "" {
+		return nil, errors.New("the check request doesn't contain the http request")
+	}
+
+	return check, nil
+}
+
+// decodeSource decodes the client address from Peer.address.socket_address.
+func (check *checkRequest) decodeSource(peer []byte) error {
+	return readProtoFields(peer, func(number int, _ uint64, address []byte) error {
+		if number != 1 {
+			return nil
+		}
+
+		return readProtoFields(address, func(number int, _ uint64, socketAddress []byte) error {
+			if number != 1 {
+				return nil
+			}
+
+			return readProtoFields(socketAddress, func(number int, value uint64, data []byte) error {
+				switch number {
+				case 2:
+					check.sourceAddress = string(data)
+				case 3:
+					check.sourcePort = value
+				}
+				return nil
+			})
+		})
+	})
+}
+
+func (check *checkRequest) decodeHttpRequest(message []byte) error {
+	var headerMap http.Header
+
+	err := readProtoFields(message, func(number int, _ uint64, value []byte) error {
+		switch number {
+		case 2:
+			check.method = string(value)
+		case 3: // map<string, string> headers
+			key, headerValue, err := decodeKeyValue(value)
+			if err != nil {
+				return err
+			}
+			addCheckHeader(check.headers, key, headerValue)
+		case 4:
+			check.path = string(value)
+		case 5:
+			check.host = string(value)
+		case 6:
+			check.scheme = string(value)
+		case 11:
+			if check.body == nil {
+				check.body = value
+			}
+		case 12: // raw_body takes precedence over body
+			check.body = value
+		case 13: // header_map, which is sent instead of headers, if envoy encodes raw headers
+			headerMap = http.Header{}
+			return readProtoFields(value, func(number int, _ uint64, header []byte) error {
+				if number != 1 {
+					return nil
+				}
+
+				key, headerValue, err := decodeKeyValue(header)
+				if err != nil {
+					return err
+				}
+				addCheckHeader(headerMap, key, headerValue)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(check.headers) == 0 && headerMap != nil {
+		check.headers = headerMap
+	}
+
+	return nil
+}
+
+// addCheckHeader adds a header of the original request. Envoy also sends the HTTP/2 pseudo headers, which are part of the request line instead.
+func addCheckHeader(headers http.Header, key string, value string) {
+	if strings.HasPrefix(key, ":") {
+		return
+	}
+
+	headers.Add(key, value)
+}
+
+// decodeKeyValue decodes a map entry or an envoy HeaderValue. The raw_value of a HeaderValue takes precedence over its value.
+func decodeKeyValue(message []byte) (string, string, error) {
+	var key, value string
+	var rawValue []byte
+
+	err := readProtoFields(message, func(number int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		case 3:
+			rawValue = data
+		}
+		return nil
+	})
+
+	if rawValue != nil {
+		value = string(rawValue)
+	}
+
+	return key, value, err
+}
+
+// toHttpRequest restores the original request of the client.
+func (check *checkRequest) toHttpRequest(ctx context.Context) (*http.Request, error) {
+	scheme := check.scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, check.method, scheme+"://"+check.host+check.path, bytes.NewReader(check.body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = check.headers
+	req.Host = check.host
+	req.RequestURI = check.path
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", scheme)
+	}
+
+	if check.sourceAddress != "" {
+		req.RemoteAddr = net.JoinHostPort(check.sourceAddress, strconv.FormatUint(check.sourcePort, 10))
+	}
+
+	return req, nil
+}
+
+// encodeCheckResponse translates the response of the middleware into a CheckResponse. Authenticated requests
+// are forwarded with the identity headers, while all other responses are returned to the client as they are.
+func (server *forwardAuthServer) encodeCheckResponse(response *checkResponseWriter) []byte {
+	var message []byte
+
+	if response.status == http.StatusOK {
+		var ok []byte
+
+		for _, name := range server.config.UpstreamHeaderNames() {
+			if value := response.header.Get(name); value != "" {
+				ok = appendProtoBytes(ok, 2, encodeHeaderValueOption(name, value, overwriteIfExistsOrAdd))
+			} else if !server.isAuthorizationHeader(name) {
+				// Remove identity headers sent by the client, which the middleware didn't set
+				ok = appendProtoBytes(ok, 5, []byte(name))
+			}
+		}
+
+		// A renewed session is returned to the client using response_headers_to_add
+		for _, cookie := range response.header.Values("Set-Cookie") {
+			ok = appendProtoBytes(ok, 6, encodeHeaderValueOption("Set-Cookie", cookie, appendIfExistsOrAdd))
+		}
+
+		message = appendProtoBytes(message, 1, appendProtoVarint(nil, 1, grpcStatusOk))
+		message = appendProtoBytes(message, 3, ok)
+
+		return message
+	}
+
+	code := grpcStatusPermissionDenied
+	if response.status == http.StatusUnauthorized {
+		code = grpcStatusUnauthenticated
+	}
+
+	denied := appendProtoBytes(nil, 1, appendProtoVarint(nil, 1, uint64(response.status)))
+	for name, values := range response.header {
+		for _, value := range values {
+			denied = appendProtoBytes(denied, 2, encodeHeaderValueOption(name, value, appendIfExistsOrAdd))
+		}
+	}
+	if response.body.Len() > 0 {
+		denied = appendProtoBytes(denied, 3, response.body.Bytes())
+	}
+
+	message = appendProtoBytes(message, 1, appendProtoVarint(nil, 1, uint64(code)))
+	message = appendProtoBytes(message, 2, denied)
+
+	return message
+}
+
+func encodeHeaderValueOption(name string, value string, appendAction uint64) []byte {
+	header := appendProtoBytes(nil, 1, []byte(strings.ToLower(name)))
+	header = appendProtoBytes(header, 2, []byte(value))
+
+	option := appendProtoBytes(nil, 1, header)
+	option = appendProtoVarint(option, 3, appendAction)
+
+	return option
+}
+
+// checkResponseWriter records the response of the middleware for a Check.
+type checkResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *checkResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *checkResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *checkResponseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+
+	return rw.body.Write(data)
+}
+
+// readProtoFields calls fn for every field of an encoded protobuf message with the value of varint and fixed
+// fields or the data of length-delimited fields. Nested messages are decoded by calling readProtoFields on the data.
+func readProtoFields(message []byte, fn func(number int, value uint64, data []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errInvalidProtobuf
+		}
+		message = message[n:]
+
+		var value uint64
+		var data []byte
+
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(message)
+			if n <= 0 {
+				return errInvalidProtobuf
+			}
+			message = message[n:]
+		case 1:
+			if len(message) < 8 {
+				return errInvalidProtobuf
+			}
+			value = binary.LittleEndian.Uint64(message)
+			message = message[8:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return errInvalidProtobuf
+			}
+			data = message[n : n+int(length)]
+			message = message[n+int(length):]
+		case 5:
+			if len(message) < 4 {
+				return errInvalidProtobuf
+			}
+			value = uint64(binary.LittleEndian.Uint32(message))
+			message = message[4:]
+		default:
+			return errInvalidProtobuf
+		}
+
+		if err := fn(int(key>>3), value, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendProtoVarint(message []byte, number int, value uint64) []byte {
+	message = binary.AppendUvarint(message, uint64(number)<<3)
+
+	return binary.AppendUvarint(message, value)
+}
+
+func appendProtoBytes(message []byte, number int, data []byte) []byte {
+	message = binary.AppendUvarint(message, uint64(number)<<3|2)
+	message = binary.AppendUvarint(message, uint64(len(data)))
+
+	return append(message, data...)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src"
+)
+
+func newExtAuthzTest(t *testing.T) *forwardAuthServer {
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer":"` + provider.URL + `","authorization_endpoint":"` + provider.URL + `/authorize","token_endpoint":"` + provider.URL + `/token","jwks_uri":"` + provider.URL + `/jwks"}`))
+	}))
+	t.Cleanup(provider.Close)
+
+	config := src.CreateConfig()
+	config.Provider.Url = provider.URL
+	config.Provider.ClientId = "client"
+	config.BypassAuthenticationRule = "PathPrefix(`/public`)"
+	config.UnauthorizedBehavior = "Unauthorized"
+	config.Headers = []src.HeaderConfig{{Name: "X-User", Value: "{{ .claims.sub }}"}}
+
+	server, err := createForwardAuthServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// encodeCheckRequest encodes a CheckRequest with the attributes of the http request.
+func encodeCheckRequest(method string, path string, headers map[string]string, sourceAddress string) []byte {
+	var httpRequest []byte
+	httpRequest = appendProtoBytes(httpRequest, 2, []byte(method))
+	for key, value := range headers {
+		entry := appendProtoBytes(nil, 1, []byte(key))
+		entry = appendProtoBytes(entry, 2, []byte(value))
+		httpRequest = appendProtoBytes(httpRequest, 3, entry)
+	}
+	httpRequest = appendProtoBytes(httpRequest, 4, []byte(path))
+	httpRequest = appendProtoBytes(httpRequest, 5, []byte("app.example.com"))
+	httpRequest = appendProtoBytes(httpRequest, 6, []byte("https"))
+
+	socketAddress := appendProtoBytes(nil, 2, []byte(sourceAddress))
+	socketAddress = appendProtoVarint(socketAddress, 3, 51234)
+	source := appendProtoBytes(nil, 1, appendProtoBytes(nil, 1, socketAddress))
+
+	attributes := appendProtoBytes(nil, 1, source)
+	attributes = appendProtoBytes(attributes, 4, appendProtoBytes(nil, 2, httpRequest))
+
+	return appendProtoBytes(nil, 1, attributes)
+}
+
+func callExtAuthz(t *testing.T, server *forwardAuthServer, path string, message []byte) *httptest.ResponseRecorder {
+	body := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+	body = append(body, message...)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc")
+	rw := httptest.NewRecorder()
+
+	server.extAuthzHandler().ServeHTTP(rw, req)
+
+	return rw
+}
+
+type checkResponse struct {
+	grpcStatus      uint64
+	httpStatus      uint64
+	headers         map[string]string
+	headersToRemove []string
+	responseHeaders map[string]string
+	body            string
+}
+
+func decodeCheckResponse(t *testing.T, rw *httptest.ResponseRecorder) *checkResponse {
+	message, err := readGrpcMessage(rw.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decodeCheckResponseMessage(t, message)
+}
+
+func decodeCheckResponseMessage(t *testing.T, message []byte) *checkResponse {
+	response := &checkResponse{headers: map[string]string{}, responseHeaders: map[string]string{}}
+
+	readHeaderValueOption := func(option []byte, headers map[string]string) {
+		readProtoFields(option, func(number int, _ uint64, header []byte) error {
+			if number == 1 {
+				key, value, _ := decodeKeyValue(header)
+				headers[key] = value
+			}
+			return nil
+		})
+	}
+
+	err := readProtoFields(message, func(number int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			return readProtoFields(data, func(number int, value uint64, _ []byte) error {
+				if number == 1 {
+					response.grpcStatus = value
+				}
+				return nil
+			})
+		case 2:
+			return readProtoFields(data, func(number int, _ uint64, data []byte) error {
+				switch number {
+				case 1:
+					readProtoFields(data, func(_ int, value uint64, _ []byte) error {
+						response.httpStatus = value
+						return nil
+					})
+				case 2:
+					readHeaderValueOption(data, response.headers)
+				case 3:
+					response.body = string(data)
+				}
+				return nil
+			})
+		case 3:
+			return readProtoFields(data, func(number int, _ uint64, data []byte) error {
+				switch number {
+				case 2:
+					readHeaderValueOption(data, response.headers)
+				case 5:
+					response.headersToRemove = append(response.headersToRemove, string(data))
+				case 6:
+					readHeaderValueOption(data, response.responseHeaders)
+				case 8:
+					t.Errorf("Expected no query parameters to be removed, but got %q", data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+func TestExtAuthzAllowsAuthenticatedRequests(t *testing.T) {
+	server := newExtAuthzTest(t)
+
+	rw := callExtAuthz(t, server, extAuthzCheckPath, encodeCheckRequest(http.MethodGet, "/public/index.html?page=1", map[string]string{
+		":authority": "app.example.com",
+		"x-user":     "admin",
+	}, "198.51.100.7"))
+
+	if rw.Code != http.StatusOK || rw.Result().Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("Expected a successful gRPC call, but got %d and status '%s'", rw.Code, rw.Result().Trailer.Get("Grpc-Status"))
+	}
+
+	response := decodeCheckResponse(t, rw)
+
+	if response.grpcStatus != grpcStatusOk {
+		t.Errorf("Expected the request to be allowed, but got status %d", response.grpcStatus)
+	}
+	if len(response.headersToRemove) != 1 || response.headersToRemove[0] != "X-User" {
+		t.Errorf("Expected the identity header of the client to be removed, but got %v", response.headersToRemove)
+	}
+}
+
+func TestExtAuthzReturnsRenewedSessionCookie(t *testing.T) {
+	server := newExtAuthzTest(t)
+
+	response := &checkResponseWriter{header: http.Header{}, status: http.StatusOK}
+	response.header.Set("X-User", "jane")
+	response.header.Add("Set-Cookie", "TraefikOidcAuth.Session=renewed; Path=/; HttpOnly")
+
+	decoded := decodeCheckResponseMessage(t, server.encodeCheckResponse(response))
+
+	if decoded.grpcStatus != grpcStatusOk || decoded.headers["x-user"] != "jane" {
+		t.Errorf("Expected the request to be allowed with the identity header, but got %+v", decoded)
+	}
+	if cookie := decoded.responseHeaders["set-cookie"]; cookie != "TraefikOidcAuth.Session=renewed; Path=/; HttpOnly" {
+		t.Errorf("Expected the renewed session cookie to be sent to the client, but got '%s'", cookie)
+	}
+}
+
+func TestExtAuthzDeniesUnauthenticatedRequests(t *testing.T) {
+	server := newExtAuthzTest(t)
+
+	rw := callExtAuthz(t, server, extAuthzCheckPath, encodeCheckRequest(http.MethodGet, "/private", nil, "198.51.100.7"))
+
+	response := decodeCheckResponse(t, rw)
+
+	if response.grpcStatus != grpcStatusUnauthenticated {
+		t.Errorf("Expected the request to be denied, but got status %d", response.grpcStatus)
+	}
+	if response.httpStatus != http.StatusUnauthorized {
+		t.Errorf("Expected the client to receive status 401, but got %d", response.httpStatus)
+	}
+}
+
+func TestExtAuthzRejectsUnknownMethods(t *testing.T) {
+	rw := callExtAuthz(t, newExtAuthzTest(t), "/envoy.service.auth.v2.Authorization/Check", nil)
+
+	if rw.Header().Get("Grpc-Status") != "12" {
+		t.Errorf("Expected status UNIMPLEMENTED, but got '%s'", rw.Header().Get("Grpc-Status"))
+	}
+}
+
+func TestDecodeCheckRequest(t *testing.T) {
+	check, err := decodeCheckRequest(encodeCheckRequest(http.MethodPost, "/oidc/callback?code=abc", map[string]string{
+		":method": "POST",
+		"cookie":  "session=1",
+	}, "2001:db8::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := check.toHttpRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != http.MethodPost || req.Host != "app.example.com" || req.URL.Path != "/oidc/callback" || req.URL.Query().Get("code") != "abc" {
+		t.Errorf("Expected the original request, but got %s %s %s", req.Method, req.Host, req.URL)
+	}
+	if req.RemoteAddr != "[2001:db8::1]:51234" {
+		t.Errorf("Expected the address of the client, but got %s", req.RemoteAddr)
+	}
+	if req.Header.Get("Cookie") != "session=1" || req.Header.Get(":method") != "" {
+		t.Errorf("Expected the headers without pseudo headers, but got %v", req.Header)
+	}
+	if req.Header.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("Expected the scheme to be forwarded, but got '%s'", req.Header.Get("X-Forwarded-Proto"))
+	}
+
+	if _, err := decodeCheckRequest([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Error("Expected a truncated message to be rejected")
+	}
+}
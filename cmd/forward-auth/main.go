@@ -0,0 +1,333 @@
+// Command forward-auth runs the middleware as a standalone forward-auth server, which can be used with
+// traefik's forwardAuth middleware, nginx's auth_request, caddy's forward_auth or envoy's ext_authz filter.
+//
+// The configuration is read from a JSON file, using the same structure as the middleware configuration:
+//
+//	go run ./cmd/forward-auth -config middleware.json -listen :8080
+//
+// Authenticated requests receive a 200 response containing the configured Headers.
+// All other requests receive the same response the middleware would return, eg. a redirect to the provider.
+//
+// Envoy's ext_authz grpc_service is served on a separate TLS listener, as gRPC requires HTTP/2:
+//
+//	go run ./cmd/forward-auth -config middleware.json -grpc-listen :9001 -grpc-tls-cert tls.crt -grpc-tls-key tls.key
+//
+// The client ip, which is used by rate limits, lockouts, session binding, rules and GeoIp, is the address
+// of the proxy, unless the proxy is listed in -trusted-proxies:
+//
+//	go run ./cmd/forward-auth -config middleware.json -trusted-proxies 10.0.0.0/8,fd00::/8
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func main() {
+	configPath := flag.String("config", "", "Path to a JSON file containing the middleware configuration.")
+	listenAddress := flag.String("listen", ":8080", "The address to listen on.")
+	pathPrefix := flag.String("path-prefix", "", "A prefix which is removed from the request path, eg. the path_prefix of envoy's ext_authz http_service.")
+	trustedProxiesValue := flag.String("trusted-proxies", "", "Comma separated ips or CIDRs of the proxies, whose X-Forwarded-For and X-Real-Ip headers are trusted.")
+	grpcListenAddress := flag.String("grpc-listen", "", "The address to serve envoy's ext_authz gRPC service on. Disabled when empty.")
+	grpcTlsCert := flag.String("grpc-tls-cert", "", "Path to the TLS certificate of the gRPC listener.")
+	grpcTlsKey := flag.String("grpc-tls-key", "", "Path to the TLS private key of the gRPC listener.")
+	flag.Parse()
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Please specify the configuration file using -config.")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := src.LoadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load the configuration: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	trustedProxies, err := parseTrustedProxies(*trustedProxiesValue)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -trusted-proxies: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	if *grpcListenAddress != "" && (*grpcTlsCert == "" || *grpcTlsKey == "") {
+		fmt.Fprintln(os.Stderr, "The gRPC listener requires -grpc-tls-cert and -grpc-tls-key.")
+		os.Exit(2)
+	}
+
+	forwardAuth, err := createForwardAuthServer(config, trustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to start: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	server := &http.Server{Addr: *listenAddress, Handler: forwardAuth.httpHandler(*pathPrefix)}
+
+	var grpcServer *http.Server
+	if *grpcListenAddress != "" {
+		grpcServer = &http.Server{Addr: *grpcListenAddress, Handler: forwardAuth.extAuthzHandler()}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Finish running requests, then export the pending spans
+		_ = server.Shutdown(ctx)
+		if grpcServer != nil {
+			_ = grpcServer.Shutdown(ctx)
+		}
+		_ = forwardAuth.Shutdown(ctx)
+
+		close(stopped)
+	}()
+
+	if grpcServer != nil {
+		go func() {
+			fmt.Printf("Serving envoy ext_authz gRPC on %s\n", *grpcListenAddress)
+
+			if err := grpcServer.ListenAndServeTLS(*grpcTlsCert, *grpcTlsKey); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	fmt.Printf("Listening on %s\n", *listenAddress)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	<-stopped
+}
+
+// forwardAuthServer authenticates the requests of the proxies using a single instance of the middleware,
+// so the http and gRPC listeners share the same sessions, rate limits and caches.
+type forwardAuthServer struct {
+	config         *src.Config
+	middleware     *src.TraefikOidcAuth
+	trustedProxies []*net.IPNet
+}
+
+func createForwardAuthServer(config *src.Config, trustedProxies []*net.IPNet) (*forwardAuthServer, error) {
+	middleware, err := src.New(context.Background(), createAuthenticatedHandler(config), config, "forward-auth")
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardAuthServer{
+		config:         config,
+		middleware:     middleware.(*src.TraefikOidcAuth),
+		trustedProxies: trustedProxies,
+	}, nil
+}
+
+// httpHandler returns the handler for traefik, nginx, caddy and envoy's ext_authz http_service.
+func (server *forwardAuthServer) httpHandler(pathPrefix string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		server.authenticate(rw, restoreClientAddress(restoreOriginalRequest(stripPathPrefix(req, pathPrefix)), server.trustedProxies))
+	})
+}
+
+// authenticate runs the original request of the client through the middleware.
+func (server *forwardAuthServer) authenticate(rw http.ResponseWriter, original *http.Request) {
+	// Never return identity headers which have been sent by the client, except the bearer token the middleware authenticates
+	for _, name := range server.config.UpstreamHeaderNames() {
+		if server.isAuthorizationHeader(name) {
+			continue
+		}
+
+		original.Header.Del(name)
+	}
+
+	server.middleware.ServeHTTP(rw, original)
+}
+
+func (server *forwardAuthServer) isAuthorizationHeader(name string) bool {
+	return server.config.AuthorizationHeader != nil && strings.EqualFold(name, server.config.AuthorizationHeader.Name)
+}
+
+// Shutdown stops the middleware gracefully.
+func (server *forwardAuthServer) Shutdown(ctx context.Context) error {
+	return server.middleware.Shutdown(ctx)
+}
+
+// createAuthenticatedHandler returns the handler which is called by the middleware for authenticated requests.
+// Instead of forwarding the request, it returns the identity headers to the proxy.
+func createAuthenticatedHandler(config *src.Config) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, name := range config.UpstreamHeaderNames() {
+			if value := req.Header.Get(name); value != "" {
+				rw.Header().Set(name, value)
+			}
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	})
+}
+
+// restoreOriginalRequest rewrites the request the proxy sent to the forward-auth server into the original request
+// of the client, so the middleware can handle the callback, login and logout urls and redirect back to the original url.
+// Traefik and caddy send X-Forwarded-Method and X-Forwarded-Uri, nginx is usually configured to send X-Original-Method and X-Original-URI.
+func restoreOriginalRequest(req *http.Request) *http.Request {
+	method := firstHeader(req, "X-Forwarded-Method", "X-Original-Method")
+	requestUri := firstHeader(req, "X-Forwarded-Uri", "X-Original-URI")
+
+	if method == "" && requestUri == "" {
+		return req
+	}
+
+	original := req.Clone(req.Context())
+
+	if method != "" {
+		original.Method = method
+	}
+
+	if requestUri != "" {
+		if parsedUri, err := url.ParseRequestURI(requestUri); err == nil {
+			original.URL.Path = parsedUri.Path
+			original.URL.RawPath = parsedUri.RawPath
+			original.URL.RawQuery = parsedUri.RawQuery
+			original.RequestURI = requestUri
+		}
+	}
+
+	if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+		original.Host = host
+	}
+
+	return original
+}
+
+// restoreClientAddress replaces the address of a trusted proxy with the address of the client. The client is
+// the last address of X-Forwarded-For which doesn't belong to a trusted proxy, as all addresses in front of it
+// could have been sent by the client. X-Real-Ip is only used without X-Forwarded-For.
+// Requests of other hosts are left unchanged, so clients can't spoof their address.
+func restoreClientAddress(req *http.Request, trustedProxies []*net.IPNet) *http.Request {
+	if !isTrustedProxy(trustedProxies, utils.GetClientIp(req)) {
+		return req
+	}
+
+	clientIp := ""
+
+	if forwardedFor := req.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		addresses := strings.Split(strings.Join(forwardedFor, ","), ",")
+
+		for i := len(addresses) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(addresses[i])
+			if net.ParseIP(address) == nil {
+				break
+			}
+
+			clientIp = address
+			if !isTrustedProxy(trustedProxies, address) {
+				break
+			}
+		}
+	} else if realIp := strings.TrimSpace(req.Header.Get("X-Real-Ip")); net.ParseIP(realIp) != nil {
+		clientIp = realIp
+	}
+
+	if clientIp == "" {
+		return req
+	}
+
+	restored := req.Clone(req.Context())
+	restored.RemoteAddr = net.JoinHostPort(clientIp, "0")
+
+	return restored
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies parses a comma separated list of ips and CIDRs.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither an ip nor a CIDR", entry)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// stripPathPrefix removes the prefix from the request path. Envoy's ext_authz http_service sends the original
+// method, host and headers, but prepends its path_prefix to the original path.
+// The prefix only matches whole path segments, so /authz doesn't match /authzfoo.
+func stripPathPrefix(req *http.Request, pathPrefix string) *http.Request {
+	pathPrefix = strings.TrimRight(pathPrefix, "/")
+	if pathPrefix == "" || (req.URL.Path != pathPrefix && !strings.HasPrefix(req.URL.Path, pathPrefix+"/")) {
+		return req
+	}
+
+	stripped := req.Clone(req.Context())
+	stripped.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, pathPrefix), "/")
+	stripped.URL.RawPath = ""
+	stripped.RequestURI = stripped.URL.RequestURI()
+
+	return stripped
+}
+
+func firstHeader(req *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := req.Header.Get(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestRestoreOriginalRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Method", http.MethodPost)
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/oidc/callback?code=abc&state=def")
+
+	original := restoreOriginalRequest(req)
+
+	if original.Method != http.MethodPost {
+		t.Errorf("Expected method POST, but got %s", original.Method)
+	}
+	if original.Host != "app.example.com" {
+		t.Errorf("Expected host app.example.com, but got %s", original.Host)
+	}
+	if original.URL.Path != "/oidc/callback" || original.URL.Query().Get("code") != "abc" {
+		t.Errorf("Expected the original url, but got %s", original.URL)
+	}
+	if original.RequestURI != "/oidc/callback?code=abc&state=def" {
+		t.Errorf("Expected the original request uri, but got %s", original.RequestURI)
+	}
+}
+
+func TestRestoreOriginalRequestFromNginxHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	req.Header.Set("X-Original-URI", "/private/page")
+
+	original := restoreOriginalRequest(req)
+
+	if original.URL.Path != "/private/page" {
+		t.Errorf("Expected path /private/page, but got %s", original.URL.Path)
+	}
+}
+
+func TestForwardAuthDoesNotReturnHeadersSentByTheClient(t *testing.T) {
+	config := src.CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.BypassAuthenticationRule = "PathPrefix(`/public`)"
+	config.Headers = []src.HeaderConfig{{Name: "X-User", Value: "{{ .claims.sub }}"}}
+	config.OAuth2Proxy.Enabled = true
+
+	server, err := createForwardAuthServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpHandler("")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", "admin")
+	req.Header.Set("X-Auth-Request-User", "admin")
+	req.Header.Set("X-Forwarded-Uri", "/public/index.html")
+	rw := httptest.NewRecorder()
+
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+	if rw.Header().Get("X-User") != "" {
+		t.Errorf("Expected the identity header of the client not to be returned, but got '%s'", rw.Header().Get("X-User"))
+	}
+	if rw.Header().Get("X-Auth-Request-User") != "" {
+		t.Errorf("Expected the oauth2-proxy header of the client not to be returned, but got '%s'", rw.Header().Get("X-Auth-Request-User"))
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ext-authz/oidc/callback?code=abc", nil)
+
+	stripped := stripPathPrefix(req, "/ext-authz")
+
+	if stripped.URL.Path != "/oidc/callback" {
+		t.Errorf("Expected path /oidc/callback, but got %s", stripped.URL.Path)
+	}
+	if stripped.RequestURI != "/oidc/callback?code=abc" {
+		t.Errorf("Expected request uri /oidc/callback?code=abc, but got %s", stripped.RequestURI)
+	}
+
+	if stripPathPrefix(req, "/other") != req {
+		t.Error("Expected requests without the prefix to be left untouched")
+	}
+
+	if stripPathPrefix(req, "/ext-authz/") == req {
+		t.Error("Expected a prefix with a trailing slash to match")
+	}
+
+	root := httptest.NewRequest(http.MethodGet, "/ext-authz", nil)
+	if stripped := stripPathPrefix(root, "/ext-authz"); stripped.URL.Path != "/" {
+		t.Errorf("Expected path /, but got %s", stripped.URL.Path)
+	}
+}
+
+func TestStripPathPrefixOnlyMatchesWholeSegments(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authzfoo/page", nil)
+
+	if stripped := stripPathPrefix(req, "/authz"); stripped.URL.Path != "/authzfoo/page" {
+		t.Errorf("Expected the path to be left untouched, but got %s", stripped.URL.Path)
+	}
+}
+
+func TestRestoreClientAddressFromTrustedProxy(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		realIp       string
+		expected     string
+	}{
+		{"10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"10.0.0.1:1234", "203.0.113.66, 198.51.100.7, 10.0.0.2", "", "198.51.100.7"},
+		{"192.0.2.10:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "198.51.100.7", "203.0.113.66", "198.51.100.7"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "unknown", "", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if test.realIp != "" {
+			req.Header.Set("X-Real-Ip", test.realIp)
+		}
+
+		if actual := utils.GetClientIp(restoreClientAddress(req, trustedProxies)); actual != test.expected {
+			t.Errorf("%s %s %s: Expected the client ip %s, but got %s", test.remoteAddr, test.forwardedFor, test.realIp, test.expected, actual)
+		}
+	}
+}
+
+func TestRestoreClientAddressIgnoresUntrustedHosts(t *testing.T) {
+	trustedProxies, _ := parseTrustedProxies("10.0.0.0/8")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.66:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req.Header.Set("X-Real-Ip", "198.51.100.7")
+
+	if actual := utils.GetClientIp(restoreClientAddress(req, trustedProxies)); actual != "203.0.113.66" {
+		t.Errorf("Expected the headers of an untrusted host to be ignored, but got %s", actual)
+	}
+
+	// Without trusted proxies, the headers are never used
+	req.RemoteAddr = "10.0.0.1:1234"
+	if actual := utils.GetClientIp(restoreClientAddress(req, nil)); actual != "10.0.0.1" {
+		t.Errorf("Expected the headers to be ignored without trusted proxies, but got %s", actual)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/8,proxy.example.com"); err == nil {
+		t.Error("Expected a host name to be rejected")
+	}
+
+	networks, err := parseTrustedProxies("")
+	if err != nil || len(networks) != 0 {
+		t.Errorf("Expected no trusted proxies, but got %v, %v", networks, err)
+	}
+}
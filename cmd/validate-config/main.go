@@ -0,0 +1,47 @@
+// Command validate-config checks a middleware configuration without starting traefik, eg. in CI pipelines.
+//
+// The configuration is read from a JSON file, using the same structure as the middleware configuration:
+//
+//	go run ./cmd/validate-config -config middleware.json
+//
+// It exits with a non-zero status code, if the configuration is invalid.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src"
+)
+
+func main() {
+	configPath := flag.String("config", "", "Path to a JSON file containing the middleware configuration.")
+	checkProvider := flag.Bool("check-provider", true, "Fetch the discovery document and the JWKS of the provider.")
+	flag.Parse()
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Please specify the configuration file using -config.")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := src.LoadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load the configuration: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	problems := src.Validate(context.Background(), config, *checkProvider)
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "The configuration is invalid:\n")
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem.Error())
+		}
+		os.Exit(1)
+	}
+
+	fmt.Println("The configuration is valid.")
+}
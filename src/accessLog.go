@@ -0,0 +1,168 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// accessLogEntry is written as a single JSON line for every request, when the access log is enabled.
+type accessLogEntry struct {
+	Time             string  `json:"time"`
+	Method           string  `json:"method"`
+	Host             string  `json:"host"`
+	Path             string  `json:"path"`
+	Result           string  `json:"result,omitempty"`
+	Reason           string  `json:"reason,omitempty"`
+	Subject          string  `json:"sub,omitempty"`
+	ImpersonatedUser string  `json:"impersonated_user,omitempty"`
+	Status           int     `json:"status"`
+	DurationMs       float64 `json:"duration_ms"`
+	TraceId          string  `json:"trace_id,omitempty"`
+}
+
+type accessLogContextKey struct{}
+
+// The access log is written to stdout like the other logs, but without a prefix, so it can be parsed as JSON.
+var accessLogOutput io.Writer = os.Stdout
+var accessLogLock sync.Mutex
+
+func (toa *TraefikOidcAuth) isAccessLogEnabled() bool {
+	return toa.Config.AccessLog != nil && toa.Config.AccessLog.Enabled
+}
+
+// startAccessLog attaches a new entry to the request and records the status of the response.
+func (toa *TraefikOidcAuth) startAccessLog(rw http.ResponseWriter, req *http.Request, traceId string) (*accessLogWriter, *http.Request, *accessLogEntry) {
+	entry := &accessLogEntry{
+		Method:  req.Method,
+		Host:    req.Host,
+		Path:    req.URL.Path,
+		TraceId: traceId,
+	}
+
+	return &accessLogWriter{ResponseWriter: rw}, req.WithContext(context.WithValue(req.Context(), accessLogContextKey{}, entry)), entry
+}
+
+func getAccessLogEntry(req *http.Request) *accessLogEntry {
+	entry, _ := req.Context().Value(accessLogContextKey{}).(*accessLogEntry)
+	return entry
+}
+
+// setAccessLogSubject records the user of the request, optionally as a keyed hash, so requests of the same
+// user can be correlated without revealing the identity.
+func (toa *TraefikOidcAuth) setAccessLogSubject(req *http.Request, claims map[string]interface{}) {
+	entry := getAccessLogEntry(req)
+	if entry == nil {
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+
+	entry.Subject = toa.getAccessLogIdentity(subject)
+}
+
+// setAccessLogImpersonatedUser records the user impersonated by the subject of the request.
+func (toa *TraefikOidcAuth) setAccessLogImpersonatedUser(req *http.Request, user string) {
+	entry := getAccessLogEntry(req)
+	if entry == nil {
+		return
+	}
+
+	entry.ImpersonatedUser = toa.getAccessLogIdentity(user)
+}
+
+func (toa *TraefikOidcAuth) getAccessLogIdentity(identity string) string {
+	if identity == "" || !toa.Config.AccessLog.HashSubject {
+		return identity
+	}
+
+	mac := hmac.New(sha256.New, []byte(toa.Config.Secret))
+	mac.Write([]byte(identity))
+
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (toa *TraefikOidcAuth) writeAccessLog(entry *accessLogEntry, rw *accessLogWriter, start time.Time) {
+	now := toa.now()
+
+	entry.Time = now.UTC().Format(time.RFC3339Nano)
+	entry.Status = rw.getStatus()
+	entry.DurationMs = float64(now.Sub(start).Microseconds()) / 1000
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to write the access log: %s", err.Error())
+		return
+	}
+
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+
+	_, _ = accessLogOutput.Write(append(line, '\n'))
+}
+
+// accessLogWriter records the status code of the response, which is written by the upstream service or the middleware.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rw *accessLogWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *accessLogWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *accessLogWriter) getStatus() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+
+	return rw.status
+}
+
+func (rw *accessLogWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is required by websockets, which are upgraded by the upstream service.
+func (rw *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func (rw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,68 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAccessLogRecordsOutcome(t *testing.T) {
+	var output bytes.Buffer
+	accessLogOutput = &output
+	defer func() { accessLogOutput = os.Stdout }()
+
+	toa := newTestOidcAuth(&Config{
+		BypassWellKnownPaths: true,
+		AccessLog:            &AccessLogConfig{Enabled: true},
+	})
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	toa.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.example.com/.well-known/security.txt", nil))
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON line, but got '%s': %v", output.String(), err)
+	}
+
+	if entry.Method != http.MethodGet || entry.Host != "app.example.com" || entry.Path != "/.well-known/security.txt" {
+		t.Errorf("Expected the request to be logged, but got %+v", entry)
+	}
+	if entry.Result != requestResultBypassed || entry.Reason != "well_known" {
+		t.Errorf("Expected the result bypassed/well_known, but got %s/%s", entry.Result, entry.Reason)
+	}
+	if entry.Status != http.StatusNoContent {
+		t.Errorf("Expected the status of the upstream service, but got %d", entry.Status)
+	}
+	if entry.Time == "" || entry.TraceId == "" {
+		t.Errorf("Expected the time and trace id to be logged, but got %+v", entry)
+	}
+}
+
+func TestAccessLogHashesSubject(t *testing.T) {
+	toa := newTestOidcAuth(&Config{AccessLog: &AccessLogConfig{Enabled: true}})
+
+	_, req, entry := toa.startAccessLog(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "")
+
+	toa.setAccessLogSubject(req, map[string]interface{}{"sub": "alice"})
+	if entry.Subject != "alice" {
+		t.Errorf("Expected the plain subject, but got '%s'", entry.Subject)
+	}
+
+	toa.Config.AccessLog.HashSubject = true
+	toa.setAccessLogSubject(req, map[string]interface{}{"sub": "alice"})
+	hashed := entry.Subject
+
+	if hashed == "alice" || len(hashed) != 32 {
+		t.Errorf("Expected a hashed subject, but got '%s'", hashed)
+	}
+
+	toa.setAccessLogSubject(req, map[string]interface{}{"sub": "alice"})
+	if entry.Subject != hashed {
+		t.Errorf("Expected the hash to be stable, but got '%s' and '%s'", hashed, entry.Subject)
+	}
+}
@@ -0,0 +1,68 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// parseAnonymousAccess validates the AnonymousAccess configuration and parses its rule.
+func parseAnonymousAccess(config *AnonymousAccessConfig) error {
+	config.Rule = utils.ExpandEnvironmentVariableString(config.Rule)
+
+	for i := range config.Headers {
+		header := &config.Headers[i]
+
+		header.Value = utils.ExpandEnvironmentVariableString(header.Value)
+
+		if header.Name == "" {
+			return fmt.Errorf("the name of anonymous header %d is missing", i+1)
+		}
+	}
+
+	if config.Rule == "" {
+		return nil
+	}
+
+	condition, err := rules.ParseRequestCondition(config.Rule)
+	if err != nil {
+		return fmt.Errorf("invalid rule: %s", err.Error())
+	}
+
+	config.condition = condition
+
+	return nil
+}
+
+// isAnonymousAccessAllowed checks whether unauthenticated users may access the requested resource as a guest.
+func (toa *TraefikOidcAuth) isAnonymousAccessAllowed(req *http.Request) bool {
+	config := toa.Config.AnonymousAccess
+
+	return config != nil && config.condition != nil && config.condition.Match(toa.logger.Module(logging.ModuleRules), req)
+}
+
+// forwardAnonymously forwards the request without the identity of a user.
+// Identity headers sent by the client are removed and the synthetic headers of AnonymousAccess are attached instead.
+func (toa *TraefikOidcAuth) forwardAnonymously(rw http.ResponseWriter, req *http.Request, span *tracing.Span, reason string, start time.Time) {
+	toa.logger.Log(logging.LevelDebug, "Forwarding request anonymously.")
+	toa.recordRequestResult(req, span, requestResultAnonymous, reason, start)
+
+	for _, name := range toa.Config.UpstreamHeaderNames() {
+		req.Header.Del(name)
+	}
+
+	if toa.Config.AnonymousAccess != nil {
+		for _, header := range toa.Config.AnonymousAccess.Headers {
+			req.Header.Set(header.Name, header.Value)
+		}
+	}
+
+	toa.sanitizeForUpstream(req)
+	toa.Tracer.Inject(req.Context(), req.Header)
+	toa.next.ServeHTTP(rw, req)
+}
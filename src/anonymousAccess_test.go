@@ -0,0 +1,72 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestAnonymousAccessForwardsGuests(t *testing.T) {
+	anonymousAccess := &AnonymousAccessConfig{
+		Rule:    "PathPrefix(`/articles`)",
+		Headers: []HeaderConfig{{Name: "X-Forwarded-User", Value: "anonymous"}},
+	}
+	if err := parseAnonymousAccess(anonymousAccess); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{
+		UnauthorizedBehavior: "Unauthorized",
+		SessionCookie:        CreateConfig().SessionCookie,
+		Headers:              []HeaderConfig{{Name: "X-Forwarded-Email", Value: "{{ .claims.email }}"}},
+		AnonymousAccess:      anonymousAccess,
+	})
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{}
+
+	var upstream *http.Request
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstream = req
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/articles/free", nil)
+	req.Header.Set("X-Forwarded-Email", "spoofed@example.com")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if upstream == nil {
+		t.Fatalf("Expected the guest to be forwarded, but got status %d", rw.Code)
+	}
+	if user := upstream.Header.Get("X-Forwarded-User"); user != "anonymous" {
+		t.Errorf("Expected the synthetic identity, but got '%s'", user)
+	}
+	if email := upstream.Header.Get("X-Forwarded-Email"); email != "" {
+		t.Errorf("Expected identity headers of the client to be removed, but got '%s'", email)
+	}
+
+	upstream = nil
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/premium", nil))
+
+	if upstream != nil || rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected other paths to require a login, but got status %d", rw.Code)
+	}
+}
+
+func TestInvalidAnonymousAccessIsRejected(t *testing.T) {
+	tests := map[string]*AnonymousAccessConfig{
+		"invalid rule":        {Rule: "Invalid("},
+		"missing header name": {Rule: "PathPrefix(`/`)", Headers: []HeaderConfig{{Value: "anonymous"}}},
+	}
+
+	for name, config := range tests {
+		if err := parseAnonymousAccess(config); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -3,127 +3,262 @@ package src
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"slices"
 	"strings"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
 	"github.com/spyzhov/ajson"
 )
 
+// The header which describes the failed assertion on 403 responses, if Authorization.ExposeFailureDetails is enabled.
+const authorizationFailureHeader = "X-Authorization-Failure"
+
+// The reasons why a user isn't authorized. They are used as the reason of the request metrics.
+const (
+	authorizationReasonClaims       = "claims"
+	authorizationReasonHostedDomain = "hosted_domain"
+)
+
+// authorizationDecision describes why the claims of a user are authorized or not.
+type authorizationDecision struct {
+	Authorized bool
+	// The assertions which held, in the order of the configuration.
+	MatchedAssertions []*ClaimAssertion
+	// The first assertion which doesn't hold. The remaining assertions aren't evaluated.
+	FailedAssertion *ClaimAssertion
+	// Either claims or hosted_domain, if the user isn't authorized.
+	Reason string
+}
+
+// isAuthorized checks the hosted domain and the claim assertions.
+// A disallowed hosted domain is reported as a failed assertion of the hd claim.
+func (toa *TraefikOidcAuth) isAuthorized(claims map[string]interface{}) *authorizationDecision {
+	if !isHostedDomainAllowed(toa.Config.Provider.HostedDomains, claims) {
+		toa.logger.Log(logging.LevelWarn, "Unauthorized. The hosted domain '%v' is not allowed.", claims["hd"])
+		return &authorizationDecision{
+			FailedAssertion: &ClaimAssertion{Name: "hd", AnyOf: toa.Config.Provider.HostedDomains},
+			Reason:          authorizationReasonHostedDomain,
+		}
+	}
+
+	return evaluateAuthorization(toa.logger.Module(logging.ModuleAuthorization), toa.Config.Authorization, claims)
+}
+
+// recordAuthorizationDecision logs a denied access and adds the failed assertion to the span of the request.
+// The actual values of the claims are never included.
+func (toa *TraefikOidcAuth) recordAuthorizationDecision(req *http.Request, claims map[string]interface{}, decision *authorizationDecision) {
+	if decision == nil || decision.Authorized {
+		return
+	}
+
+	description := describeFailedAssertion(decision.FailedAssertion)
+
+	toa.logger.Log(logging.LevelInfo, "Access denied for subject '%v' to %s: %s", claims["sub"], req.URL.Path, description)
+
+	span := tracing.SpanFromContext(req.Context())
+	span.SetAttribute("oidc.authorization.reason", decision.Reason)
+	span.SetAttribute("oidc.claim_assertion", description)
+	span.SetAttribute("oidc.claim_assertions.matched", len(decision.MatchedAssertions))
+}
+
+// isHostedDomainAllowed checks the hd claim, which Google sets for Workspace accounts only.
+// Personal Gmail accounts don't have this claim and are therefore rejected when domains are configured.
+func isHostedDomainAllowed(domains []string, claims map[string]interface{}) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	hd, _ := claims["hd"].(string)
+	if hd == "" {
+		return false
+	}
+
+	for _, domain := range domains {
+		if domain == "*" || strings.EqualFold(domain, hd) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getHostedDomainParameter returns the hd parameter of the authorization request, which lets Google
+// preselect the account. Multiple domains can't be sent, so any Workspace account is requested instead.
+func getHostedDomainParameter(domains []string) string {
+	switch len(domains) {
+	case 0:
+		return ""
+	case 1:
+		return domains[0]
+	default:
+		return "*"
+	}
+}
+
 func isAuthorized(logger *logging.Logger, authorization *AuthorizationConfig, claims map[string]interface{}) bool {
+	return evaluateAuthorization(logger, authorization, claims).Authorized
+}
+
+// evaluateAuthorization evaluates the assertions until the first one doesn't hold.
+func evaluateAuthorization(logger *logging.Logger, authorization *AuthorizationConfig, claims map[string]interface{}) *authorizationDecision {
+	decision := &authorizationDecision{Authorized: true}
+
 	if authorization.AssertClaims != nil && len(authorization.AssertClaims) > 0 {
 		parsed, err := json.Marshal(claims)
 		if err != nil {
 			logger.Log(logging.LevelWarn, "Error whilst marshalling claims object: %s", err.Error())
-			return false
+			return &authorizationDecision{FailedAssertion: &ClaimAssertion{}, Reason: authorizationReasonClaims}
 		}
 
-	assertions:
-		for _, assertion := range authorization.AssertClaims {
-			value, err := ajson.JSONPath(parsed, fmt.Sprintf("$.%s", assertion.Name))
-			if err != nil {
-				logger.Log(logging.LevelWarn, "Error whilst parsing path for claim %s in token claims: %s", assertion.Name, err.Error())
-				return false
-			} else if len(value) == 0 {
-				logger.Log(logging.LevelWarn, "Unauthorized. Unable to find claim %s in token claims.", assertion.Name)
-				logAvailableClaims(logger, claims)
-				return false
-			}
+		for i := range authorization.AssertClaims {
+			assertion := &authorization.AssertClaims[i]
 
-			if len(assertion.AllOf) == 0 && len(assertion.AnyOf) == 0 {
-				logger.Log(logging.LevelDebug, "Authorized claim %s. No assertions were defined and claim exists", assertion.Name)
-				continue assertions
+			if !evaluateClaimAssertion(logger, assertion, parsed, claims) {
+				decision.Authorized = false
+				decision.FailedAssertion = assertion
+				decision.Reason = authorizationReasonClaims
+				return decision
 			}
 
-			// check all matched nodes whether for one of the nodes all assertions hold
-			// should the assertions hold for no node we return `false` to indicate
-			// an unauthorized state
+			decision.MatchedAssertions = append(decision.MatchedAssertions, assertion)
+		}
+	}
+
+	return decision
+}
 
-			allMatches := make([]bool, len(assertion.AllOf))
-			anyMatch := false
+// evaluateClaimAssertion checks whether a single assertion holds for the marshalled claims.
+func evaluateClaimAssertion(logger *logging.Logger, assertion *ClaimAssertion, parsed []byte, claims map[string]interface{}) bool {
+	value, err := ajson.JSONPath(parsed, fmt.Sprintf("$.%s", assertion.Name))
+	if err != nil {
+		logger.Log(logging.LevelWarn, "Error whilst parsing path for claim %s in token claims: %s", assertion.Name, err.Error())
+		return false
+	} else if len(value) == 0 {
+		logger.Log(logging.LevelWarn, "Unauthorized. Unable to find claim %s in token claims.", assertion.Name)
+		logAvailableClaims(logger, claims)
+		return false
+	}
 
-		matches:
-			for _, val := range value {
-				unpacked, err := val.Unpack()
-				if err != nil {
-					logger.Log(logging.LevelError, "Error whilst unpacking json node: %s", err.Error())
-					continue matches
-				}
+	if len(assertion.AllOf) == 0 && len(assertion.AnyOf) == 0 {
+		logger.Log(logging.LevelDebug, "Authorized claim %s. No assertions were defined and claim exists", assertion.Name)
+		return true
+	}
 
-				switch val := unpacked.(type) {
-				// the value is any array
-				case []interface{}:
-					mapped := make([]string, len(val))
-					for i, rawVal := range val {
-						mapped[i] = fmt.Sprintf("%v", rawVal)
-					}
+	// check all matched nodes whether for one of the nodes all assertions hold
+	// should the assertions hold for no node we return `false` to indicate
+	// an unauthorized state
 
-					// first check whether allOf assertion is fulfilled -> return false if not
-					if len(assertion.AllOf) > 0 {
-						for _, assert := range assertion.AllOf {
-							if !slices.Contains(mapped, assert) {
-								break matches
-							}
-						}
-					}
-					// should allOf assertion be fulfilled check whether anyOf assertion is fulfilled -> return true when fulfilled
-					if len(assertion.AnyOf) > 0 {
-						for _, assert := range assertion.AnyOf {
-							if slices.Contains(mapped, assert) {
-								logger.Log(logging.LevelDebug, "Authorized claim %s: Found value %s which is any of [%s]", assertion.Name, assert, strings.Join(assertion.AnyOf, ", "))
-								continue assertions
-							}
-						}
-						continue matches
+	allMatches := make([]bool, len(assertion.AllOf))
+	anyMatch := false
+
+matches:
+	for _, val := range value {
+		unpacked, err := val.Unpack()
+		if err != nil {
+			logger.Log(logging.LevelError, "Error whilst unpacking json node: %s", err.Error())
+			continue matches
+		}
+
+		switch val := unpacked.(type) {
+		// the value is any array
+		case []interface{}:
+			mapped := make([]string, len(val))
+			for i, rawVal := range val {
+				mapped[i] = fmt.Sprintf("%v", rawVal)
+			}
+
+			// first check whether allOf assertion is fulfilled -> return false if not
+			if len(assertion.AllOf) > 0 {
+				for _, assert := range assertion.AllOf {
+					if !slices.Contains(mapped, assert) {
+						break matches
 					}
-					logger.Log(logging.LevelDebug, "Authorized claim %s: Found all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
-					continue assertions
-				// the value is any other json type
-				default:
-					strVal := fmt.Sprintf("%v", val)
-					if len(assertion.AnyOf) > 0 {
-						if slices.Contains(assertion.AnyOf, strVal) {
-							anyMatch = true
-						}
+				}
+			}
+			// should allOf assertion be fulfilled check whether anyOf assertion is fulfilled -> return true when fulfilled
+			if len(assertion.AnyOf) > 0 {
+				for _, assert := range assertion.AnyOf {
+					if slices.Contains(mapped, assert) {
+						logger.Log(logging.LevelDebug, "Authorized claim %s: Found value %s which is any of [%s]", assertion.Name, assert, strings.Join(assertion.AnyOf, ", "))
+						return true
 					}
-					if len(assertion.AllOf) > 0 {
-						for i, assert := range assertion.AllOf {
-							if assert == strVal {
-								allMatches[i] = true
-								break
-							}
-						}
+				}
+				continue matches
+			}
+			logger.Log(logging.LevelDebug, "Authorized claim %s: Found all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
+			return true
+		// the value is any other json type
+		default:
+			strVal := fmt.Sprintf("%v", val)
+			if len(assertion.AnyOf) > 0 {
+				if slices.Contains(assertion.AnyOf, strVal) {
+					anyMatch = true
+				}
+			}
+			if len(assertion.AllOf) > 0 {
+				for i, assert := range assertion.AllOf {
+					if assert == strVal {
+						allMatches[i] = true
+						break
 					}
-					continue matches
 				}
 			}
+			continue matches
+		}
+	}
 
-			if len(assertion.AnyOf) > 0 && anyMatch && len(assertion.AllOf) > 0 && !slices.Contains(allMatches, false) {
-				logger.Log(logging.LevelDebug, "Authorized claim %s: Found any value of [%s] and all values of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "), strings.Join(assertion.AllOf, ", "))
-				continue assertions
-			} else if len(assertion.AnyOf) > 0 && anyMatch && len(assertion.AllOf) == 0 {
-				logger.Log(logging.LevelDebug, "Authorized claim %s: Found any value of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "))
-				continue assertions
-			} else if len(assertion.AllOf) > 0 && !slices.Contains(allMatches, false) && len(assertion.AnyOf) == 0 {
-				logger.Log(logging.LevelDebug, "Authorized claim %s: Found all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
-				continue assertions
-			}
+	if len(assertion.AnyOf) > 0 && anyMatch && len(assertion.AllOf) > 0 && !slices.Contains(allMatches, false) {
+		logger.Log(logging.LevelDebug, "Authorized claim %s: Found any value of [%s] and all values of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "), strings.Join(assertion.AllOf, ", "))
+		return true
+	} else if len(assertion.AnyOf) > 0 && anyMatch && len(assertion.AllOf) == 0 {
+		logger.Log(logging.LevelDebug, "Authorized claim %s: Found any value of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "))
+		return true
+	} else if len(assertion.AllOf) > 0 && !slices.Contains(allMatches, false) && len(assertion.AnyOf) == 0 {
+		logger.Log(logging.LevelDebug, "Authorized claim %s: Found all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
+		return true
+	}
 
-			if len(assertion.AllOf) > 0 && len(assertion.AnyOf) > 0 {
-				logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain any value of [%s] and all values of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "), strings.Join(assertion.AllOf, ", "))
-			} else if len(assertion.AllOf) > 0 {
-				logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
-			} else if len(assertion.AnyOf) > 0 {
-				logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain any value of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "))
-			}
+	if len(assertion.AllOf) > 0 && len(assertion.AnyOf) > 0 {
+		logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain any value of [%s] and all values of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "), strings.Join(assertion.AllOf, ", "))
+	} else if len(assertion.AllOf) > 0 {
+		logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain all values of [%s]", assertion.Name, strings.Join(assertion.AllOf, ", "))
+	} else if len(assertion.AnyOf) > 0 {
+		logger.Log(logging.LevelWarn, "Unauthorized. Expected claim %s to contain any value of [%s]", assertion.Name, strings.Join(assertion.AnyOf, ", "))
+	}
 
-			logAvailableClaims(logger, claims)
+	logAvailableClaims(logger, claims)
 
-			return false
-		}
+	return false
+}
+
+// hasClaim checks whether the path of an assertion matches any value in the marshalled claims.
+func hasClaim(parsed []byte, name string) bool {
+	value, err := ajson.JSONPath(parsed, fmt.Sprintf("$.%s", name))
+
+	return err == nil && len(value) > 0
+}
+
+// describeFailedAssertion describes the values an assertion expects. The actual values of the claims are never included.
+func describeFailedAssertion(assertion *ClaimAssertion) string {
+	if assertion.Name == "" {
+		return "the claims could not be evaluated"
+	}
+
+	var expectations []string
+	if len(assertion.AnyOf) > 0 {
+		expectations = append(expectations, fmt.Sprintf("any of [%s]", strings.Join(assertion.AnyOf, ", ")))
+	}
+	if len(assertion.AllOf) > 0 {
+		expectations = append(expectations, fmt.Sprintf("all of [%s]", strings.Join(assertion.AllOf, ", ")))
+	}
+
+	if len(expectations) == 0 {
+		return fmt.Sprintf("claim %s is required", assertion.Name)
 	}
 
-	return true
+	return fmt.Sprintf("claim %s must contain %s", assertion.Name, strings.Join(expectations, " and "))
 }
 
 func logAvailableClaims(logger *logging.Logger, claims map[string]interface{}) {
@@ -1,11 +1,17 @@
 package src
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
 )
 
 func createAuthInstance(claims []ClaimAssertion) *AuthorizationConfig {
@@ -245,3 +251,145 @@ func TestMultipleAssertions(t *testing.T) {
 		t.Fatal("Should not authorize since both of the assertions do not hold")
 	}
 }
+
+func TestHostedDomainIsEnforced(t *testing.T) {
+	toa := newTestOidcAuth(&Config{Authorization: &AuthorizationConfig{}})
+	toa.Config.Provider.HostedDomains = []string{"example.com"}
+
+	if !toa.isAuthorized(map[string]interface{}{"hd": "Example.com"}).Authorized {
+		t.Error("Expected an account of the hosted domain to be authorized")
+	}
+	if toa.isAuthorized(map[string]interface{}{"hd": "other.com"}).Authorized {
+		t.Error("Expected an account of another domain to be unauthorized")
+	}
+	if toa.isAuthorized(map[string]interface{}{"email": "jane@gmail.com"}).Authorized {
+		t.Error("Expected a personal account without hd claim to be unauthorized")
+	}
+
+	toa.Config.Provider.HostedDomains = []string{"*"}
+
+	if !toa.isAuthorized(map[string]interface{}{"hd": "other.com"}).Authorized {
+		t.Error("Expected any hosted domain to be authorized with a wildcard")
+	}
+}
+
+func TestHostedDomainParameter(t *testing.T) {
+	tests := map[string][]string{
+		"":            nil,
+		"example.com": {"example.com"},
+		"*":           {"example.com", "example.org"},
+	}
+
+	for expected, domains := range tests {
+		if actual := getHostedDomainParameter(domains); actual != expected {
+			t.Errorf("Expected hd=%s for %v, but got %s", expected, domains, actual)
+		}
+	}
+}
+
+func TestEvaluateAuthorization(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	authorization := createAuthInstance([]ClaimAssertion{
+		{Name: "name"},
+		{Name: "roles", AnyOf: []string{"owner", "auditor"}},
+		{Name: "age"},
+	})
+
+	decision := evaluateAuthorization(logger, authorization, getTestClaims())
+	if decision.Authorized || decision.Reason != authorizationReasonClaims {
+		t.Fatalf("Expected the claims to be unauthorized, but got %+v", decision)
+	}
+	if len(decision.MatchedAssertions) != 1 || decision.MatchedAssertions[0].Name != "name" {
+		t.Errorf("Expected only the name assertion to be matched, but got %v", decision.MatchedAssertions)
+	}
+
+	assertion := decision.FailedAssertion
+	if assertion == nil || assertion.Name != "roles" {
+		t.Fatalf("Expected the roles assertion to fail, but got %v", assertion)
+	}
+
+	description := describeFailedAssertion(assertion)
+	if description != "claim roles must contain any of [owner, auditor]" {
+		t.Errorf("Unexpected description '%s'", description)
+	}
+	if strings.Contains(description, "administrator") {
+		t.Error("Expected the actual values not to be exposed")
+	}
+}
+
+func TestUnauthorizedResponseExposesFailedAssertion(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		toa := newTestOidcAuth(&Config{
+			Authorization: &AuthorizationConfig{
+				AssertClaims:         []ClaimAssertion{{Name: "roles", AllOf: []string{"owner"}}},
+				ExposeFailureDetails: expose,
+			},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept", "text/html")
+		rw := httptest.NewRecorder()
+
+		toa.writeUnauthorizedError(rw, req, getTestClaims(), toa.isAuthorized(getTestClaims()), "")
+
+		header := rw.Header().Get(authorizationFailureHeader)
+		if expose && (header != "claim roles must contain all of [owner]" || !strings.Contains(rw.Body.String(), "all of [owner]")) {
+			t.Errorf("Expected the failed assertion to be exposed, but got '%s'", header)
+		}
+		if !expose && header != "" {
+			t.Error("Expected no details without ExposeFailureDetails")
+		}
+	}
+}
+
+func TestUnauthorizedPageShowsAccountAndRequestedUrl(t *testing.T) {
+	page := &errorPages.ErrorPageConfig{
+		Template:      `{{ .claims.name }} may not access {{ .requestedUrl }}{{ with .claims.roles }} ({{ . }}){{ end }}`,
+		ExposedClaims: []string{"name"},
+	}
+	if err := page.ParseTemplates(logging.CreateLogger(logging.LevelError)); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{ErrorPages: &errorPages.ErrorPagesConfig{Unauthorized: page}})
+
+	tests := []struct {
+		requestedUrl string
+		expected     string
+	}{
+		{"", "Alice may not access http://app.example.com/admin?tab=1"},
+		{"https://app.example.com/reports", "Alice may not access https://app.example.com/reports"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/admin?tab=1", nil)
+		req.Header.Set("Accept", "text/html")
+		rw := httptest.NewRecorder()
+
+		toa.writeUnauthorizedError(rw, req, getTestClaims(), nil, test.requestedUrl)
+
+		if rw.Body.String() != test.expected {
+			t.Errorf("Expected '%s', but got '%s'", test.expected, rw.Body.String())
+		}
+	}
+}
+
+func TestAuthorizationDecisionIsRecordedOnTheSpan(t *testing.T) {
+	toa := newTestOidcAuth(&Config{Authorization: &AuthorizationConfig{}})
+	toa.Tracer = tracing.CreateTracer(1, nil, nil)
+	toa.Config.Provider.HostedDomains = []string{"example.com"}
+
+	ctx, span := toa.Tracer.Start(context.Background(), "oidc.request", tracing.SpanKindServer)
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil).WithContext(ctx)
+
+	decision := toa.isAuthorized(map[string]interface{}{"hd": "other.com"})
+	if decision.Reason != authorizationReasonHostedDomain {
+		t.Fatalf("Expected the hosted domain to be the reason, but got '%s'", decision.Reason)
+	}
+
+	toa.recordAuthorizationDecision(req, map[string]interface{}{"hd": "other.com"}, decision)
+
+	if span.Attributes["oidc.authorization.reason"] != authorizationReasonHostedDomain || span.Attributes["oidc.claim_assertion"] != "claim hd must contain any of [example.com]" {
+		t.Errorf("Expected the decision to be recorded, but got %v", span.Attributes)
+	}
+}
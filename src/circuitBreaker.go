@@ -0,0 +1,213 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// The behaviors while the circuit breaker is open.
+const (
+	circuitFallbackFailClosed = "FailClosed"
+	circuitFallbackFailOpen   = "FailOpen"
+)
+
+var errCircuitOpen = fmt.Errorf("%w: the circuit breaker is open", ErrProviderUnavailable)
+
+// CircuitBreaker stops sending requests to the identity provider after too many consecutive failures.
+// After OpenDuration, a single request is let through to probe whether the provider is available again.
+// All methods may be called on a nil circuit breaker, which never opens.
+type CircuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+
+	// Called whenever the state changes.
+	OnStateChange func(state string)
+
+	lock                sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool
+}
+
+func CreateCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		state:            circuitClosed,
+	}
+}
+
+// Allow returns whether a request may be sent to the provider.
+func (breaker *CircuitBreaker) Allow() bool {
+	if breaker == nil {
+		return true
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Since(breaker.openedAt) < breaker.openDuration {
+			return false
+		}
+
+		breaker.setState(circuitHalfOpen)
+		breaker.probing = true
+		return true
+	case circuitHalfOpen:
+		// Only a single probe at a time
+		if breaker.probing {
+			return false
+		}
+
+		breaker.probing = true
+		return true
+	}
+
+	return true
+}
+
+// RecordResult records the outcome of a request, which has been allowed before.
+func (breaker *CircuitBreaker) RecordResult(success bool) {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.probing = false
+
+	if success {
+		breaker.consecutiveFailures = 0
+		if breaker.state != circuitClosed {
+			breaker.setState(circuitClosed)
+		}
+		return
+	}
+
+	breaker.consecutiveFailures++
+
+	if breaker.state == circuitHalfOpen || (breaker.state == circuitClosed && breaker.consecutiveFailures >= breaker.failureThreshold) {
+		breaker.openedAt = time.Now()
+		breaker.setState(circuitOpen)
+	}
+}
+
+// release allows another probe, without recording a result.
+func (breaker *CircuitBreaker) release() {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	breaker.probing = false
+	breaker.lock.Unlock()
+}
+
+// State returns one of closed, open or half_open.
+func (breaker *CircuitBreaker) State() string {
+	if breaker == nil {
+		return circuitClosed
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	return breaker.state
+}
+
+// IsOpen returns whether the provider is considered unavailable.
+func (breaker *CircuitBreaker) IsOpen() bool {
+	return breaker.State() != circuitClosed
+}
+
+func (breaker *CircuitBreaker) setState(state string) {
+	breaker.state = state
+
+	if breaker.OnStateChange != nil {
+		breaker.OnStateChange(state)
+	}
+}
+
+// circuitBreakerTransport guards all requests to the identity provider by the circuit breaker.
+// Requests to trusted issuers hosted elsewhere are not affected.
+type circuitBreakerTransport struct {
+	next http.RoundTripper
+	toa  *TraefikOidcAuth
+}
+
+func (transport *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := transport.toa.CircuitBreaker
+
+	if !transport.toa.isProviderUrl(req.URL) {
+		return transport.next.RoundTrip(req)
+	}
+
+	if !breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := transport.next.RoundTrip(req)
+
+	// A cancelled request of a user doesn't tell anything about the provider
+	if err != nil && (req.Context().Err() != nil || errors.Is(err, context.Canceled)) {
+		breaker.release()
+		return resp, err
+	}
+
+	breaker.RecordResult(err == nil && resp.StatusCode < 500)
+
+	return resp, err
+}
+
+// isProviderUrl returns whether the url points to the host of the provider or one of its endpoints.
+func (toa *TraefikOidcAuth) isProviderUrl(u *url.URL) bool {
+	if toa.ProviderURL != nil && u.Host == toa.ProviderURL.Host {
+		return true
+	}
+
+	if document := toa.DiscoveryDocument; document != nil {
+		for _, endpoint := range []string{document.TokenEndpoint, document.JWKSURI, document.UserinfoEndpoint, document.IntrospectionEndpoint} {
+			if endpointUrl, err := url.Parse(endpoint); err == nil && endpointUrl.Host == u.Host {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isProviderFailOpen returns whether requests should be served using locally verifiable tokens only,
+// as the provider is unavailable.
+func (toa *TraefikOidcAuth) isProviderFailOpen() bool {
+	return toa.CircuitBreaker.IsOpen() && toa.Config.CircuitBreaker.Fallback == circuitFallbackFailOpen
+}
+
+func validateCircuitBreakerConfig(config *CircuitBreakerConfig) error {
+	if config.FailureThreshold < 1 {
+		return errors.New("the failure threshold must be at least 1")
+	}
+	if config.OpenDuration <= 0 {
+		return errors.New("the open duration must be greater than 0")
+	}
+	if config.Fallback != circuitFallbackFailClosed && config.Fallback != circuitFallbackFailOpen {
+		return fmt.Errorf("invalid fallback '%s', must be either %s or %s", config.Fallback, circuitFallbackFailClosed, circuitFallbackFailOpen)
+	}
+
+	return nil
+}
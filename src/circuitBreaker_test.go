@@ -0,0 +1,180 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	breaker := CreateCircuitBreaker(2, 20*time.Millisecond)
+
+	breaker.RecordResult(false)
+	if breaker.IsOpen() {
+		t.Fatal("Expected the breaker to stay closed below the threshold")
+	}
+
+	breaker.RecordResult(false)
+	if breaker.State() != circuitOpen || breaker.Allow() {
+		t.Fatalf("Expected the breaker to be open, but it is %s", breaker.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if !breaker.Allow() || breaker.State() != circuitHalfOpen {
+		t.Fatalf("Expected a probe to be allowed, but the breaker is %s", breaker.State())
+	}
+	if breaker.Allow() {
+		t.Error("Expected only a single probe at a time")
+	}
+
+	breaker.RecordResult(false)
+	if breaker.State() != circuitOpen {
+		t.Fatalf("Expected a failed probe to open the breaker again, but it is %s", breaker.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	breaker.Allow()
+	breaker.RecordResult(true)
+
+	if breaker.State() != circuitClosed {
+		t.Errorf("Expected a successful probe to close the breaker, but it is %s", breaker.State())
+	}
+}
+
+func TestCircuitBreakerTransportFailsFast(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	providerUrl, _ := url.Parse(server.URL)
+
+	toa := newTestOidcAuth(&Config{})
+	toa.ProviderURL = providerUrl
+	toa.CircuitBreaker = CreateCircuitBreaker(2, time.Minute)
+
+	var states []string
+	toa.CircuitBreaker.OnStateChange = func(state string) {
+		states = append(states, state)
+	}
+
+	client := &http.Client{Transport: &circuitBreakerTransport{next: http.DefaultTransport, toa: toa}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/.well-known/openid-configuration")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	_, err := client.Get(server.URL + "/.well-known/openid-configuration")
+	if !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected the provider to be unavailable, but got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests to reach the provider, but got %d", requests)
+	}
+	if len(states) != 1 || states[0] != circuitOpen {
+		t.Errorf("Expected a single transition to open, but got %v", states)
+	}
+}
+
+func TestOpenCircuitBreakerRespondsWithServiceUnavailable(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		CircuitBreaker: &CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenDuration: 60, Fallback: "FailClosed"},
+		ReadyUri:       "/oidc/ready",
+	})
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{}
+	toa.Jwks = &oidc.JwksHandler{}
+	toa.httpClient = &http.Client{Transport: &circuitBreakerTransport{next: http.DefaultTransport, toa: toa}}
+	toa.CircuitBreaker = CreateCircuitBreaker(1, time.Minute)
+	toa.CircuitBreaker.RecordResult(false)
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 instead of a login redirect, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/ready", nil))
+
+	response := &healthResponse{}
+	json.Unmarshal(rw.Body.Bytes(), response)
+
+	if check := response.Checks["circuit_breaker"]; check.Status != healthStatusDown || check.State != circuitOpen {
+		t.Errorf("Expected the open circuit breaker to be reported, but got %+v", check)
+	}
+}
+
+func TestOpenCircuitBreakerFailsOpenForLocallyValidTokens(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userInfoRequested := false
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		userInfoRequested = true
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	toa.Config.Provider.TokenValidation = "AccessToken"
+	toa.Config.Provider.UseClaimsFromUserInfoBool = true
+	toa.Config.CircuitBreaker = &CircuitBreakerConfig{Fallback: "FailOpen"}
+	toa.CircuitBreaker = CreateCircuitBreaker(1, time.Minute)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "test-kid"
+	accessToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the JWKS while the provider is still available
+	if err := toa.Jwks.EnsureLoaded(context.Background(), toa.logger, toa.httpClient, false); err != nil {
+		t.Fatal(err)
+	}
+
+	toa.CircuitBreaker.RecordResult(false)
+
+	ok, claims, err := toa.validateToken(context.Background(), &session.SessionState{Id: "session", AccessToken: accessToken})
+	if !ok || err != nil || claims["sub"] != "12345" {
+		t.Errorf("Expected the token to be accepted, but got %v, %v", ok, err)
+	}
+	if userInfoRequested {
+		t.Error("Expected the userinfo endpoint to be skipped while the provider is unavailable")
+	}
+}
+
+func TestValidateCircuitBreakerConfig(t *testing.T) {
+	if err := validateCircuitBreakerConfig(CreateConfig().CircuitBreaker); err != nil {
+		t.Errorf("Expected the defaults to be valid, but got %s", err.Error())
+	}
+	if validateCircuitBreakerConfig(&CircuitBreakerConfig{FailureThreshold: 5, OpenDuration: 30, Fallback: "Ignore"}) == nil {
+		t.Error("Expected an invalid fallback to be rejected")
+	}
+}
@@ -0,0 +1,217 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/spyzhov/ajson"
+)
+
+// parseClaimMappings validates the claim mappings and parses their templates.
+func parseClaimMappings(mappings []ClaimMappingConfig) error {
+	for i := range mappings {
+		mapping := &mappings[i]
+
+		if mapping.Name == "" {
+			return fmt.Errorf("the name of claim mapping %d is missing", i+1)
+		}
+		if (len(mapping.From) == 0) == (mapping.Value == "") {
+			return fmt.Errorf("the claim mapping %s must either specify From or Value", mapping.Name)
+		}
+
+		if mapping.Value != "" {
+			tpl, err := template.New(mapping.Name).Option("missingkey=zero").Parse(mapping.Value)
+			if err != nil {
+				return fmt.Errorf("invalid template of claim mapping %s: %s", mapping.Name, err.Error())
+			}
+
+			mapping.template = tpl
+		}
+	}
+
+	return nil
+}
+
+// mapClaims applies the configured claim mappings, so authorization rules and headers can rely on a canonical shape
+// of the claims, regardless of the identity provider. The given claims are not modified.
+func (toa *TraefikOidcAuth) mapClaims(claims map[string]interface{}) map[string]interface{} {
+	if len(toa.Config.ClaimMappings) == 0 || claims == nil {
+		return claims
+	}
+
+	mapped := make(map[string]interface{}, len(claims))
+	for key, value := range claims {
+		mapped[key] = value
+	}
+
+	for i := range toa.Config.ClaimMappings {
+		mapping := &toa.Config.ClaimMappings[i]
+
+		var value interface{}
+		var err error
+
+		if mapping.template != nil {
+			value, err = renderClaimMapping(mapping, mapped)
+		} else {
+			value, err = collectClaimValues(mapped, mapping.From)
+		}
+
+		if err != nil {
+			toa.logger.Log(logging.LevelWarn, "Failed to map claim %s: %s", mapping.Name, err.Error())
+			continue
+		}
+
+		if value != nil {
+			mapped[mapping.Name] = mapping.transform(value)
+		}
+	}
+
+	return mapped
+}
+
+// transform applies the configured transformations to a string value or to the strings of a list.
+// Values which become empty are removed from lists.
+func (mapping *ClaimMappingConfig) transform(value interface{}) interface{} {
+	if !mapping.StripDistinguishedName && mapping.StripPrefix == "" && !mapping.Lowercase {
+		return value
+	}
+
+	switch v := value.(type) {
+	case string:
+		return mapping.transformString(v)
+	case []interface{}:
+		transformed := []interface{}{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				if s = mapping.transformString(s); s == "" {
+					continue
+				}
+				item = s
+			}
+			transformed = appendUnique(transformed, item)
+		}
+		return transformed
+	default:
+		return value
+	}
+}
+
+func (mapping *ClaimMappingConfig) transformString(value string) string {
+	if mapping.StripDistinguishedName {
+		value = getCommonName(value)
+	}
+	if mapping.StripPrefix != "" {
+		value = strings.TrimPrefix(value, mapping.StripPrefix)
+	}
+	if mapping.Lowercase {
+		value = strings.ToLower(value)
+	}
+
+	return value
+}
+
+// getCommonName returns the value of the leading CN of a distinguished name, eg. "Admins" for
+// "CN=Admins,OU=Groups,DC=example,DC=com". Escaped characters are unescaped. Other values are returned as they are.
+func getCommonName(dn string) string {
+	if len(dn) < 3 || !strings.EqualFold(dn[:3], "cn=") {
+		return dn
+	}
+
+	var name strings.Builder
+	for i := 3; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			if i+1 < len(dn) {
+				i++
+				name.WriteByte(dn[i])
+			}
+		case ',', '+':
+			return strings.TrimSpace(name.String())
+		default:
+			name.WriteByte(dn[i])
+		}
+	}
+
+	return strings.TrimSpace(name.String())
+}
+
+func renderClaimMapping(mapping *ClaimMappingConfig, claims map[string]interface{}) (interface{}, error) {
+	var rendered bytes.Buffer
+
+	err := mapping.template.Execute(&rendered, map[string]interface{}{"claims": claims})
+	if err != nil {
+		return nil, err
+	}
+
+	if rendered.Len() == 0 {
+		return nil, nil
+	}
+
+	return rendered.String(), nil
+}
+
+// collectClaimValues reads the values of the given JSON paths. A single value is returned as it is,
+// while multiple values and lists are flattened into a single list without duplicates.
+// Nil is returned, if none of the paths exist.
+func collectClaimValues(claims map[string]interface{}, paths []string) (interface{}, error) {
+	parsed, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	isList := false
+
+	for _, path := range paths {
+		nodes, err := ajson.JSONPath(parsed, fmt.Sprintf("$.%s", path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %s", path, err.Error())
+		}
+
+		for _, node := range nodes {
+			unpacked, err := node.Unpack()
+			if err != nil {
+				return nil, err
+			}
+
+			if list, ok := unpacked.([]interface{}); ok {
+				isList = true
+				values = appendUnique(values, list...)
+			} else {
+				values = appendUnique(values, unpacked)
+			}
+		}
+	}
+
+	switch {
+	case len(values) == 0 && !isList:
+		return nil, nil
+	case len(values) == 1 && !isList:
+		return values[0], nil
+	default:
+		if values == nil {
+			values = []interface{}{}
+		}
+		return values, nil
+	}
+}
+
+func appendUnique(values []interface{}, items ...interface{}) []interface{} {
+items:
+	for _, item := range items {
+		for _, value := range values {
+			if reflect.DeepEqual(value, item) {
+				continue items
+			}
+		}
+
+		values = append(values, item)
+	}
+
+	return values
+}
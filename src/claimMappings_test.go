@@ -0,0 +1,128 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimMappingsNormalizeClaims(t *testing.T) {
+	mappings := []ClaimMappingConfig{
+		{Name: "groups", From: []string{"['cognito:groups']", "realm_access.roles"}},
+		{Name: "username", From: []string{"preferred_username", "email"}},
+		{Name: "display_name", Value: "{{ .claims.given_name }} {{ .claims.family_name }}"},
+		{Name: "missing", From: []string{"unknown"}},
+	}
+
+	if err := parseClaimMappings(mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{ClaimMappings: mappings})
+
+	claims := map[string]interface{}{
+		"cognito:groups": []interface{}{"admins", "users"},
+		"realm_access":   map[string]interface{}{"roles": []interface{}{"users", "auditors"}},
+		"email":          "jane@example.com",
+		"given_name":     "Jane",
+		"family_name":    "Doe",
+	}
+
+	mapped := toa.mapClaims(claims)
+
+	if groups := mapped["groups"]; !reflect.DeepEqual(groups, []interface{}{"admins", "users", "auditors"}) {
+		t.Errorf("Expected the groups to be merged, but got %v", groups)
+	}
+	if username := mapped["username"]; username != "jane@example.com" {
+		t.Errorf("Expected the username to fall back to the email, but got %v", username)
+	}
+	if displayName := mapped["display_name"]; displayName != "Jane Doe" {
+		t.Errorf("Expected the templated display name, but got %v", displayName)
+	}
+	if _, ok := mapped["missing"]; ok {
+		t.Error("Expected a mapping without any source claim not to be set")
+	}
+	if _, ok := claims["groups"]; ok {
+		t.Error("Expected the original claims not to be modified")
+	}
+}
+
+func TestMappedClaimsAreUsedForAuthorization(t *testing.T) {
+	mappings := []ClaimMappingConfig{{Name: "groups", From: []string{"realm_access.roles"}}}
+	if err := parseClaimMappings(mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{ClaimMappings: mappings})
+	authorization := &AuthorizationConfig{AssertClaims: []ClaimAssertion{{Name: "groups", AnyOf: []string{"admins"}}}}
+
+	claims := toa.mapClaims(map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admins"}},
+	})
+
+	if !isAuthorized(toa.logger, authorization, claims) {
+		t.Error("Expected the mapped groups to be authorized")
+	}
+}
+
+func TestInvalidClaimMappingsAreRejected(t *testing.T) {
+	tests := map[string][]ClaimMappingConfig{
+		"missing name":     {{From: []string{"email"}}},
+		"missing source":   {{Name: "groups"}},
+		"both sources":     {{Name: "groups", From: []string{"roles"}, Value: "x"}},
+		"invalid template": {{Name: "groups", Value: "{{ .claims"}},
+	}
+
+	for name, mappings := range tests {
+		if err := parseClaimMappings(mappings); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestClaimMappingsTransformGroups(t *testing.T) {
+	mappings := []ClaimMappingConfig{
+		{Name: "groups", From: []string{"groups"}, StripDistinguishedName: true, StripPrefix: "App-", Lowercase: true},
+		{Name: "department", From: []string{"department"}, Lowercase: true},
+	}
+
+	if err := parseClaimMappings(mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{ClaimMappings: mappings})
+
+	mapped := toa.mapClaims(map[string]interface{}{
+		"groups": []interface{}{
+			"CN=App-Admins,OU=Groups,DC=example,DC=com",
+			"CN=App-Sales\\, EMEA,OU=Groups,DC=example,DC=com",
+			"app-admins",
+			"App-",
+			"Users",
+		},
+		"department": "Engineering",
+	})
+
+	if groups := mapped["groups"]; !reflect.DeepEqual(groups, []interface{}{"admins", "sales, emea", "app-admins", "users"}) {
+		t.Errorf("Expected the groups to be transformed, but got %v", groups)
+	}
+	if department := mapped["department"]; department != "engineering" {
+		t.Errorf("Expected a single value to be transformed, but got %v", department)
+	}
+}
+
+func TestGetCommonName(t *testing.T) {
+	tests := map[string]string{
+		"CN=Admins,OU=Groups,DC=example,DC=com": "Admins",
+		"cn=Domain Users,DC=example":            "Domain Users",
+		"CN=a\\+b+OU=x":                         "a+b",
+		"CN=Admins":                             "Admins",
+		"OU=Groups,DC=example":                  "OU=Groups,DC=example",
+		"admins":                                "admins",
+	}
+
+	for dn, expected := range tests {
+		if actual := getCommonName(dn); actual != expected {
+			t.Errorf("%s: Expected '%s', but got '%s'", dn, expected, actual)
+		}
+	}
+}
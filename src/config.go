@@ -3,34 +3,58 @@ package src
 import (
 	"context"
 	"crypto/rsa"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
 	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 const DefaultSecret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
 
+const minimumSecretLength = 16
+
 type Config struct {
 	LogLevel string `json:"log_level"`
+	// Overrides the LogLevel of single modules, eg. rules: DEBUG. See logging.Modules.
+	LogLevels map[string]string `json:"log_levels"`
+	// Writes the logs to a file, a syslog server or an HTTP collector
+	LogOutput *LogOutputConfig `json:"log_output"`
 
 	Secret string `json:"secret"`
+	// Reads the secret from a file instead, eg. a mounted Docker or Kubernetes secret.
+	SecretFile string `json:"secret_file"`
+	// Secrets which have been used before. They are only used for decryption, so the secret can be rotated
+	// without invalidating all existing sessions.
+	PreviousSecrets []string `json:"previous_secrets"`
+	// An optional salt, used when deriving the encryption key from secrets which are not exactly 32 characters long.
+	SecretSalt string `json:"secret_salt"`
+	// The cipher used to encrypt cookies and states. Can be one of aes-gcm or xaes-256-gcm.
+	Cipher string `json:"cipher"`
+
+	encryptionKeys []string
 
 	Provider *ProviderConfig `json:"provider"`
-	Scopes   []string        `json:"scopes"`
+	// Applies the defaults of an identity provider: generic or keycloak.
+	ProviderType string   `json:"provider_type"`
+	Scopes       []string `json:"scopes"`
 
 	// Can be a relative path or a full URL.
 	// If a relative path is used, the scheme and domain will be taken from the incoming request.
@@ -49,22 +73,146 @@ type Config struct {
 	PostLogoutRedirectUri       string   `json:"post_logout_redirect_uri"`
 	ValidPostLogoutRedirectUris []string `json:"valid_post_logout_redirect_uris"`
 
+	// How the redirect uris, which clients pass to the login and logout endpoints, are validated:
+	// Patterns, RelativeOnly or SameHost. Patterns uses ValidPostLoginRedirectUris and ValidPostLogoutRedirectUris.
+	RedirectUriPolicy string `json:"redirect_uri_policy"`
+
+	// Query parameters of the original request, which are carried through the state and appended to the
+	// redirect url after the login, eg. invite_token. A trailing * matches any parameter starting with the prefix.
+	PreservedQueryParameters []string `json:"preserved_query_parameters"`
+
+	// Controls how requests are matched against the LoginUri, LogoutUri and CallbackUri
+	InternalUris *InternalUrisConfig `json:"internal_uris"`
+
+	// The urls of the health and readiness endpoints. Set to an empty string to disable them.
+	HealthUri string `json:"health_uri"`
+	ReadyUri  string `json:"ready_uri"`
+
+	// The number of seconds a login or logout flow may take until the state of the callback expires.
+	StateMaxAge int `json:"state_max_age"`
+
+	// The maximum sizes in bytes of inbound tokens and of the session cookie.
+	// Larger requests are rejected before anything is parsed or decrypted. 0 disables the limit.
+	MaxTokenSize  int `json:"max_token_size"`
+	MaxCookieSize int `json:"max_cookie_size"`
+	// The maximum size in bytes of request bodies read by the middleware, like the form_post callback.
+	MaxBodySize int `json:"max_body_size"`
+	// The number of seconds the middleware waits for a request body it reads.
+	BodyReadTimeout float64 `json:"body_read_timeout"`
+
 	CookieNamePrefix     string                     `json:"cookie_name_prefix"`
 	SessionCookie        *SessionCookieConfig       `json:"session_cookie"`
+	PkceCookie           *PkceCookieConfig          `json:"pkce_cookie"`
+	SessionStorage       *SessionStorageConfig      `json:"session_storage"`
+	SessionManagement    *SessionManagementConfig   `json:"session_management"`
 	AuthorizationHeader  *AuthorizationHeaderConfig `json:"authorization_header"`
 	AuthorizationCookie  *AuthorizationCookieConfig `json:"authorization_cookie"`
 	UnauthorizedBehavior string                     `json:"unauthorized_behavior"`
 
+	// Disabled or Embedded. Embedded allows the application to be used in iframes of other sites.
+	CrossSiteMode string `json:"cross_site_mode"`
+
+	// Defines the behavior for requests with an expired or invalid session: SilentRefresh, Challenge, Unauthorized or Anonymous.
+	// When empty, these requests are handled by UnauthorizedBehavior.
+	ExpiredSessionBehavior string `json:"expired_session_behavior"`
+	// Overrides the ExpiredSessionBehavior for matching requests. The first matching rule wins.
+	ExpiredSessionRules []ExpiredSessionRuleConfig `json:"expired_session_rules"`
+
+	// Requires additional scopes for matching requests, which are requested from the provider when missing.
+	ScopeRules []ScopeRuleConfig `json:"scope_rules"`
+
 	Authorization *AuthorizationConfig `json:"authorization"`
 
+	// Maps the claims of the provider into a canonical shape before authorization and header evaluation
+	ClaimMappings []ClaimMappingConfig `json:"claim_mappings"`
+
 	Headers []HeaderConfig `json:"headers"`
 
+	// What is sent as bearer token in the Authorization header of upstream requests: AccessToken, IdToken, Minted or None.
+	// When empty, the header isn't changed.
+	UpstreamAuthorization string             `json:"upstream_authorization"`
+	MintedToken           *MintedTokenConfig `json:"minted_token"`
+
+	// Eases the migration from oauth2-proxy
+	OAuth2Proxy *OAuth2ProxyConfig `json:"oauth2_proxy"`
+
 	BypassAuthenticationRule string `json:"bypass_authentication_rule"`
+	// Forwards requests to /.well-known/* without authentication, eg. ACME HTTP-01 challenges.
+	BypassWellKnownPaths bool `json:"bypass_well_known_paths"`
+	// Forwards requests for static assets when a session cookie is present, without validating the session.
+	StaticAssets *StaticAssetsConfig `json:"static_assets"`
+
+	// Writes a JSON line with the outcome of every request, eg. for security analytics
+	AccessLog *AccessLogConfig `json:"access_log"`
+
+	// Sends security-relevant events, like lockouts, to a webhook
+	Webhook *WebhookConfig `json:"webhook"`
+
+	// Calls an endpoint on the first login of a user, eg. to create the user in the upstream application
+	Provisioning *ProvisioningConfig `json:"provisioning"`
+
+	// Restricts the keys which are accepted from the JWKS of the provider and the trusted issuers
+	Jwks *JwksConfig `json:"jwks"`
+
+	// Requires users to accept the terms of use before requests are forwarded
+	Consent *ConsentConfig `json:"consent"`
+
+	// Allows support staff to assume the identity of other users
+	Impersonation *ImpersonationConfig `json:"impersonation"`
+
+	// Unauthenticated requests matching the rule of AnonymousAccess are forwarded with a synthetic identity
+	AnonymousAccess *AnonymousAccessConfig `json:"anonymous_access"`
+
+	// Requests matching this rule are treated as API requests. They are never redirected
+	// and always receive RFC 6750 compliant responses.
+	ApiRouteRule string `json:"api_route_rule"`
 
 	// JavaScriptRequestDetection allows configuring how to detect JavaScript/AJAX requests
 	JavaScriptRequestDetection *JavaScriptRequestDetectionConfig `json:"javascript_request_detection"`
 
 	ErrorPages *errorPages.ErrorPagesConfig `json:"error_pages"`
+
+	// Limits the number of logins and callbacks per client ip
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+
+	// Locks out clients and subjects after too many failed authentication attempts
+	Lockout *LockoutConfig `json:"lockout"`
+
+	// Stops sending requests to the provider after consecutive failures
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+
+	// Keeps existing sessions working while the provider is unavailable
+	GracefulDegradation *GracefulDegradationConfig `json:"graceful_degradation"`
+
+	// Limits the number of concurrent token refreshes at the provider
+	RefreshLimit *RefreshLimitConfig `json:"refresh_limit"`
+
+	// Binds sessions to the client's network and/or browser
+	SessionBinding *SessionBindingConfig `json:"session_binding"`
+
+	// Resolves the country of the client to restrict logins and to use it in rules
+	GeoIp *GeoIpConfig `json:"geo_ip"`
+
+	// Allows users to request a persistent session on the login endpoint
+	RememberMe *RememberMeConfig `json:"remember_me"`
+
+	// Allows logins in a popup, which notifies its opener and closes itself after the callback
+	PopupCallback *PopupCallbackConfig `json:"popup_callback"`
+
+	// Reloads some settings from a file at runtime
+	HotReload *HotReloadConfig `json:"hot_reload"`
+
+	// Shares the discovery documents and JWKS with other instances of the middleware in the process
+	SharedCache *SharedCacheConfig `json:"shared_cache"`
+
+	// Collects metrics and serves them in the Prometheus text format
+	Metrics *MetricsConfig `json:"metrics"`
+
+	// Exports traces to an OpenTelemetry collector
+	Tracing *TracingConfig `json:"tracing"`
+
+	// Serves the current state of the middleware for debugging
+	Debug *DebugConfig `json:"debug"`
 }
 
 type ProviderConfig struct {
@@ -76,17 +224,36 @@ type ProviderConfig struct {
 	CABundle     string `json:"ca_bundle"`
 	CABundleFile string `json:"ca_bundle_file"`
 
+	// The minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	TlsMinVersion string `json:"tls_min_version"`
+	// The names of the allowed cipher suites for TLS 1.2 and below, eg. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	TlsCipherSuites []string `json:"tls_cipher_suites"`
+	// Overrides the server name which is sent using SNI and used to verify the certificate
+	TlsServerName string `json:"tls_server_name"`
+
+	// Proxies used to reach the provider instead of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	HttpProxy  string `json:"http_proxy"`
+	HttpsProxy string `json:"https_proxy"`
+	NoProxy    string `json:"no_proxy"`
+
 	ClientId              string `json:"client_id"`
 	ClientSecret          string `json:"client_secret"`
+	ClientSecretFile      string `json:"client_secret_file"`
 	ClientJwtPrivateKey   string `json:"client_jwt_private_key"`
 	ClientJwtPrivateKeyId string `json:"client_jwt_private_key_id"`
 
 	UsePkce     string `json:"use_pkce"`
 	UsePkceBool bool   `json:"use_pkce_bool"`
+	// The method of the code challenge: S256 or plain.
+	PkceMethod string `json:"pkce_method"`
+	// Fails the discovery, if the provider doesn't advertise the PkceMethod in code_challenge_methods_supported.
+	RequirePkceSupport bool `json:"require_pkce_support"`
 
 	ValidateAudience     string `json:"validate_audience"`
 	ValidateAudienceBool bool   `json:"validate_audience_bool"`
 	ValidAudience        string `json:"valid_audience"`
+	// The API whose access tokens are requested, sent as audience parameter, eg. for Auth0 and Okta custom authorization servers.
+	Audience string `json:"audience"`
 
 	ValidateIssuer     string `json:"validate_issuer"`
 	ValidateIssuerBool bool   `json:"validate_issuer_bool"`
@@ -99,6 +266,79 @@ type ProviderConfig struct {
 
 	UseClaimsFromUserInfo     string `json:"use_claims_from_user_info"`
 	UseClaimsFromUserInfoBool bool   `json:"use_claims_from_user_info_bool"`
+
+	// Whether to request the offline_access scope: Auto, Always or Never. Auto requests it, when the sessions
+	// depend on a refresh token and the provider supports the scope.
+	OfflineAccess string `json:"offline_access"`
+
+	// The response_type of the authorization request: code or one of the hybrid flows code id_token, code token
+	// and code id_token token.
+	ResponseType string `json:"response_type"`
+	// How the provider returns the authorization response: query or form_post. Hybrid flows use form_post by default.
+	ResponseMode string `json:"response_mode"`
+
+	// The Google Workspace domains whose users are allowed to log in, checked against the hd claim. "*" allows any Workspace domain.
+	HostedDomains []string `json:"hosted_domains"`
+
+	// Claims which must be present in the token, eg. because the policies depend on them. A login fails, if one is missing.
+	RequiredClaims []string `json:"required_claims"`
+
+	// The parameter of the authorization request, which receives the idp_hint of the login, eg. kc_idp_hint.
+	IdpHintParameter string `json:"idp_hint_parameter"`
+
+	// How the client secret is sent to the token and introspection endpoints: client_secret_basic or client_secret_post.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+
+	// Additional headers and form parameters of the requests to the token endpoint, including refreshes.
+	TokenRequest *ProviderRequestConfig `json:"token_request"`
+	// Additional headers and form parameters of the requests to the introspection endpoint.
+	IntrospectionRequest *ProviderRequestConfig `json:"introspection_request"`
+
+	Timeouts *ProviderTimeoutsConfig `json:"timeouts"`
+	Retry    *ProviderRetryConfig    `json:"retry"`
+
+	// A standby provider which is used for new logins while the primary provider is failing.
+	Secondary *SecondaryProviderConfig `json:"secondary"`
+}
+
+// SecondaryProviderConfig defines the standby provider of an active-passive deployment.
+// The client id and secret of the primary provider are used, if ClientId is empty.
+type SecondaryProviderConfig struct {
+	Url          string `json:"url"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// If left empty, the issuer from the discovery document is used.
+	ValidIssuer string `json:"valid_issuer"`
+	// The number of seconds new logins stay at the secondary provider after the primary provider failed.
+	FailbackAfter float64 `json:"failback_after"`
+}
+
+// ProviderRequestConfig adds headers and form parameters to requests to the provider,
+// eg. an API key required by a gateway in front of it.
+type ProviderRequestConfig struct {
+	Headers    map[string]string `json:"headers"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// ProviderTimeoutsConfig defines the timeouts of a single request to the provider in seconds.
+// A value of 0 falls back to Default.
+type ProviderTimeoutsConfig struct {
+	Default       float64 `json:"default"`
+	Discovery     float64 `json:"discovery"`
+	Token         float64 `json:"token"`
+	Jwks          float64 `json:"jwks"`
+	Introspection float64 `json:"introspection"`
+	Userinfo      float64 `json:"userinfo"`
+}
+
+// ProviderRetryConfig defines how idempotent requests to the provider are retried.
+type ProviderRetryConfig struct {
+	// The maximum number of attempts, including the first one. 1 disables retries.
+	MaxAttempts int `json:"max_attempts"`
+	// The backoff before the first retry in seconds. It is doubled for every further retry.
+	InitialBackoff float64 `json:"initial_backoff"`
+	// The upper limit of the backoff in seconds.
+	MaxBackoff float64 `json:"max_backoff"`
 }
 
 type SessionCookieConfig struct {
@@ -108,10 +348,73 @@ type SessionCookieConfig struct {
 	HttpOnly bool   `json:"http_only"`
 	SameSite string `json:"same_site"`
 	MaxAge   int    `json:"max_age"`
+
+	// Assign a new session id when a token renewal changes the user's claims, eg. roles.
+	RegenerateId bool `json:"regenerate_id"`
+
+	// Compress the session before encryption to reduce the number of cookie chunks.
+	Compress bool `json:"compress"`
+
+	// Only store the refresh token in the cookie. The other tokens are kept in memory.
+	Minimal bool `json:"minimal"`
+
+	// Emits the Partitioned attribute (CHIPS), which is required for cookies in cross-site iframes.
+	Partitioned bool `json:"partitioned"`
+
+	// The maximum number of bytes of the value of a single cookie. Larger values are split into multiple chunks.
+	ChunkSize int `json:"chunk_size"`
+	// The maximum number of chunks. 0 allows any number of chunks.
+	MaxChunks int `json:"max_chunks"`
+
+	// The minimum number of seconds between re-issuing an unchanged session cookie. 0 re-issues it on every update.
+	MinCookieRefreshInterval int `json:"min_cookie_refresh_interval"`
+}
+
+// PkceCookieConfig configures the cookie, which holds the PKCE code verifier during the login.
+type PkceCookieConfig struct {
+	// Defaults to the host of the CallbackUri.
+	Domain string `json:"domain"`
+	Secure bool   `json:"secure"`
+	// Defaults to none for the form_post response mode and to the browser's default otherwise.
+	SameSite string `json:"same_site"`
+	// The number of seconds the cookie is kept. 0 keeps it until the browser is closed.
+	MaxAge int `json:"max_age"`
+}
+
+type SessionStorageConfig struct {
+	// Either Cookie, which stores the whole session in the cookie, or Memory, which only stores the session id in the cookie.
+	Type string `json:"type"`
+	// The number of seconds after which unused sessions are removed from the memory.
+	IdleTimeout int `json:"idle_timeout"`
+	// The maximum number of sessions kept in memory. When reached, the sessions expiring first are removed. 0 means unlimited.
+	MaxSessions int `json:"max_sessions"`
+}
+
+type SessionManagementConfig struct {
+	Enabled bool `json:"enabled"`
+	// The url users can list and revoke their sessions on. Requires the Memory session storage.
+	Path string `json:"path"`
 }
 
 type AuthorizationHeaderConfig struct {
 	Name string `json:"name"`
+
+	// Additional issuers whose JWTs are accepted on this header, besides the primary provider.
+	TrustedIssuers []TrustedIssuerConfig `json:"trusted_issuers"`
+
+	// When enabled, tokens which are not a JWT are validated using the provider's introspection endpoint.
+	IntrospectOpaqueTokens bool `json:"introspect_opaque_tokens"`
+	// The number of seconds a successful introspection result is cached. 0 disables caching.
+	// A revoked token is still accepted until its cached result expires.
+	IntrospectionCacheDuration int `json:"introspection_cache_duration"`
+}
+
+type TrustedIssuerConfig struct {
+	Issuer string `json:"issuer"`
+
+	// If left empty, the JWKS url is read from the issuer's discovery document.
+	JwksUri  string `json:"jwks_uri"`
+	Audience string `json:"audience"`
 }
 type AuthorizationCookieConfig struct {
 	Name string `json:"name"`
@@ -120,6 +423,8 @@ type AuthorizationCookieConfig struct {
 type AuthorizationConfig struct {
 	AssertClaims        []ClaimAssertion `json:"assert_claims"`
 	CheckOnEveryRequest bool             `json:"check_on_every_request"`
+	// Tells users which assertion failed, without revealing the actual values of their claims.
+	ExposeFailureDetails bool `json:"expose_failure_details"`
 }
 
 type ClaimAssertion struct {
@@ -128,6 +433,25 @@ type ClaimAssertion struct {
 	AllOf []string `json:"allOf"`
 }
 
+type ClaimMappingConfig struct {
+	// The name of the claim which is set.
+	Name string `json:"name"`
+	// JSON paths of the source claims. Multiple values and lists are flattened into a single list.
+	From []string `json:"from"`
+	// A Go template rendering the value of the claim instead, eg. "{{ .claims.given_name }} {{ .claims.family_name }}".
+	Value string `json:"value"`
+
+	// Reduces distinguished names like "CN=Admins,OU=Groups,DC=example,DC=com", eg. ADFS groups, to the common name.
+	StripDistinguishedName bool `json:"strip_distinguished_name"`
+	// A prefix which is removed from the values, eg. a namespace of the identity provider.
+	StripPrefix string `json:"strip_prefix"`
+	// Converts the values to lower case.
+	Lowercase bool `json:"lowercase"`
+
+	// A reference to the parsed Value-template
+	template *template.Template
+}
+
 type HeaderConfig struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
@@ -136,6 +460,320 @@ type HeaderConfig struct {
 	template *template.Template
 }
 
+type RateLimitConfig struct {
+	// The number of allowed requests per minute and client ip. 0 disables rate limiting.
+	RequestsPerMinute int `json:"requests_per_minute"`
+	Burst             int `json:"burst"`
+}
+
+type LockoutConfig struct {
+	Enabled bool `json:"enabled"`
+	// The number of failed callbacks and invalid tokens after which a client ip or subject is locked out.
+	MaxFailures int `json:"max_failures"`
+	// The number of seconds in which the failures are counted.
+	Window int `json:"window"`
+	// The number of seconds a client ip or subject stays locked out.
+	Duration int `json:"duration"`
+}
+
+type CircuitBreakerConfig struct {
+	Enabled bool `json:"enabled"`
+	// The number of consecutive failed requests to the provider after which the circuit breaker opens.
+	FailureThreshold int `json:"failure_threshold"`
+	// The number of seconds after which a single request is sent to probe the provider again.
+	OpenDuration int `json:"open_duration"`
+	// Either FailClosed or FailOpen.
+	Fallback string `json:"fallback"`
+}
+
+type GracefulDegradationConfig struct {
+	Enabled bool `json:"enabled"`
+	// The number of seconds a token may be expired, while it can't be renewed because the provider is unavailable.
+	MaxStaleness int `json:"max_staleness"`
+	// The number of seconds between renewal attempts of a session, while the provider is unavailable.
+	RenewalRetryInterval int `json:"renewal_retry_interval"`
+}
+
+type RefreshLimitConfig struct {
+	// The number of refresh token grants which may run at the same time. 0 disables the limit.
+	MaxConcurrent int `json:"max_concurrent"`
+	// The number of seconds a refresh waits for a free slot, before the request is rejected.
+	QueueTimeout int `json:"queue_timeout"`
+}
+
+type SessionBindingConfig struct {
+	// Can be one of None, Subnet or Exact.
+	ClientIp  string `json:"client_ip"`
+	UserAgent bool   `json:"user_agent"`
+	// Requires a new login, when the country of the client changes. Requires the GeoIp block.
+	Country bool `json:"country"`
+}
+
+type GeoIpConfig struct {
+	// Path to a CSV file with lines of the form "network,country", eg. "192.0.2.0/24,DE".
+	DatabaseFile string `json:"database_file"`
+	// A header containing the country of the client, eg. CF-IPCountry. Takes precedence over the database.
+	// Only use this, when the header is always set by a trusted proxy.
+	CountryHeader string `json:"country_header"`
+	// ISO 3166-1 alpha-2 codes of the countries logins are allowed from. When empty, all countries are allowed.
+	AllowedCountries []string `json:"allowed_countries"`
+	// ISO 3166-1 alpha-2 codes of the countries logins are denied from.
+	DeniedCountries []string `json:"denied_countries"`
+}
+
+type RememberMeConfig struct {
+	Enabled bool `json:"enabled"`
+	// The max age of the session cookie in seconds, when the user asked to be remembered.
+	MaxAge int `json:"max_age"`
+	// Adds the offline_access scope, so the IDP issues a long-lived refresh token.
+	RequestOfflineAccess bool `json:"request_offline_access"`
+}
+
+type InternalUrisConfig struct {
+	// Only matches the exact path of the LoginUri and LogoutUri instead of every path starting with it.
+	ExactMatch bool `json:"exact_match"`
+	// The allowed HTTP methods per uri. All methods are allowed, if empty.
+	LoginMethods    []string `json:"login_methods"`
+	LogoutMethods   []string `json:"logout_methods"`
+	CallbackMethods []string `json:"callback_methods"`
+}
+
+type WebhookConfig struct {
+	// The url the events are posted to. When empty, no events are sent.
+	Url string `json:"url"`
+	// The key of the HMAC-SHA256 signature of the events.
+	Secret string `json:"secret"`
+	// The events which are sent. All events are sent when empty.
+	Events []string `json:"events"`
+	// Additional headers, eg. for authentication.
+	Headers map[string]string `json:"headers"`
+	// The timeout of a request to the webhook in seconds.
+	Timeout int `json:"timeout"`
+}
+
+type ProvisioningConfig struct {
+	// The url which is called on the first login of a subject. When empty, nobody is provisioned.
+	Url string `json:"url"`
+	// The key of the HMAC-SHA256 signature of the requests.
+	Secret string `json:"secret"`
+	// Additional headers, eg. for authentication.
+	Headers map[string]string `json:"headers"`
+	// The timeout of a request to the endpoint in seconds.
+	Timeout int `json:"timeout"`
+	// The number of retries after network and server errors.
+	Retries int `json:"retries"`
+	// A file where the provisioned subjects are remembered across restarts.
+	SeenSubjectsFile string `json:"seen_subjects_file"`
+}
+
+type AccessLogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Logs a keyed hash of the subject instead of the subject itself.
+	HashSubject bool `json:"hash_subject"`
+}
+
+type StaticAssetsConfig struct {
+	// File extensions of static assets, eg. css or js.
+	Extensions []string `json:"extensions"`
+	// Paths below which all requests are static assets, eg. /assets/.
+	PathPrefixes []string `json:"path_prefixes"`
+}
+
+type JwksConfig struct {
+	// The maximum number of keys accepted from a JWKS. Additional keys are ignored. 0 means unlimited.
+	MaxKeys int `json:"max_keys"`
+	// The allowed algorithms of the keys, eg. RS256. Keys without an alg are always accepted.
+	AllowedAlgorithms []string `json:"allowed_algorithms"`
+}
+
+type ConsentConfig struct {
+	Enabled bool `json:"enabled"`
+	// The url which records the acceptance of the terms.
+	Uri string `json:"uri"`
+	// An optional claim, which indicates that the user has already accepted the terms at the identity provider.
+	Claim string `json:"claim"`
+	// The version of the terms. Changing it requires all users to accept the terms again.
+	Version string `json:"version"`
+	// The number of seconds after which users have to accept the terms again. 0 means never.
+	ReconsentAfter int `json:"reconsent_after"`
+}
+
+type ImpersonationConfig struct {
+	Enabled bool `json:"enabled"`
+	// The assertions a user must fulfill to impersonate other users.
+	PrivilegeClaims []ClaimAssertion `json:"privilege_claims"`
+	// The claim which identifies users, eg. sub. It is replaced by the impersonated user.
+	IdentityClaim string `json:"identity_claim"`
+	// Starts the impersonation for the rest of the session, once the user confirmed it. An empty value stops it.
+	QueryParameter string `json:"query_parameter"`
+	// The url which confirms the impersonation requested by the QueryParameter.
+	Uri string `json:"uri"`
+	// Impersonates a user for a single request.
+	Header string `json:"header"`
+	// The upstream header containing the identity of the impersonator.
+	ImpersonatorHeader string `json:"impersonator_header"`
+}
+
+type AnonymousAccessConfig struct {
+	Rule string `json:"rule"`
+	// Static headers which identify guests upstream, eg. X-Forwarded-User: anonymous
+	Headers []HeaderConfig `json:"headers"`
+
+	condition *rules.RequestCondition
+}
+
+type PopupCallbackConfig struct {
+	Enabled bool `json:"enabled"`
+	// The type of the message which is posted to the opener.
+	MessageType string `json:"message_type"`
+}
+
+type ExpiredSessionRuleConfig struct {
+	Rule     string `json:"rule"`
+	Behavior string `json:"behavior"`
+
+	condition *rules.RequestCondition
+}
+
+type ScopeRuleConfig struct {
+	Rule   string   `json:"rule"`
+	Scopes []string `json:"scopes"`
+
+	condition *rules.RequestCondition
+}
+
+// MintedTokenConfig defines the tokens issued by the middleware for upstream services.
+type MintedTokenConfig struct {
+	// An RSA private key in PEM format, used to sign the tokens with RS256.
+	PrivateKey string `json:"private_key"`
+	KeyId      string `json:"key_id"`
+	// A secret of at least 32 characters, used to sign the tokens with HS256 instead.
+	SharedSecret string `json:"shared_secret"`
+	Issuer       string `json:"issuer"`
+	Audience     string `json:"audience"`
+	// The number of seconds the tokens are valid.
+	Lifetime int `json:"lifetime"`
+	// The claims of the user which are copied into the token, besides sub.
+	Claims []string `json:"claims"`
+}
+
+type OAuth2ProxyConfig struct {
+	// Sets the X-Auth-Request-* headers like oauth2-proxy.
+	Enabled     bool   `json:"enabled"`
+	UserClaim   string `json:"user_claim"`
+	EmailClaim  string `json:"email_claim"`
+	GroupsClaim string `json:"groups_claim"`
+	// Also sets X-Auth-Request-Access-Token.
+	PassAccessToken bool `json:"pass_access_token"`
+	// The name of oauth2-proxy's cookie. Its cookies are removed from upstream requests and expired after the login.
+	CookieName string `json:"cookie_name"`
+}
+
+type SharedCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// The number of seconds a discovery document fetched by another instance is reused.
+	MaxAge float64 `json:"max_age"`
+}
+
+type HotReloadConfig struct {
+	// Path to a JSON file containing the reloadable settings.
+	FilePath string `json:"file_path"`
+	// The number of seconds between checks for changes of the file.
+	Interval int `json:"interval"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `json:"enabled"`
+	// The url the metrics are served on. Set to an empty string to only collect the metrics.
+	Path string `json:"path"`
+	// An optional bearer token, which is required to read the metrics.
+	Token string `json:"token"`
+	// An optional list of ip ranges in CIDR notation, which are allowed to read the metrics.
+	AllowedSourceRanges []string `json:"allowed_source_ranges"`
+	// The upper bounds of the latency histogram buckets in seconds.
+	Buckets []float64 `json:"buckets"`
+	// Optionally pushes the metrics to a StatsD server.
+	StatsD *StatsDConfig `json:"statsd"`
+}
+
+type DebugConfig struct {
+	Enabled bool `json:"enabled"`
+	// The url the state of the middleware is served on.
+	Path string `json:"path"`
+	// The bearer token, which is required to read the state. Either Token or AllowedSourceRanges is required.
+	Token string `json:"token"`
+	// A list of ip ranges in CIDR notation, which are allowed to read the state.
+	AllowedSourceRanges []string `json:"allowed_source_ranges"`
+	// The url claims can be posted to, to test the authorization rules against them.
+	PolicyTestPath string `json:"policy_test_path"`
+	// Logs the headers sent to the upstream service at the debug level. This doesn't require the endpoint to be enabled.
+	LogUpstreamHeaders bool `json:"log_upstream_headers"`
+	// The headers whose values are logged by LogUpstreamHeaders. All other values are redacted, as are credentials.
+	LogHeaderValues []string `json:"log_header_values"`
+}
+
+type LogOutputConfig struct {
+	// Whether the logs are still written to stdout, where they are mixed with the logs of traefik.
+	Stdout bool           `json:"stdout"`
+	File   *LogFileConfig `json:"file"`
+	Syslog *SyslogConfig  `json:"syslog"`
+	Http   *LogHttpConfig `json:"http"`
+}
+
+type LogFileConfig struct {
+	// The path of the log file. When empty, no file is written.
+	Path string `json:"path"`
+	// The size in megabytes after which the file is rotated. 0 disables the rotation.
+	MaxSize int `json:"max_size"`
+	// The number of rotated files which are kept.
+	MaxBackups int `json:"max_backups"`
+}
+
+type SyslogConfig struct {
+	// Either udp or tcp.
+	Network string `json:"network"`
+	// The address of the syslog server, eg. localhost:514. When empty, no logs are sent.
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
+
+type LogHttpConfig struct {
+	// The url the logs are posted to as newline-delimited JSON. When empty, no logs are sent.
+	Url string `json:"url"`
+	// Additional headers, eg. for authentication.
+	Headers map[string]string `json:"headers"`
+	// The number of seconds after which buffered logs are sent.
+	FlushInterval int `json:"flush_interval"`
+}
+
+type StatsDConfig struct {
+	// The address of the StatsD server, eg. localhost:8125. When empty, no metrics are sent.
+	Address string `json:"address"`
+	Prefix  string `json:"prefix"`
+	// Sends the labels and Tags as DogStatsD tags. Disable this for servers which don't support tags.
+	DogStatsD bool `json:"dogstatsd"`
+	// Additional tags, which are added to every metric, eg. env:prod.
+	Tags []string `json:"tags"`
+	// The number of seconds after which buffered metrics are sent.
+	FlushInterval int `json:"flush_interval"`
+}
+
+type TracingConfig struct {
+	Enabled     bool   `json:"enabled"`
+	ServiceName string `json:"service_name"`
+	// The url of the OTLP/HTTP endpoint, eg. http://otel-collector:4318.
+	OtlpEndpoint string `json:"otlp_endpoint"`
+	// Additional headers, which are sent to the OTLP endpoint, eg. for authentication.
+	OtlpHeaders map[string]string `json:"otlp_headers"`
+	// Additional headers whose values are read from files, eg. mounted Docker or Kubernetes secrets.
+	// The key is the name of the header and the value the path of the file.
+	OtlpHeadersFile map[string]string `json:"otlp_headers_file"`
+	// The ratio of traces to sample, between 0 and 1. Requests with a sampled parent are always sampled.
+	SampleRate float64 `json:"sample_rate"`
+	// The format used to read and write the trace context: w3c, b3, b3multi or jaeger.
+	Propagator string `json:"propagator"`
+}
+
 type JavaScriptRequestDetectionConfig struct {
 	// Headers to check for JavaScript/AJAX request detection
 	// Each header can have a list of values to match against
@@ -146,15 +784,45 @@ type JavaScriptRequestDetectionConfig struct {
 func CreateConfig() *Config {
 	return &Config{
 		LogLevel: logging.LevelWarn,
-		Secret:   DefaultSecret,
+		LogOutput: &LogOutputConfig{
+			Stdout: true,
+			File: &LogFileConfig{
+				MaxSize:    100,
+				MaxBackups: 3,
+			},
+			Syslog: &SyslogConfig{
+				Network: "udp",
+				Tag:     "traefik-oidc-auth",
+			},
+			Http: &LogHttpConfig{
+				FlushInterval: 1,
+			},
+		},
+		Secret: DefaultSecret,
+		Cipher: utils.CipherAesGcm,
 		Provider: &ProviderConfig{
 			UsePkceBool:               false,
+			PkceMethod:                pkceMethodS256,
 			InsecureSkipVerifyBool:    false,
 			ValidateIssuerBool:        true,
 			ValidateAudienceBool:      true,
+			TlsMinVersion:             "1.2",
 			TokenValidation:           "IdToken",
 			TokenRenewalThreshold:     0.75,
 			UseClaimsFromUserInfoBool: false,
+			OfflineAccess:             offlineAccessAuto,
+			ResponseType:              responseTypeCode,
+			Timeouts: &ProviderTimeoutsConfig{
+				Default: 10,
+			},
+			Retry: &ProviderRetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: 0.1,
+				MaxBackoff:     2,
+			},
+			Secondary: &SecondaryProviderConfig{
+				FailbackAfter: 60,
+			},
 		},
 		// Note: It looks like we're not allowed to specify a default value for arrays here.
 		// Maybe a traefik bug. So I've moved this to the New() method.
@@ -162,16 +830,39 @@ func CreateConfig() *Config {
 		CallbackUri:           "/oidc/callback",
 		LogoutUri:             "/logout",
 		PostLogoutRedirectUri: "/",
+		HealthUri:             "/oidc/health",
+		ReadyUri:              "/oidc/ready",
+		StateMaxAge:           600,
+		MaxTokenSize:          16384,
+		MaxCookieSize:         32768,
+		MaxBodySize:           65536,
+		BodyReadTimeout:       10,
 		CookieNamePrefix:      "TraefikOidcAuth",
 		SessionCookie: &SessionCookieConfig{
-			Path:     "/",
-			Domain:   "",
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: "default",
-			MaxAge:   0,
+			Path:         "/",
+			Domain:       "",
+			Secure:       true,
+			HttpOnly:     true,
+			SameSite:     "default",
+			MaxAge:       0,
+			RegenerateId: true,
+			ChunkSize:    defaultCookieChunkSize,
+		},
+		PkceCookie: &PkceCookieConfig{
+			Secure: true,
+		},
+		SessionStorage: &SessionStorageConfig{
+			Type:        "Cookie",
+			IdleTimeout: 86400,
+			MaxSessions: 100000,
+		},
+		SessionManagement: &SessionManagementConfig{
+			Enabled: false,
+			Path:    "/oidc/sessions",
+		},
+		AuthorizationHeader: &AuthorizationHeaderConfig{
+			IntrospectionCacheDuration: 0,
 		},
-		AuthorizationHeader:  &AuthorizationHeaderConfig{},
 		AuthorizationCookie:  &AuthorizationCookieConfig{},
 		UnauthorizedBehavior: "Auto",
 		Authorization: &AuthorizationConfig{
@@ -184,19 +875,193 @@ func CreateConfig() *Config {
 				"Content-Type":     {"application/json"},
 			},
 		},
+		RateLimit: &RateLimitConfig{
+			RequestsPerMinute: 0,
+			Burst:             10,
+		},
+		Lockout: &LockoutConfig{
+			Enabled:     false,
+			MaxFailures: 10,
+			Window:      300,
+			Duration:    900,
+		},
+		CircuitBreaker: &CircuitBreakerConfig{
+			Enabled:          false,
+			FailureThreshold: 5,
+			OpenDuration:     30,
+			Fallback:         "FailClosed",
+		},
+		GracefulDegradation: &GracefulDegradationConfig{
+			Enabled:              false,
+			MaxStaleness:         300,
+			RenewalRetryInterval: 30,
+		},
+		RefreshLimit: &RefreshLimitConfig{
+			MaxConcurrent: 0,
+			QueueTimeout:  10,
+		},
+		SessionBinding: &SessionBindingConfig{
+			ClientIp:  "None",
+			UserAgent: false,
+			Country:   false,
+		},
+		GeoIp: &GeoIpConfig{},
+		RememberMe: &RememberMeConfig{
+			Enabled:              false,
+			MaxAge:               2592000,
+			RequestOfflineAccess: true,
+		},
+		InternalUris: &InternalUrisConfig{
+			ExactMatch: false,
+		},
+		Jwks: &JwksConfig{
+			MaxKeys: 50,
+		},
+		Consent: &ConsentConfig{
+			Enabled: false,
+			Uri:     "/oidc/consent",
+		},
+		Impersonation: &ImpersonationConfig{
+			Enabled:            false,
+			PrivilegeClaims:    []ClaimAssertion{{Name: "impersonation", AnyOf: []string{"true"}}},
+			IdentityClaim:      "sub",
+			QueryParameter:     "impersonate",
+			Uri:                "/oidc/impersonate",
+			Header:             "X-Impersonate-User",
+			ImpersonatorHeader: "X-Impersonator",
+		},
+		PopupCallback: &PopupCallbackConfig{
+			Enabled:     false,
+			MessageType: "traefik-oidc-auth:login",
+		},
+		MintedToken: &MintedTokenConfig{
+			Issuer:   "traefik-oidc-auth",
+			Lifetime: 60,
+			Claims:   []string{"email", "name", "preferred_username", "groups"},
+		},
+		OAuth2Proxy: &OAuth2ProxyConfig{
+			Enabled:     false,
+			UserClaim:   "sub",
+			EmailClaim:  "email",
+			GroupsClaim: "groups",
+		},
+		HotReload: &HotReloadConfig{
+			FilePath: "",
+			Interval: 10,
+		},
+		SharedCache: &SharedCacheConfig{
+			Enabled: false,
+			MaxAge:  300,
+		},
+		Metrics: &MetricsConfig{
+			Enabled: false,
+			Path:    "/oidc/metrics",
+			StatsD: &StatsDConfig{
+				Address:       "",
+				Prefix:        "traefik_oidc_auth.",
+				DogStatsD:     true,
+				FlushInterval: 1,
+			},
+		},
+		Tracing: &TracingConfig{
+			Enabled:     false,
+			ServiceName: "traefik-oidc-auth",
+			SampleRate:  1,
+			Propagator:  "w3c",
+		},
+		Webhook: &WebhookConfig{
+			Timeout: 5,
+		},
+		Provisioning: &ProvisioningConfig{
+			Timeout: 5,
+			Retries: 3,
+		},
+		Debug: &DebugConfig{
+			Enabled:        false,
+			Path:           "/oidc/debug",
+			PolicyTestPath: "/oidc/debug/policy",
+		},
 		ErrorPages: &errorPages.ErrorPagesConfig{
 			Unauthenticated: &errorPages.ErrorPageConfig{},
 			Unauthorized:    &errorPages.ErrorPageConfig{},
+			Interstitial:    &errorPages.ErrorPageConfig{},
+			ProviderUnavailable: &errorPages.ErrorPageConfig{
+				RetryAfter: 30,
+			},
+			Consent:     &errorPages.ErrorPageConfig{},
+			LoginFailed: &errorPages.ErrorPageConfig{},
 		},
 	}
 }
 
 // Will be called by traefik
 func New(uctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	toa, err := createTraefikOidcAuth(uctx, next, config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if toa.Webhook != nil {
+		go toa.Webhook.run()
+	}
+
+	// Traefik never stops a plugin, but cancels its context when the middleware is replaced or removed
+	go func() {
+		<-uctx.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := toa.Shutdown(ctx); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Failed to shut down the middleware: %s", err.Error())
+		}
+	}()
+
+	if toa.ConfigReloader != nil {
+		go toa.watchConfigFile(uctx)
+
+		toa.logger.Log(logging.LevelInfo, "Watching %s for configuration changes.", config.HotReload.FilePath)
+	}
+
+	return toa, nil
+}
+
+// createTraefikOidcAuth validates the configuration and creates the middleware without starting any background tasks.
+func createTraefikOidcAuth(uctx context.Context, next http.Handler, config *Config, name string) (*TraefikOidcAuth, error) {
 	config.LogLevel = utils.ExpandEnvironmentVariableString(config.LogLevel)
 
 	logger := logging.CreateLogger(config.LogLevel)
 
+	if len(config.LogLevels) > 0 {
+		if err := applyModuleLogLevels(logger, config.LogLevels); err != nil {
+			return nil, err
+		}
+	}
+
+	var logSinks []string
+	if config.LogOutput != nil {
+		expandLogOutputConfig(config.LogOutput)
+
+		sinks, keys, err := createLogSinks(config.LogOutput)
+		if err != nil {
+			_ = releaseLogSinks(uctx, keys)
+			logger.Log(logging.LevelError, "Invalid LogOutput configuration: %s", err.Error())
+			return nil, err
+		}
+
+		logger.SetSinks(sinks, config.LogOutput.Stdout)
+		logSinks = keys
+	}
+
+	// Only a middleware which has been created successfully is shut down by traefik,
+	// so everything started up to a failure must be released here
+	created := false
+	defer func() {
+		if !created {
+			_ = releaseLogSinks(uctx, logSinks)
+		}
+	}()
+
 	logger.Log(logging.LevelInfo, "Loading Configuration...")
 
 	if config.Provider == nil {
@@ -213,23 +1078,132 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 	var err error
 
 	config.Secret = utils.ExpandEnvironmentVariableString(config.Secret)
+	config.SecretFile = utils.ExpandEnvironmentVariableString(config.SecretFile)
+	if config.SecretFile != "" {
+		config.Secret, err = utils.ReadSecretFile(config.SecretFile)
+		if err != nil {
+			logger.Log(logging.LevelError, "Failed to read the secret from %s: %s", config.SecretFile, err.Error())
+			return nil, err
+		}
+	}
+	for i, previousSecret := range config.PreviousSecrets {
+		config.PreviousSecrets[i] = utils.ExpandEnvironmentVariableString(previousSecret)
+	}
+	config.SecretSalt = utils.ExpandEnvironmentVariableString(config.SecretSalt)
+	config.Cipher = utils.ExpandEnvironmentVariableString(config.Cipher)
+	config.SessionBinding.ClientIp = utils.ExpandEnvironmentVariableString(config.SessionBinding.ClientIp)
+	config.SessionStorage.Type = utils.ExpandEnvironmentVariableString(config.SessionStorage.Type)
+	config.SessionManagement.Path = utils.ExpandEnvironmentVariableString(config.SessionManagement.Path)
+	config.GeoIp.DatabaseFile = utils.ExpandEnvironmentVariableString(config.GeoIp.DatabaseFile)
+	config.GeoIp.CountryHeader = utils.ExpandEnvironmentVariableString(config.GeoIp.CountryHeader)
+	for i := range config.GeoIp.AllowedCountries {
+		config.GeoIp.AllowedCountries[i] = strings.ToUpper(utils.ExpandEnvironmentVariableString(config.GeoIp.AllowedCountries[i]))
+	}
+	for i := range config.GeoIp.DeniedCountries {
+		config.GeoIp.DeniedCountries[i] = strings.ToUpper(utils.ExpandEnvironmentVariableString(config.GeoIp.DeniedCountries[i]))
+	}
+	config.HotReload.FilePath = utils.ExpandEnvironmentVariableString(config.HotReload.FilePath)
+	config.Metrics.Path = utils.ExpandEnvironmentVariableString(config.Metrics.Path)
+	if config.Webhook != nil {
+		config.Webhook.Url = utils.ExpandEnvironmentVariableString(config.Webhook.Url)
+		config.Webhook.Secret = utils.ExpandEnvironmentVariableString(config.Webhook.Secret)
+		for name, value := range config.Webhook.Headers {
+			config.Webhook.Headers[name] = utils.ExpandEnvironmentVariableString(value)
+		}
+	}
+	if config.Provisioning != nil {
+		config.Provisioning.Url = utils.ExpandEnvironmentVariableString(config.Provisioning.Url)
+		config.Provisioning.Secret = utils.ExpandEnvironmentVariableString(config.Provisioning.Secret)
+		config.Provisioning.SeenSubjectsFile = utils.ExpandEnvironmentVariableString(config.Provisioning.SeenSubjectsFile)
+		for name, value := range config.Provisioning.Headers {
+			config.Provisioning.Headers[name] = utils.ExpandEnvironmentVariableString(value)
+		}
+	}
+	config.Metrics.Token = utils.ExpandEnvironmentVariableString(config.Metrics.Token)
+	for i := range config.Metrics.AllowedSourceRanges {
+		config.Metrics.AllowedSourceRanges[i] = utils.ExpandEnvironmentVariableString(config.Metrics.AllowedSourceRanges[i])
+	}
+	config.Debug.Path = utils.ExpandEnvironmentVariableString(config.Debug.Path)
+	config.Debug.Token = utils.ExpandEnvironmentVariableString(config.Debug.Token)
+	config.Debug.PolicyTestPath = utils.ExpandEnvironmentVariableString(config.Debug.PolicyTestPath)
+	for i := range config.Debug.AllowedSourceRanges {
+		config.Debug.AllowedSourceRanges[i] = utils.ExpandEnvironmentVariableString(config.Debug.AllowedSourceRanges[i])
+	}
+	for i := range config.Debug.LogHeaderValues {
+		config.Debug.LogHeaderValues[i] = utils.ExpandEnvironmentVariableString(config.Debug.LogHeaderValues[i])
+	}
+	config.Tracing.ServiceName = utils.ExpandEnvironmentVariableString(config.Tracing.ServiceName)
+	config.Tracing.OtlpEndpoint = utils.ExpandEnvironmentVariableString(config.Tracing.OtlpEndpoint)
+	config.Tracing.Propagator = utils.ExpandEnvironmentVariableString(config.Tracing.Propagator)
+	for name, value := range config.Tracing.OtlpHeaders {
+		config.Tracing.OtlpHeaders[name] = utils.ExpandEnvironmentVariableString(value)
+	}
+	for name, path := range config.Tracing.OtlpHeadersFile {
+		config.Tracing.OtlpHeadersFile[name] = utils.ExpandEnvironmentVariableString(path)
+	}
+	if config.Metrics.StatsD != nil {
+		config.Metrics.StatsD.Address = utils.ExpandEnvironmentVariableString(config.Metrics.StatsD.Address)
+		config.Metrics.StatsD.Prefix = utils.ExpandEnvironmentVariableString(config.Metrics.StatsD.Prefix)
+		for i := range config.Metrics.StatsD.Tags {
+			config.Metrics.StatsD.Tags[i] = utils.ExpandEnvironmentVariableString(config.Metrics.StatsD.Tags[i])
+		}
+	}
 	config.CallbackUri = utils.ExpandEnvironmentVariableString(config.CallbackUri)
 	config.LoginUri = utils.ExpandEnvironmentVariableString(config.LoginUri)
 	config.PostLoginRedirectUri = utils.ExpandEnvironmentVariableString(config.PostLoginRedirectUri)
 	config.LogoutUri = utils.ExpandEnvironmentVariableString(config.LogoutUri)
+	if config.InternalUris != nil {
+		for _, methods := range [][]string{config.InternalUris.LoginMethods, config.InternalUris.LogoutMethods, config.InternalUris.CallbackMethods} {
+			for i := range methods {
+				methods[i] = strings.ToUpper(utils.ExpandEnvironmentVariableString(methods[i]))
+			}
+		}
+	}
 	config.PostLogoutRedirectUri = utils.ExpandEnvironmentVariableString(config.PostLogoutRedirectUri)
+	config.HealthUri = utils.ExpandEnvironmentVariableString(config.HealthUri)
+	config.ReadyUri = utils.ExpandEnvironmentVariableString(config.ReadyUri)
 	config.CookieNamePrefix = utils.ExpandEnvironmentVariableString(config.CookieNamePrefix)
 	config.UnauthorizedBehavior = utils.ExpandEnvironmentVariableString(config.UnauthorizedBehavior)
+	config.ExpiredSessionBehavior = utils.ExpandEnvironmentVariableString(config.ExpiredSessionBehavior)
+	config.RedirectUriPolicy = utils.ExpandEnvironmentVariableString(config.RedirectUriPolicy)
+	config.CrossSiteMode = utils.ExpandEnvironmentVariableString(config.CrossSiteMode)
+	config.ProviderType = utils.ExpandEnvironmentVariableString(config.ProviderType)
 	config.BypassAuthenticationRule = utils.ExpandEnvironmentVariableString(config.BypassAuthenticationRule)
+	config.ApiRouteRule = utils.ExpandEnvironmentVariableString(config.ApiRouteRule)
 	config.Provider.Url = utils.ExpandEnvironmentVariableString(config.Provider.Url)
 	config.Provider.ClientId = utils.ExpandEnvironmentVariableString(config.Provider.ClientId)
 	config.Provider.ClientSecret = utils.ExpandEnvironmentVariableString(config.Provider.ClientSecret)
+	config.Provider.ClientSecretFile = utils.ExpandEnvironmentVariableString(config.Provider.ClientSecretFile)
+
+	var clientSecretFile *utils.FileSecret
+	if config.Provider.ClientSecretFile != "" {
+		if config.Provider.ClientSecret != "" {
+			logger.Log(logging.LevelError, "You can only use ClientSecret OR ClientSecretFile, not both.")
+			return nil, errors.New("you can only use ClientSecret OR ClientSecretFile, not both")
+		}
+
+		clientSecretFile, err = utils.LoadFileSecret(config.Provider.ClientSecretFile)
+		if err != nil {
+			logger.Log(logging.LevelError, "Failed to read the client secret from %s: %s", config.Provider.ClientSecretFile, err.Error())
+			return nil, err
+		}
+	}
 	config.Provider.ClientJwtPrivateKeyId = utils.ExpandEnvironmentVariableString(config.Provider.ClientJwtPrivateKeyId)
 	config.Provider.ClientJwtPrivateKey = utils.ExpandEnvironmentVariableString(config.Provider.ClientJwtPrivateKey)
 	config.Provider.UsePkceBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.UsePkce, config.Provider.UsePkceBool)
 	if err != nil {
 		return nil, err
 	}
+	// Public clients can't authenticate at the token endpoint, so PKCE protects their codes, unless it has been disabled explicitly
+	if config.Provider.UsePkce == "" && !config.Provider.UsePkceBool && config.Provider.isPublicClient() {
+		logger.Log(logging.LevelInfo, "No client secret is configured. Enabling PKCE for the public client.")
+		config.Provider.UsePkceBool = true
+	}
+	config.Provider.PkceMethod = utils.ExpandEnvironmentVariableString(config.Provider.PkceMethod)
+	if !isValidPkceMethod(config.Provider.PkceMethod) {
+		logger.Log(logging.LevelError, "Invalid Provider.PkceMethod '%s'. Use S256 or plain.", config.Provider.PkceMethod)
+		return nil, errors.New("invalid pkce method")
+	}
 	config.Provider.UseClaimsFromUserInfoBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.UseClaimsFromUserInfo, config.Provider.UseClaimsFromUserInfoBool)
 	if err != nil {
 		return nil, err
@@ -244,6 +1218,7 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		return nil, err
 	}
 	config.Provider.ValidAudience = utils.ExpandEnvironmentVariableString(config.Provider.ValidAudience)
+	config.Provider.Audience = utils.ExpandEnvironmentVariableString(config.Provider.Audience)
 	config.Provider.InsecureSkipVerifyBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.InsecureSkipVerify, config.Provider.InsecureSkipVerifyBool)
 	if err != nil {
 		return nil, err
@@ -259,29 +1234,165 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 
 	config.Provider.CABundle = utils.ExpandEnvironmentVariableString(config.Provider.CABundle)
 	config.Provider.CABundleFile = utils.ExpandEnvironmentVariableString(config.Provider.CABundleFile)
+	config.Provider.TlsMinVersion = utils.ExpandEnvironmentVariableString(config.Provider.TlsMinVersion)
+	config.Provider.TlsServerName = utils.ExpandEnvironmentVariableString(config.Provider.TlsServerName)
+	config.Provider.HttpProxy = utils.ExpandEnvironmentVariableString(config.Provider.HttpProxy)
+	config.Provider.HttpsProxy = utils.ExpandEnvironmentVariableString(config.Provider.HttpsProxy)
+	config.Provider.NoProxy = utils.ExpandEnvironmentVariableString(config.Provider.NoProxy)
 	config.Provider.TokenValidation = utils.ExpandEnvironmentVariableString(config.Provider.TokenValidation)
+	config.Provider.OfflineAccess = utils.ExpandEnvironmentVariableString(config.Provider.OfflineAccess)
+	config.Provider.ResponseType = utils.ExpandEnvironmentVariableString(config.Provider.ResponseType)
+	config.Provider.TokenEndpointAuthMethod = utils.ExpandEnvironmentVariableString(config.Provider.TokenEndpointAuthMethod)
+	config.Provider.ResponseMode = utils.ExpandEnvironmentVariableString(config.Provider.ResponseMode)
 
-	config.ErrorPages.Unauthenticated.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.FilePath)
-	config.ErrorPages.Unauthenticated.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.RedirectTo)
-	config.ErrorPages.Unauthorized.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.FilePath)
-	config.ErrorPages.Unauthorized.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.RedirectTo)
+	if config.PkceCookie != nil {
+		config.PkceCookie.Domain = utils.ExpandEnvironmentVariableString(config.PkceCookie.Domain)
+	}
 
-	if config.Secret == DefaultSecret {
-		logger.Log(logging.LevelWarn, "You're using the default secret! It is highly recommended to change the secret by specifying a random 32 character value using the Secret-option.")
+	if config.PopupCallback != nil {
+		config.PopupCallback.MessageType = utils.ExpandEnvironmentVariableString(config.PopupCallback.MessageType)
 	}
 
-	secret := []byte(config.Secret)
-	if len(secret) != 32 {
-		logger.Log(logging.LevelError, "Invalid secret provided. Secret must be exactly 32 characters in length. The provided secret has %d characters.", len(secret))
-		return nil, errors.New("invalid secret")
+	config.UpstreamAuthorization = utils.ExpandEnvironmentVariableString(config.UpstreamAuthorization)
+	if config.MintedToken != nil {
+		config.MintedToken.PrivateKey = utils.ExpandEnvironmentVariableString(config.MintedToken.PrivateKey)
+		config.MintedToken.KeyId = utils.ExpandEnvironmentVariableString(config.MintedToken.KeyId)
+		config.MintedToken.SharedSecret = utils.ExpandEnvironmentVariableString(config.MintedToken.SharedSecret)
+		config.MintedToken.Issuer = utils.ExpandEnvironmentVariableString(config.MintedToken.Issuer)
+		config.MintedToken.Audience = utils.ExpandEnvironmentVariableString(config.MintedToken.Audience)
 	}
 
-	if config.Provider.CABundle != "" && config.Provider.CABundleFile != "" {
-		logger.Log(logging.LevelError, "You can only use an inline CABundle OR CABundleFile, not both.")
-		return nil, errors.New("you can only use an inline CABundle OR CABundleFile, not both.")
+	if config.OAuth2Proxy != nil {
+		config.OAuth2Proxy.CookieName = utils.ExpandEnvironmentVariableString(config.OAuth2Proxy.CookieName)
 	}
 
-	// Specify default scopes if not provided
+	for _, request := range []*ProviderRequestConfig{config.Provider.TokenRequest, config.Provider.IntrospectionRequest} {
+		if request == nil {
+			continue
+		}
+		for name, value := range request.Headers {
+			request.Headers[name] = utils.ExpandEnvironmentVariableString(value)
+		}
+		for name, value := range request.Parameters {
+			request.Parameters[name] = utils.ExpandEnvironmentVariableString(value)
+		}
+	}
+	if config.Provider.Secondary != nil {
+		config.Provider.Secondary.Url = utils.ExpandEnvironmentVariableString(config.Provider.Secondary.Url)
+		config.Provider.Secondary.ClientId = utils.ExpandEnvironmentVariableString(config.Provider.Secondary.ClientId)
+		config.Provider.Secondary.ClientSecret = utils.ExpandEnvironmentVariableString(config.Provider.Secondary.ClientSecret)
+		config.Provider.Secondary.ValidIssuer = utils.ExpandEnvironmentVariableString(config.Provider.Secondary.ValidIssuer)
+	}
+
+	config.ErrorPages.Unauthenticated.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.FilePath)
+	config.ErrorPages.Unauthenticated.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.RedirectTo)
+	config.ErrorPages.Unauthorized.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.FilePath)
+	config.ErrorPages.Unauthorized.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.RedirectTo)
+	config.ErrorPages.Interstitial.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Interstitial.FilePath)
+	config.ErrorPages.Interstitial.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Interstitial.RedirectTo)
+	config.ErrorPages.ProviderUnavailable.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.ProviderUnavailable.FilePath)
+	config.ErrorPages.ProviderUnavailable.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.ProviderUnavailable.RedirectTo)
+	if config.ErrorPages.Consent != nil {
+		config.ErrorPages.Consent.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Consent.FilePath)
+		config.ErrorPages.Consent.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Consent.RedirectTo)
+	}
+	if config.ErrorPages.LoginFailed != nil {
+		config.ErrorPages.LoginFailed.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.LoginFailed.FilePath)
+		config.ErrorPages.LoginFailed.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.LoginFailed.RedirectTo)
+	}
+
+	config.ErrorPages.DefaultLanguage = utils.ExpandEnvironmentVariableString(config.ErrorPages.DefaultLanguage)
+
+	if err := config.ErrorPages.Init(logger); err != nil {
+		logger.Log(logging.LevelError, "Failed to parse error page template: %s", err.Error())
+		return nil, err
+	}
+
+	if config.Secret == DefaultSecret {
+		logger.Log(logging.LevelWarn, "You're using the default secret! It is highly recommended to change the secret by specifying a random value using the Secret-option.")
+	}
+
+	if len(config.Secret) < minimumSecretLength {
+		logger.Log(logging.LevelError, "Invalid secret provided. Secret must be at least %d characters in length. The provided secret has %d characters.", minimumSecretLength, len(config.Secret))
+		return nil, errors.New("invalid secret")
+	}
+
+	for i, previousSecret := range config.PreviousSecrets {
+		if len(previousSecret) < minimumSecretLength {
+			logger.Log(logging.LevelError, "Invalid previous secret at index %d provided. Secret must be at least %d characters in length.", i, minimumSecretLength)
+			return nil, errors.New("invalid previous secret")
+		}
+	}
+
+	config.encryptionKeys = config.deriveEncryptionKeys()
+
+	if config.SessionBinding.ClientIp != "None" && config.SessionBinding.ClientIp != "Subnet" && config.SessionBinding.ClientIp != "Exact" {
+		logger.Log(logging.LevelError, "Invalid SessionBinding.ClientIp '%s' provided. Must be one of None, Subnet or Exact.", config.SessionBinding.ClientIp)
+		return nil, errors.New("invalid session binding")
+	}
+
+	if config.RememberMe.Enabled && config.RememberMe.MaxAge <= 0 {
+		logger.Log(logging.LevelError, "Invalid RememberMe.MaxAge provided. Must be greater than 0.")
+		return nil, errors.New("invalid remember me max age")
+	}
+
+	if config.SessionCookie.ChunkSize < 0 || config.SessionCookie.MaxChunks < 0 {
+		logger.Log(logging.LevelError, "Invalid SessionCookie configuration. ChunkSize and MaxChunks must not be negative.")
+		return nil, errors.New("invalid session cookie chunks")
+	}
+	if config.SessionCookie.MinCookieRefreshInterval < 0 {
+		logger.Log(logging.LevelError, "Invalid SessionCookie.MinCookieRefreshInterval provided. Must not be negative.")
+		return nil, errors.New("invalid session cookie refresh interval")
+	}
+
+	var sessionStorage session.SessionStorage
+	switch config.SessionStorage.Type {
+	case "Cookie":
+		sessionStorage = session.CreateCookieSessionStorage()
+	case "Memory":
+		if config.SessionStorage.IdleTimeout <= 0 || config.SessionStorage.MaxSessions < 0 {
+			logger.Log(logging.LevelError, "SessionStorage.IdleTimeout must be greater than 0 and SessionStorage.MaxSessions must not be negative.")
+			return nil, errors.New("invalid session storage configuration")
+		}
+
+		sessionStorage = session.CreateMemorySessionStorage(time.Duration(config.SessionStorage.IdleTimeout)*time.Second, config.SessionStorage.MaxSessions, utils.SystemClock)
+	default:
+		logger.Log(logging.LevelError, "Invalid SessionStorage.Type '%s' provided. Must be one of Cookie or Memory.", config.SessionStorage.Type)
+		return nil, errors.New("invalid session storage type")
+	}
+
+	if config.SessionManagement.Enabled && config.SessionStorage.Type != "Memory" {
+		logger.Log(logging.LevelError, "SessionManagement requires SessionStorage.Type Memory, as sessions stored in cookies can't be listed or revoked.")
+		return nil, errors.New("invalid session management configuration")
+	}
+
+	if config.SessionCookie.Partitioned && !config.SessionCookie.Secure {
+		logger.Log(logging.LevelError, "Partitioned cookies must also be secure. Please set SessionCookie.Secure to true.")
+		return nil, errors.New("partitioned cookies must be secure")
+	}
+
+	if config.PkceCookie != nil {
+		if config.PkceCookie.MaxAge < 0 {
+			logger.Log(logging.LevelError, "Invalid PkceCookie.MaxAge %d. It must not be negative.", config.PkceCookie.MaxAge)
+			return nil, errors.New("invalid pkce cookie max age")
+		}
+		if !config.PkceCookie.Secure && (config.PkceCookie.SameSite == "none" || config.SessionCookie.Partitioned) {
+			logger.Log(logging.LevelError, "Cookies with SameSite=None or Partitioned must be secure. Please set PkceCookie.Secure to true.")
+			return nil, errors.New("pkce cookie must be secure")
+		}
+	}
+
+	if config.Cipher != utils.CipherAesGcm && config.Cipher != utils.CipherXAesGcm {
+		logger.Log(logging.LevelError, "Invalid cipher '%s' provided. Must be one of %s or %s.", config.Cipher, utils.CipherAesGcm, utils.CipherXAesGcm)
+		return nil, errors.New("invalid cipher")
+	}
+
+	if config.Provider.CABundle != "" && config.Provider.CABundleFile != "" {
+		logger.Log(logging.LevelError, "You can only use an inline CABundle OR CABundleFile, not both.")
+		return nil, errors.New("you can only use an inline CABundle OR CABundleFile, not both.")
+	}
+
+	// Specify default scopes if not provided
 	if config.Scopes == nil || len(config.Scopes) == 0 {
 		config.Scopes = []string{"openid", "profile", "email"}
 	}
@@ -302,6 +1413,12 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 	logger.Log(logging.LevelInfo, "I will use this URL for callbacks from the IDP: %v", parsedCallbackURL)
 	if utils.UrlIsAbsolute(parsedCallbackURL) {
 		logger.Log(logging.LevelInfo, "Callback URL is absolute, will not overlay wrapped services")
+
+		// The session is created on the callback, so the browser must accept the shared cookie there
+		if config.SessionCookie.Domain != "" && !isHostInCookieDomain(parsedCallbackURL.Host, config.SessionCookie.Domain) {
+			logger.Log(logging.LevelError, "The host of the CallbackUri %s isn't part of the SessionCookie.Domain %s.", parsedCallbackURL.Host, config.SessionCookie.Domain)
+			return nil, errors.New("callback uri outside of the session cookie domain")
+		}
 	} else {
 		logger.Log(logging.LevelInfo, "Callback URL is relative, will overlay any wrapped host")
 	}
@@ -316,11 +1433,41 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		}
 	}
 
+	if config.StateMaxAge <= 0 {
+		logger.Log(logging.LevelError, "Invalid StateMaxAge. The value must be greater than 0.")
+		return nil, errors.New("invalid StateMaxAge")
+	}
+
+	if config.MaxTokenSize < 0 || config.MaxCookieSize < 0 || config.MaxBodySize < 0 || config.BodyReadTimeout < 0 {
+		logger.Log(logging.LevelError, "Invalid MaxTokenSize, MaxCookieSize, MaxBodySize or BodyReadTimeout. The values must not be negative.")
+		return nil, errors.New("invalid MaxTokenSize, MaxCookieSize, MaxBodySize or BodyReadTimeout")
+	}
+
 	if config.Provider.TokenRenewalThreshold < 0.5 || config.Provider.TokenRenewalThreshold > 1.0 {
 		logger.Log(logging.LevelError, "Invalid TokenRenewalThreshold. The value must be >= 0.5 and <= 1.0.")
 		return nil, errors.New("invalid TokenRenewalThreshold")
 	}
 
+	if config.AuthorizationHeader != nil {
+		for i := range config.AuthorizationHeader.TrustedIssuers {
+			trustedIssuer := &config.AuthorizationHeader.TrustedIssuers[i]
+
+			trustedIssuer.Issuer = utils.ExpandEnvironmentVariableString(trustedIssuer.Issuer)
+			trustedIssuer.JwksUri = utils.ExpandEnvironmentVariableString(trustedIssuer.JwksUri)
+			trustedIssuer.Audience = utils.ExpandEnvironmentVariableString(trustedIssuer.Audience)
+
+			if trustedIssuer.Issuer == "" {
+				logger.Log(logging.LevelError, "Invalid trusted issuer. The Issuer must not be empty.")
+				return nil, errors.New("invalid trusted issuer")
+			}
+			if trustedIssuer.Audience == "" {
+				logger.Log(logging.LevelWarn, "No audience configured for trusted issuer %s. Tokens for any audience of this issuer will be accepted.", trustedIssuer.Issuer)
+			}
+
+			logger.Log(logging.LevelDebug, "Trusted issuer: %s", trustedIssuer.Issuer)
+		}
+	}
+
 	var conditionalAuth *rules.RequestCondition
 	if config.BypassAuthenticationRule != "" {
 		ca, err := rules.ParseRequestCondition(config.BypassAuthenticationRule)
@@ -332,6 +1479,129 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		conditionalAuth = ca
 	}
 
+	if config.StaticAssets != nil {
+		if err := validateStaticAssetsConfig(logger, config.StaticAssets); err != nil {
+			return nil, err
+		}
+	}
+
+	var apiRouteRule *rules.RequestCondition
+	if config.ApiRouteRule != "" {
+		apiRouteRule, err = rules.ParseRequestCondition(config.ApiRouteRule)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parseExpiredSessionRules(config); err != nil {
+		logger.Log(logging.LevelError, "%s", err.Error())
+		return nil, err
+	}
+
+	if err := parseScopeRules(config); err != nil {
+		logger.Log(logging.LevelError, "%s", err.Error())
+		return nil, err
+	}
+
+	if !isValidOfflineAccess(config.Provider.OfflineAccess) {
+		logger.Log(logging.LevelError, "Invalid Provider.OfflineAccess '%s'. Use Auto, Always or Never.", config.Provider.OfflineAccess)
+		return nil, errors.New("invalid offline access")
+	}
+
+	if !isValidTokenEndpointAuthMethod(config.Provider.TokenEndpointAuthMethod) {
+		logger.Log(logging.LevelError, "Invalid Provider.TokenEndpointAuthMethod '%s'. Use client_secret_basic or client_secret_post.", config.Provider.TokenEndpointAuthMethod)
+		return nil, errors.New("invalid token endpoint auth method")
+	}
+
+	if config.Provider.isPublicClient() {
+		if !config.Provider.UsePkceBool {
+			logger.Log(logging.LevelWarn, "No client secret is configured and PKCE is disabled. The authorization code isn't protected against interception.")
+		}
+		if config.Provider.TokenValidation == "Introspection" {
+			logger.Log(logging.LevelWarn, "No client secret is configured, but TokenValidation is Introspection. Most providers only allow confidential clients to introspect tokens.")
+		}
+	}
+
+	if config.Provider.ResponseType != "" {
+		responseType := normalizeResponseType(config.Provider.ResponseType)
+		if responseType == "" {
+			logger.Log(logging.LevelError, "Invalid Provider.ResponseType '%s'. Use code, code id_token, code token or code id_token token.", config.Provider.ResponseType)
+			return nil, errors.New("invalid response type")
+		}
+
+		config.Provider.ResponseType = responseType
+	}
+	if !isValidResponseMode(config.Provider.ResponseMode) {
+		logger.Log(logging.LevelError, "Invalid Provider.ResponseMode '%s'. Use query or form_post.", config.Provider.ResponseMode)
+		return nil, errors.New("invalid response mode")
+	}
+	isHybridFlow := config.Provider.ResponseType != "" && config.Provider.ResponseType != responseTypeCode
+	if isHybridFlow && config.Provider.ResponseMode == responseModeQuery {
+		logger.Log(logging.LevelError, "Provider.ResponseMode query must not be used with the hybrid flow '%s', because the tokens would be exposed in the url.", config.Provider.ResponseType)
+		return nil, errors.New("invalid response mode")
+	}
+	if config.InternalUris != nil && len(config.InternalUris.CallbackMethods) > 0 && !slices.Contains(config.InternalUris.CallbackMethods, http.MethodPost) {
+		if config.Provider.ResponseMode == responseModeFormPost || (config.Provider.ResponseMode == "" && isHybridFlow) {
+			logger.Log(logging.LevelWarn, "The form_post response mode requires POST in InternalUris.CallbackMethods.")
+		}
+	}
+
+	if !isValidCrossSiteMode(config.CrossSiteMode) {
+		logger.Log(logging.LevelError, "Invalid CrossSiteMode '%s'. Use Disabled or Embedded.", config.CrossSiteMode)
+		return nil, errors.New("invalid cross site mode")
+	}
+	if err := applyCrossSiteMode(logger, config); err != nil {
+		return nil, err
+	}
+
+	if !isValidRedirectUriPolicy(config.RedirectUriPolicy) {
+		logger.Log(logging.LevelError, "Invalid RedirectUriPolicy '%s'. Use Patterns, RelativeOnly, SameHost or SameDomain.", config.RedirectUriPolicy)
+		return nil, errors.New("invalid redirect uri policy")
+	}
+	if config.RedirectUriPolicy == redirectUriPolicySameDomain && config.SessionCookie.Domain == "" {
+		logger.Log(logging.LevelError, "The RedirectUriPolicy SameDomain requires SessionCookie.Domain to be set.")
+		return nil, errors.New("invalid redirect uri policy")
+	}
+	if config.RedirectUriPolicy != "" && config.RedirectUriPolicy != redirectUriPolicyPatterns {
+		if len(config.ValidPostLoginRedirectUris) > 0 || len(config.ValidPostLogoutRedirectUris) > 0 {
+			logger.Log(logging.LevelWarn, "ValidPostLoginRedirectUris and ValidPostLogoutRedirectUris are ignored, because the RedirectUriPolicy is %s.", config.RedirectUriPolicy)
+		}
+	}
+
+	if config.Consent != nil && config.Consent.Enabled {
+		config.Consent.Uri = utils.ExpandEnvironmentVariableString(config.Consent.Uri)
+		config.Consent.Version = utils.ExpandEnvironmentVariableString(config.Consent.Version)
+
+		if config.Consent.Uri == "" || config.Consent.ReconsentAfter < 0 {
+			logger.Log(logging.LevelError, "Invalid Consent configuration. The Uri is required and ReconsentAfter must not be negative.")
+			return nil, errors.New("invalid consent configuration")
+		}
+	}
+
+	if config.Impersonation != nil && config.Impersonation.Enabled {
+		config.Impersonation.QueryParameter = utils.ExpandEnvironmentVariableString(config.Impersonation.QueryParameter)
+		config.Impersonation.Uri = utils.ExpandEnvironmentVariableString(config.Impersonation.Uri)
+		config.Impersonation.Header = utils.ExpandEnvironmentVariableString(config.Impersonation.Header)
+		config.Impersonation.ImpersonatorHeader = utils.ExpandEnvironmentVariableString(config.Impersonation.ImpersonatorHeader)
+
+		if len(config.Impersonation.PrivilegeClaims) == 0 || config.Impersonation.IdentityClaim == "" || config.Impersonation.ImpersonatorHeader == "" {
+			logger.Log(logging.LevelError, "Invalid Impersonation configuration. PrivilegeClaims, IdentityClaim and ImpersonatorHeader are required.")
+			return nil, errors.New("invalid impersonation configuration")
+		}
+		if config.Impersonation.QueryParameter != "" && config.Impersonation.Uri == "" {
+			logger.Log(logging.LevelError, "Invalid Impersonation configuration. The Uri is required to confirm the QueryParameter.")
+			return nil, errors.New("invalid impersonation configuration")
+		}
+	}
+
+	if config.AnonymousAccess != nil {
+		if err := parseAnonymousAccess(config.AnonymousAccess); err != nil {
+			logger.Log(logging.LevelError, "Invalid AnonymousAccess configuration: %s", err.Error())
+			return nil, err
+		}
+	}
+
 	rootCAs, _ := x509.SystemCertPool()
 	if rootCAs == nil {
 		rootCAs = x509.NewCertPool()
@@ -369,31 +1639,398 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 
 	}
 
+	if err := validateProviderClientConfig(config.Provider); err != nil {
+		logger.Log(logging.LevelError, "Invalid Provider configuration: %s", err.Error())
+		return nil, err
+	}
+
+	proxy, err := utils.CreateProxyFunc(config.Provider.HttpProxy, config.Provider.HttpsProxy, config.Provider.NoProxy)
+	if err != nil {
+		logger.Log(logging.LevelError, "Invalid proxy configuration: %s", err.Error())
+		return nil, err
+	}
+
+	tlsConfig, err := createProviderTlsConfig(config.Provider, rootCAs)
+	if err != nil {
+		logger.Log(logging.LevelError, "Invalid TLS configuration: %s", err.Error())
+		return nil, err
+	}
+
 	httpTransport := &http.Transport{
 		// MaxIdleConns:    10,
 		// IdleConnTimeout: 30 * time.Second,
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: config.Provider.InsecureSkipVerifyBool,
-			RootCAs:            rootCAs,
-		},
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
 	}
 
 	httpClient := &http.Client{
 		Transport: httpTransport,
 	}
 
-	logger.Log(logging.LevelInfo, "Configuration loaded successfully, starting OIDC Auth middleware...")
+	var trustedIssuers []*TrustedIssuer
+	if config.AuthorizationHeader != nil {
+		trustedIssuers = createTrustedIssuers(config.AuthorizationHeader.TrustedIssuers, utils.SystemClock)
+	}
+
+	var secondaryProvider *SecondaryProvider
+	if config.Provider.Secondary != nil && config.Provider.Secondary.Url != "" {
+		secondaryUrl, err := utils.ParseUrl(config.Provider.Secondary.Url)
+		if err != nil {
+			logger.Log(logging.LevelError, "Error while parsing Provider.Secondary.Url: %s", err.Error())
+			return nil, err
+		}
+		if config.Provider.Secondary.FailbackAfter <= 0 {
+			logger.Log(logging.LevelError, "Invalid Provider.Secondary.FailbackAfter. The value must be greater than 0.")
+			return nil, errors.New("invalid secondary provider failback duration")
+		}
+
+		secondaryProvider = CreateSecondaryProvider(config.Provider.Secondary, secondaryUrl)
+	}
+
+	var jwksPolicy *oidc.JwksPolicy
+	if config.Jwks != nil {
+		if config.Jwks.MaxKeys < 0 {
+			logger.Log(logging.LevelError, "Invalid Jwks.MaxKeys. The value must not be negative.")
+			return nil, errors.New("invalid jwks max keys")
+		}
+
+		jwksPolicy = &oidc.JwksPolicy{
+			MaxKeys:           config.Jwks.MaxKeys,
+			AllowedAlgorithms: config.Jwks.AllowedAlgorithms,
+		}
+	}
+
+	for _, issuer := range trustedIssuers {
+		issuer.Jwks.Policy = jwksPolicy
+	}
+	if secondaryProvider != nil {
+		secondaryProvider.Jwks.Policy = jwksPolicy
+	}
+
+	var rateLimiter *RateLimiter
+	if config.RateLimit != nil && config.RateLimit.RequestsPerMinute > 0 {
+		rateLimiter = CreateRateLimiter(config.RateLimit.RequestsPerMinute, config.RateLimit.Burst)
+	}
+
+	if err := applyProviderType(logger, config); err != nil {
+		return nil, err
+	}
+
+	if err := parseClaimMappings(config.ClaimMappings); err != nil {
+		logger.Log(logging.LevelError, "Invalid ClaimMappings: %s", err.Error())
+		return nil, err
+	}
+
+	config.UpstreamAuthorization, err = normalizeUpstreamAuthorization(config.UpstreamAuthorization)
+	if err != nil {
+		logger.Log(logging.LevelError, "Invalid UpstreamAuthorization: %s", err.Error())
+		return nil, err
+	}
+
+	var tokenMinter *TokenMinter
+	if config.UpstreamAuthorization == upstreamAuthorizationMinted {
+		if config.MintedToken == nil {
+			logger.Log(logging.LevelError, "The MintedToken configuration is required, when UpstreamAuthorization is set to Minted.")
+			return nil, errors.New("missing minted token configuration")
+		}
+
+		tokenMinter, err = CreateTokenMinter(config.MintedToken)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid MintedToken configuration: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	var circuitBreaker *CircuitBreaker
+	if config.CircuitBreaker != nil && config.CircuitBreaker.Enabled {
+		if err := validateCircuitBreakerConfig(config.CircuitBreaker); err != nil {
+			logger.Log(logging.LevelError, "Invalid CircuitBreaker configuration: %s", err.Error())
+			return nil, err
+		}
+
+		circuitBreaker = CreateCircuitBreaker(config.CircuitBreaker.FailureThreshold, time.Duration(config.CircuitBreaker.OpenDuration)*time.Second)
+	}
+
+	var renewalQueue *RenewalQueue
+	if config.GracefulDegradation != nil && config.GracefulDegradation.Enabled {
+		if config.GracefulDegradation.MaxStaleness < 0 || config.GracefulDegradation.RenewalRetryInterval < 0 {
+			logger.Log(logging.LevelError, "Invalid GracefulDegradation configuration. The values must not be negative.")
+			return nil, errors.New("invalid graceful degradation configuration")
+		}
+
+		renewalQueue = CreateRenewalQueue(time.Duration(config.GracefulDegradation.RenewalRetryInterval) * time.Second)
+	}
+
+	var refreshLimiter *RefreshLimiter
+	if config.RefreshLimit != nil && config.RefreshLimit.MaxConcurrent != 0 {
+		if config.RefreshLimit.MaxConcurrent < 0 || config.RefreshLimit.QueueTimeout < 0 {
+			logger.Log(logging.LevelError, "Invalid RefreshLimit configuration. The values must not be negative.")
+			return nil, errors.New("invalid refresh limit configuration")
+		}
+
+		refreshLimiter = CreateRefreshLimiter(config.RefreshLimit.MaxConcurrent, time.Duration(config.RefreshLimit.QueueTimeout)*time.Second)
+	}
+
+	var metricsCollector *MetricsCollector
+	if config.Metrics.Enabled {
+		provider := config.Provider.ValidIssuer
+		if provider == "" {
+			provider = config.Provider.Url
+		}
+
+		metricsCollector, err = CreateMetricsCollector(config.Metrics, name, provider)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid Metrics configuration: %s", err.Error())
+			return nil, err
+		}
+
+		// The StatsD sink is already running
+		defer func() {
+			if !created {
+				_ = metricsCollector.Shutdown(context.Background())
+			}
+		}()
+	}
+
+	var debugNetworks []*net.IPNet
+	if config.Debug.Enabled {
+		// The state reveals internals of the middleware, so it must never be public
+		if config.Debug.Token == "" && len(config.Debug.AllowedSourceRanges) == 0 {
+			logger.Log(logging.LevelError, "The debug endpoint requires a Token or AllowedSourceRanges.")
+			return nil, errors.New("invalid debug configuration")
+		}
+
+		debugNetworks, err = parseSourceRanges(config.Debug.AllowedSourceRanges)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid Debug configuration: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	var lockout *Lockout
+	if config.Lockout != nil && config.Lockout.Enabled {
+		if config.Lockout.MaxFailures < 1 || config.Lockout.Window < 1 || config.Lockout.Duration < 1 {
+			logger.Log(logging.LevelError, "Lockout.MaxFailures, Lockout.Window and Lockout.Duration must be greater than 0.")
+			return nil, errors.New("invalid Lockout configuration")
+		}
+
+		lockout = CreateLockout(config.Lockout.MaxFailures, time.Duration(config.Lockout.Window)*time.Second, time.Duration(config.Lockout.Duration)*time.Second, utils.SystemClock)
+	}
+
+	var geoIpDatabase *geoip.Database
+	if config.GeoIp.DatabaseFile != "" {
+		geoIpDatabase, err = geoip.LoadDatabase(config.GeoIp.DatabaseFile)
+		if err != nil {
+			logger.Log(logging.LevelError, "Failed to load the GeoIp database: %s", err.Error())
+			return nil, err
+		}
+
+		logger.Log(logging.LevelInfo, "Loaded %d networks from the GeoIp database.", geoIpDatabase.Len())
+	}
+
+	geoIpEnabled := config.GeoIp.DatabaseFile != "" || config.GeoIp.CountryHeader != ""
+	if !geoIpEnabled && (len(config.GeoIp.AllowedCountries) > 0 || len(config.GeoIp.DeniedCountries) > 0 || config.SessionBinding.Country) {
+		logger.Log(logging.LevelError, "Restricting logins by country and binding sessions to a country requires GeoIp.DatabaseFile or GeoIp.CountryHeader.")
+		return nil, errors.New("invalid GeoIp configuration")
+	}
+
+	var webhook *WebhookEmitter
+	if config.Webhook != nil && config.Webhook.Url != "" {
+		webhook, err = CreateWebhookEmitter(logger, config.Webhook, name)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid Webhook configuration: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	var provisioner *Provisioner
+	if config.Provisioning != nil && config.Provisioning.Url != "" {
+		provisioner, err = CreateProvisioner(logger, config.Provisioning, name)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid Provisioning configuration: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	var tracer *tracing.Tracer
+	if config.Tracing.Enabled {
+		tracer, err = createTracer(config.Tracing)
+		if err != nil {
+			logger.Log(logging.LevelError, "Invalid Tracing configuration: %s", err.Error())
+			return nil, err
+		}
 
-	return &TraefikOidcAuth{
+		// The exporter is already running
+		defer func() {
+			if !created {
+				_ = tracer.Shutdown(context.Background())
+			}
+		}()
+	}
+
+	toa := &TraefikOidcAuth{
 		logger:                   logger,
 		next:                     next,
+		Webhook:                  webhook,
+		Provisioner:              provisioner,
 		httpClient:               httpClient,
 		ProviderURL:              parsedURL,
 		ClientJwtPrivateKey:      clientAssertionPrivateKey,
 		CallbackURL:              parsedCallbackURL,
 		Config:                   config,
-		SessionStorage:           session.CreateCookieSessionStorage(),
+		SessionStorage:           sessionStorage,
 		BypassAuthenticationRule: conditionalAuth,
-	}, nil
+		ApiRouteRule:             apiRouteRule,
+		TrustedIssuers:           trustedIssuers,
+		IntrospectionCache:       CreateIntrospectionCache(utils.SystemClock),
+		RateLimiter:              rateLimiter,
+		ConsumedStates:           CreateConsumedStateCache(),
+		TokenCache:               CreateTokenCache(utils.SystemClock),
+		ClientSecretFile:         clientSecretFile,
+		Metrics:                  metricsCollector,
+		Tracer:                   tracer,
+		CircuitBreaker:           circuitBreaker,
+		RenewalQueue:             renewalQueue,
+		RefreshLimiter:           refreshLimiter,
+		SecondaryProvider:        secondaryProvider,
+		TokenMinter:              tokenMinter,
+		JwksPolicy:               jwksPolicy,
+		Clock:                    utils.SystemClock,
+		GeoIp:                    geoIpDatabase,
+		Lockout:                  lockout,
+		debugNetworks:            debugNetworks,
+		sharedCacheScope:         getProviderClientFingerprint(config.Provider, caBundleData),
+		logSinks:                 logSinks,
+	}
+
+	var transport http.RoundTripper = &providerClientTransport{
+		next:     httpTransport,
+		toa:      toa,
+		timeouts: config.Provider.Timeouts,
+		retry:    config.Provider.Retry,
+	}
+	if circuitBreaker != nil {
+		transport = &circuitBreakerTransport{next: transport, toa: toa}
+	}
+	if tracer != nil {
+		transport = &providerTracingTransport{next: transport, toa: toa}
+	}
+	if metricsCollector != nil {
+		transport = &providerMetricsTransport{next: transport, toa: toa}
+	}
+	httpClient.Transport = transport
+
+	if config.SharedCache != nil && config.SharedCache.Enabled {
+		if config.SharedCache.MaxAge <= 0 {
+			logger.Log(logging.LevelError, "Invalid SharedCache.MaxAge. The value must be greater than 0.")
+			return nil, errors.New("invalid shared cache max age")
+		}
+
+		for _, issuer := range trustedIssuers {
+			issuer.Jwks.Shared = true
+			issuer.Jwks.SharedScope = toa.sharedCacheScope
+		}
+		if secondaryProvider != nil {
+			secondaryProvider.Jwks.Shared = true
+			secondaryProvider.Jwks.SharedScope = toa.sharedCacheScope
+		}
+	}
+
+	if metricsCollector != nil {
+		for _, issuer := range trustedIssuers {
+			issuer.Jwks.OnReload = metricsCollector.jwksReloadRecorder(issuer.Config.Issuer)
+		}
+
+		if secondaryProvider != nil {
+			secondaryProvider.Jwks.OnReload = metricsCollector.jwksReloadRecorder(providerSecondary)
+		}
+
+		if circuitBreaker != nil {
+			circuitBreaker.OnStateChange = metricsCollector.RecordCircuitBreakerState
+			metricsCollector.setCircuitBreakerState(circuitBreaker.State())
+		}
+	}
+
+	if config.HotReload.FilePath != "" {
+		if config.HotReload.Interval <= 0 {
+			logger.Log(logging.LevelError, "Invalid HotReload.Interval. The value must be greater than 0.")
+			return nil, errors.New("invalid hot reload interval")
+		}
+
+		toa.ConfigReloader = CreateConfigReloader(config.HotReload.FilePath, time.Duration(config.HotReload.Interval)*time.Second, config)
+
+		if err := toa.reloadConfig(); err != nil {
+			logger.Log(logging.LevelError, "Failed to load the reloadable config file %s: %s", config.HotReload.FilePath, err.Error())
+			return nil, err
+		}
+	}
+
+	logger.Log(logging.LevelInfo, "Configuration loaded successfully, starting OIDC Auth middleware...")
+
+	created = true
+
+	return toa, nil
+}
+
+// EncryptionKey returns the key used to encrypt new cookies and states.
+func (config *Config) EncryptionKey() string {
+	return config.DecryptionKeys()[0]
+}
+
+// DecryptionKeys returns the key of the current secret followed by the keys of all previous secrets.
+func (config *Config) DecryptionKeys() []string {
+	if config.encryptionKeys != nil {
+		return config.encryptionKeys
+	}
+
+	return config.deriveEncryptionKeys()
+}
+
+func (config *Config) deriveEncryptionKeys() []string {
+	keys := []string{utils.DeriveEncryptionKey(config.Secret, config.SecretSalt)}
+
+	for _, previousSecret := range config.PreviousSecrets {
+		keys = append(keys, utils.DeriveEncryptionKey(previousSecret, config.SecretSalt))
+	}
+
+	return keys
+}
+
+func createTracer(config *TracingConfig) (*tracing.Tracer, error) {
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, errors.New("the sample rate must be between 0 and 1")
+	}
+
+	endpoint, err := tracing.NormalizeOtlpEndpoint(config.OtlpEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+	}
+
+	propagator, err := tracing.CreatePropagator(config.Propagator)
+	if err != nil {
+		return nil, err
+	}
+
+	headerFiles := make(map[string]*utils.FileSecret, len(config.OtlpHeadersFile))
+	for name, path := range config.OtlpHeadersFile {
+		if _, ok := config.OtlpHeaders[name]; ok {
+			return nil, errors.New("the OTLP header " + name + " can only be set in OtlpHeaders OR OtlpHeadersFile, not both")
+		}
+
+		secret, err := utils.LoadFileSecret(path)
+		if err != nil {
+			return nil, errors.New("failed to read the OTLP header " + name + " from " + path + ": " + err.Error())
+		}
+
+		headerFiles[name] = secret
+	}
+
+	exporter := tracing.CreateOtlpExporter(endpoint, config.OtlpHeaders, headerFiles, config.ServiceName, httpClient, 5*time.Second)
+
+	return tracing.CreateTracer(config.SampleRate, propagator, exporter), nil
 }
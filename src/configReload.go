@@ -0,0 +1,268 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// reloadableConfig contains all settings which can be changed at runtime using the HotReload file.
+// Settings which are not present in the file keep the value of the static configuration.
+type reloadableConfig struct {
+	Authorization               *AuthorizationConfig         `json:"authorization"`
+	Headers                     []HeaderConfig               `json:"headers"`
+	BypassAuthenticationRule    string                       `json:"bypass_authentication_rule"`
+	ApiRouteRule                string                       `json:"api_route_rule"`
+	ErrorPages                  *errorPages.ErrorPagesConfig `json:"error_pages"`
+	ValidPostLoginRedirectUris  []string                     `json:"valid_post_login_redirect_uris"`
+	ValidPostLogoutRedirectUris []string                     `json:"valid_post_logout_redirect_uris"`
+}
+
+type ConfigReloader struct {
+	filePath string
+	interval time.Duration
+
+	// The static configuration, which the reloadable settings are applied to.
+	baseConfig *Config
+
+	lastModified time.Time
+	lastSize     int64
+
+	// The handler using the latest reloaded configuration
+	handler atomic.Value
+}
+
+func CreateConfigReloader(filePath string, interval time.Duration, baseConfig *Config) *ConfigReloader {
+	return &ConfigReloader{
+		filePath:   filePath,
+		interval:   interval,
+		baseConfig: baseConfig,
+	}
+}
+
+// reloadConfig reads the reloadable configuration file and applies it.
+// If the file is invalid, the current configuration is kept and an error is returned.
+func (toa *TraefikOidcAuth) reloadConfig() error {
+	reloader := toa.ConfigReloader
+
+	fileInfo, err := os.Stat(reloader.filePath)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(reloader.filePath)
+	if err != nil {
+		return err
+	}
+
+	config, bypassAuthenticationRule, apiRouteRule, err := buildReloadedConfig(reloader.baseConfig, content, toa.logger)
+	if err != nil {
+		return err
+	}
+
+	// The configuration of a handler is never changed, so every request uses a single version of it.
+	// Requests which are already in flight finish with the previous handler.
+	reloader.handler.Store(toa.current().withReloadedConfig(config, bypassAuthenticationRule, apiRouteRule))
+
+	reloader.lastModified = fileInfo.ModTime()
+	reloader.lastSize = fileInfo.Size()
+
+	return nil
+}
+
+// current returns the handler using the latest reloaded configuration, or the handler itself,
+// if the configuration hasn't been reloaded.
+func (toa *TraefikOidcAuth) current() *TraefikOidcAuth {
+	if toa.ConfigReloader == nil {
+		return toa
+	}
+
+	if handler, ok := toa.ConfigReloader.handler.Load().(*TraefikOidcAuth); ok {
+		return handler
+	}
+
+	return toa
+}
+
+// withReloadedConfig returns a copy of the handler using the reloaded configuration. All other state,
+// like caches and metrics, is shared. The discovery document is taken over, if it is already loaded.
+func (toa *TraefikOidcAuth) withReloadedConfig(config *Config, bypassAuthenticationRule *rules.RequestCondition, apiRouteRule *rules.RequestCondition) *TraefikOidcAuth {
+	toa.Lock.RLock()
+	discoveryDocument := toa.DiscoveryDocument
+	jwks := toa.Jwks
+	discoveredAt := toa.discoveredAt
+	toa.Lock.RUnlock()
+
+	return &TraefikOidcAuth{
+		logger:                   toa.logger,
+		next:                     toa.next,
+		httpClient:               toa.httpClient,
+		ProviderURL:              toa.ProviderURL,
+		ClientJwtPrivateKey:      toa.ClientJwtPrivateKey,
+		CallbackURL:              toa.CallbackURL,
+		Config:                   config,
+		SessionStorage:           toa.SessionStorage,
+		DiscoveryDocument:        discoveryDocument,
+		Jwks:                     jwks,
+		BypassAuthenticationRule: bypassAuthenticationRule,
+		ApiRouteRule:             apiRouteRule,
+		TrustedIssuers:           toa.TrustedIssuers,
+		IntrospectionCache:       toa.IntrospectionCache,
+		RateLimiter:              toa.RateLimiter,
+		ConsumedStates:           toa.ConsumedStates,
+		TokenCache:               toa.TokenCache,
+		ConfigReloader:           toa.ConfigReloader,
+		ClientSecretFile:         toa.ClientSecretFile,
+		Metrics:                  toa.Metrics,
+		Tracer:                   toa.Tracer,
+		CircuitBreaker:           toa.CircuitBreaker,
+		RenewalQueue:             toa.RenewalQueue,
+		RefreshLimiter:           toa.RefreshLimiter,
+		SecondaryProvider:        toa.SecondaryProvider,
+		TokenMinter:              toa.TokenMinter,
+		JwksPolicy:               toa.JwksPolicy,
+		Clock:                    toa.Clock,
+		Lockout:                  toa.Lockout,
+		GeoIp:                    toa.GeoIp,
+		Webhook:                  toa.Webhook,
+		Provisioner:              toa.Provisioner,
+		discoveredAt:             discoveredAt,
+		debugNetworks:            toa.debugNetworks,
+		sharedCacheScope:         toa.sharedCacheScope,
+		logSinks:                 toa.logSinks,
+	}
+}
+
+// watchConfigFile polls the reloadable configuration file and reloads it whenever it changes.
+// It stops when the context is done, ie. when traefik replaces the middleware.
+func (toa *TraefikOidcAuth) watchConfigFile(ctx context.Context) {
+	reloader := toa.ConfigReloader
+
+	ticker := time.NewTicker(reloader.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fileInfo, err := os.Stat(reloader.filePath)
+		if err != nil {
+			toa.logger.Log(logging.LevelWarn, "Unable to check the reloadable config file: %s", err.Error())
+			continue
+		}
+
+		if fileInfo.ModTime().Equal(reloader.lastModified) && fileInfo.Size() == reloader.lastSize {
+			continue
+		}
+
+		toa.logger.Log(logging.LevelInfo, "The reloadable config file has changed. Reloading...")
+
+		if err := toa.reloadConfig(); err != nil {
+			toa.logger.Log(logging.LevelError, "Failed to reload the config. Keeping the previous configuration. %s", err.Error())
+
+			// Don't try again until the file changes
+			reloader.lastModified = fileInfo.ModTime()
+			reloader.lastSize = fileInfo.Size()
+			continue
+		}
+
+		toa.logger.Log(logging.LevelInfo, "Config reloaded successfully.")
+	}
+}
+
+func buildReloadedConfig(baseConfig *Config, content []byte, logger *logging.Logger) (*Config, *rules.RequestCondition, *rules.RequestCondition, error) {
+	// Start with a deep copy of the static settings, so the file only needs to contain the settings to override
+	baseJson, err := json.Marshal(&reloadableConfig{
+		Authorization:               baseConfig.Authorization,
+		Headers:                     baseConfig.Headers,
+		BypassAuthenticationRule:    baseConfig.BypassAuthenticationRule,
+		ApiRouteRule:                baseConfig.ApiRouteRule,
+		ErrorPages:                  baseConfig.ErrorPages,
+		ValidPostLoginRedirectUris:  baseConfig.ValidPostLoginRedirectUris,
+		ValidPostLogoutRedirectUris: baseConfig.ValidPostLogoutRedirectUris,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reloaded := &reloadableConfig{}
+	if err := json.Unmarshal(baseJson, reloaded); err != nil {
+		return nil, nil, nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reloaded); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid config file: %s", err.Error())
+	}
+
+	if reloaded.Authorization == nil || reloaded.ErrorPages == nil ||
+		reloaded.ErrorPages.Unauthenticated == nil || reloaded.ErrorPages.Unauthorized == nil ||
+		reloaded.ErrorPages.Interstitial == nil || reloaded.ErrorPages.ProviderUnavailable == nil {
+		return nil, nil, nil, errors.New("invalid config file: authorization and error pages must not be null")
+	}
+
+	reloaded.BypassAuthenticationRule = utils.ExpandEnvironmentVariableString(reloaded.BypassAuthenticationRule)
+	reloaded.ApiRouteRule = utils.ExpandEnvironmentVariableString(reloaded.ApiRouteRule)
+
+	var bypassAuthenticationRule *rules.RequestCondition
+	if reloaded.BypassAuthenticationRule != "" {
+		bypassAuthenticationRule, err = rules.ParseRequestCondition(reloaded.BypassAuthenticationRule)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid BypassAuthenticationRule: %s", err.Error())
+		}
+	}
+
+	var apiRouteRule *rules.RequestCondition
+	if reloaded.ApiRouteRule != "" {
+		apiRouteRule, err = rules.ParseRequestCondition(reloaded.ApiRouteRule)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid ApiRouteRule: %s", err.Error())
+		}
+	}
+
+	if err := validateHeaderTemplates(reloaded.Headers); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if reloaded.ErrorPages.Consent == nil {
+		reloaded.ErrorPages.Consent = &errorPages.ErrorPageConfig{}
+	}
+	if reloaded.ErrorPages.LoginFailed == nil {
+		reloaded.ErrorPages.LoginFailed = &errorPages.ErrorPageConfig{}
+	}
+
+	for _, page := range []*errorPages.ErrorPageConfig{reloaded.ErrorPages.Unauthenticated, reloaded.ErrorPages.Unauthorized, reloaded.ErrorPages.Interstitial, reloaded.ErrorPages.ProviderUnavailable, reloaded.ErrorPages.Consent, reloaded.ErrorPages.LoginFailed} {
+		page.FilePath = utils.ExpandEnvironmentVariableString(page.FilePath)
+		page.RedirectTo = utils.ExpandEnvironmentVariableString(page.RedirectTo)
+	}
+	reloaded.ErrorPages.DefaultLanguage = utils.ExpandEnvironmentVariableString(reloaded.ErrorPages.DefaultLanguage)
+
+	if err := reloaded.ErrorPages.Init(logger); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid error page: %s", err.Error())
+	}
+
+	config := *baseConfig
+	config.Authorization = reloaded.Authorization
+	config.Headers = reloaded.Headers
+	config.BypassAuthenticationRule = reloaded.BypassAuthenticationRule
+	config.ApiRouteRule = reloaded.ApiRouteRule
+	config.ErrorPages = reloaded.ErrorPages
+	config.ValidPostLoginRedirectUris = reloaded.ValidPostLoginRedirectUris
+	config.ValidPostLogoutRedirectUris = reloaded.ValidPostLogoutRedirectUris
+
+	return &config, bypassAuthenticationRule, apiRouteRule, nil
+}
@@ -0,0 +1,190 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func createReloadTestOidcAuth(t *testing.T, content string) (*TraefikOidcAuth, string) {
+	filePath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := CreateConfig()
+
+	toa := newTestOidcAuth(&Config{
+		Authorization:              defaults.Authorization,
+		ValidPostLoginRedirectUris: []string{"https://static.example.com/*"},
+	})
+	toa.ConfigReloader = CreateConfigReloader(filePath, time.Second, toa.Config)
+
+	return toa, filePath
+}
+
+func TestReloadConfigAppliesSettingsFromFile(t *testing.T) {
+	toa, _ := createReloadTestOidcAuth(t, `{
+		"authorization": { "assert_claims": [ { "name": "roles", "anyOf": ["admin"] } ] },
+		"bypass_authentication_rule": "PathPrefix(`+"`/public`"+`)"
+	}`)
+
+	if err := toa.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := toa.current()
+
+	if len(reloaded.Config.Authorization.AssertClaims) != 1 || reloaded.Config.Authorization.AssertClaims[0].Name != "roles" {
+		t.Errorf("Expected the claim assertions to be reloaded, but got %+v", reloaded.Config.Authorization.AssertClaims)
+	}
+	if reloaded.BypassAuthenticationRule == nil {
+		t.Error("Expected the bypass authentication rule to be parsed")
+	}
+	if len(reloaded.Config.ValidPostLoginRedirectUris) != 1 || reloaded.Config.ValidPostLoginRedirectUris[0] != "https://static.example.com/*" {
+		t.Errorf("Expected settings which are missing in the file to be kept, but got %v", reloaded.Config.ValidPostLoginRedirectUris)
+	}
+	if toa.Config.Authorization.AssertClaims != nil {
+		t.Error("Expected the configuration of the running handler not to be changed")
+	}
+	if toa.ConfigReloader.baseConfig.Authorization.AssertClaims != nil {
+		t.Error("Expected the static configuration to be left untouched")
+	}
+}
+
+func TestReloadConfigKeepsPreviousConfigOnError(t *testing.T) {
+	invalidFiles := []string{
+		`{ "authorization": `,
+		`{ "unknown_setting": true }`,
+		`{ "api_route_rule": "PathPrefix(" }`,
+		`{ "headers": [ { "name": "X-User", "value": "{{ .claims.sub " } ] }`,
+	}
+
+	for _, content := range invalidFiles {
+		toa, _ := createReloadTestOidcAuth(t, content)
+		if err := toa.reloadConfig(); err == nil {
+			t.Errorf("Expected an error for '%s'", content)
+		}
+		if toa.current() != toa {
+			t.Errorf("Expected the previous config to be kept for '%s'", content)
+		}
+	}
+}
+
+func TestReloadedHandlerSharesState(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.Secret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	toa, err := createTraefikOidcAuth(context.Background(), http.NewServeMux(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All fields except the reloadable configuration must be taken over
+	reloaded := toa.withReloadedConfig(toa.Config, toa.BypassAuthenticationRule, toa.ApiRouteRule)
+
+	if !reflect.DeepEqual(toa, reloaded) {
+		t.Errorf("Expected the reloaded handler to share the state of the handler, but got %+v", reloaded)
+	}
+}
+
+func TestConcurrentReloadsDontAffectRequests(t *testing.T) {
+	toa, filePath := createReloadTestOidcAuth(t, `{}`)
+	toa.Config.SessionCookie = &SessionCookieConfig{}
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{AuthorizationEndpoint: "https://idp.example.com/authorize"}
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			content := fmt.Sprintf(`{ "bypass_authentication_rule": "PathPrefix(`+"`/public-%d`"+`)" }`, i%2)
+			if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := toa.reloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				rw := httptest.NewRecorder()
+				toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/public-0/page", nil))
+
+				if rw.Code != http.StatusOK && rw.Code != http.StatusUnauthorized {
+					t.Errorf("Expected the request to be bypassed or unauthenticated, but got %d", rw.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+func TestConfigWatcherStopsWithContext(t *testing.T) {
+	toa, filePath := createReloadTestOidcAuth(t, `{}`)
+	toa.ConfigReloader.interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
+	go func() {
+		toa.watchConfigFile(ctx)
+		close(stopped)
+	}()
+
+	if err := os.WriteFile(filePath, []byte(`{ "api_route_rule": "PathPrefix(`+"`/api`"+`)" }`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100 && toa.current() == toa; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if toa.current().ApiRouteRule == nil {
+		t.Error("Expected the changed file to be reloaded")
+	}
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Expected the watcher to stop when the context is done")
+	}
+}
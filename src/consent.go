@@ -0,0 +1,122 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func (toa *TraefikOidcAuth) isConsentEnabled() bool {
+	return toa.Config.Consent != nil && toa.Config.Consent.Enabled
+}
+
+func (toa *TraefikOidcAuth) isConsentRequest(req *http.Request) bool {
+	return toa.isConsentEnabled() && req.URL.Path == toa.Config.Consent.Uri
+}
+
+// hasConsent checks whether the user has accepted the current terms, either at the identity provider, indicated by a claim,
+// or on the consent page of the middleware. Tokens of the AuthorizationHeader or AuthorizationCookie can't accept the terms,
+// so they are never gated.
+func (toa *TraefikOidcAuth) hasConsent(session *session.SessionState, claims map[string]interface{}) bool {
+	if !toa.isConsentEnabled() || session.Id == "AuthorizationHeader" || session.Id == "AuthorizationCookie" {
+		return true
+	}
+
+	config := toa.Config.Consent
+
+	if config.Claim != "" {
+		if value, ok := claims[config.Claim]; ok && isTrueParameter(fmt.Sprint(value)) {
+			return true
+		}
+	}
+
+	if session.ConsentedAt == 0 || session.ConsentVersion != config.Version {
+		return false
+	}
+
+	if config.ReconsentAfter > 0 {
+		expiresAt := time.Unix(session.ConsentedAt, 0).Add(time.Duration(config.ReconsentAfter) * time.Second)
+		return toa.now().Before(expiresAt)
+	}
+
+	return true
+}
+
+// writeConsentPage shows the terms to the user. The link to accept them is bound to the session,
+// so it can't be used to accept the terms on behalf of someone else.
+func (toa *TraefikOidcAuth) writeConsentPage(rw http.ResponseWriter, req *http.Request, session *session.SessionState, claims map[string]interface{}) {
+	state := oidc.NewState("Consent", fmt.Sprintf("%s%s", utils.GetFullHost(req), req.RequestURI))
+	state.SessionId = session.Id
+
+	stateBase64, err := oidc.EncodeState(state, toa.Config.EncryptionKey(), toa.Config.Cipher)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to serialize state: %s", err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	consentUrl := utils.EnsureAbsoluteUrl(req, toa.Config.Consent.Uri) + "?state=" + url.QueryEscape(stateBase64)
+
+	data := make(map[string]interface{})
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
+	data["statusCode"] = http.StatusForbidden
+	data["statusName"] = "Terms of use"
+	data["description"] = "Please accept the terms of use to continue."
+	data["primaryButtonText"] = "Accept"
+	data["primaryButtonUrl"] = consentUrl
+	data["consentUrl"] = consentUrl
+	data["consentVersion"] = toa.Config.Consent.Version
+	data["claims"] = claims
+
+	if toa.Config.LogoutUri != "" {
+		data["secondaryButtonText"] = "Logout"
+		data["secondaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, toa.Config.LogoutUri)
+	}
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	page := toa.Config.ErrorPages.Consent
+	if page == nil {
+		page = &errorPages.ErrorPageConfig{}
+	}
+
+	errorPages.WriteError(toa.logger, page, rw, req, data, jsHeaders)
+}
+
+// handleConsent records the acceptance of the terms in the session and redirects back to the original url.
+func (toa *TraefikOidcAuth) handleConsent(rw http.ResponseWriter, req *http.Request, session *session.SessionState) {
+	state, err := oidc.DecodeState(req.URL.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil || state.Action != "Consent" || state.SessionId != session.Id {
+		toa.logger.Log(logging.LevelWarn, "State on consent request is invalid.")
+		http.Error(rw, "State is invalid", http.StatusBadRequest)
+		return
+	}
+
+	stateExpiresAt := time.Unix(state.IssuedAt, 0).Add(time.Duration(toa.Config.StateMaxAge) * time.Second)
+
+	if toa.now().After(stateExpiresAt) || !toa.ConsumedStates.TryConsume(state.Id, stateExpiresAt) {
+		toa.logger.Log(logging.LevelWarn, "State on consent request is expired or has already been used.")
+		http.Error(rw, "State is expired", http.StatusBadRequest)
+		return
+	}
+
+	session.ConsentedAt = toa.now().Unix()
+	session.ConsentVersion = toa.Config.Consent.Version
+
+	toa.logger.Log(logging.LevelInfo, "The terms of use (version '%s') have been accepted.", session.ConsentVersion)
+
+	toa.storeSessionAndAttachCookie(session, rw)
+
+	http.Redirect(rw, req, state.RedirectUrl, http.StatusFound)
+}
@@ -0,0 +1,100 @@
+package src
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func newConsentTest() *TraefikOidcAuth {
+	toa := newTestOidcAuth(&Config{
+		Consent:       &ConsentConfig{Enabled: true, Uri: "/oidc/consent", Claim: "terms_accepted", Version: "2"},
+		SessionCookie: CreateConfig().SessionCookie,
+	})
+	toa.ConsumedStates = CreateConsumedStateCache()
+	toa.SessionStorage = session.CreateCookieSessionStorage()
+
+	return toa
+}
+
+func TestConsentIsRequired(t *testing.T) {
+	toa := newConsentTest()
+
+	tests := map[string]struct {
+		session  *session.SessionState
+		claims   map[string]interface{}
+		expected bool
+	}{
+		"no consent":             {&session.SessionState{Id: "1"}, nil, false},
+		"consent claim":          {&session.SessionState{Id: "1"}, map[string]interface{}{"terms_accepted": true}, true},
+		"accepted":               {&session.SessionState{Id: "1", ConsentedAt: time.Now().Unix(), ConsentVersion: "2"}, nil, true},
+		"outdated version":       {&session.SessionState{Id: "1", ConsentedAt: time.Now().Unix(), ConsentVersion: "1"}, nil, false},
+		"authorization header":   {&session.SessionState{Id: "AuthorizationHeader"}, nil, true},
+		"expired with reconsent": {&session.SessionState{Id: "1", ConsentedAt: time.Now().Add(-2 * time.Hour).Unix(), ConsentVersion: "2"}, nil, false},
+	}
+
+	toa.Config.Consent.ReconsentAfter = 3600
+
+	for name, test := range tests {
+		if actual := toa.hasConsent(test.session, test.claims); actual != test.expected {
+			t.Errorf("Expected %t for %s, but got %t", test.expected, name, actual)
+		}
+	}
+}
+
+func TestConsentIsRecordedInTheSession(t *testing.T) {
+	toa := newConsentTest()
+	state := &session.SessionState{Id: "session"}
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.writeConsentPage(rw, req, state, nil)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", rw.Code)
+	}
+
+	consentUrl := findConsentUrl(t, rw.Body.String())
+
+	// The link must not be usable by another session
+	rw = httptest.NewRecorder()
+	toa.handleConsent(rw, httptest.NewRequest(http.MethodGet, consentUrl.RequestURI(), nil), &session.SessionState{Id: "other"})
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for another session, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.handleConsent(rw, httptest.NewRequest(http.MethodGet, consentUrl.RequestURI(), nil), state)
+
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "http://example.com/page" {
+		t.Fatalf("Expected a redirect back to the page, but got %d to '%s'", rw.Code, rw.Header().Get("Location"))
+	}
+	if !toa.hasConsent(state, nil) {
+		t.Error("Expected the consent to be recorded in the session")
+	}
+}
+
+var consentLinkPattern = regexp.MustCompile(`href="([^"]*/oidc/consent[^"]*)"`)
+
+func findConsentUrl(t *testing.T, body string) *url.URL {
+	match := consentLinkPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Expected the page to link to the consent url")
+	}
+
+	link, err := url.Parse(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return link
+}
@@ -9,11 +9,30 @@ import (
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
-func setChunkedCookies(config *Config, rw http.ResponseWriter, cookieName string, cookieValue string) {
-	cookieChunks := utils.ChunkString(cookieValue, 3072)
+// The size of a cookie chunk, if SessionCookie.ChunkSize isn't set.
+const defaultCookieChunkSize = 3072
+
+func setChunkedCookies(config *Config, rw http.ResponseWriter, cookieName string, cookieValue string) error {
+	return setChunkedCookiesWithMaxAge(config, rw, cookieName, cookieValue, config.SessionCookie.MaxAge)
+}
+
+// setChunkedCookiesWithMaxAge splits the value into chunks of SessionCookie.ChunkSize. No cookie is set,
+// if more than SessionCookie.MaxChunks chunks are required.
+func setChunkedCookiesWithMaxAge(config *Config, rw http.ResponseWriter, cookieName string, cookieValue string, maxAge int) error {
+	chunkSize := config.SessionCookie.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultCookieChunkSize
+	}
+
+	cookieChunks := utils.ChunkString(cookieValue, chunkSize)
+
+	if maxChunks := config.SessionCookie.MaxChunks; maxChunks > 0 && len(cookieChunks) > maxChunks {
+		return fmt.Errorf("the cookie %s requires %d chunks of %d bytes, but at most %d chunks are allowed", cookieName, len(cookieChunks), chunkSize, maxChunks)
+	}
 
 	baseCookie := createSessionCookie(config)
 	baseCookie.Name = cookieName
+	baseCookie.MaxAge = maxAge
 
 	// Set the cookie
 	if len(cookieChunks) == 1 {
@@ -32,6 +51,8 @@ func setChunkedCookies(config *Config, rw http.ResponseWriter, cookieName string
 			http.SetCookie(rw, c)
 		}
 	}
+
+	return nil
 }
 func readChunkedCookie(req *http.Request, cookieName string) (string, error) {
 	chunkCount, err := getChunkedCookieCount(req, cookieName)
@@ -0,0 +1,39 @@
+package src
+
+import (
+	"net"
+	"strings"
+)
+
+// isHostInCookieDomain checks whether browsers accept a cookie for the domain on the host, which is the
+// case for the domain itself and all of its subdomains, eg. app.example.com for .example.com.
+func isHostInCookieDomain(host string, domain string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+
+	if host == "" || domain == "" {
+		return false
+	}
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// getCodeVerifierCookieDomain returns the domain of the PKCE cookie. When the callback is on another host,
+// eg. login.example.com, the cookie must be issued for the shared domain of the session cookie,
+// because browsers reject cookies for other hosts.
+func (toa *TraefikOidcAuth) getCodeVerifierCookieDomain() string {
+	if toa.Config.PkceCookie != nil && toa.Config.PkceCookie.Domain != "" {
+		return toa.Config.PkceCookie.Domain
+	}
+
+	sessionCookie := toa.Config.SessionCookie
+	if toa.CallbackURL.Host != "" && sessionCookie != nil && isHostInCookieDomain(toa.CallbackURL.Host, sessionCookie.Domain) {
+		return sessionCookie.Domain
+	}
+
+	return toa.CallbackURL.Host
+}
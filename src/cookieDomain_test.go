@@ -0,0 +1,80 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIsHostInCookieDomain(t *testing.T) {
+	tests := []struct {
+		host     string
+		domain   string
+		expected bool
+	}{
+		{"sub1.example.com", ".example.com", true},
+		{"sub1.example.com", "example.com", true},
+		{"example.com", ".example.com", true},
+		{"Sub1.Example.com:8443", ".example.com", true},
+		{"example.com.", ".example.com", true},
+		{"sub1.example.com.evil.com", ".example.com", false},
+		{"evilexample.com", ".example.com", false},
+		{"sub1.example.com", "", false},
+	}
+
+	for _, test := range tests {
+		if actual := isHostInCookieDomain(test.host, test.domain); actual != test.expected {
+			t.Errorf("%s in %s: Expected %v, but got %v", test.host, test.domain, test.expected, actual)
+		}
+	}
+}
+
+func TestCodeVerifierCookieUsesSharedDomainForCentralCallback(t *testing.T) {
+	toa := newTestOidcAuth(&Config{SessionCookie: &SessionCookieConfig{Domain: ".example.com"}})
+
+	toa.CallbackURL, _ = url.Parse("https://login.example.com/oidc/callback")
+	if domain := toa.getCodeVerifierCookieDomain(); domain != ".example.com" {
+		t.Errorf("Expected the shared domain, but got '%s'", domain)
+	}
+
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	if domain := toa.getCodeVerifierCookieDomain(); domain != "" {
+		t.Errorf("Expected a host-only cookie for relative callbacks, but got '%s'", domain)
+	}
+
+	toa.Config.SessionCookie.Domain = ""
+	toa.CallbackURL, _ = url.Parse("https://login.example.com/oidc/callback")
+	if domain := toa.getCodeVerifierCookieDomain(); domain != "login.example.com" {
+		t.Errorf("Expected the host of the callback, but got '%s'", domain)
+	}
+
+	toa.Config.PkceCookie = &PkceCookieConfig{Domain: "auth.example.com"}
+	if domain := toa.getCodeVerifierCookieDomain(); domain != "auth.example.com" {
+		t.Errorf("Expected the configured domain, but got '%s'", domain)
+	}
+}
+
+func TestCallbackOutsideOfCookieDomainIsRejected(t *testing.T) {
+	tests := []struct {
+		callbackUri string
+		valid       bool
+	}{
+		{"https://login.example.com/oidc/callback", true},
+		{"/oidc/callback", true},
+		{"https://login.example.org/oidc/callback", false},
+	}
+
+	for _, test := range tests {
+		config := CreateConfig()
+		config.Provider.Url = "https://idp.example.com"
+		config.Provider.ClientId = "client"
+		config.CallbackUri = test.callbackUri
+		config.SessionCookie.Domain = ".example.com"
+
+		_, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test")
+		if (err == nil) != test.valid {
+			t.Errorf("%s: Expected valid to be %v, but got %v", test.callbackUri, test.valid, err)
+		}
+	}
+}
@@ -215,3 +215,68 @@ func randomFixedLengthString(n int) string {
 	}
 	return string(b)
 }
+
+func TestSetChunkedCookiesPartitioned(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:        "/",
+			Secure:      true,
+			HttpOnly:    true,
+			SameSite:    "none",
+			Partitioned: true,
+		},
+	}
+
+	rw := newMockResponseWriter()
+
+	setChunkedCookies(config, rw, "TraefikOidcAuth.Session", "some-short-value")
+
+	setCookieHeader := rw.HeaderMap.Get("Set-Cookie")
+
+	if setCookieHeader != "TraefikOidcAuth.Session=some-short-value; Path=/; HttpOnly; Secure; SameSite=None; Partitioned" {
+		t.Errorf("Unexpected cookie header '%s'", setCookieHeader)
+	}
+}
+
+func TestSetChunkedCookiesUsesChunkSize(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:      "/",
+			ChunkSize: 1000,
+		},
+	}
+
+	rw := newMockResponseWriter()
+
+	if err := setChunkedCookies(config, rw, "TraefikOidcAuth.Session", randomFixedLengthString(2500)); err != nil {
+		t.Fatal(err)
+	}
+
+	setCookieHeader := rw.HeaderMap.Values("Set-Cookie")
+
+	if len(setCookieHeader) != 4 || setCookieHeader[0] != "TraefikOidcAuth.Session.Chunks=3; Path=/" {
+		t.Errorf("Expected 3 chunks, but got %v", setCookieHeader)
+	}
+}
+
+func TestSetChunkedCookiesRejectsTooManyChunks(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:      "/",
+			ChunkSize: 1000,
+			MaxChunks: 2,
+		},
+	}
+
+	rw := newMockResponseWriter()
+
+	if err := setChunkedCookies(config, rw, "TraefikOidcAuth.Session", randomFixedLengthString(2500)); err == nil {
+		t.Error("Expected an error")
+	}
+	if len(rw.HeaderMap.Values("Set-Cookie")) != 0 {
+		t.Error("Expected no cookies to be set")
+	}
+}
@@ -0,0 +1,119 @@
+package src
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The ways the protected application can be used by other sites.
+const (
+	crossSiteModeDisabled = "Disabled"
+	crossSiteModeEmbedded = "Embedded"
+)
+
+func isValidCrossSiteMode(mode string) bool {
+	switch mode {
+	case "", crossSiteModeDisabled, crossSiteModeEmbedded:
+		return true
+	default:
+		return false
+	}
+}
+
+// applyCrossSiteMode configures the session cookie, so browsers send it to an application which is
+// embedded in an iframe of another site.
+func applyCrossSiteMode(logger *logging.Logger, config *Config) error {
+	if config.CrossSiteMode != crossSiteModeEmbedded {
+		return nil
+	}
+
+	// A partitioned cookie set on the top-level login isn't available in the iframe
+	if config.SessionCookie.Partitioned {
+		logger.Log(logging.LevelError, "CrossSiteMode Embedded can't be combined with partitioned session cookies. Please set SessionCookie.Partitioned to false.")
+		return errors.New("cross site mode embedded can't use partitioned cookies")
+	}
+
+	if config.SessionCookie.SameSite != "none" || !config.SessionCookie.Secure {
+		logger.Log(logging.LevelInfo, "CrossSiteMode is Embedded. Using SameSite=None and Secure for the session cookie.")
+	}
+
+	config.SessionCookie.SameSite = "none"
+	config.SessionCookie.Secure = true
+
+	return nil
+}
+
+// isEmbeddedRequest checks whether the browser loads the request into an iframe, which is only reported
+// by browsers supporting the Fetch Metadata headers.
+func (toa *TraefikOidcAuth) isEmbeddedRequest(req *http.Request) bool {
+	return toa.Config.CrossSiteMode == crossSiteModeEmbedded && req.Header.Get("Sec-Fetch-Dest") == "iframe"
+}
+
+// The page asks the browser for access to the cookies first, as the user may already have a session,
+// which is blocked as a third-party cookie. Otherwise, the login is started in the top-level window,
+// because providers refuse to be embedded and cookies set in the iframe may be blocked.
+var topLevelRedirectTemplate = template.Must(template.New("topLevel").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sign in required</title>
+</head>
+<body>
+<p>You need to sign in to access this content.</p>
+<a id="login" href="{{ .loginUrl }}" target="_top">Sign in</a>
+<script>
+if (window.top === window.self) {
+	window.location.replace({{ .loginUrl }});
+}
+
+document.getElementById("login").addEventListener("click", function (event) {
+	if (!document.hasStorageAccess || !document.requestStorageAccess) {
+		return;
+	}
+
+	event.preventDefault();
+
+	document.hasStorageAccess().then(function (hasAccess) {
+		if (hasAccess) {
+			window.top.location.href = {{ .loginUrl }};
+			return;
+		}
+
+		document.requestStorageAccess().then(function () {
+			window.location.reload();
+		}, function () {
+			window.top.location.href = {{ .loginUrl }};
+		});
+	});
+});
+</script>
+</body>
+</html>
+`))
+
+// writeTopLevelRedirectPage is served instead of redirecting an iframe to the provider.
+// The login returns to the requested url at the top level afterwards.
+func (toa *TraefikOidcAuth) writeTopLevelRedirectPage(rw http.ResponseWriter, req *http.Request) {
+	loginUrl := utils.GetFullHost(req) + req.URL.RequestURI()
+
+	var page bytes.Buffer
+	err := topLevelRedirectTemplate.Execute(&page, map[string]interface{}{
+		"loginUrl": loginUrl,
+	})
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Error while rendering the top-level redirect page: %s", err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusUnauthorized)
+
+	_, _ = rw.Write(page.Bytes())
+}
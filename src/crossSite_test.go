@@ -0,0 +1,72 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestEmbeddedModeConfiguresSessionCookie(t *testing.T) {
+	config := &Config{
+		CrossSiteMode: crossSiteModeEmbedded,
+		SessionCookie: &SessionCookieConfig{SameSite: "lax"},
+	}
+
+	if err := applyCrossSiteMode(logging.CreateLogger(logging.LevelError), config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.SessionCookie.SameSite != "none" || !config.SessionCookie.Secure {
+		t.Errorf("Expected a secure cookie with SameSite=None, but got %v", config.SessionCookie)
+	}
+
+	config.SessionCookie.Partitioned = true
+	if err := applyCrossSiteMode(logging.CreateLogger(logging.LevelError), config); err == nil {
+		t.Error("Expected partitioned cookies to be rejected")
+	}
+}
+
+func TestEmbeddedLoginStartsAtTopLevel(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.CrossSiteMode = crossSiteModeEmbedded
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/embedded?tab=1", nil)
+	req.Header.Set("Sec-Fetch-Dest", "iframe")
+	rw := httptest.NewRecorder()
+
+	toa.redirectToProvider(rw, req)
+
+	if rw.Code != http.StatusUnauthorized || rw.Header().Get("Location") != "" {
+		t.Fatalf("Expected the top-level redirect page, but got status %d and location '%s'", rw.Code, rw.Header().Get("Location"))
+	}
+	if !strings.Contains(rw.Body.String(), `href="https://app.example.com/embedded?tab=1" target="_top"`) {
+		t.Errorf("Expected a link to the requested url in the top-level window, but got %s", rw.Body.String())
+	}
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("Expected no login cookies to be set in the iframe, but got %v", rw.Result().Cookies())
+	}
+
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	rw = httptest.NewRecorder()
+
+	toa.redirectToProvider(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Errorf("Expected top-level requests to be redirected, but got %d", rw.Code)
+	}
+}
+
+func TestInvalidCrossSiteModeIsRejected(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.CrossSiteMode = "Iframe"
+
+	if _, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected an invalid CrossSiteMode to be rejected")
+	}
+}
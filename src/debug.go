@@ -0,0 +1,285 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+const maskedValue = "***"
+
+type debugResponse struct {
+	Discovery      debugDiscovery         `json:"discovery"`
+	Jwks           []debugJwks            `json:"jwks"`
+	Caches         map[string]int         `json:"caches"`
+	CircuitBreaker string                 `json:"circuit_breaker,omitempty"`
+	Features       map[string]bool        `json:"features"`
+	Config         map[string]interface{} `json:"config"`
+}
+
+type debugDiscovery struct {
+	Loaded     bool   `json:"loaded"`
+	Issuer     string `json:"issuer,omitempty"`
+	AgeSeconds int64  `json:"age_seconds,omitempty"`
+}
+
+type debugJwks struct {
+	Source     string   `json:"source"`
+	Url        string   `json:"url,omitempty"`
+	KeyIds     []string `json:"key_ids"`
+	AgeSeconds int64    `json:"age_seconds,omitempty"`
+}
+
+func (toa *TraefikOidcAuth) isDebugRequest(req *http.Request) bool {
+	config := toa.Config.Debug
+
+	return config != nil && config.Enabled && config.Path != "" && req.URL.Path == config.Path
+}
+
+// handleDebug serves the current state of the middleware, so problems can be analyzed without
+// setting the log level to debug. Secrets in the configuration are masked.
+func (toa *TraefikOidcAuth) handleDebug(rw http.ResponseWriter, req *http.Request) {
+	if !toa.checkEndpointAccess(rw, req, "debug endpoint", toa.debugNetworks, toa.Config.Debug.Token) {
+		return
+	}
+
+	config, err := maskConfig(toa.Config)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to serialize the configuration: %s", err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	response := &debugResponse{
+		Discovery: toa.getDebugDiscovery(),
+		Jwks:      toa.getDebugJwks(),
+		Caches: map[string]int{
+			"token_cache":          toa.TokenCache.Len(),
+			"introspection_cache":  toa.IntrospectionCache.Len(),
+			"consumed_states":      toa.ConsumedStates.Len(),
+			"renewal_queue":        toa.RenewalQueue.Len(),
+			"active_refreshes":     toa.RefreshLimiter.Active(),
+			"rate_limiter_clients": toa.RateLimiter.Len(),
+			"lockout_entries":      toa.Lockout.Len(),
+			"shared_discoveries":   sharedDiscoveries.Len(),
+			"shared_key_sets":      oidc.SharedKeySetCount(),
+		},
+		Features: toa.getDebugFeatures(),
+		Config:   config,
+	}
+
+	if toa.CircuitBreaker != nil {
+		response.CircuitBreaker = toa.CircuitBreaker.State()
+	}
+
+	body, _ := json.Marshal(response)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+
+	_, _ = rw.Write(body)
+}
+
+func (toa *TraefikOidcAuth) getDebugDiscovery() debugDiscovery {
+	toa.Lock.RLock()
+	defer toa.Lock.RUnlock()
+
+	if toa.DiscoveryDocument == nil {
+		return debugDiscovery{}
+	}
+
+	return debugDiscovery{
+		Loaded:     true,
+		Issuer:     toa.DiscoveryDocument.Issuer,
+		AgeSeconds: int64(toa.now().Sub(toa.discoveredAt).Seconds()),
+	}
+}
+
+func (toa *TraefikOidcAuth) getDebugJwks() []debugJwks {
+	jwks := []debugJwks{}
+
+	add := func(source string, handler *oidc.JwksHandler) {
+		if handler == nil {
+			return
+		}
+
+		entry := debugJwks{
+			Source: source,
+			KeyIds: handler.KeyIds(),
+		}
+
+		handler.Lock.RLock()
+		entry.Url = handler.Url
+		if !handler.CacheDate.IsZero() {
+			entry.AgeSeconds = int64(time.Since(handler.CacheDate).Seconds())
+		}
+		handler.Lock.RUnlock()
+
+		jwks = append(jwks, entry)
+	}
+
+	add(providerPrimary, toa.Jwks)
+	if toa.SecondaryProvider != nil {
+		add(providerSecondary, toa.SecondaryProvider.Jwks)
+	}
+	for _, issuer := range toa.TrustedIssuers {
+		add(issuer.Config.Issuer, issuer.Jwks)
+	}
+
+	return jwks
+}
+
+func (toa *TraefikOidcAuth) getDebugFeatures() map[string]bool {
+	config := toa.Config
+
+	return map[string]bool{
+		"secondary_provider":   toa.SecondaryProvider != nil,
+		"trusted_issuers":      len(toa.TrustedIssuers) > 0,
+		"circuit_breaker":      toa.CircuitBreaker != nil,
+		"graceful_degradation": toa.RenewalQueue != nil,
+		"rate_limit":           toa.RateLimiter != nil,
+		"lockout":              toa.Lockout != nil,
+		"hot_reload":           toa.ConfigReloader != nil,
+		"metrics":              toa.Metrics != nil,
+		"tracing":              toa.Tracer != nil,
+		"minted_token":         toa.TokenMinter != nil,
+		"remember_me":          config.RememberMe != nil && config.RememberMe.Enabled,
+		"popup_callback":       config.PopupCallback != nil && config.PopupCallback.Enabled,
+		"consent":              toa.isConsentEnabled(),
+		"impersonation":        config.Impersonation != nil && config.Impersonation.Enabled,
+		"anonymous_access":     config.AnonymousAccess != nil && config.AnonymousAccess.condition != nil,
+	}
+}
+
+// maskConfig converts the configuration into a map, in which all secrets are masked.
+func maskConfig(config *Config) (map[string]interface{}, error) {
+	serialized, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	masked := map[string]interface{}{}
+	if err := json.Unmarshal(serialized, &masked); err != nil {
+		return nil, err
+	}
+
+	maskSecrets(masked)
+
+	return masked, nil
+}
+
+func maskSecrets(values map[string]interface{}) {
+	for key, value := range values {
+		if isSecretConfigKey(key) {
+			values[key] = maskValue(value)
+			continue
+		}
+
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			maskSecrets(typed)
+		case []interface{}:
+			for _, item := range typed {
+				if nested, ok := item.(map[string]interface{}); ok {
+					maskSecrets(nested)
+				}
+			}
+		}
+	}
+}
+
+// isSecretConfigKey checks whether the json key of a setting holds a secret, eg. client_secret or private_key.
+// The paths of secret files are not masked.
+func isSecretConfigKey(key string) bool {
+	if strings.HasSuffix(key, "_file") {
+		return false
+	}
+
+	return key == "token" || strings.Contains(key, "secret") || strings.Contains(key, "private_key") || strings.Contains(key, "password")
+}
+
+// maskValue replaces all non-empty strings, so it is still visible whether a secret has been configured.
+func maskValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case string:
+		if typed == "" {
+			return typed
+		}
+		return maskedValue
+	case []interface{}:
+		for i := range typed {
+			typed[i] = maskValue(typed[i])
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+// Headers which carry credentials. Their values are never logged, even if they are listed in LogHeaderValues.
+var credentialHeaders = map[string]bool{
+	"Authorization":              true,
+	"Proxy-Authorization":        true,
+	"Cookie":                     true,
+	"Set-Cookie":                 true,
+	oauth2ProxyAccessTokenHeader: true,
+}
+
+// logUpstreamHeaders writes the headers sent to the upstream service to the debug log, if LogUpstreamHeaders is enabled.
+func (toa *TraefikOidcAuth) logUpstreamHeaders(req *http.Request) {
+	config := toa.Config.Debug
+	if config == nil || !config.LogUpstreamHeaders {
+		return
+	}
+
+	toa.logger.Log(logging.LevelDebug, "Headers sent to the upstream service: %s", toa.formatUpstreamHeaders(req.Header, config.LogHeaderValues))
+}
+
+// formatUpstreamHeaders lists the headers sorted by name. Only the values of the allowed headers are written,
+// all other values are replaced by their length.
+func (toa *TraefikOidcAuth) formatUpstreamHeaders(header http.Header, allowed []string) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+
+		if !containsHeaderName(allowed, name) || toa.isCredentialHeader(name) {
+			value = fmt.Sprintf("[redacted, %d bytes]", len(value))
+		}
+
+		entries = append(entries, name+": "+value)
+	}
+
+	return strings.Join(entries, "; ")
+}
+
+func (toa *TraefikOidcAuth) isCredentialHeader(name string) bool {
+	if credentialHeaders[http.CanonicalHeaderKey(name)] {
+		return true
+	}
+
+	authorizationHeader := toa.Config.AuthorizationHeader
+	return authorizationHeader != nil && authorizationHeader.Name != "" && strings.EqualFold(name, authorizationHeader.Name)
+}
+
+func containsHeaderName(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func newDebugTest() *TraefikOidcAuth {
+	config := CreateConfig()
+	config.Secret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	config.Provider.ClientSecret = "client-secret"
+	config.Debug = &DebugConfig{Enabled: true, Path: "/oidc/debug", Token: "debug-token", PolicyTestPath: "/oidc/debug/policy"}
+
+	toa := newTestOidcAuth(config)
+	toa.Jwks = &oidc.JwksHandler{Url: "https://idp.example.com/jwks"}
+
+	return toa
+}
+
+func TestDebugEndpointRequiresToken(t *testing.T) {
+	toa := newDebugTest()
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/debug", nil))
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", rw.Code)
+	}
+}
+
+func TestDebugEndpointMasksSecrets(t *testing.T) {
+	toa := newDebugTest()
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/debug", nil)
+	req.Header.Set("Authorization", "Bearer debug-token")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+
+	body := rw.Body.String()
+	for _, secret := range []string{"MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ", "client-secret", "debug-token"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %s to be masked", secret)
+		}
+	}
+
+	response := &debugResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Discovery.Loaded {
+		t.Error("Expected the discovery document not to be loaded")
+	}
+	if len(response.Jwks) != 1 || response.Jwks[0].Url != "https://idp.example.com/jwks" {
+		t.Errorf("Expected the JWKS of the provider, but got %+v", response.Jwks)
+	}
+	if provider := response.Config["provider"].(map[string]interface{}); provider["client_secret"] != maskedValue || provider["client_id"] != "" {
+		t.Errorf("Expected only the client secret to be masked, but got %v", provider)
+	}
+}
+
+func TestDebugEndpointIsDisabledByDefault(t *testing.T) {
+	toa := newTestOidcAuth(CreateConfig())
+
+	if toa.isDebugRequest(httptest.NewRequest(http.MethodGet, "/oidc/debug", nil)) {
+		t.Error("Expected the debug endpoint to be disabled")
+	}
+}
+
+func TestFormatUpstreamHeadersRedactsValues(t *testing.T) {
+	toa := newDebugTest()
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "X-Api-Token"}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer eyJhbGciOi")
+	header.Set("X-Api-Token", "secret")
+	header.Set("X-Oidc-Username", "alice")
+	header.Set("X-Oidc-Email", "alice@example.com")
+
+	actual := toa.formatUpstreamHeaders(header, []string{"authorization", "x-api-token", "X-Oidc-Username"})
+	expected := "Authorization: [redacted, 17 bytes]; X-Api-Token: [redacted, 6 bytes]; X-Oidc-Email: [redacted, 17 bytes]; X-Oidc-Username: alice"
+
+	if actual != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, actual)
+	}
+}
@@ -1,11 +1,62 @@
 package errorPages
 
+import (
+	"html/template"
+	textTemplate "text/template"
+)
+
 type ErrorPagesConfig struct {
 	Unauthenticated *ErrorPageConfig `json:"unauthenticated"`
 	Unauthorized    *ErrorPageConfig `json:"unauthorized"`
+
+	// Shown instead of redirecting to the provider, when UnauthorizedBehavior is set to Interstitial.
+	Interstitial *ErrorPageConfig `json:"interstitial"`
+	// Shown when the identity provider can't be reached.
+	ProviderUnavailable *ErrorPageConfig `json:"provider_unavailable"`
+	// Shown when the user has to accept the terms of use.
+	Consent *ErrorPageConfig `json:"consent"`
+	// Shown when the identity provider returns an error on the callback, eg. because the user denied the consent.
+	LoginFailed *ErrorPageConfig `json:"login_failed"`
+
+	// The language used when none of the languages accepted by the client is available.
+	DefaultLanguage string `json:"default_language"`
 }
 
 type ErrorPageConfig struct {
 	FilePath   string `json:"file_path"`
 	RedirectTo string `json:"redirect_to"`
+
+	// An inline Go-template of the page. Takes precedence over FilePath.
+	Template string `json:"template"`
+	// The names of the claims which are made available to the template.
+	ExposedClaims []string `json:"exposed_claims"`
+
+	// Overrides the status code returned to JavaScript requests.
+	XhrStatusCode int `json:"xhr_status_code"`
+	// A Go-template rendering the JSON body returned to JavaScript requests.
+	XhrResponseTemplate string `json:"xhr_response_template"`
+
+	// An optional number of seconds sent as Retry-After header.
+	RetryAfter int `json:"retry_after"`
+
+	// Localized variants of the page, keyed by language tag. Eg. "de" or "fr-CH".
+	Localized map[string]*LocalizedErrorPageConfig `json:"localized"`
+
+	// Copied from ErrorPagesConfig during Init
+	defaultLanguage string
+
+	// References to the parsed templates
+	pageTemplate *template.Template
+	xhrTemplate  *textTemplate.Template
+}
+
+type LocalizedErrorPageConfig struct {
+	FilePath string `json:"file_path"`
+	Template string `json:"template"`
+
+	// Overrides the texts of the page. Supported keys are statusName, description,
+	// primaryButtonText and secondaryButtonText.
+	Texts map[string]string `json:"texts"`
+
+	pageTemplate *template.Template
 }
@@ -3,32 +3,53 @@ package errorPages
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"strings"
+	textTemplate "text/template"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+// TraceIdHeader is set by the middleware on every response.
+// Its value is exposed to error pages as traceId, so users can quote it in support requests.
+const TraceIdHeader = "X-Trace-Id"
+
 type ProblemDetails struct {
 	Type      string `json:"type"`
 	Title     string `json:"title"`
 	Detail    string `json:"detail"`
 	LoginUrl  string `json:"login_url,omitempty"`
 	LogoutUrl string `json:"logout_url,omitempty"`
+	TraceId   string `json:"trace_id,omitempty"`
 }
 
 func WriteError(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseWriter,
 	req *http.Request,
 	data map[string]interface{},
 	jsDetectionHeaders map[string][]string) {
+	addTemplateData(page, rw, req, data)
+	localized := localize(page, req, data)
+
 	// For XHR requests, skip any redirects and return JSON
 	if utils.IsXHRRequestWithHeaders(req, jsDetectionHeaders) {
+		if page.XhrStatusCode != 0 {
+			data["statusCode"] = page.XhrStatusCode
+		}
+
+		if page.xhrTemplate != nil {
+			writeXhrTemplate(logger, page, rw, data)
+			return
+		}
+
 		problemDetails := ProblemDetails{
-			Type:   data["statusType"].(string),
-			Title:  data["statusName"].(string),
-			Detail: data["description"].(string),
+			Type:    data["statusType"].(string),
+			Title:   data["statusName"].(string),
+			Detail:  data["description"].(string),
+			TraceId: data["traceId"].(string),
 		}
 
 		// Add login and logout URLs if provided
@@ -49,10 +70,11 @@ func WriteError(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseW
 	}
 
 	if utils.IsHtmlRequest(req) {
-		html, err := renderPage(logger, page, data)
+		html, err := renderPage(page, localized, data)
 		if err != nil {
 			logger.Log(logging.LevelError, "Error while rendering unauthorized page: %s", err.Error())
 			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 
 		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -62,9 +84,10 @@ func WriteError(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseW
 	}
 
 	problemDetails := ProblemDetails{
-		Type:   data["statusType"].(string),
-		Title:  data["statusName"].(string),
-		Detail: data["description"].(string),
+		Type:    data["statusType"].(string),
+		Title:   data["statusName"].(string),
+		Detail:  data["description"].(string),
+		TraceId: data["traceId"].(string),
 	}
 
 	// Add login and logout URLs if provided (for non-XHR JSON requests)
@@ -78,6 +101,125 @@ func WriteError(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseW
 	writeProblemDetail(logger, problemDetails, rw, data["statusCode"].(int))
 }
 
+// WriteBearerError writes an RFC 6750 compliant error response including a WWW-Authenticate challenge.
+// It never redirects or renders HTML, so it's suitable for machine clients.
+func WriteBearerError(logger *logging.Logger, rw http.ResponseWriter, errorCode string, data map[string]interface{}) {
+	challenge := "Bearer"
+
+	if errorCode != "" {
+		description := strings.NewReplacer("\"", "'", "\n", " ", "\\", "").Replace(data["description"].(string))
+		challenge = fmt.Sprintf("Bearer error=\"%s\", error_description=\"%s\"", errorCode, description)
+	}
+	if scope, ok := data["scope"].(string); ok && scope != "" {
+		challenge += fmt.Sprintf(", scope=\"%s\"", scope)
+	}
+
+	rw.Header().Set("WWW-Authenticate", challenge)
+
+	problemDetails := ProblemDetails{
+		Type:    data["statusType"].(string),
+		Title:   data["statusName"].(string),
+		Detail:  data["description"].(string),
+		TraceId: rw.Header().Get(TraceIdHeader),
+	}
+
+	writeProblemDetail(logger, problemDetails, rw, data["statusCode"].(int))
+}
+
+// ParseTemplates reads and parses the templates of the page, so errors are detected at startup.
+func (page *ErrorPageConfig) ParseTemplates(logger *logging.Logger) error {
+	tpl, err := loadPageTemplate(page.Template, page.FilePath)
+	if err != nil {
+		return err
+	}
+
+	page.pageTemplate = tpl
+
+	for language, localized := range page.Localized {
+		tpl, err := loadPageTemplate(localized.Template, localized.FilePath)
+		if err != nil {
+			return fmt.Errorf("invalid template for language %s: %w", language, err)
+		}
+
+		localized.pageTemplate = tpl
+	}
+
+	if page.XhrResponseTemplate != "" {
+		tpl, err := textTemplate.New("").Funcs(textTemplate.FuncMap{
+			"json": func(value interface{}) (string, error) {
+				encoded, err := json.Marshal(value)
+				return string(encoded), err
+			},
+		}).Parse(page.XhrResponseTemplate)
+		if err != nil {
+			return err
+		}
+
+		page.xhrTemplate = tpl
+	}
+
+	return nil
+}
+
+// loadPageTemplate parses the inline template or the template file. It returns nil if neither is set.
+// A configured file which can't be read is an error, so a typo in the path doesn't silently fall back to the default page.
+func loadPageTemplate(inlineTemplate string, filePath string) (*template.Template, error) {
+	pageTemplate := inlineTemplate
+
+	if pageTemplate == "" && filePath != "" {
+		templateData, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the error page file \"%s\": %w", filePath, err)
+		}
+
+		pageTemplate = string(templateData)
+	}
+
+	if pageTemplate == "" {
+		return nil, nil
+	}
+
+	return template.New("").Parse(pageTemplate)
+}
+
+// addTemplateData adds information about the request, the trace and the allowed claims to the data of the page.
+func addTemplateData(page *ErrorPageConfig, rw http.ResponseWriter, req *http.Request, data map[string]interface{}) {
+	data["traceId"] = rw.Header().Get(TraceIdHeader)
+
+	data["request"] = map[string]interface{}{
+		"method": req.Method,
+		"host":   req.Host,
+		"path":   req.URL.Path,
+		"url":    utils.EnsureAbsoluteUrl(req, req.URL.RequestURI()),
+	}
+
+	exposedClaims := make(map[string]interface{})
+
+	if claims, ok := data["claims"].(map[string]interface{}); ok {
+		for _, name := range page.ExposedClaims {
+			if value, ok := claims[name]; ok {
+				exposedClaims[name] = value
+			}
+		}
+	}
+
+	data["claims"] = exposedClaims
+}
+
+func writeXhrTemplate(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseWriter, data map[string]interface{}) {
+	var renderedValue bytes.Buffer
+	err := page.xhrTemplate.Execute(&renderedValue, data)
+	if err != nil {
+		logger.Log(logging.LevelError, "Error while rendering XHR response template: %s", err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(data["statusCode"].(int))
+	rw.Write(renderedValue.Bytes())
+}
+
 func writeProblemDetail(logger *logging.Logger, problem ProblemDetails, rw http.ResponseWriter, statusCode int) {
 	json, err := json.Marshal(problem)
 	if err != nil {
@@ -91,9 +233,32 @@ func writeProblemDetail(logger *logging.Logger, problem ProblemDetails, rw http.
 	rw.Write([]byte(json))
 }
 
-func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[string]interface{}) (string, error) {
-	htmlTemplate := `<!DOCTYPE html>
-<html>
+func renderPage(page *ErrorPageConfig, localized *LocalizedErrorPageConfig, evalContext map[string]interface{}) (string, error) {
+	tpl := page.pageTemplate
+
+	if localized != nil && localized.pageTemplate != nil {
+		tpl = localized.pageTemplate
+	}
+
+	if tpl == nil {
+		var err error
+		tpl, err = template.New("").Parse(defaultPageTemplate)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var renderedValue bytes.Buffer
+	err := tpl.Execute(&renderedValue, evalContext)
+	if err != nil {
+		return "", err
+	}
+
+	return renderedValue.String(), nil
+}
+
+const defaultPageTemplate = `<!DOCTYPE html>
+<html{{ if .lang }} lang="{{ .lang }}"{{ end }}>
 <head>
   <title>{{ .statusName }}</title>
   <style>
@@ -159,6 +324,15 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
       all: unset;
       cursor: pointer;
     }
+    .failed-assertion {
+      margin-top: 1em;
+      color: #888;
+    }
+    .trace-id {
+      margin-top: 2em;
+      color: #aaa;
+      font-family: monospace;
+    }
   </style>
 </head>
 
@@ -167,6 +341,9 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
     <span class="error-code">{{ .statusCode }}</span>
     <h1>{{ .statusName }}</h1>
     <h2>{{ .description }}</h2>
+    {{ with .failedAssertion }}
+    <span class="failed-assertion">Reason: {{ .description }}</span>
+    {{ end }}
 
     <div class="button-container">
       {{ if .primaryButtonUrl }}
@@ -177,32 +354,13 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
       {{ end }}
     </div>
 
+    {{ if .traceId }}
+    <span class="trace-id">Trace ID: {{ .traceId }}</span>
+    {{ end }}
+
     <div class="footer">
       <a href="https://traefik-oidc-auth.sevensolutions.cc/" target="_blank">Powered by traefik-oidc-auth</a>
     </div>
   </div>
 </body>
 </html>`
-
-	if page.FilePath != "" {
-		templateData, err := os.ReadFile(page.FilePath)
-		if err != nil {
-			logger.Log(logging.LevelWarn, "Error while reading error page file \"%s\": %s", page.FilePath, err.Error())
-		} else {
-			htmlTemplate = string(templateData)
-		}
-	}
-
-	tpl, err := template.New("").Parse(htmlTemplate)
-	if err != nil {
-		return "", err
-	}
-
-	var renderedValue bytes.Buffer
-	err = tpl.Execute(&renderedValue, evalContext)
-	if err != nil {
-		return "", err
-	}
-
-	return renderedValue.String(), nil
-}
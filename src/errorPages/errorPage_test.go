@@ -0,0 +1,188 @@
+package errorPages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func createTestData() map[string]interface{} {
+	return map[string]interface{}{
+		"statusType":  "https://tools.ietf.org/html/rfc9110#section-15.5.2",
+		"statusCode":  http.StatusUnauthorized,
+		"statusName":  "Unauthorized",
+		"description": "Please log in.",
+		"loginUrl":    "https://example.com/login",
+	}
+}
+
+func TestWriteErrorUsesXhrResponseTemplate(t *testing.T) {
+	page := &ErrorPageConfig{
+		XhrStatusCode:       440,
+		XhrResponseTemplate: `{"error":{"code":{{ .statusCode }},"message":{{ json .description }},"login":{{ json .loginUrl }}}}`,
+	}
+
+	err := page.ParseTemplates(logging.CreateLogger(logging.LevelDebug))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	rw := httptest.NewRecorder()
+
+	WriteError(logging.CreateLogger(logging.LevelDebug), page, rw, req, createTestData(), nil)
+
+	if rw.Code != 440 {
+		t.Errorf("Expected status 440, but got %d", rw.Code)
+	}
+
+	expected := `{"error":{"code":440,"message":"Please log in.","login":"https://example.com/login"}}`
+	if rw.Body.String() != expected {
+		t.Errorf("Expected body '%s', but got '%s'", expected, rw.Body.String())
+	}
+}
+
+func TestWriteErrorKeepsProblemDetailsWithoutTemplate(t *testing.T) {
+	page := &ErrorPageConfig{
+		XhrStatusCode: http.StatusForbidden,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	rw := httptest.NewRecorder()
+
+	WriteError(logging.CreateLogger(logging.LevelDebug), page, rw, req, createTestData(), nil)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Content-Type") != "application/json+problem" {
+		t.Errorf("Expected problem details, but got content type '%s'", rw.Header().Get("Content-Type"))
+	}
+}
+
+func TestWriteErrorIncludesTraceId(t *testing.T) {
+	page := &ErrorPageConfig{}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	rw := httptest.NewRecorder()
+	rw.Header().Set(TraceIdHeader, "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	WriteError(logging.CreateLogger(logging.LevelDebug), page, rw, req, createTestData(), nil)
+
+	if !strings.Contains(rw.Body.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Errorf("Expected the trace id in the problem details, but got '%s'", rw.Body.String())
+	}
+
+	req.Header.Set("Accept", "text/html")
+	rw = httptest.NewRecorder()
+	rw.Header().Set(TraceIdHeader, "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	WriteError(logging.CreateLogger(logging.LevelDebug), page, rw, req, createTestData(), nil)
+
+	if !strings.Contains(rw.Body.String(), "Trace ID: 4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("Expected the trace id on the page, but got '%s'", rw.Body.String())
+	}
+}
+
+func TestParseTemplatesFailsOnInvalidTemplate(t *testing.T) {
+	page := &ErrorPageConfig{
+		XhrResponseTemplate: `{{ .statusCode `,
+	}
+
+	if page.ParseTemplates(logging.CreateLogger(logging.LevelDebug)) == nil {
+		t.Fatal("Expected an error for an invalid template")
+	}
+}
+
+func TestParseTemplatesFailsOnMissingFile(t *testing.T) {
+	page := &ErrorPageConfig{
+		FilePath: filepath.Join(t.TempDir(), "missing.html"),
+	}
+
+	if page.ParseTemplates(logging.CreateLogger(logging.LevelDebug)) == nil {
+		t.Fatal("Expected an error for a missing template file")
+	}
+
+	page = &ErrorPageConfig{
+		Localized: map[string]*LocalizedErrorPageConfig{
+			"de": {FilePath: filepath.Join(t.TempDir(), "missing.html")},
+		},
+	}
+
+	if page.ParseTemplates(logging.CreateLogger(logging.LevelDebug)) == nil {
+		t.Fatal("Expected an error for a missing localized template file")
+	}
+}
+
+func TestWriteErrorRendersInlineTemplate(t *testing.T) {
+	page := &ErrorPageConfig{
+		Template:      `{{ .statusCode }} {{ .request.path }} {{ .claims.email }} {{ .claims.secret }}`,
+		ExposedClaims: []string{"email"},
+	}
+
+	err := page.ParseTemplates(logging.CreateLogger(logging.LevelDebug))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := createTestData()
+	data["claims"] = map[string]interface{}{
+		"email":  "alice@example.com",
+		"secret": "top-secret",
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/admin", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	WriteError(logging.CreateLogger(logging.LevelDebug), page, rw, req, data, nil)
+
+	expected := "401 /admin alice@example.com "
+	if rw.Body.String() != expected {
+		t.Errorf("Expected body '%s', but got '%s'", expected, rw.Body.String())
+	}
+}
+
+func TestWriteErrorSelectsLanguage(t *testing.T) {
+	config := &ErrorPagesConfig{
+		DefaultLanguage: "en",
+		Unauthenticated: &ErrorPageConfig{
+			Template: `{{ .lang }}: {{ .description }}`,
+			Localized: map[string]*LocalizedErrorPageConfig{
+				"de": {Texts: map[string]string{"description": "Bitte melden Sie sich an."}},
+				"en": {Texts: map[string]string{"description": "Please sign in."}},
+			},
+		},
+		Unauthorized: &ErrorPageConfig{},
+	}
+
+	err := config.Init(logging.CreateLogger(logging.LevelDebug))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"de-AT,de;q=0.9":   "de: Bitte melden Sie sich an.",
+		"fr-FR,fr;q=0.9":   "en: Please sign in.",
+		"fr;q=0.9, de;q=1": "de: Bitte melden Sie sich an.",
+	}
+
+	for acceptLanguage, expected := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("Accept-Language", acceptLanguage)
+		rw := httptest.NewRecorder()
+
+		WriteError(logging.CreateLogger(logging.LevelDebug), config.Unauthenticated, rw, req, createTestData(), nil)
+
+		if rw.Body.String() != expected {
+			t.Errorf("Expected '%s' for '%s', but got '%s'", expected, acceptLanguage, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package errorPages
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+var localizableTexts = []string{"statusName", "description", "primaryButtonText", "secondaryButtonText"}
+
+// Init prepares all configured error pages. It must be called once at startup.
+func (config *ErrorPagesConfig) Init(logger *logging.Logger) error {
+	for _, page := range []*ErrorPageConfig{config.Unauthenticated, config.Unauthorized, config.Interstitial, config.ProviderUnavailable, config.Consent, config.LoginFailed} {
+		if page == nil {
+			continue
+		}
+
+		page.defaultLanguage = config.DefaultLanguage
+
+		err := page.ParseTemplates(logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localize selects the localized variant of the page matching the Accept-Language header
+// and applies it's texts to the data.
+func localize(page *ErrorPageConfig, req *http.Request, data map[string]interface{}) *LocalizedErrorPageConfig {
+	if len(page.Localized) == 0 {
+		return nil
+	}
+
+	language, localized := selectLanguage(page, utils.ParseAcceptLanguage(req.Header.Get("Accept-Language")))
+	if localized == nil {
+		return nil
+	}
+
+	data["lang"] = language
+
+	for _, key := range localizableTexts {
+		if text, ok := localized.Texts[key]; ok {
+			data[key] = text
+		}
+	}
+
+	return localized
+}
+
+func selectLanguage(page *ErrorPageConfig, acceptedLanguages []string) (string, *LocalizedErrorPageConfig) {
+	for _, accepted := range acceptedLanguages {
+		// Try an exact match first, then fall back to the primary language. Eg. "de-AT" -> "de".
+		candidates := []string{accepted}
+		if primary, _, found := strings.Cut(accepted, "-"); found {
+			candidates = append(candidates, primary)
+		}
+
+		for _, candidate := range candidates {
+			for language, localized := range page.Localized {
+				if strings.EqualFold(language, candidate) {
+					return language, localized
+				}
+			}
+		}
+	}
+
+	if localized, ok := page.Localized[page.defaultLanguage]; ok {
+		return page.defaultLanguage, localized
+	}
+
+	return "", nil
+}
@@ -0,0 +1,105 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The behaviors for requests whose session cookie is expired or invalid.
+const (
+	expiredSessionBehaviorSilentRefresh = "SilentRefresh"
+	expiredSessionBehaviorChallenge     = "Challenge"
+	expiredSessionBehaviorUnauthorized  = "Unauthorized"
+	expiredSessionBehaviorAnonymous     = "Anonymous"
+)
+
+func isValidExpiredSessionBehavior(behavior string) bool {
+	switch behavior {
+	case "", expiredSessionBehaviorSilentRefresh, expiredSessionBehaviorChallenge, expiredSessionBehaviorUnauthorized, expiredSessionBehaviorAnonymous:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseExpiredSessionRules validates the behaviors and parses the rules of ExpiredSessionRules.
+func parseExpiredSessionRules(config *Config) error {
+	if !isValidExpiredSessionBehavior(config.ExpiredSessionBehavior) {
+		return fmt.Errorf("invalid ExpiredSessionBehavior '%s'", config.ExpiredSessionBehavior)
+	}
+
+	for i := range config.ExpiredSessionRules {
+		rule := &config.ExpiredSessionRules[i]
+
+		rule.Rule = utils.ExpandEnvironmentVariableString(rule.Rule)
+		rule.Behavior = utils.ExpandEnvironmentVariableString(rule.Behavior)
+
+		if rule.Behavior == "" || !isValidExpiredSessionBehavior(rule.Behavior) {
+			return fmt.Errorf("invalid behavior '%s' of expired session rule %d", rule.Behavior, i+1)
+		}
+
+		condition, err := rules.ParseRequestCondition(rule.Rule)
+		if err != nil {
+			return fmt.Errorf("invalid expired session rule %d: %s", i+1, err.Error())
+		}
+
+		rule.condition = condition
+	}
+
+	return nil
+}
+
+// getExpiredSessionBehavior returns the behavior of the first matching rule or the ExpiredSessionBehavior.
+// An empty behavior means the request is handled like every other unauthenticated request.
+func (toa *TraefikOidcAuth) getExpiredSessionBehavior(req *http.Request) string {
+	for i := range toa.Config.ExpiredSessionRules {
+		rule := &toa.Config.ExpiredSessionRules[i]
+
+		if rule.condition != nil && rule.condition.Match(toa.logger.Module(logging.ModuleRules), req) {
+			return rule.Behavior
+		}
+	}
+
+	return toa.Config.ExpiredSessionBehavior
+}
+
+// handleExpiredSession handles a request whose session is expired or invalid, eg. because the refresh failed.
+// The session cookie has already been cleared. Returns false, if the request should be handled by UnauthorizedBehavior.
+func (toa *TraefikOidcAuth) handleExpiredSession(rw http.ResponseWriter, req *http.Request, span *tracing.Span, start time.Time) bool {
+	behavior := toa.getExpiredSessionBehavior(req)
+
+	switch behavior {
+	case expiredSessionBehaviorSilentRefresh:
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "invalid_session", start)
+
+		// Other requests can't follow a redirect to the identity provider
+		if !utils.IsHtmlRequest(req) {
+			toa.writeUnauthenticatedError(rw, req)
+			return true
+		}
+
+		toa.logger.Log(logging.LevelInfo, "Session expired. Trying to log in silently...")
+		parameters := toa.getLoginParameters(req)
+		parameters.Prompt = "none"
+
+		toa.redirectToProviderWithParameters(rw, req, parameters)
+	case expiredSessionBehaviorChallenge:
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "invalid_session", start)
+		toa.redirectToProvider(rw, req)
+	case expiredSessionBehaviorUnauthorized:
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "invalid_session", start)
+		toa.writeUnauthenticatedError(rw, req)
+	case expiredSessionBehaviorAnonymous:
+		toa.forwardAnonymously(rw, req, span, "invalid_session", start)
+	default:
+		return false
+	}
+
+	return true
+}
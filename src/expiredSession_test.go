@@ -0,0 +1,126 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func newExpiredSessionTest(t *testing.T, config *Config) *TraefikOidcAuth {
+	if err := parseExpiredSessionRules(config); err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(config)
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.ConsumedStates = CreateConsumedStateCache()
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{
+		AuthorizationEndpoint: "https://idp.example.com/authorize",
+	}
+
+	return toa
+}
+
+func TestExpiredSessionRulesSelectBehavior(t *testing.T) {
+	toa := newExpiredSessionTest(t, &Config{
+		ExpiredSessionBehavior: expiredSessionBehaviorChallenge,
+		ExpiredSessionRules: []ExpiredSessionRuleConfig{
+			{Rule: "PathPrefix(`/api`)", Behavior: expiredSessionBehaviorUnauthorized},
+			{Rule: "PathPrefix(`/public`)", Behavior: expiredSessionBehaviorAnonymous},
+		},
+	})
+
+	tests := map[string]string{
+		"/api/poll":    expiredSessionBehaviorUnauthorized,
+		"/public/home": expiredSessionBehaviorAnonymous,
+		"/app":         expiredSessionBehaviorChallenge,
+	}
+
+	for path, expected := range tests {
+		if behavior := toa.getExpiredSessionBehavior(httptest.NewRequest(http.MethodGet, path, nil)); behavior != expected {
+			t.Errorf("Expected %s for %s, but got %s", expected, path, behavior)
+		}
+	}
+}
+
+func TestExpiredSessionBehaviors(t *testing.T) {
+	tests := map[string]int{
+		"":                                  0,
+		expiredSessionBehaviorChallenge:     http.StatusFound,
+		expiredSessionBehaviorUnauthorized:  http.StatusUnauthorized,
+		expiredSessionBehaviorAnonymous:     http.StatusNoContent,
+		expiredSessionBehaviorSilentRefresh: http.StatusFound,
+	}
+
+	for behavior, expected := range tests {
+		toa := newExpiredSessionTest(t, &Config{ExpiredSessionBehavior: behavior})
+
+		var upstream *http.Request
+		toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			upstream = req
+			rw.WriteHeader(http.StatusNoContent)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept", "text/html")
+		rw := httptest.NewRecorder()
+
+		handled := toa.handleExpiredSession(rw, req, nil, time.Now())
+
+		if expected == 0 {
+			if handled {
+				t.Error("Expected requests to be left to UnauthorizedBehavior without an ExpiredSessionBehavior")
+			}
+			continue
+		}
+
+		if rw.Code != expected {
+			t.Errorf("Expected status %d for %s, but got %d", expected, behavior, rw.Code)
+		}
+		if (upstream != nil) != (behavior == expiredSessionBehaviorAnonymous) {
+			t.Errorf("Expected only %s to forward the request", expiredSessionBehaviorAnonymous)
+		}
+	}
+}
+
+func TestSilentRefreshFallsBackAfterLoginRequired(t *testing.T) {
+	toa := newExpiredSessionTest(t, &Config{ExpiredSessionBehavior: expiredSessionBehaviorSilentRefresh})
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.handleExpiredSession(rw, req, nil, time.Now())
+
+	authorizationUrl, _ := url.Parse(rw.Header().Get("Location"))
+	if prompt := authorizationUrl.Query().Get("prompt"); prompt != "none" {
+		t.Fatalf("Expected prompt=none, but got '%s'", prompt)
+	}
+
+	callback := httptest.NewRequest(http.MethodGet, "/oidc/callback?error=login_required&state="+authorizationUrl.Query().Get("state"), nil)
+	rw = httptest.NewRecorder()
+
+	toa.handleCallback(rw, callback)
+
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "http://example.com/page" {
+		t.Errorf("Expected a redirect back to the page, but got %d to '%s'", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestInvalidExpiredSessionBehaviorsAreRejected(t *testing.T) {
+	tests := map[string]*Config{
+		"invalid behavior":      {ExpiredSessionBehavior: "Redirect"},
+		"missing rule behavior": {ExpiredSessionRules: []ExpiredSessionRuleConfig{{Rule: "PathPrefix(`/api`)"}}},
+		"invalid rule":          {ExpiredSessionRules: []ExpiredSessionRuleConfig{{Rule: "Invalid(", Behavior: expiredSessionBehaviorAnonymous}}},
+	}
+
+	for name, config := range tests {
+		if err := parseExpiredSessionRules(config); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
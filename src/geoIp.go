@@ -0,0 +1,85 @@
+package src
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// getCountry returns the ISO 3166-1 alpha-2 code of the client's country, or an empty string if it is unknown.
+// The country of a request which has already been resolved is taken from its context.
+func (toa *TraefikOidcAuth) getCountry(req *http.Request) string {
+	if country := geoip.CountryFromContext(req.Context()); country != "" {
+		return country
+	}
+
+	config := toa.Config.GeoIp
+	if config == nil {
+		return ""
+	}
+
+	if config.CountryHeader != "" {
+		if country := strings.ToUpper(strings.TrimSpace(req.Header.Get(config.CountryHeader))); country != "" {
+			return country
+		}
+	}
+
+	return toa.GeoIp.Lookup(net.ParseIP(utils.GetClientIp(req)))
+}
+
+// isCountryAllowed checks whether logins are allowed from the country.
+// Unknown countries are only allowed, if no AllowedCountries are configured.
+func isCountryAllowed(config *GeoIpConfig, country string) bool {
+	if config == nil {
+		return true
+	}
+
+	if slices.Contains(config.DeniedCountries, country) {
+		return false
+	}
+
+	return len(config.AllowedCountries) == 0 || slices.Contains(config.AllowedCountries, country)
+}
+
+// checkLoginCountry rejects logins from countries which aren't allowed by the GeoIp configuration.
+// Returns false, if the request has been rejected.
+func (toa *TraefikOidcAuth) checkLoginCountry(rw http.ResponseWriter, req *http.Request) bool {
+	country := toa.getCountry(req)
+
+	if isCountryAllowed(toa.Config.GeoIp, country) {
+		return true
+	}
+
+	toa.logger.Log(logging.LevelInfo, "Denied a login from country '%s' for client %s.", country, utils.GetClientIp(req))
+
+	toa.writeCountryDeniedError(rw, req)
+
+	return false
+}
+
+func (toa *TraefikOidcAuth) writeCountryDeniedError(rw http.ResponseWriter, req *http.Request) {
+	data := make(map[string]interface{})
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
+	data["statusCode"] = http.StatusForbidden
+	data["statusName"] = "Forbidden"
+	data["description"] = "Logins are not allowed from your current location."
+
+	if toa.isApiRequest(req) {
+		errorPages.WriteBearerError(toa.logger, rw, "insufficient_scope", data)
+		return
+	}
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthorized, rw, req, data, jsHeaders)
+}
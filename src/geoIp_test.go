@@ -0,0 +1,95 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func newGeoIpTest(config *GeoIpConfig) *TraefikOidcAuth {
+	toa := newLoginTest()
+	toa.Config.GeoIp = config
+	toa.GeoIp, _ = geoip.ParseDatabase(strings.NewReader("192.0.2.0/24,DE\n198.51.100.0/24,US\n"))
+
+	return toa
+}
+
+func TestGetCountryPrefersTheHeader(t *testing.T) {
+	toa := newGeoIpTest(&GeoIpConfig{CountryHeader: "CF-IPCountry"})
+
+	req := createBindingRequest("192.0.2.10:1234", "Firefox")
+	if country := toa.getCountry(req); country != "DE" {
+		t.Errorf("Expected the country of the database, but got '%s'", country)
+	}
+
+	req.Header.Set("CF-IPCountry", "at")
+	if country := toa.getCountry(req); country != "AT" {
+		t.Errorf("Expected the country of the header, but got '%s'", country)
+	}
+}
+
+func TestIsCountryAllowed(t *testing.T) {
+	tests := []struct {
+		config   *GeoIpConfig
+		country  string
+		expected bool
+	}{
+		{&GeoIpConfig{}, "", true},
+		{&GeoIpConfig{DeniedCountries: []string{"US"}}, "US", false},
+		{&GeoIpConfig{DeniedCountries: []string{"US"}}, "", true},
+		{&GeoIpConfig{AllowedCountries: []string{"DE", "AT"}}, "AT", true},
+		{&GeoIpConfig{AllowedCountries: []string{"DE", "AT"}}, "", false},
+		{nil, "US", true},
+	}
+
+	for _, test := range tests {
+		if isCountryAllowed(test.config, test.country) != test.expected {
+			t.Errorf("Expected %t for country '%s' with %+v", test.expected, test.country, test.config)
+		}
+	}
+}
+
+func TestLoginFromDeniedCountryIsRejected(t *testing.T) {
+	toa := newGeoIpTest(&GeoIpConfig{DeniedCountries: []string{"US"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.RemoteAddr = "198.51.100.10:1234"
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", rw.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Errorf("Expected a redirect to the provider, but got %d", rw.Code)
+	}
+}
+
+func TestSessionBindingCountry(t *testing.T) {
+	toa := newGeoIpTest(&GeoIpConfig{})
+	toa.Config.SessionBinding = &SessionBindingConfig{ClientIp: "None", Country: true}
+
+	state := &session.SessionState{}
+	toa.bindSession(state, createBindingRequest("192.0.2.10:1234", "Firefox"))
+
+	if state.Country != "DE" {
+		t.Fatalf("Expected the country to be bound, but got '%s'", state.Country)
+	}
+
+	if err := toa.verifySessionBinding(state, createBindingRequest("192.0.2.99:1234", "Firefox")); err != nil {
+		t.Errorf("Expected the session to be accepted, but got %v", err)
+	}
+	if err := toa.verifySessionBinding(state, createBindingRequest("198.51.100.10:1234", "Firefox")); err == nil {
+		t.Error("Expected the session to be rejected in another country")
+	}
+}
@@ -0,0 +1,144 @@
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Database maps ip ranges to ISO 3166-1 alpha-2 country codes.
+// All methods may be called on a nil database, in which case no country is found.
+type Database struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+type contextKey struct{}
+
+// LoadDatabase reads a CSV file with lines of the form "network,country", eg. "192.0.2.0/24,DE".
+// Empty lines, comments starting with # and a header line are skipped. Networks must not overlap.
+func LoadDatabase(filePath string) (*Database, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseDatabase(file)
+}
+
+// ParseDatabase reads the database in the format described by LoadDatabase.
+func ParseDatabase(reader io.Reader) (*Database, error) {
+	database := &Database{}
+
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid line %d: expected a network and a country", lineNumber)
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			// The first line may be a header, eg. "network,country"
+			if lineNumber == 1 {
+				continue
+			}
+
+			return nil, fmt.Errorf("invalid network on line %d: %s", lineNumber, err.Error())
+		}
+
+		database.ranges = append(database.ranges, ipRange{
+			start:   network.IP.To16(),
+			end:     lastAddress(network),
+			country: strings.ToUpper(strings.Trim(strings.TrimSpace(fields[1]), "\"")),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(database.ranges, func(i, j int) bool {
+		return bytes.Compare(database.ranges[i].start, database.ranges[j].start) < 0
+	})
+
+	return database, nil
+}
+
+// Lookup returns the country of the ip, or an empty string if it is unknown.
+func (database *Database) Lookup(ip net.IP) string {
+	if database == nil || ip == nil {
+		return ""
+	}
+
+	ip = ip.To16()
+
+	// Find the last range starting before or at the ip
+	index := sort.Search(len(database.ranges), func(i int) bool {
+		return bytes.Compare(database.ranges[i].start, ip) > 0
+	}) - 1
+
+	if index < 0 || bytes.Compare(ip, database.ranges[index].end) > 0 {
+		return ""
+	}
+
+	return database.ranges[index].country
+}
+
+// Len returns the number of networks in the database.
+func (database *Database) Len() int {
+	if database == nil {
+		return 0
+	}
+
+	return len(database.ranges)
+}
+
+// WithCountry attaches the country of the client to the context of a request.
+func WithCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, contextKey{}, country)
+}
+
+// CountryFromContext returns the country attached by WithCountry, or an empty string.
+func CountryFromContext(ctx context.Context) string {
+	country, _ := ctx.Value(contextKey{}).(string)
+	return country
+}
+
+func lastAddress(network *net.IPNet) net.IP {
+	start := network.IP.To16()
+	mask := network.Mask
+
+	// Masks of IPv4 networks only cover the last 4 bytes of the 16 byte representation
+	offset := len(start) - len(mask)
+
+	end := make(net.IP, len(start))
+	copy(end, start)
+
+	for i := range mask {
+		end[offset+i] |= ^mask[i]
+	}
+
+	return end
+}
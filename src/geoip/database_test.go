@@ -0,0 +1,61 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDatabaseLookup(t *testing.T) {
+	database, err := ParseDatabase(strings.NewReader(`network,country
+# Documentation ranges
+192.0.2.0/24,DE
+198.51.100.0/25,at
+2001:db8::/32,CH
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"192.0.2.1":        "DE",
+		"192.0.2.255":      "DE",
+		"192.0.3.0":        "",
+		"198.51.100.127":   "AT",
+		"198.51.100.128":   "",
+		"2001:db8::1":      "CH",
+		"2001:db9::1":      "",
+		"203.0.113.1":      "",
+		"::ffff:192.0.2.7": "DE",
+	}
+
+	for ip, expected := range tests {
+		if country := database.Lookup(net.ParseIP(ip)); country != expected {
+			t.Errorf("Expected '%s' for %s, but got '%s'", expected, ip, country)
+		}
+	}
+}
+
+func TestParseDatabaseRejectsInvalidLines(t *testing.T) {
+	if _, err := ParseDatabase(strings.NewReader("192.0.2.0/24,DE\nnot-a-network,AT\n")); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestNilDatabaseFindsNothing(t *testing.T) {
+	var database *Database
+
+	if database.Lookup(net.ParseIP("192.0.2.1")) != "" || database.Len() != 0 {
+		t.Error("Expected a nil database to find nothing")
+	}
+}
+
+func TestCountryContext(t *testing.T) {
+	if CountryFromContext(context.Background()) != "" {
+		t.Error("Expected no country")
+	}
+	if CountryFromContext(WithCountry(context.Background(), "DE")) != "DE" {
+		t.Error("Expected the country of the context")
+	}
+}
@@ -0,0 +1,119 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+const (
+	healthStatusUp   = "up"
+	healthStatusDown = "down"
+)
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Status string `json:"status"`
+	State  string `json:"state,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleHealth reports that the middleware is alive. It doesn't depend on the identity provider.
+// The state of the circuit breaker is included for information only.
+func (toa *TraefikOidcAuth) handleHealth(rw http.ResponseWriter, req *http.Request) {
+	response := &healthResponse{Status: healthStatusUp}
+
+	if toa.CircuitBreaker != nil {
+		response.Checks = map[string]healthCheck{
+			"circuit_breaker": {Status: healthStatusUp, State: toa.CircuitBreaker.State()},
+		}
+	}
+
+	writeHealthResponse(rw, response)
+}
+
+// handleReady reports whether the middleware is able to authenticate users:
+// The discovery document must be fetched, the JWKS must be loaded and the session store must be reachable.
+func (toa *TraefikOidcAuth) handleReady(rw http.ResponseWriter, req *http.Request) {
+	response := &healthResponse{
+		Status: healthStatusUp,
+		Checks: map[string]healthCheck{},
+	}
+
+	addCheck := func(name string, err error) {
+		if err != nil {
+			toa.logger.Log(logging.LevelWarn, "Readiness check %s failed: %s", name, err.Error())
+
+			response.Status = healthStatusDown
+			response.Checks[name] = healthCheck{Status: healthStatusDown, Error: err.Error()}
+		} else {
+			response.Checks[name] = healthCheck{Status: healthStatusUp}
+		}
+	}
+
+	discoveryErr := toa.EnsureOidcDiscovery(req.Context())
+	addCheck("discovery", discoveryErr)
+
+	if discoveryErr != nil {
+		addCheck("jwks", errors.New("the discovery document is not available"))
+	} else {
+		addCheck("jwks", toa.checkJwksLoaded(req.Context()))
+	}
+
+	// Sessions are stored in encrypted cookies, so the store is always reachable.
+	addCheck("session_store", nil)
+
+	// An open circuit breaker only makes the middleware unready, if requests are rejected while it is open.
+	if toa.CircuitBreaker != nil {
+		state := toa.CircuitBreaker.State()
+
+		if state != circuitClosed && toa.Config.CircuitBreaker.Fallback == circuitFallbackFailClosed {
+			addCheck("circuit_breaker", errors.New("the circuit breaker of the provider is open"))
+		} else {
+			addCheck("circuit_breaker", nil)
+		}
+
+		check := response.Checks["circuit_breaker"]
+		check.State = state
+		response.Checks["circuit_breaker"] = check
+	}
+
+	writeHealthResponse(rw, response)
+}
+
+func (toa *TraefikOidcAuth) checkJwksLoaded(ctx context.Context) error {
+	if err := toa.Jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, false); err != nil {
+		return err
+	}
+
+	toa.Jwks.Lock.RLock()
+	defer toa.Jwks.Lock.RUnlock()
+
+	if len(toa.Jwks.RsaKeys) == 0 && len(toa.Jwks.EcdsaKeys) == 0 {
+		return errors.New("the JWKS doesn't contain any supported keys")
+	}
+
+	return nil
+}
+
+func writeHealthResponse(rw http.ResponseWriter, response *healthResponse) {
+	body, _ := json.Marshal(response)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if response.Status == healthStatusUp {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,72 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHealthEndpointIsAlwaysUp(t *testing.T) {
+	toa := newTestOidcAuth(&Config{HealthUri: "/oidc/health"})
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/health", nil))
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", rw.Code)
+	}
+}
+
+func TestReadyEndpointReportsProviderState(t *testing.T) {
+	jwksAvailable := false
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		if !jwksAvailable {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"keys":[{"kid":"key","kty":"RSA","use":"sig","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw","e":"AQAB"}]}`))
+	})
+
+	providerUrl, _ := url.Parse(server.URL)
+
+	toa := newTestOidcAuth(&Config{ReadyUri: "/oidc/ready"})
+	toa.ProviderURL = providerUrl
+	toa.httpClient = server.Client()
+
+	ready := func() (int, *healthResponse) {
+		rw := httptest.NewRecorder()
+		toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/ready", nil))
+
+		response := &healthResponse{}
+		if err := json.Unmarshal(rw.Body.Bytes(), response); err != nil {
+			t.Fatalf("Invalid response: %s", err.Error())
+		}
+
+		return rw.Code, response
+	}
+
+	status, response := ready()
+	if status != http.StatusServiceUnavailable || response.Checks["discovery"].Status != healthStatusUp || response.Checks["jwks"].Status != healthStatusDown {
+		t.Errorf("Expected the missing JWKS to be reported, but got %d %v", status, response)
+	}
+
+	jwksAvailable = true
+
+	status, response = ready()
+	if status != http.StatusOK || response.Status != healthStatusUp {
+		t.Errorf("Expected the middleware to be ready, but got %d %v", status, response)
+	}
+}
@@ -0,0 +1,256 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The names of the identity providers. The name is stored in the state and the session,
+// so every session keeps using the provider which issued its tokens.
+const (
+	providerPrimary   = "primary"
+	providerSecondary = "secondary"
+)
+
+// IdentityProvider holds everything needed to talk to a single identity provider.
+type IdentityProvider struct {
+	Name              string
+	DiscoveryDocument *oidc.OidcDiscovery
+	Jwks              *oidc.JwksHandler
+	ClientId          string
+	ClientSecret      string
+	ValidIssuer       string
+	ValidAudience     string
+}
+
+// SecondaryProvider is a standby identity provider of an active-passive deployment.
+// New logins are sent to it while the discovery or token endpoint of the primary provider is failing.
+// All methods may be called on a nil provider, in which case the primary provider is always used.
+type SecondaryProvider struct {
+	Config *SecondaryProviderConfig
+	Url    *url.URL
+	Jwks   *oidc.JwksHandler
+
+	// Collapses concurrent fetches of the discovery document, while lock guards the fields
+	discoveryFlight    utils.SingleFlight
+	lock               sync.Mutex
+	discoveryDocument  *oidc.OidcDiscovery
+	primaryFailedUntil time.Time
+	active             bool
+}
+
+func CreateSecondaryProvider(config *SecondaryProviderConfig, providerUrl *url.URL) *SecondaryProvider {
+	return &SecondaryProvider{
+		Config: config,
+		Url:    providerUrl,
+		Jwks:   &oidc.JwksHandler{},
+	}
+}
+
+// ensureDiscovery fetches the discovery document of the secondary provider, if it isn't loaded yet.
+func (secondary *SecondaryProvider) ensureDiscovery(ctx context.Context, toa *TraefikOidcAuth) (*oidc.OidcDiscovery, error) {
+	if document := secondary.getDiscoveryDocument(); document != nil {
+		return document, nil
+	}
+
+	result, err, _ := secondary.discoveryFlight.Do("discovery", func() (interface{}, error) {
+		if document := secondary.getDiscoveryDocument(); document != nil {
+			return document, nil
+		}
+
+		toa.logger.Log(logging.LevelInfo, "Getting OIDC discovery document of the secondary provider...")
+
+		// Other requests share the result, so the discovery isn't cancelled with the request which started it
+		document, err := toa.getOidcDiscovery(context.WithoutCancel(ctx), secondary.Url)
+		if err != nil {
+			toa.logger.Log(logging.LevelError, "Error while retrieving the discovery document of the secondary provider: %s", err.Error())
+			return nil, err
+		}
+
+		if err := toa.checkPkceSupport(document); err != nil {
+			toa.logger.Log(logging.LevelError, "Secondary provider: %s", err.Error())
+			return nil, err
+		}
+
+		secondary.Jwks.Url = document.JWKSURI
+
+		secondary.lock.Lock()
+		secondary.discoveryDocument = document
+		secondary.lock.Unlock()
+
+		return document, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*oidc.OidcDiscovery), nil
+}
+
+// getDiscoveryDocument returns the discovery document, or nil if it hasn't been fetched yet.
+func (secondary *SecondaryProvider) getDiscoveryDocument() *oidc.OidcDiscovery {
+	if secondary == nil {
+		return nil
+	}
+
+	secondary.lock.Lock()
+	defer secondary.lock.Unlock()
+
+	return secondary.discoveryDocument
+}
+
+// markPrimaryFailing sends new logins to the secondary provider until FailbackAfter has passed.
+func (secondary *SecondaryProvider) markPrimaryFailing() {
+	if secondary == nil {
+		return
+	}
+
+	secondary.lock.Lock()
+	secondary.primaryFailedUntil = time.Now().Add(time.Duration(secondary.Config.FailbackAfter * float64(time.Second)))
+	secondary.lock.Unlock()
+}
+
+func (secondary *SecondaryProvider) isPrimaryFailing() bool {
+	if secondary == nil {
+		return false
+	}
+
+	secondary.lock.Lock()
+	defer secondary.lock.Unlock()
+
+	return time.Now().Before(secondary.primaryFailedUntil)
+}
+
+// setActive records whether new logins are currently sent to the secondary provider.
+// It returns true, if this changed.
+func (secondary *SecondaryProvider) setActive(active bool) bool {
+	if secondary == nil {
+		return false
+	}
+
+	secondary.lock.Lock()
+	defer secondary.lock.Unlock()
+
+	changed := secondary.active != active
+	secondary.active = active
+
+	return changed
+}
+
+// getProvider returns the provider with the given name. Unknown names, eg. of sessions created
+// before a secondary provider was configured, refer to the primary provider.
+// An error is returned, if the discovery document of the provider is not available.
+func (toa *TraefikOidcAuth) getProvider(ctx context.Context, name string) (*IdentityProvider, error) {
+	if name == providerSecondary && toa.SecondaryProvider != nil {
+		secondary := toa.SecondaryProvider
+
+		document, err := secondary.ensureDiscovery(ctx, toa)
+		if err != nil {
+			return nil, err
+		}
+
+		provider := &IdentityProvider{
+			Name:              providerSecondary,
+			DiscoveryDocument: document,
+			Jwks:              secondary.Jwks,
+			ClientId:          secondary.Config.ClientId,
+			ClientSecret:      secondary.Config.ClientSecret,
+			ValidIssuer:       secondary.Config.ValidIssuer,
+			ValidAudience:     secondary.Config.ClientId,
+		}
+
+		// The same client is registered at both providers by default
+		if provider.ClientId == "" {
+			provider.ClientId = toa.Config.Provider.ClientId
+			provider.ClientSecret = toa.getClientSecret()
+			provider.ValidAudience = toa.Config.Provider.ValidAudience
+		}
+		if provider.ValidIssuer == "" {
+			provider.ValidIssuer = document.Issuer
+		}
+
+		return provider, nil
+	}
+
+	if toa.DiscoveryDocument == nil {
+		return nil, fmt.Errorf("%w: the discovery document of the provider is not loaded", ErrProviderUnavailable)
+	}
+
+	return toa.primaryProvider(), nil
+}
+
+func (toa *TraefikOidcAuth) primaryProvider() *IdentityProvider {
+	return &IdentityProvider{
+		Name:              providerPrimary,
+		DiscoveryDocument: toa.DiscoveryDocument,
+		Jwks:              toa.Jwks,
+		ClientId:          toa.Config.Provider.ClientId,
+		ClientSecret:      toa.getClientSecret(),
+		ValidIssuer:       toa.Config.Provider.ValidIssuer,
+		ValidAudience:     toa.Config.Provider.ValidAudience,
+	}
+}
+
+// selectProvider returns the provider to be used for a new login.
+// This is the primary provider, unless it is failing and a secondary provider is configured.
+func (toa *TraefikOidcAuth) selectProvider(ctx context.Context) (*IdentityProvider, error) {
+	primaryErr := toa.EnsureOidcDiscovery(ctx)
+
+	if toa.SecondaryProvider == nil {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+
+		return toa.primaryProvider(), nil
+	}
+
+	if primaryErr != nil || toa.CircuitBreaker.IsOpen() || toa.SecondaryProvider.isPrimaryFailing() {
+		provider, err := toa.getProvider(ctx, providerSecondary)
+		if err == nil {
+			toa.recordFailover(providerSecondary)
+			return provider, nil
+		}
+
+		// Try the primary provider anyway, as long as its discovery document is available
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+	}
+
+	toa.recordFailover(providerPrimary)
+	return toa.primaryProvider(), nil
+}
+
+// recordFailover logs and records when new logins are switched to the given provider.
+func (toa *TraefikOidcAuth) recordFailover(target string) {
+	if !toa.SecondaryProvider.setActive(target == providerSecondary) {
+		return
+	}
+
+	if target == providerSecondary {
+		toa.logger.Log(logging.LevelWarn, "The primary provider is failing. Sending new logins to the secondary provider.")
+	} else {
+		toa.logger.Log(logging.LevelInfo, "The primary provider is available again. Sending new logins to the primary provider.")
+	}
+
+	toa.Metrics.RecordProviderFailover(target)
+	toa.Webhook.Emit(webhookEventProviderFailover, map[string]interface{}{
+		"provider": target,
+	})
+}
+
+// recordProviderError remembers when a request to the token endpoint of the primary provider failed,
+// because the provider is unavailable.
+func (toa *TraefikOidcAuth) recordProviderError(provider *IdentityProvider, err error) {
+	if provider.Name == providerPrimary && errors.Is(err, ErrProviderUnavailable) {
+		toa.SecondaryProvider.markPrimaryFailing()
+	}
+}
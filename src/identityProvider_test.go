@@ -0,0 +1,168 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func newDiscoveryServer(t *testing.T, available *bool) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(&oidc.OidcDiscovery{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/authorize",
+			TokenEndpoint:         server.URL + "/token",
+			JWKSURI:               server.URL + "/jwks",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newSecondaryProviderTest(t *testing.T, primaryAvailable *bool) (*TraefikOidcAuth, *httptest.Server) {
+	secondaryAvailable := true
+	primary := newDiscoveryServer(t, primaryAvailable)
+	secondary := newDiscoveryServer(t, &secondaryAvailable)
+
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+	toa.Config.Provider.ClientId = "primary-client"
+	toa.ProviderURL, _ = url.Parse(primary.URL)
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.httpClient = &http.Client{}
+
+	secondaryUrl, _ := url.Parse(secondary.URL)
+	toa.SecondaryProvider = CreateSecondaryProvider(&SecondaryProviderConfig{ClientId: "secondary-client", FailbackAfter: 60}, secondaryUrl)
+
+	return toa, secondary
+}
+
+func TestSelectProviderFailsOverToSecondary(t *testing.T) {
+	primaryAvailable := false
+	toa, secondary := newSecondaryProviderTest(t, &primaryAvailable)
+
+	provider, err := toa.selectProvider(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Name != providerSecondary || provider.ClientId != "secondary-client" || provider.ValidIssuer != secondary.URL {
+		t.Errorf("Expected the secondary provider while the discovery of the primary fails, but got %+v", provider)
+	}
+
+	primaryAvailable = true
+
+	if provider, _ := toa.selectProvider(context.Background()); provider.Name != providerPrimary {
+		t.Errorf("Expected the primary provider once it is available again, but got %s", provider.Name)
+	}
+
+	// A failing token endpoint keeps new logins at the secondary provider until FailbackAfter has passed
+	toa.recordProviderError(toa.primaryProvider(), ErrProviderUnavailable)
+
+	if provider, _ := toa.selectProvider(context.Background()); provider.Name != providerSecondary {
+		t.Errorf("Expected the secondary provider after the token endpoint failed, but got %s", provider.Name)
+	}
+
+	toa.SecondaryProvider.primaryFailedUntil = time.Now().Add(-time.Second)
+
+	if provider, _ := toa.selectProvider(context.Background()); provider.Name != providerPrimary {
+		t.Errorf("Expected to fail back to the primary provider, but got %s", provider.Name)
+	}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	for _, expected := range []string{`target="secondary"} 2`, `target="primary"} 2`} {
+		if !strings.Contains(rw.Body.String(), expected) {
+			t.Errorf("Expected the failovers to be counted with %s, but got:\n%s", expected, rw.Body.String())
+		}
+	}
+}
+
+func TestLoginUsesSecondaryProviderAndRemembersIt(t *testing.T) {
+	primaryAvailable := false
+	toa, secondary := newSecondaryProviderTest(t, &primaryAvailable)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/protected", nil)
+	rw := httptest.NewRecorder()
+
+	authorizationUrl, ok := toa.createAuthorizationUrl(rw, req)
+	if !ok {
+		t.Fatalf("Expected an authorization url, but got status %d", rw.Code)
+	}
+	if !strings.HasPrefix(authorizationUrl, secondary.URL+"/authorize?") || !strings.Contains(authorizationUrl, "client_id=secondary-client") {
+		t.Fatalf("Expected the authorization endpoint of the secondary provider, but got %s", authorizationUrl)
+	}
+
+	parsed, _ := url.Parse(authorizationUrl)
+	state, err := oidc.DecodeState(parsed.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Provider != providerSecondary {
+		t.Errorf("Expected the provider to be stored in the state, but got %q", state.Provider)
+	}
+
+	// Sessions of the secondary provider keep using it, even after the primary is back
+	primaryAvailable = true
+
+	provider, err := toa.getProvider(context.Background(), state.Provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.DiscoveryDocument.TokenEndpoint != secondary.URL+"/token" {
+		t.Errorf("Expected the token endpoint of the secondary provider, but got %s", provider.DiscoveryDocument.TokenEndpoint)
+	}
+}
+
+func TestSecondaryProviderDefaultsToPrimaryClient(t *testing.T) {
+	primaryAvailable := true
+	toa, _ := newSecondaryProviderTest(t, &primaryAvailable)
+	toa.Config.Provider.ClientSecret = "primary-secret"
+	toa.Config.Provider.ValidAudience = "primary-client"
+	toa.SecondaryProvider.Config.ClientId = ""
+
+	provider, err := toa.getProvider(context.Background(), providerSecondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provider.ClientId != "primary-client" || provider.ClientSecret != "primary-secret" || provider.ValidAudience != "primary-client" {
+		t.Errorf("Expected the client of the primary provider, but got %+v", provider)
+	}
+}
+
+func TestDiscoveryIsNotCancelledWithTheRequestWhichStartedIt(t *testing.T) {
+	available := true
+	server := newDiscoveryServer(t, &available)
+	providerUrl, _ := url.Parse(server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := GetOidcDiscovery(ctx, logging.CreateLogger(logging.LevelError), &http.Client{}, providerUrl); err == nil {
+		t.Error("Expected the discovery to honour the cancelled context")
+	}
+
+	toa := newTestOidcAuth(&Config{})
+	toa.ProviderURL = providerUrl
+	toa.httpClient = &http.Client{}
+
+	// The discovery is shared by all waiting requests, so it must not fail because one of them has been cancelled
+	if err := toa.EnsureOidcDiscovery(ctx); err != nil {
+		t.Errorf("Expected the shared discovery to succeed, but got %s", err.Error())
+	}
+}
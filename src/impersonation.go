@@ -0,0 +1,203 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+var errImpersonationForbidden = errors.New("the user is not allowed to impersonate other users")
+
+// errImpersonationConfirmationRequired indicates that the impersonation requested by the query parameter must be confirmed,
+// because a link can be placed on another site to start it on behalf of the user.
+var errImpersonationConfirmationRequired = errors.New("the impersonation must be confirmed")
+
+func (toa *TraefikOidcAuth) isImpersonationRequest(req *http.Request) bool {
+	config := toa.Config.Impersonation
+
+	return config != nil && config.Enabled && config.QueryParameter != "" && req.URL.Path == config.Uri
+}
+
+// hasImpersonationPrivilege checks whether the user may assume the identity of other users.
+func (toa *TraefikOidcAuth) hasImpersonationPrivilege(claims map[string]interface{}) bool {
+	config := toa.Config.Impersonation
+
+	return isAuthorized(toa.logger, &AuthorizationConfig{AssertClaims: config.PrivilegeClaims}, claims)
+}
+
+// applyImpersonation swaps the identity of privileged users with the impersonated user, which is either requested
+// by the query parameter for the rest of the session, or by the header for a single request.
+// Starting an impersonation by the query parameter returns errImpersonationConfirmationRequired, while stopping it
+// takes effect immediately. The query parameter is removed before the request is forwarded.
+// The returned claims only contain the identity of the impersonated user, so privileges of the impersonator don't leak.
+// Returns whether the session has been changed.
+func (toa *TraefikOidcAuth) applyImpersonation(req *http.Request, session *session.SessionState, claims map[string]interface{}) (map[string]interface{}, bool, error) {
+	config := toa.Config.Impersonation
+	if config == nil || !config.Enabled {
+		return claims, false, nil
+	}
+
+	// Never accept the marker from the client
+	req.Header.Del(config.ImpersonatorHeader)
+
+	sessionChanged := false
+	confirmationRequired := false
+	impersonatedUser := session.ImpersonatedUser
+
+	if config.QueryParameter != "" && req.URL.Query().Has(config.QueryParameter) {
+		user := req.URL.Query().Get(config.QueryParameter)
+
+		// Tokens of the AuthorizationHeader or AuthorizationCookie can't remember the impersonation
+		if user != session.ImpersonatedUser && session.Id != "AuthorizationHeader" && session.Id != "AuthorizationCookie" {
+			impersonatedUser = user
+			sessionChanged = user == ""
+			confirmationRequired = user != ""
+		}
+
+		// The confirmation page needs the requested user
+		if !confirmationRequired {
+			removeQueryParameter(req, config.QueryParameter)
+		}
+	}
+
+	requestedUser := impersonatedUser
+	if config.Header != "" {
+		if user := req.Header.Get(config.Header); user != "" {
+			requestedUser = user
+		}
+		req.Header.Del(config.Header)
+	}
+
+	impersonator := fmt.Sprint(claims[config.IdentityClaim])
+
+	if requestedUser == "" {
+		if sessionChanged {
+			toa.logger.Log(logging.LevelInfo, "Impersonation: %s stopped impersonating %s", impersonator, session.ImpersonatedUser)
+			session.ImpersonatedUser = ""
+		}
+		return claims, sessionChanged, nil
+	}
+
+	if !toa.hasImpersonationPrivilege(claims) {
+		toa.logger.Log(logging.LevelWarn, "Impersonation: %s tried to impersonate %s without the privilege", impersonator, requestedUser)
+
+		// The privilege may have been revoked in the meantime
+		sessionChanged = session.ImpersonatedUser != ""
+		session.ImpersonatedUser = ""
+
+		return claims, sessionChanged, errImpersonationForbidden
+	}
+
+	if confirmationRequired {
+		return claims, false, errImpersonationConfirmationRequired
+	}
+	if sessionChanged {
+		session.ImpersonatedUser = impersonatedUser
+	}
+	if requestedUser != session.ImpersonatedUser {
+		toa.logger.Log(logging.LevelInfo, "Impersonation: %s is impersonating %s", impersonator, requestedUser)
+	}
+
+	req.Header.Set(config.ImpersonatorHeader, impersonator)
+	toa.setAccessLogImpersonatedUser(req, requestedUser)
+
+	return map[string]interface{}{
+		config.IdentityClaim: requestedUser,
+		"impersonator":       impersonator,
+	}, sessionChanged, nil
+}
+
+// writeImpersonationConfirmation asks the user to confirm the impersonation requested by the query parameter.
+// The link to confirm it is bound to the session and can only be used once, so it can't be forged by another site.
+func (toa *TraefikOidcAuth) writeImpersonationConfirmation(rw http.ResponseWriter, req *http.Request, session *session.SessionState) {
+	config := toa.Config.Impersonation
+	user := req.URL.Query().Get(config.QueryParameter)
+
+	// Continue on the requested page without starting the impersonation again
+	redirectUrl := *req.URL
+	query := redirectUrl.Query()
+	query.Del(config.QueryParameter)
+	redirectUrl.RawQuery = query.Encode()
+
+	state := oidc.NewState("Impersonate", fmt.Sprintf("%s%s", utils.GetFullHost(req), redirectUrl.RequestURI()))
+	state.SessionId = session.Id
+	state.ImpersonatedUser = user
+
+	stateBase64, err := oidc.EncodeState(state, toa.Config.EncryptionKey(), toa.Config.Cipher)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to serialize state: %s", err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	confirmationUrl := utils.EnsureAbsoluteUrl(req, config.Uri) + "?state=" + url.QueryEscape(stateBase64)
+
+	data := make(map[string]interface{})
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
+	data["statusCode"] = http.StatusForbidden
+	data["statusName"] = "Impersonation"
+	data["description"] = fmt.Sprintf("Do you want to impersonate %s?", user)
+	data["primaryButtonText"] = "Impersonate"
+	data["primaryButtonUrl"] = confirmationUrl
+	data["secondaryButtonText"] = "Cancel"
+	data["secondaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, redirectUrl.RequestURI())
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	errorPages.WriteError(toa.logger, &errorPages.ErrorPageConfig{}, rw, req, data, jsHeaders)
+}
+
+// handleImpersonation starts the confirmed impersonation for the rest of the session and redirects back to the original url.
+func (toa *TraefikOidcAuth) handleImpersonation(rw http.ResponseWriter, req *http.Request, session *session.SessionState, claims map[string]interface{}) {
+	state, err := oidc.DecodeState(req.URL.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil || state.Action != "Impersonate" || state.SessionId != session.Id || state.ImpersonatedUser == "" {
+		toa.logger.Log(logging.LevelWarn, "State on impersonation request is invalid.")
+		http.Error(rw, "State is invalid", http.StatusBadRequest)
+		return
+	}
+
+	stateExpiresAt := time.Unix(state.IssuedAt, 0).Add(time.Duration(toa.Config.StateMaxAge) * time.Second)
+
+	if toa.now().After(stateExpiresAt) || !toa.ConsumedStates.TryConsume(state.Id, stateExpiresAt) {
+		toa.logger.Log(logging.LevelWarn, "State on impersonation request is expired or has already been used.")
+		http.Error(rw, "State is expired", http.StatusBadRequest)
+		return
+	}
+
+	impersonator := fmt.Sprint(claims[toa.Config.Impersonation.IdentityClaim])
+
+	// The privilege may have been revoked since the confirmation page has been shown
+	if !toa.hasImpersonationPrivilege(claims) {
+		toa.logger.Log(logging.LevelWarn, "Impersonation: %s tried to impersonate %s without the privilege", impersonator, state.ImpersonatedUser)
+		toa.handleUnauthorized(rw, req, claims, nil, "")
+		return
+	}
+
+	session.ImpersonatedUser = state.ImpersonatedUser
+
+	toa.logger.Log(logging.LevelInfo, "Impersonation: %s is impersonating %s", impersonator, session.ImpersonatedUser)
+
+	toa.storeSessionAndAttachCookie(session, rw)
+
+	http.Redirect(rw, req, state.RedirectUrl, http.StatusFound)
+}
+
+// removeQueryParameter removes the parameter from the request, so it isn't forwarded upstream.
+func removeQueryParameter(req *http.Request, name string) {
+	query := req.URL.Query()
+	query.Del(name)
+
+	req.URL.RawQuery = query.Encode()
+	req.RequestURI = req.URL.RequestURI()
+}
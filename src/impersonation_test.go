@@ -0,0 +1,200 @@
+package src
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func newImpersonationTest() *TraefikOidcAuth {
+	toa := newTestOidcAuth(&Config{
+		Impersonation: CreateConfig().Impersonation,
+		SessionCookie: CreateConfig().SessionCookie,
+	})
+	toa.Config.Impersonation.Enabled = true
+	toa.ConsumedStates = CreateConsumedStateCache()
+	toa.SessionStorage = session.CreateCookieSessionStorage()
+
+	return toa
+}
+
+var impersonationLinkPattern = regexp.MustCompile(`href="([^"]*/oidc/impersonate[^"]*)"`)
+
+// startImpersonation requests the impersonation using the query parameter and follows the link on the confirmation page.
+func startImpersonation(t *testing.T, toa *TraefikOidcAuth, state *session.SessionState, claims map[string]interface{}, user string) {
+	req := httptest.NewRequest(http.MethodGet, "/page?impersonate="+user+"&tab=1", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	_, changed, err := toa.applyImpersonation(req, state, claims)
+	if err != errImpersonationConfirmationRequired {
+		t.Fatalf("Expected the impersonation to require a confirmation, but got %v", err)
+	}
+	if changed || state.ImpersonatedUser != "" {
+		t.Fatal("Expected the impersonation not to start before it is confirmed")
+	}
+
+	toa.writeImpersonationConfirmation(rw, req, state)
+
+	match := impersonationLinkPattern.FindStringSubmatch(rw.Body.String())
+	if match == nil {
+		t.Fatalf("Expected the page to link to the confirmation url, but got:\n%s", rw.Body.String())
+	}
+
+	link, err := url.Parse(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link must not be usable by another session
+	rw = httptest.NewRecorder()
+	toa.handleImpersonation(rw, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil), &session.SessionState{Id: "other"}, claims)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for another session, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.handleImpersonation(rw, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil), state, claims)
+
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "http://example.com/page?tab=1" {
+		t.Fatalf("Expected a redirect back to the page without the query parameter, but got %d to '%s'", rw.Code, rw.Header().Get("Location"))
+	}
+
+	// The link can only be used once
+	rw = httptest.NewRecorder()
+	toa.handleImpersonation(rw, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil), state, claims)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a used link, but got %d", rw.Code)
+	}
+}
+
+func TestImpersonationSwapsIdentityForTheSession(t *testing.T) {
+	toa := newImpersonationTest()
+
+	state := &session.SessionState{Id: "session"}
+	claims := map[string]interface{}{"sub": "support", "impersonation": true, "groups": []interface{}{"admins"}}
+
+	startImpersonation(t, toa, state, claims, "jane")
+
+	if state.ImpersonatedUser != "jane" {
+		t.Errorf("Expected the session to be marked as impersonated, but got '%s'", state.ImpersonatedUser)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Impersonator", "spoofed")
+
+	impersonated, changed, err := toa.applyImpersonation(req, state, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed {
+		t.Error("Expected the session not to be changed by a continued impersonation")
+	}
+	if impersonated["sub"] != "jane" || impersonated["impersonator"] != "support" {
+		t.Errorf("Expected the identity to be swapped, but got %v", impersonated)
+	}
+	if _, ok := impersonated["groups"]; ok {
+		t.Error("Expected the claims of the impersonator not to be passed on")
+	}
+	if impersonator := req.Header.Get("X-Impersonator"); impersonator != "support" {
+		t.Errorf("Expected the impersonator header to be set, but got '%s'", impersonator)
+	}
+
+	// Stopping the impersonation doesn't require a confirmation and isn't forwarded
+	req = httptest.NewRequest(http.MethodGet, "/page?impersonate=&tab=1", nil)
+
+	impersonated, changed, _ = toa.applyImpersonation(req, state, claims)
+	if !changed || state.ImpersonatedUser != "" || impersonated["sub"] != "support" {
+		t.Errorf("Expected the impersonation to be stopped, but got %v", impersonated)
+	}
+	if req.URL.RequestURI() != "/page?tab=1" || req.RequestURI != "/page?tab=1" {
+		t.Errorf("Expected the query parameter to be removed, but got '%s'", req.URL.RequestURI())
+	}
+}
+
+func TestImpersonationConfirmationRequiresPrivilege(t *testing.T) {
+	toa := newImpersonationTest()
+
+	state := &session.SessionState{Id: "session"}
+	claims := map[string]interface{}{"sub": "user", "impersonation": false}
+
+	_, changed, err := toa.applyImpersonation(httptest.NewRequest(http.MethodGet, "/?impersonate=jane", nil), state, claims)
+
+	if err != errImpersonationForbidden {
+		t.Errorf("Expected the impersonation to be forbidden, but got %v", err)
+	}
+	if changed || state.ImpersonatedUser != "" {
+		t.Error("Expected the session not to be impersonated")
+	}
+}
+
+func TestImpersonationUsingHeader(t *testing.T) {
+	toa := newImpersonationTest()
+
+	state := &session.SessionState{Id: "AuthorizationHeader"}
+	claims := map[string]interface{}{"sub": "support", "impersonation": "true"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Impersonate-User", "jane")
+
+	impersonated, changed, err := toa.applyImpersonation(req, state, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed || state.ImpersonatedUser != "" {
+		t.Error("Expected the header to impersonate for a single request only")
+	}
+	if impersonated["sub"] != "jane" {
+		t.Errorf("Expected the identity to be swapped, but got %v", impersonated)
+	}
+	if req.Header.Get("X-Impersonate-User") != "" {
+		t.Error("Expected the request header to be removed")
+	}
+}
+
+func TestImpersonationRequiresPrivilege(t *testing.T) {
+	toa := newImpersonationTest()
+
+	state := &session.SessionState{Id: "session", ImpersonatedUser: "jane"}
+	claims := map[string]interface{}{"sub": "user", "impersonation": false}
+
+	impersonated, changed, err := toa.applyImpersonation(httptest.NewRequest(http.MethodGet, "/", nil), state, claims)
+
+	if err != errImpersonationForbidden {
+		t.Errorf("Expected the impersonation to be forbidden, but got %v", err)
+	}
+	if !changed || state.ImpersonatedUser != "" {
+		t.Error("Expected the impersonation to be removed from the session")
+	}
+	if impersonated["sub"] != "user" {
+		t.Errorf("Expected the own identity, but got %v", impersonated)
+	}
+}
+
+func TestImpersonatedUserIsAccessLogged(t *testing.T) {
+	toa := newImpersonationTest()
+	toa.Config.AccessLog = &AccessLogConfig{Enabled: true}
+
+	state := &session.SessionState{Id: "session", ImpersonatedUser: "jane"}
+	claims := map[string]interface{}{"sub": "support", "impersonation": true}
+
+	_, req, entry := toa.startAccessLog(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "")
+	toa.setAccessLogSubject(req, claims)
+
+	if _, _, err := toa.applyImpersonation(req, state, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Subject != "support" || entry.ImpersonatedUser != "jane" {
+		t.Errorf("Expected the impersonator and the impersonated user to be logged, but got %s/%s", entry.Subject, entry.ImpersonatedUser)
+	}
+}
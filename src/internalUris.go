@@ -0,0 +1,56 @@
+package src
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+var defaultInternalUris = &InternalUrisConfig{}
+
+func (toa *TraefikOidcAuth) getInternalUris() *InternalUrisConfig {
+	if toa.Config.InternalUris == nil {
+		return defaultInternalUris
+	}
+
+	return toa.Config.InternalUris
+}
+
+func (toa *TraefikOidcAuth) isLoginRequest(req *http.Request) bool {
+	return toa.matchesInternalUri(req, toa.Config.LoginUri)
+}
+
+func (toa *TraefikOidcAuth) isLogoutRequest(req *http.Request) bool {
+	return toa.matchesInternalUri(req, toa.Config.LogoutUri)
+}
+
+// matchesInternalUri checks whether the request targets the internal uri. By default, every request starting
+// with the uri matches, eg. /logout-now for /logout. With ExactMatch, only the path itself matches.
+func (toa *TraefikOidcAuth) matchesInternalUri(req *http.Request, uri string) bool {
+	if uri == "" {
+		return false
+	}
+
+	if toa.getInternalUris().ExactMatch {
+		return req.URL.Path == uri
+	}
+
+	return strings.HasPrefix(req.RequestURI, uri)
+}
+
+// checkInternalUriMethod rejects requests to an internal uri with a method which isn't allowed.
+// All methods are allowed, if none are configured. Returns false, if the request has been rejected.
+func (toa *TraefikOidcAuth) checkInternalUriMethod(rw http.ResponseWriter, req *http.Request, allowedMethods []string) bool {
+	if len(allowedMethods) == 0 || slices.Contains(allowedMethods, req.Method) {
+		return true
+	}
+
+	toa.logger.Log(logging.LevelInfo, "Method %s is not allowed for %s.", req.Method, req.URL.Path)
+
+	rw.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+	return false
+}
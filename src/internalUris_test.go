@@ -0,0 +1,71 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInternalUrisMatchPrefixByDefault(t *testing.T) {
+	toa := newTestOidcAuth(&Config{LoginUri: "/login", LogoutUri: "/logout"})
+
+	tests := map[string]bool{
+		"/logout":          true,
+		"/logout?x=1":      true,
+		"/logout-and-more": true,
+		"/app/logout":      false,
+	}
+
+	for path, expected := range tests {
+		if toa.isLogoutRequest(httptest.NewRequest(http.MethodGet, path, nil)) != expected {
+			t.Errorf("Expected %t for %s", expected, path)
+		}
+	}
+}
+
+func TestInternalUrisExactMatch(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		LoginUri:     "/login",
+		LogoutUri:    "/logout",
+		InternalUris: &InternalUrisConfig{ExactMatch: true},
+	})
+
+	tests := map[string]bool{
+		"/logout":          true,
+		"/logout?x=../":    true,
+		"/logout-and-more": false,
+		"/logout/":         false,
+	}
+
+	for path, expected := range tests {
+		if toa.isLogoutRequest(httptest.NewRequest(http.MethodGet, path, nil)) != expected {
+			t.Errorf("Expected %t for %s", expected, path)
+		}
+	}
+
+	if !toa.isLoginRequest(httptest.NewRequest(http.MethodGet, "/login?redirect_uri=/app", nil)) {
+		t.Error("Expected the login uri with a query to match")
+	}
+	if toa.isLoginRequest(httptest.NewRequest(http.MethodGet, "/login-page", nil)) {
+		t.Error("Expected other paths not to match")
+	}
+}
+
+func TestInternalUriMethodsAreRestricted(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.InternalUris = &InternalUrisConfig{LoginMethods: []string{http.MethodGet}}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/login", nil))
+
+	if rw.Code != http.StatusMethodNotAllowed || rw.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("Expected status 405 with Allow: GET, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/login", nil))
+
+	if rw.Code != http.StatusFound {
+		t.Errorf("Expected a redirect to the provider, but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+const maxIntrospectionCacheEntries = 10000
+
+type introspectionCacheEntry struct {
+	claims    map[string]interface{}
+	expiresAt time.Time
+}
+
+// IntrospectionCache caches successful introspection results of opaque tokens.
+// Tokens are stored by their SHA-256 hash only.
+type IntrospectionCache struct {
+	entries map[string]*introspectionCacheEntry
+	lock    sync.Mutex
+	clock   utils.Clock
+}
+
+func CreateIntrospectionCache(clock utils.Clock) *IntrospectionCache {
+	return &IntrospectionCache{
+		entries: make(map[string]*introspectionCacheEntry),
+		clock:   clock,
+	}
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (cache *IntrospectionCache) Get(token string) (map[string]interface{}, bool) {
+	key := hashToken(token)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if cache.clock.Now().After(entry.expiresAt) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+
+	return entry.claims, true
+}
+
+func (cache *IntrospectionCache) Set(token string, claims map[string]interface{}, ttl time.Duration) {
+	now := cache.clock.Now()
+	expiresAt := now.Add(ttl)
+
+	// Never cache a token beyond it's own expiration
+	if exp, ok := claims["exp"].(float64); ok {
+		tokenExpiresAt := time.Unix(int64(exp), 0)
+		if tokenExpiresAt.Before(expiresAt) {
+			expiresAt = tokenExpiresAt
+		}
+	}
+
+	if !expiresAt.After(now) {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if len(cache.entries) >= maxIntrospectionCacheEntries {
+		cache.removeExpired()
+	}
+	if len(cache.entries) >= maxIntrospectionCacheEntries {
+		// Still full, so just start over instead of growing indefinitely
+		cache.entries = make(map[string]*introspectionCacheEntry)
+	}
+
+	cache.entries[hashToken(token)] = &introspectionCacheEntry{
+		claims:    claims,
+		expiresAt: expiresAt,
+	}
+}
+
+// Len returns the number of entries, including expired ones which haven't been removed yet.
+func (cache *IntrospectionCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.entries)
+}
+
+func (cache *IntrospectionCache) removeExpired() {
+	now := cache.clock.Now()
+
+	for key, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// isJwt checks whether the token is a structurally valid JWT. It does not verify the signature.
+func isJwt(token string) bool {
+	if strings.Count(token, ".") != 2 {
+		return false
+	}
+
+	_, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+
+	return err == nil
+}
+
+func (toa *TraefikOidcAuth) introspectTokenCached(ctx context.Context, provider *IdentityProvider, token string) (bool, map[string]interface{}, error) {
+	ttl := time.Duration(toa.Config.AuthorizationHeader.IntrospectionCacheDuration) * time.Second
+
+	if ttl > 0 {
+		claims, ok := toa.IntrospectionCache.Get(token)
+		toa.Metrics.RecordIntrospectionCacheLookup(ok)
+
+		if ok {
+			toa.logger.Module(logging.ModuleOidc).Log(logging.LevelDebug, "Using cached introspection result.")
+			return true, claims, nil
+		}
+	}
+
+	active, claims, err := toa.introspectToken(ctx, provider, token)
+
+	if active && err == nil && ttl > 0 {
+		toa.IntrospectionCache.Set(token, claims, ttl)
+	}
+
+	return active, claims, err
+}
@@ -0,0 +1,108 @@
+package src
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// TrustedIssuer is an additional token issuer whose JWTs are accepted on the AuthorizationHeader.
+type TrustedIssuer struct {
+	Config *TrustedIssuerConfig
+	Jwks   *oidc.JwksHandler
+
+	lock sync.Mutex
+}
+
+func createTrustedIssuers(configs []TrustedIssuerConfig, clock utils.Clock) []*TrustedIssuer {
+	var issuers []*TrustedIssuer
+
+	for i := range configs {
+		issuers = append(issuers, &TrustedIssuer{
+			Config: &configs[i],
+			Jwks: &oidc.JwksHandler{
+				Url:   configs[i].JwksUri,
+				Clock: clock,
+			},
+		})
+	}
+
+	return issuers
+}
+
+// ensureJwksUrl resolves the JWKS url from the issuer's discovery document if it wasn't configured explicitly.
+func (issuer *TrustedIssuer) ensureJwksUrl(ctx context.Context, toa *TraefikOidcAuth) error {
+	issuer.lock.Lock()
+	defer issuer.lock.Unlock()
+
+	if issuer.Jwks.Url != "" {
+		return nil
+	}
+
+	issuerUrl, err := utils.ParseUrl(issuer.Config.Issuer)
+	if err != nil {
+		return err
+	}
+
+	toa.logger.Module(logging.ModuleOidc).Log(logging.LevelInfo, "Getting OIDC discovery document of trusted issuer %s...", issuer.Config.Issuer)
+
+	discovery, err := toa.getOidcDiscovery(ctx, issuerUrl)
+	if err != nil {
+		return err
+	}
+
+	issuer.Jwks.Url = discovery.JWKSURI
+
+	return nil
+}
+
+// findTrustedIssuer returns the additional trusted issuer matching the (unverified) iss claim of the token, if any.
+func (toa *TraefikOidcAuth) findTrustedIssuer(tokenString string) *TrustedIssuer {
+	if len(toa.TrustedIssuers) == 0 {
+		return nil
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil
+	}
+
+	iss, err := claims.GetIssuer()
+	if err != nil || iss == "" {
+		return nil
+	}
+
+	for _, issuer := range toa.TrustedIssuers {
+		if issuer.Config.Issuer == iss {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+func (toa *TraefikOidcAuth) validateTrustedIssuerToken(ctx context.Context, issuer *TrustedIssuer, tokenString string) (bool, map[string]interface{}, error) {
+	err := issuer.ensureJwksUrl(ctx, toa)
+	if err != nil {
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Failed to resolve JWKS of trusted issuer %s: %s", issuer.Config.Issuer, err.Error())
+		return false, nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(issuer.Config.Issuer),
+	}
+
+	if issuer.Config.Audience != "" {
+		options = append(options, jwt.WithAudience(issuer.Config.Audience))
+	}
+
+	toa.logger.Module(logging.ModuleOidc).Log(logging.LevelDebug, "Validating token of trusted issuer %s.", issuer.Config.Issuer)
+
+	return toa.validateJwt(ctx, issuer.Jwks, tokenString, options)
+}
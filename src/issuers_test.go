@@ -0,0 +1,163 @@
+package src
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func newTrustedIssuerTest(t *testing.T, audience string) (*TraefikOidcAuth, func(claims jwt.MapClaims) string, *httptest.Server) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := &oidc.JwksKeys{
+		Keys: []oidc.JwksKey{{
+			Kid: "machine-kid",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.PublicKey.E)).Bytes()),
+		}},
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+
+	config := &Config{
+		Provider: &ProviderConfig{
+			TokenValidation: "AccessToken",
+		},
+		AuthorizationHeader: &AuthorizationHeaderConfig{
+			Name: "Authorization",
+			TrustedIssuers: []TrustedIssuerConfig{
+				{Issuer: "https://machines.example.com", JwksUri: jwksServer.URL, Audience: audience},
+			},
+		},
+	}
+
+	toa := &TraefikOidcAuth{
+		logger:         logging.CreateLogger(logging.LevelDebug),
+		Config:         config,
+		httpClient:     jwksServer.Client(),
+		Jwks:           &oidc.JwksHandler{},
+		TrustedIssuers: createTrustedIssuers(config.AuthorizationHeader.TrustedIssuers, utils.SystemClock),
+	}
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "machine-kid"
+		signed, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	return toa, sign, jwksServer
+}
+
+func TestTrustedIssuerTokenIsAccepted(t *testing.T) {
+	toa, sign, server := newTrustedIssuerTest(t, "my-api")
+	defer server.Close()
+
+	token := sign(jwt.MapClaims{
+		"iss": "https://machines.example.com",
+		"aud": "my-api",
+		"sub": "service-account",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	ok, claims, err := toa.validateToken(context.Background(), &session.SessionState{Id: "AuthorizationHeader", AccessToken: token})
+
+	if !ok || err != nil {
+		t.Fatalf("Expected token to be valid, but got: %v", err)
+	}
+
+	if claims["sub"] != "service-account" {
+		t.Errorf("Expected sub to be 'service-account', but got '%v'", claims["sub"])
+	}
+}
+
+func TestTrustedIssuerTokenWithWrongAudienceIsRejected(t *testing.T) {
+	toa, sign, server := newTrustedIssuerTest(t, "my-api")
+	defer server.Close()
+
+	token := sign(jwt.MapClaims{
+		"iss": "https://machines.example.com",
+		"aud": "other-api",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	ok, _, err := toa.validateToken(context.Background(), &session.SessionState{Id: "AuthorizationHeader", AccessToken: token})
+
+	if ok || err == nil {
+		t.Fatal("Expected token with a wrong audience to be rejected")
+	}
+}
+
+func TestFindTrustedIssuerIgnoresUnknownIssuers(t *testing.T) {
+	toa, sign, server := newTrustedIssuerTest(t, "")
+	defer server.Close()
+
+	token := sign(jwt.MapClaims{
+		"iss": "https://unknown.example.com",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	if toa.findTrustedIssuer(token) != nil {
+		t.Fatal("Expected no trusted issuer to be found")
+	}
+
+	if toa.findTrustedIssuer("not-a-jwt") != nil {
+		t.Fatal("Expected no trusted issuer to be found for an opaque token")
+	}
+}
+
+func TestTrustedIssuerKeysExpireWithTheClock(t *testing.T) {
+	toa, sign, server := newTrustedIssuerTest(t, "")
+	defer server.Close()
+
+	clock := utils.NewFakeClock(time.Now())
+	toa.Clock = clock
+	toa.TrustedIssuers = createTrustedIssuers(toa.Config.AuthorizationHeader.TrustedIssuers, clock)
+
+	token := sign(jwt.MapClaims{
+		"iss": "https://machines.example.com",
+		"sub": "service-account",
+		"exp": clock.Now().Add(24 * time.Hour).Unix(),
+	})
+
+	if ok, _, err := toa.validateToken(context.Background(), &session.SessionState{Id: "AuthorizationHeader", AccessToken: token}); !ok {
+		t.Fatalf("Expected token to be valid, but got: %v", err)
+	}
+
+	jwks := toa.TrustedIssuers[0].Jwks
+	if !jwks.CacheDate.Equal(clock.Now()) {
+		t.Fatalf("Expected the keys to be cached at %v, but got %v", clock.Now(), jwks.CacheDate)
+	}
+
+	clock.Advance(7 * time.Hour)
+
+	if ok, _, err := toa.validateToken(context.Background(), &session.SessionState{Id: "AuthorizationHeader", AccessToken: token}); !ok {
+		t.Fatalf("Expected token to be valid, but got: %v", err)
+	}
+
+	if !jwks.CacheDate.Equal(clock.Now()) {
+		t.Errorf("Expected the outdated keys to be reloaded at %v, but got %v", clock.Now(), jwks.CacheDate)
+	}
+}
@@ -0,0 +1,258 @@
+package src
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The kinds of keys failures are tracked for.
+const (
+	lockoutKeyIp      = "ip"
+	lockoutKeySubject = "subject"
+)
+
+// The reasons recorded for failed authentication attempts.
+const (
+	lockoutFailureCallback = "callback"
+	lockoutFailureToken    = "token"
+)
+
+type lockoutEntry struct {
+	failures    int
+	firstAt     time.Time
+	lockedUntil time.Time
+}
+
+// Lockout counts failed authentication attempts by an arbitrary key, eg. the client ip,
+// and locks the key for a while when too many attempts failed within the window.
+// All methods may be called on a nil lockout, which never locks.
+type Lockout struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	clock       utils.Clock
+
+	entries     map[string]*lockoutEntry
+	lastCleanup time.Time
+
+	lock sync.Mutex
+}
+
+func CreateLockout(maxFailures int, window time.Duration, duration time.Duration, clock utils.Clock) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		clock:       clock,
+		entries:     make(map[string]*lockoutEntry),
+		lastCleanup: clock.Now(),
+	}
+}
+
+// RecordFailure counts a failed attempt for the key. It returns true, if the key has been locked by this failure.
+func (lockout *Lockout) RecordFailure(key string) bool {
+	if lockout == nil {
+		return false
+	}
+
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	now := lockout.clock.Now()
+
+	lockout.cleanup(now)
+
+	entry, ok := lockout.entries[key]
+	if !ok || now.Sub(entry.firstAt) > lockout.window {
+		// Keep an active lock, but start counting again
+		lockedUntil := time.Time{}
+		if ok {
+			lockedUntil = entry.lockedUntil
+		}
+
+		entry = &lockoutEntry{firstAt: now, lockedUntil: lockedUntil}
+		lockout.entries[key] = entry
+	}
+
+	entry.failures++
+
+	if entry.failures < lockout.maxFailures || now.Before(entry.lockedUntil) {
+		return false
+	}
+
+	entry.lockedUntil = now.Add(lockout.duration)
+
+	return true
+}
+
+// IsLocked returns whether the key is locked and the duration after which the lock ends.
+func (lockout *Lockout) IsLocked(key string) (bool, time.Duration) {
+	if lockout == nil {
+		return false, 0
+	}
+
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	entry, ok := lockout.entries[key]
+	if !ok {
+		return false, 0
+	}
+
+	remaining := entry.lockedUntil.Sub(lockout.clock.Now())
+	if remaining <= 0 {
+		return false, 0
+	}
+
+	return true, remaining
+}
+
+// Reset forgets all failures and an active lock of the key.
+func (lockout *Lockout) Reset(key string) {
+	if lockout == nil {
+		return
+	}
+
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	delete(lockout.entries, key)
+}
+
+// Len returns the number of tracked keys, including expired ones which haven't been removed yet.
+func (lockout *Lockout) Len() int {
+	if lockout == nil {
+		return 0
+	}
+
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	return len(lockout.entries)
+}
+
+// cleanup removes all entries, which are neither locked nor within the window anymore.
+func (lockout *Lockout) cleanup(now time.Time) {
+	if now.Sub(lockout.lastCleanup) < time.Minute {
+		return
+	}
+
+	lockout.lastCleanup = now
+
+	for key, entry := range lockout.entries {
+		if now.Sub(entry.firstAt) > lockout.window && !now.Before(entry.lockedUntil) {
+			delete(lockout.entries, key)
+		}
+	}
+}
+
+// recordAuthenticationFailure counts a failed callback or an invalid token for the client ip and, if known, the subject.
+// The subject must be taken from a token with a verified signature, see getVerifiedSubject.
+func (toa *TraefikOidcAuth) recordAuthenticationFailure(req *http.Request, reason string, subject string) {
+	clientIp := utils.GetClientIp(req)
+
+	toa.Webhook.Emit(webhookEventAuthenticationFailed, map[string]interface{}{
+		"reason":    reason,
+		"client_ip": clientIp,
+		"sub":       subject,
+	})
+
+	if toa.Lockout == nil {
+		return
+	}
+
+	toa.Metrics.RecordLockoutFailure(reason)
+
+	if toa.Lockout.RecordFailure(lockoutKeyIp + ":" + clientIp) {
+		toa.logger.Log(logging.LevelWarn, "Locked out client %s for %d seconds after %d failed authentication attempts.", clientIp, toa.Config.Lockout.Duration, toa.Config.Lockout.MaxFailures)
+		toa.Metrics.RecordLockout(lockoutKeyIp)
+		toa.Webhook.Emit(webhookEventLockout, map[string]interface{}{
+			"key":       lockoutKeyIp,
+			"client_ip": clientIp,
+			"duration":  toa.Config.Lockout.Duration,
+		})
+	}
+
+	if subject != "" && toa.Lockout.RecordFailure(lockoutKeySubject+":"+subject) {
+		toa.logger.Log(logging.LevelWarn, "Requiring a new login of subject '%s' for %d seconds after %d failed authentication attempts.", subject, toa.Config.Lockout.Duration, toa.Config.Lockout.MaxFailures)
+		toa.Metrics.RecordLockout(lockoutKeySubject)
+		toa.Webhook.Emit(webhookEventLockout, map[string]interface{}{
+			"key":       lockoutKeySubject,
+			"client_ip": clientIp,
+			"sub":       subject,
+			"duration":  toa.Config.Lockout.Duration,
+		})
+	}
+}
+
+// checkLockout returns false and writes a 429 response, if the client ip is locked out.
+func (toa *TraefikOidcAuth) checkLockout(rw http.ResponseWriter, req *http.Request) bool {
+	if toa.Lockout == nil {
+		return true
+	}
+
+	clientIp := utils.GetClientIp(req)
+
+	locked, retryAfter := toa.Lockout.IsLocked(lockoutKeyIp + ":" + clientIp)
+	if !locked {
+		return true
+	}
+
+	toa.logger.Log(logging.LevelInfo, "Rejected a request of locked out client %s to %s.", clientIp, req.URL.Path)
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+	return false
+}
+
+// isSubjectLockedOut checks whether the subject has to log in again, because of too many failed attempts.
+func (toa *TraefikOidcAuth) isSubjectLockedOut(subject string) bool {
+	if subject == "" {
+		return false
+	}
+
+	locked, _ := toa.Lockout.IsLocked(lockoutKeySubject + ":" + subject)
+
+	return locked
+}
+
+// getVerifiedSubject returns the subject of a rejected token, if its signature has been verified.
+// Anyone can put any subject into a forged token, so failures of those are only counted for the client ip.
+func getVerifiedSubject(err error) string {
+	var rejected *rejectedTokenError
+	if errors.As(err, &rejected) {
+		return rejected.subject
+	}
+
+	return ""
+}
+
+// hasExternalToken checks whether the request carries a token in the AuthorizationHeader or AuthorizationCookie.
+func (toa *TraefikOidcAuth) hasExternalToken(req *http.Request) bool {
+	if toa.Config.AuthorizationHeader != nil && toa.Config.AuthorizationHeader.Name != "" && req.Header.Get(toa.Config.AuthorizationHeader.Name) != "" {
+		return true
+	}
+
+	if toa.Config.AuthorizationCookie != nil && toa.Config.AuthorizationCookie.Name != "" {
+		if cookie, err := req.Cookie(toa.Config.AuthorizationCookie.Name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCountedTokenFailure checks whether a failed token validation counts towards the lockout.
+// Expired tokens are sent by legitimate clients as well and an unavailable provider isn't the client's fault.
+func isCountedTokenFailure(err error) bool {
+	return !errors.Is(err, jwt.ErrTokenExpired) && !errors.Is(err, ErrProviderUnavailable)
+}
@@ -0,0 +1,160 @@
+package src
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestLockoutLocksAfterMaxFailures(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1700000000, 0))
+	lockout := CreateLockout(3, time.Minute, 10*time.Minute, clock)
+
+	for i := 0; i < 2; i++ {
+		if lockout.RecordFailure("ip:192.0.2.1") {
+			t.Fatalf("Expected failure %d not to lock", i+1)
+		}
+	}
+	if !lockout.RecordFailure("ip:192.0.2.1") {
+		t.Fatal("Expected the third failure to lock")
+	}
+
+	if locked, remaining := lockout.IsLocked("ip:192.0.2.1"); !locked || remaining != 10*time.Minute {
+		t.Errorf("Expected the key to be locked for 10 minutes, but got %t and %v", locked, remaining)
+	}
+	if locked, _ := lockout.IsLocked("ip:192.0.2.2"); locked {
+		t.Error("Expected other keys not to be locked")
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	if locked, _ := lockout.IsLocked("ip:192.0.2.1"); locked {
+		t.Error("Expected the lock to end after the duration")
+	}
+}
+
+func TestLockoutOnlyCountsFailuresWithinTheWindow(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1700000000, 0))
+	lockout := CreateLockout(2, time.Minute, 10*time.Minute, clock)
+
+	lockout.RecordFailure("sub:alice")
+	clock.Advance(2 * time.Minute)
+
+	if lockout.RecordFailure("sub:alice") {
+		t.Error("Expected the failure outside of the window not to be counted")
+	}
+
+	lockout.Reset("sub:alice")
+	if lockout.Len() != 0 {
+		t.Errorf("Expected the key to be removed, but got %d entries", lockout.Len())
+	}
+}
+
+func TestInvalidCallbacksLockOutTheClient(t *testing.T) {
+	toa := newLoginTest()
+	toa.ConsumedStates = CreateConsumedStateCache()
+	toa.Config.Lockout = &LockoutConfig{Enabled: true, MaxFailures: 2, Window: 60, Duration: 600}
+	toa.Lockout = CreateLockout(2, time.Minute, 10*time.Minute, utils.SystemClock)
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/callback?code=abc&state=invalid", nil))
+
+		if rw.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected the invalid state to be rejected, but got %d", rw.Code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/login", nil))
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "600" {
+		t.Errorf("Expected Retry-After to be 600, but got '%s'", rw.Header().Get("Retry-After"))
+	}
+}
+
+func TestRestartedLoginKeepsTheRedirectUrl(t *testing.T) {
+	toa := newLoginTest()
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=abc&keep=1", nil)
+	rw := httptest.NewRecorder()
+
+	authorizationUrl, ok := toa.createAuthorizationUrlWithParameters(rw, req, &loginParameters{
+		Prompt:      "login",
+		redirectUrl: "https://app.example.com/dashboard?tab=2",
+	})
+	if !ok {
+		t.Fatalf("Expected an authorization url, but got status %d", rw.Code)
+	}
+
+	parsed, _ := url.Parse(authorizationUrl)
+	if parsed.Query().Get("prompt") != "login" {
+		t.Errorf("Expected prompt=login, but got %s", authorizationUrl)
+	}
+
+	state, err := oidc.DecodeState(parsed.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RedirectUrl != "https://app.example.com/dashboard?tab=2" || !state.PromptLogin {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+}
+
+func TestGetVerifiedSubject(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgingKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	sign := func(key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": "alice",
+			"aud": "another-client",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	options := []jwt.ParserOption{jwt.WithAudience("client")}
+
+	_, _, err = toa.validateJwt(context.Background(), toa.Jwks, sign(privateKey), options)
+	if subject := getVerifiedSubject(err); subject != "alice" {
+		t.Errorf("Expected the subject of the token for another audience, but got '%s' from %v", subject, err)
+	}
+	if !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("Expected the original error to be kept, but got %v", err)
+	}
+
+	_, _, err = toa.validateJwt(context.Background(), toa.Jwks, sign(forgingKey), options)
+	if subject := getVerifiedSubject(err); subject != "" {
+		t.Errorf("Expected no subject for a forged token, but got '%s'", subject)
+	}
+}
@@ -0,0 +1,185 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// Traefik creates the middlewares again whenever its configuration changes and multiple middlewares may use
+// the same destination. They share a single sink, so a file isn't rotated by multiple writers and no
+// connections are leaked. A sink is shut down, once the last middleware using it has been shut down.
+var sharedLogSinks = make(map[string]*sharedLogSink)
+var sharedLogSinksLock sync.Mutex
+
+type sharedLogSink struct {
+	sink       logging.Sink
+	references int
+}
+
+func getSharedLogSink(key string, create func() (logging.Sink, error)) (logging.Sink, error) {
+	sharedLogSinksLock.Lock()
+	defer sharedLogSinksLock.Unlock()
+
+	if shared, ok := sharedLogSinks[key]; ok {
+		shared.references++
+		return shared.sink, nil
+	}
+
+	sink, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedLogSinks[key] = &sharedLogSink{sink: sink, references: 1}
+
+	return sink, nil
+}
+
+// releaseLogSinks releases the sinks of a middleware, which is shut down. Sinks which aren't used by
+// another middleware send their queued lines and are closed.
+func releaseLogSinks(ctx context.Context, keys []string) error {
+	var unused []logging.Sink
+
+	sharedLogSinksLock.Lock()
+	for _, key := range keys {
+		shared, ok := sharedLogSinks[key]
+		if !ok {
+			continue
+		}
+
+		shared.references--
+		if shared.references <= 0 {
+			delete(sharedLogSinks, key)
+			unused = append(unused, shared.sink)
+		}
+	}
+	sharedLogSinksLock.Unlock()
+
+	var errs []error
+	for _, sink := range unused {
+		errs = append(errs, sink.Shutdown(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+func expandLogOutputConfig(config *LogOutputConfig) {
+	if config.File != nil {
+		config.File.Path = utils.ExpandEnvironmentVariableString(config.File.Path)
+	}
+	if config.Syslog != nil {
+		config.Syslog.Address = utils.ExpandEnvironmentVariableString(config.Syslog.Address)
+	}
+	if config.Http != nil {
+		config.Http.Url = utils.ExpandEnvironmentVariableString(config.Http.Url)
+
+		for name, value := range config.Http.Headers {
+			config.Http.Headers[name] = utils.ExpandEnvironmentVariableString(value)
+		}
+	}
+}
+
+// createLogSinks creates the sinks of all configured destinations. A destination without a path,
+// address or url is disabled. The keys of the sinks must be released using releaseLogSinks.
+func createLogSinks(config *LogOutputConfig) ([]logging.Sink, []string, error) {
+	var sinks []logging.Sink
+	var keys []string
+
+	if config.File != nil && config.File.Path != "" {
+		if config.File.MaxSize < 0 || config.File.MaxBackups < 0 {
+			return nil, keys, errors.New("LogOutput.File.MaxSize and MaxBackups must not be negative")
+		}
+
+		file := config.File
+		key := "file:" + file.Path
+		sink, err := getSharedLogSink(key, func() (logging.Sink, error) {
+			return logging.CreateFileSink(file.Path, int64(file.MaxSize)*1024*1024, file.MaxBackups)
+		})
+		if err != nil {
+			return nil, keys, fmt.Errorf("unable to open the log file: %w", err)
+		}
+
+		sinks = append(sinks, sink)
+		keys = append(keys, key)
+	}
+
+	if config.Syslog != nil && config.Syslog.Address != "" {
+		syslog := config.Syslog
+		key := "syslog:" + syslog.Network + ":" + syslog.Address + ":" + syslog.Tag
+		sink, err := getSharedLogSink(key, func() (logging.Sink, error) {
+			return logging.CreateSyslogSink(syslog.Network, syslog.Address, syslog.Tag)
+		})
+		if err != nil {
+			return nil, keys, err
+		}
+
+		sinks = append(sinks, sink)
+		keys = append(keys, key)
+	}
+
+	if config.Http != nil && config.Http.Url != "" {
+		if config.Http.FlushInterval <= 0 {
+			return nil, keys, errors.New("LogOutput.Http.FlushInterval must be greater than 0")
+		}
+
+		http := config.Http
+		key := getHttpLogSinkKey(http)
+		sink, err := getSharedLogSink(key, func() (logging.Sink, error) {
+			return logging.CreateHttpSink(http.Url, http.Headers, time.Duration(http.FlushInterval)*time.Second), nil
+		})
+		if err != nil {
+			return nil, keys, err
+		}
+
+		sinks = append(sinks, sink)
+		keys = append(keys, key)
+	}
+
+	return sinks, keys, nil
+}
+
+func getHttpLogSinkKey(config *LogHttpConfig) string {
+	names := make([]string, 0, len(config.Headers))
+	for name := range config.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(fmt.Sprintf("http:%s:%d", config.Url, config.FlushInterval))
+	for _, name := range names {
+		key.WriteString(":" + name + "=" + config.Headers[name])
+	}
+
+	return key.String()
+}
+
+// applyModuleLogLevels validates the levels of the modules and configures the logger to use them.
+func applyModuleLogLevels(logger *logging.Logger, levels map[string]string) error {
+	for module, level := range levels {
+		level = strings.ToUpper(utils.ExpandEnvironmentVariableString(level))
+		levels[module] = level
+
+		if !slices.Contains(logging.Modules, strings.ToLower(module)) {
+			logger.Log(logging.LevelError, "Invalid module %s in LogLevels. Must be one of %s.", module, strings.Join(logging.Modules, ", "))
+			return errors.New("invalid log module")
+		}
+		if _, ok := logging.LogLevels[level]; !ok {
+			logger.Log(logging.LevelError, "Invalid LogLevels.%s %s. Must be one of DEBUG, INFO, WARN or ERROR.", module, level)
+			return errors.New("invalid log level")
+		}
+	}
+
+	logger.SetModuleLevels(levels)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package src
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestLogSinksAreShared(t *testing.T) {
+	config := CreateConfig().LogOutput
+	config.File.Path = filepath.Join(t.TempDir(), "oidc.log")
+
+	first, firstKeys, err := createLogSinks(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, secondKeys, err := createLogSinks(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != 1 || len(second) != 1 || first[0] != second[0] {
+		t.Errorf("Expected a single shared file sink, but got %v and %v", first, second)
+	}
+
+	// The sink stays open, while another middleware is using it
+	if err := releaseLogSinks(context.Background(), firstKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	third, thirdKeys, _ := createLogSinks(config)
+	if len(third) != 1 || third[0] != first[0] {
+		t.Error("Expected the sink to be shared until it is released by all middlewares")
+	}
+
+	releaseLogSinks(context.Background(), secondKeys)
+	releaseLogSinks(context.Background(), thirdKeys)
+
+	fourth, fourthKeys, _ := createLogSinks(config)
+	defer releaseLogSinks(context.Background(), fourthKeys)
+
+	if len(fourth) != 1 || fourth[0] == first[0] {
+		t.Error("Expected a new sink after the old one has been released by all middlewares")
+	}
+}
+
+func TestLogSinksAreFlushedOnShutdown(t *testing.T) {
+	received := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.LogOutput.Http.Url = server.URL
+	config.LogOutput.Http.FlushInterval = 3600
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := New(ctx, http.NotFoundHandler(), config, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body, `"source":"traefik-oidc-auth"`) {
+			t.Errorf("Expected the queued lines to be sent, but got %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the queued lines to be sent when the context is cancelled")
+	}
+}
+
+func TestLogSinksAreReleasedWhenTheMiddlewareFailsToStart(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.LogOutput.File.Path = filepath.Join(t.TempDir(), "oidc.log")
+	config.Secret = "short"
+
+	if _, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Fatal("Expected the invalid secret to be rejected")
+	}
+
+	sharedLogSinksLock.Lock()
+	defer sharedLogSinksLock.Unlock()
+
+	if shared, ok := sharedLogSinks["file:"+config.LogOutput.File.Path]; ok {
+		t.Errorf("Expected the file sink to be released, but it still has %d references", shared.references)
+	}
+}
+
+func TestInvalidLogOutputIsRejected(t *testing.T) {
+	config := CreateConfig().LogOutput
+	config.Http.Url = "http://localhost:3100/logs"
+	config.Http.FlushInterval = 0
+
+	if _, _, err := createLogSinks(config); err == nil {
+		t.Error("Expected a missing flush interval to be rejected")
+	}
+
+	config = CreateConfig().LogOutput
+	config.Syslog.Address = "localhost:514"
+	config.Syslog.Network = "unix"
+
+	if _, _, err := createLogSinks(config); err == nil {
+		t.Error("Expected an unsupported syslog network to be rejected")
+	}
+
+	if sinks, _, err := createLogSinks(CreateConfig().LogOutput); err != nil || len(sinks) != 0 {
+		t.Errorf("Expected no sinks by default, but got %v, %v", sinks, err)
+	}
+}
+
+func TestInvalidModuleLogLevelsAreRejected(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelError)
+
+	if err := applyModuleLogLevels(logger, map[string]string{"rules": "debug", "oidc": "WARN"}); err != nil {
+		t.Errorf("Expected valid levels to be accepted, but got %v", err)
+	}
+	if err := applyModuleLogLevels(logger, map[string]string{"tokens": "DEBUG"}); err == nil {
+		t.Error("Expected an unknown module to be rejected")
+	}
+	if err := applyModuleLogLevels(logger, map[string]string{"rules": "TRACE"}); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
@@ -13,3 +13,17 @@ var LogLevels = map[string]int{
 	LevelInfo:  3,
 	LevelDebug: 4,
 }
+
+// The modules whose level can be set separately.
+const (
+	// Discovery, token validation, introspection, userinfo and JWKS.
+	ModuleOidc string = "oidc"
+	// Reading, renewing and storing sessions.
+	ModuleSession string = "session"
+	// Evaluation of request rules, eg. the BypassAuthenticationRule.
+	ModuleRules string = "rules"
+	// Evaluation of the claim assertions.
+	ModuleAuthorization string = "authorization"
+)
+
+var Modules = []string{ModuleOidc, ModuleSession, ModuleRules, ModuleAuthorization}
@@ -9,6 +9,15 @@ import (
 
 type Logger struct {
 	MinLevel string
+
+	// Additional destinations of the log lines, eg. a file or a syslog server.
+	sinks      []Sink
+	skipStdout bool
+
+	// The loggers of modules with their own minimum level. See SetModuleLevels.
+	modules map[string]*Logger
+	// Modules write through the logger they belong to, so they share its destinations.
+	parent *Logger
 }
 
 func CreateLogger(minLevel string) *Logger {
@@ -17,15 +26,66 @@ func CreateLogger(minLevel string) *Logger {
 	}
 }
 
+// SetSinks sends all following log lines to the sinks. Stdout can be disabled, so the logs of the middleware
+// aren't mixed with the logs of traefik.
+func (logger *Logger) SetSinks(sinks []Sink, stdout bool) {
+	logger.sinks = sinks
+	logger.skipStdout = !stdout
+}
+
+// SetModuleLevels overrides the minimum level of single modules, eg. to debug the rules only.
+func (logger *Logger) SetModuleLevels(levels map[string]string) {
+	logger.modules = make(map[string]*Logger)
+
+	for module, level := range levels {
+		logger.modules[strings.ToLower(module)] = &Logger{
+			MinLevel: strings.ToUpper(level),
+			parent:   logger,
+		}
+	}
+}
+
+// Module returns the logger of the module, which is the logger itself, if the module has no level of its own.
+func (logger *Logger) Module(module string) *Logger {
+	if moduleLogger, ok := logger.modules[module]; ok {
+		return moduleLogger
+	}
+
+	return logger
+}
+
 func shouldLog(minLevel, level string) bool {
 	return LogLevels[strings.ToUpper(minLevel)] >= LogLevels[strings.ToUpper(level)]
 }
 
+// IsEnabled checks whether lines of the level are logged, eg. to skip computing expensive details.
+func (logger *Logger) IsEnabled(level string) bool {
+	return shouldLog(logger.MinLevel, level)
+}
+
 func (logger *Logger) Log(level string, format string, a ...interface{}) {
 	if !shouldLog(logger.MinLevel, level) {
 		return
 	}
 
-	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	os.Stdout.WriteString(currentTime + " [" + level + "]" + " [traefik-oidc-auth] " + fmt.Sprintf(format, a...) + "\n")
+	output := logger
+	if logger.parent != nil {
+		output = logger.parent
+	}
+
+	output.write(time.Now(), level, fmt.Sprintf(format, a...))
+}
+
+func (logger *Logger) write(now time.Time, level string, message string) {
+	if !logger.skipStdout {
+		os.Stdout.WriteString(formatLine(now, level, message))
+	}
+
+	for _, sink := range logger.sinks {
+		sink.WriteLog(now, level, message)
+	}
+}
+
+func formatLine(timestamp time.Time, level string, message string) string {
+	return timestamp.Format("2006-01-02 15:04:05") + " [" + level + "]" + " [traefik-oidc-auth] " + message + "\n"
 }
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oidc.log")
+
+	sink, err := CreateFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := CreateLogger(LevelWarn)
+	logger.SetSinks([]Sink{sink}, false)
+	logger.SetModuleLevels(map[string]string{"Rules": "debug", ModuleOidc: LevelError})
+
+	logger.Module(ModuleRules).Log(LevelDebug, "rule evaluated")
+	logger.Module(ModuleOidc).Log(LevelWarn, "token expires soon")
+	logger.Module(ModuleSession).Log(LevelWarn, "session warning")
+	logger.Module(ModuleSession).Log(LevelInfo, "session info")
+
+	content, _ := os.ReadFile(path)
+	log := string(content)
+
+	if !strings.Contains(log, "rule evaluated") {
+		t.Error("Expected the debug line of the rules module to be logged")
+	}
+	if strings.Contains(log, "token expires soon") {
+		t.Error("Expected warnings of the oidc module to be hidden")
+	}
+	if !strings.Contains(log, "session warning") || strings.Contains(log, "session info") {
+		t.Error("Expected modules without a level to use the level of the logger")
+	}
+
+	if !logger.Module(ModuleRules).IsEnabled(LevelDebug) || logger.Module(ModuleSession).IsEnabled(LevelDebug) {
+		t.Error("Expected IsEnabled to respect the module levels")
+	}
+}
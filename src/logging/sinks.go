@@ -0,0 +1,369 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives every log line, which passes the minimum level of the logger.
+// Writing must never block a request for long, so network sinks queue the lines and drop them when the queue is full.
+type Sink interface {
+	WriteLog(timestamp time.Time, level string, message string)
+	// Shutdown sends the queued lines and releases the file or connection. Lines written afterwards are dropped.
+	Shutdown(ctx context.Context) error
+}
+
+// sinkStopper stops the background task of a network sink once and waits for it to send the queued lines.
+type sinkStopper struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newSinkStopper() sinkStopper {
+	return sinkStopper{stop: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (stopper *sinkStopper) Shutdown(ctx context.Context) error {
+	stopper.stopOnce.Do(func() { close(stopper.stop) })
+
+	select {
+	case <-stopper.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The number of lines which may be queued by network sinks before new lines are dropped.
+const sinkQueueSize = 4096
+
+// FileSink appends the log lines to a file. When the file exceeds the maximum size, it is renamed to
+// <path>.1, older files are shifted to <path>.2 etc. and the oldest one is removed.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// CreateFileSink opens the file for appending. A maxSize of 0 disables the rotation.
+func CreateFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	sink := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (sink *FileSink) WriteLog(timestamp time.Time, level string, message string) {
+	line := formatLine(timestamp, level, message)
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	if sink.closed {
+		return
+	}
+
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+		sink.rotate()
+	}
+
+	if sink.file == nil {
+		return
+	}
+
+	n, _ := sink.file.WriteString(line)
+	sink.size += int64(n)
+}
+
+func (sink *FileSink) Shutdown(ctx context.Context) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	sink.closed = true
+	if sink.file == nil {
+		return nil
+	}
+
+	err := sink.file.Close()
+	sink.file = nil
+
+	return err
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	sink.file = file
+	sink.size = info.Size()
+
+	return nil
+}
+
+func (sink *FileSink) rotate() {
+	sink.file.Close()
+	sink.file = nil
+
+	if sink.maxBackups > 0 {
+		for i := sink.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", sink.path, i), fmt.Sprintf("%s.%d", sink.path, i+1))
+		}
+
+		_ = os.Rename(sink.path, sink.path+".1")
+	} else {
+		_ = os.Remove(sink.path)
+	}
+
+	// When the file can't be opened again, the lines are dropped until the next rotation is attempted
+	if err := sink.open(); err != nil {
+		os.Stdout.WriteString(formatLine(time.Now(), LevelError, "Unable to open the log file: "+err.Error()))
+	}
+}
+
+// The syslog severities of the log levels, see RFC 5424.
+var syslogSeverities = map[string]int{
+	LevelError: 3,
+	LevelWarn:  4,
+	LevelInfo:  6,
+	LevelDebug: 7,
+}
+
+// The local0 facility, which is meant for local use.
+const syslogFacility = 16
+
+// SyslogSink sends the log lines to a syslog server in the RFC 5424 format using UDP or TCP.
+type SyslogSink struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+
+	lines chan string
+	sinkStopper
+}
+
+func CreateSyslogSink(network string, address string, tag string) (*SyslogSink, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network %s", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	sink := &SyslogSink{
+		network:     network,
+		address:     address,
+		tag:         tag,
+		hostname:    hostname,
+		lines:       make(chan string, sinkQueueSize),
+		sinkStopper: newSinkStopper(),
+	}
+
+	go sink.run()
+
+	return sink, nil
+}
+
+func (sink *SyslogSink) WriteLog(timestamp time.Time, level string, message string) {
+	priority := syslogFacility*8 + syslogSeverities[strings.ToUpper(level)]
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, timestamp.Format(time.RFC3339Nano), sink.hostname, sink.tag, os.Getpid(), message)
+
+	select {
+	case sink.lines <- line:
+	default:
+	}
+}
+
+// run sends the queued lines until the sink is shut down.
+func (sink *SyslogSink) run() {
+	var conn net.Conn
+
+	for {
+		select {
+		case line := <-sink.lines:
+			conn = sink.send(conn, line)
+		case <-sink.stop:
+			for len(sink.lines) > 0 {
+				conn = sink.send(conn, <-sink.lines)
+			}
+
+			if conn != nil {
+				conn.Close()
+			}
+			close(sink.stopped)
+			return
+		}
+	}
+}
+
+// send writes the line and returns the connection to use for the next line. The connection is established again
+// after an error, eg. when the server restarted.
+func (sink *SyslogSink) send(conn net.Conn, line string) net.Conn {
+	if conn == nil {
+		var err error
+		conn, err = net.DialTimeout(sink.network, sink.address, 5*time.Second)
+		if err != nil {
+			return nil
+		}
+	}
+
+	// TCP requires the messages to be framed, see RFC 6587
+	if sink.network == "tcp" {
+		line += "\n"
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(line)); err != nil {
+		conn.Close()
+		return nil
+	}
+
+	return conn
+}
+
+// The maximum number of lines sent in a single request by the HttpSink.
+const httpSinkMaxBatchSize = 500
+
+// HttpSink posts the log lines as newline-delimited JSON to a collector, eg. Loki, Vector or Logstash.
+// The lines are sent in batches, when a batch is full or the flush interval elapsed.
+type HttpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	lines chan []byte
+	sinkStopper
+}
+
+type httpSinkLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+}
+
+func CreateHttpSink(url string, headers map[string]string, flushInterval time.Duration) *HttpSink {
+	sink := &HttpSink{
+		url:         url,
+		headers:     headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		lines:       make(chan []byte, sinkQueueSize),
+		sinkStopper: newSinkStopper(),
+	}
+
+	go sink.run(flushInterval)
+
+	return sink
+}
+
+func (sink *HttpSink) WriteLog(timestamp time.Time, level string, message string) {
+	line, err := json.Marshal(&httpSinkLine{
+		Time:    timestamp.UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: message,
+		Source:  "traefik-oidc-auth",
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case sink.lines <- line:
+	default:
+	}
+}
+
+func (sink *HttpSink) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	count := 0
+
+	flush := func() {
+		if count > 0 {
+			sink.send(batch.Bytes())
+			batch.Reset()
+			count = 0
+		}
+	}
+
+	add := func(line []byte) {
+		batch.Write(line)
+		batch.WriteByte('\n')
+		count++
+
+		if count >= httpSinkMaxBatchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case line := <-sink.lines:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-sink.stop:
+			for len(sink.lines) > 0 {
+				add(<-sink.lines)
+			}
+			flush()
+
+			close(sink.stopped)
+			return
+		}
+	}
+}
+
+// send posts a batch. Failed batches are dropped, as logging the error would only add more lines to send.
+func (sink *HttpSink) send(body []byte) {
+	req, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for name, value := range sink.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	resp.Body.Close()
+}
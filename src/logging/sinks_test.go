@@ -0,0 +1,167 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oidc.log")
+
+	sink, err := CreateFileSink(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line has about 70 bytes, so every line after the first one rotates the file
+	for i := 0; i < 4; i++ {
+		sink.WriteLog(time.Now(), LevelInfo, strings.Repeat("x", 20))
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(content), "\n") != 1 || !strings.Contains(string(content), "[INFO] [traefik-oidc-auth]") {
+			t.Errorf("Expected %s to contain a single line, but got '%s'", name, content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only two backups to be kept, but got %v", err)
+	}
+}
+
+func TestSyslogSinkSendsRfc5424Messages(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := CreateSyslogSink("udp", conn.LocalAddr().String(), "oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.WriteLog(time.Now(), LevelWarn, "Something happened")
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := string(buffer[:n])
+	if !strings.HasPrefix(message, "<132>1 ") || !strings.Contains(message, " oidc ") || !strings.HasSuffix(message, " - - Something happened") {
+		t.Errorf("Expected a local0.warning message, but got '%s'", message)
+	}
+
+	if _, err := CreateSyslogSink("unix", "/dev/log", "oidc"); err == nil {
+		t.Error("Expected unsupported networks to be rejected")
+	}
+}
+
+func TestHttpSinkPostsBatches(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("Unexpected headers %v", req.Header)
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	sink := CreateHttpSink(server.URL, map[string]string{"Authorization": "Bearer token"}, 10*time.Millisecond)
+
+	sink.WriteLog(time.Now(), LevelError, "first")
+	sink.WriteLog(time.Now(), LevelInfo, "second")
+
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for len(lines) < 2 {
+		select {
+		case body := <-bodies:
+			lines = append(lines, strings.Split(strings.TrimSuffix(body, "\n"), "\n")...)
+		case <-timeout:
+			t.Fatalf("Expected two lines to be posted, but got %v", lines)
+		}
+	}
+
+	var line httpSinkLine
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Level != LevelError || line.Message != "first" || line.Time == "" {
+		t.Errorf("Unexpected line %+v", line)
+	}
+}
+
+func TestLoggerWritesToSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oidc.log")
+
+	sink, err := CreateFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := CreateLogger(LevelInfo)
+	logger.SetSinks([]Sink{sink}, false)
+
+	logger.Log(LevelDebug, "hidden")
+	logger.Log(LevelInfo, "Hello %s", "world")
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "hidden") || !strings.Contains(string(content), "Hello world") {
+		t.Errorf("Expected only lines of the minimum level, but got '%s'", content)
+	}
+}
+
+func TestSinksDropLinesAfterShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oidc.log")
+
+	fileSink, err := CreateFileSink(path, 50, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSink.WriteLog(time.Now(), LevelInfo, "before shutdown")
+
+	syslogSink, err := CreateSyslogSink("udp", "127.0.0.1:9", "oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sink := range []Sink{fileSink, syslogSink, CreateHttpSink("http://127.0.0.1:9", nil, time.Hour)} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		if err := sink.Shutdown(ctx); err != nil {
+			t.Errorf("%T: Expected the shutdown to succeed, but got %v", sink, err)
+		}
+
+		// Writing to a stopped sink must neither block nor panic
+		sink.WriteLog(time.Now(), LevelInfo, "after shutdown")
+
+		if err := sink.Shutdown(ctx); err != nil {
+			t.Errorf("%T: Expected the second shutdown to succeed, but got %v", sink, err)
+		}
+
+		cancel()
+	}
+
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("Expected the closed file not to be rotated, but got %v", err)
+	}
+}
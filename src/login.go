@@ -0,0 +1,98 @@
+package src
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The maximum size of the JSON body of a login request.
+const maxLoginBodySize = 16 * 1024
+
+// loginParameters are passed to the login endpoint, either as query parameters or as JSON body of a POST request.
+type loginParameters struct {
+	RedirectUri string `json:"redirect_uri"`
+	Prompt      string `json:"prompt"`
+	LoginHint   string `json:"login_hint"`
+	// The identity provider the user should be sent to by a brokering provider, see IdpHintParameter.
+	IdpHint    string `json:"idp_hint"`
+	RememberMe bool   `json:"remember_me"`
+	Popup      bool   `json:"popup"`
+
+	// The url to return to after the login, which has already been validated, eg. when a login is restarted.
+	redirectUrl string
+	// The scopes to request instead of the configured ones, eg. when additional scopes are required.
+	scopes []string
+}
+
+type loginResponse struct {
+	AuthorizationUrl string `json:"authorization_url"`
+}
+
+// isJsonLoginRequest checks whether the login is started by a POST request with a JSON body.
+// Form posts, eg. with remember_me, are still redirected to the provider.
+func isJsonLoginRequest(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	return mediaType == "application/json"
+}
+
+// getLoginParameters reads the login parameters from the query of the request.
+func (toa *TraefikOidcAuth) getLoginParameters(req *http.Request) *loginParameters {
+	query := req.URL.Query()
+
+	return &loginParameters{
+		RedirectUri: query.Get("redirect_uri"),
+		Prompt:      query.Get("prompt"),
+		LoginHint:   query.Get("login_hint"),
+		IdpHint:     query.Get("idp_hint"),
+		RememberMe:  toa.isRememberMeRequested(req),
+		Popup:       toa.isPopupRequested(req),
+	}
+}
+
+// handleLoginPost starts a login and responds with the authorization url instead of redirecting,
+// so SPAs can initiate the login using fetch and navigate to the provider themselves.
+func (toa *TraefikOidcAuth) handleLoginPost(rw http.ResponseWriter, req *http.Request) {
+	if !toa.checkRateLimit(rw, req, "login") {
+		return
+	}
+
+	parameters := &loginParameters{}
+
+	body, err := toa.readRequestBody(rw, req, maxLoginBodySize)
+	if err != nil {
+		toa.writeBodyError(rw, req, err)
+		return
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, parameters); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Invalid login request: %s", err.Error())
+			http.Error(rw, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	parameters.RememberMe = parameters.RememberMe && toa.Config.RememberMe != nil && toa.Config.RememberMe.Enabled
+	parameters.Popup = parameters.Popup && toa.Config.PopupCallback != nil && toa.Config.PopupCallback.Enabled
+
+	authorizationUrl, ok := toa.createAuthorizationUrlWithParameters(rw, req, parameters)
+	if !ok {
+		return
+	}
+
+	response, _ := json.Marshal(&loginResponse{AuthorizationUrl: authorizationUrl})
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+
+	_, _ = rw.Write(response)
+}
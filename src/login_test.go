@@ -0,0 +1,151 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func newLoginTest() *TraefikOidcAuth {
+	toa := newTestOidcAuth(&Config{
+		LoginUri:                   "/login",
+		ValidPostLoginRedirectUris: []string{"https://app.example.com/*"},
+	})
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{
+		AuthorizationEndpoint: "https://idp.example.com/authorize",
+	}
+
+	return toa
+}
+
+func TestLoginPostReturnsAuthorizationUrl(t *testing.T) {
+	toa := newLoginTest()
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"redirect_uri":"https://app.example.com/dashboard","prompt":"login","login_hint":"jane@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+
+	toa.handleLoginPost(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Location") != "" {
+		t.Error("Expected no redirect")
+	}
+
+	var response loginResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	authorizationUrl, _ := url.Parse(response.AuthorizationUrl)
+	query := authorizationUrl.Query()
+
+	if query.Get("prompt") != "login" || query.Get("login_hint") != "jane@example.com" {
+		t.Errorf("Expected prompt and login_hint to be passed, but got %s", authorizationUrl.RawQuery)
+	}
+
+	state, err := oidc.DecodeState(query.Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RedirectUrl != "https://app.example.com/dashboard" {
+		t.Errorf("Expected the redirect uri to be stored in the state, but got '%s'", state.RedirectUrl)
+	}
+}
+
+func TestOnlyJsonLoginRequestsAreAnsweredWithJson(t *testing.T) {
+	tests := map[string]bool{
+		"application/json":                  true,
+		"application/json; charset=utf-8":   true,
+		"application/x-www-form-urlencoded": false,
+	}
+
+	for contentType, expected := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.Header.Set("Content-Type", contentType)
+
+		if isJsonLoginRequest(req) != expected {
+			t.Errorf("Expected %t for %s", expected, contentType)
+		}
+	}
+
+	if isJsonLoginRequest(httptest.NewRequest(http.MethodGet, "/login", nil)) {
+		t.Error("Expected GET requests to be redirected")
+	}
+}
+
+func TestLoginPostRejectsInvalidRequests(t *testing.T) {
+	tests := map[string]string{
+		"invalid json":         `{"redirect_uri":`,
+		"invalid redirect uri": `{"redirect_uri":"https://evil.example.com/"}`,
+	}
+
+	for name, body := range tests {
+		toa := newLoginTest()
+
+		rw := httptest.NewRecorder()
+		toa.handleLoginPost(rw, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, but got %d", name, rw.Code)
+		}
+	}
+}
+
+func newCallbackErrorRequest(t *testing.T, toa *TraefikOidcAuth, query string) *http.Request {
+	toa.ConsumedStates = CreateConsumedStateCache()
+
+	state, err := oidc.EncodeState(oidc.NewState("Login", "https://app.example.com/dashboard"), toa.Config.EncryptionKey(), toa.Config.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query+"&state="+url.QueryEscape(state), nil)
+	req.Header.Set("Accept", "text/html")
+
+	return req
+}
+
+func TestCallbackShowsDeniedLogin(t *testing.T) {
+	toa := newLoginTest()
+
+	rw := httptest.NewRecorder()
+	toa.handleCallback(rw, newCallbackErrorRequest(t, toa, "error=access_denied&error_description=The+user+cancelled"))
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", rw.Code)
+	}
+	if body := rw.Body.String(); !strings.Contains(body, "access has been denied") || !strings.Contains(body, "https://app.example.com/dashboard") {
+		t.Errorf("Expected the page to explain the denial and offer to try again, but got %s", body)
+	}
+}
+
+func TestCallbackReportsProviderErrorsAsProblemDetails(t *testing.T) {
+	toa := newLoginTest()
+
+	req := newCallbackErrorRequest(t, toa, "error=server_error")
+	req.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+
+	toa.handleCallback(rw, req)
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, but got %d", rw.Code)
+	}
+
+	var problem map[string]interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem["title"] != "Bad Gateway" {
+		t.Errorf("Expected problem details, but got %v", problem)
+	}
+}
@@ -2,24 +2,28 @@ package src
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
 	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
 
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
@@ -36,26 +40,89 @@ type TraefikOidcAuth struct {
 	Jwks                     *oidc.JwksHandler
 	Lock                     sync.RWMutex
 	BypassAuthenticationRule *rules.RequestCondition
+	ApiRouteRule             *rules.RequestCondition
+	TrustedIssuers           []*TrustedIssuer
+	IntrospectionCache       *IntrospectionCache
+	RateLimiter              *RateLimiter
+	ConsumedStates           *ConsumedStateCache
+	TokenCache               *TokenCache
+	ConfigReloader           *ConfigReloader
+	ClientSecretFile         *utils.FileSecret
+	Metrics                  *MetricsCollector
+	Tracer                   *tracing.Tracer
+	CircuitBreaker           *CircuitBreaker
+	RenewalQueue             *RenewalQueue
+	RefreshLimiter           *RefreshLimiter
+	SecondaryProvider        *SecondaryProvider
+	TokenMinter              *TokenMinter
+	JwksPolicy               *oidc.JwksPolicy
+	Clock                    utils.Clock
+	Lockout                  *Lockout
+	GeoIp                    *geoip.Database
+	Webhook                  *WebhookEmitter
+	Provisioner              *Provisioner
+
+	// Collapses concurrent fetches of the discovery document into a single request
+	discoveryFlight utils.SingleFlight
+	discoveredAt    time.Time
+
+	// The networks which are allowed to read the debug endpoint
+	debugNetworks []*net.IPNet
+
+	// Identifies the TLS and proxy settings of the provider client. Instances only share discovery documents
+	// and key sets with instances connecting to the provider the same way.
+	sharedCacheScope string
+
+	// The keys of the shared log sinks, which are released on shutdown
+	logSinks []string
+}
+
+// now returns the current time of the configured clock.
+func (toa *TraefikOidcAuth) now() time.Time {
+	if toa.Clock == nil {
+		return time.Now()
+	}
+
+	return toa.Clock.Now()
 }
 
 // Make sure we fetch oidc discovery document during first request - avoid race condition
 // Perform lock when changing document - we are in concurrent environment
-func (toa *TraefikOidcAuth) EnsureOidcDiscovery() error {
+func (toa *TraefikOidcAuth) EnsureOidcDiscovery(ctx context.Context) error {
 	var config = toa.Config
 	var parsedURL = toa.ProviderURL
 	if toa.DiscoveryDocument == nil {
-		toa.Lock.Lock()
-		defer toa.Lock.Unlock()
-		// check again after lock
-		if toa.DiscoveryDocument == nil {
-			var jwks = &oidc.JwksHandler{}
+		// Requests waiting for the discovery share the result of the request in flight, even if it fails
+		_, err, _ := toa.discoveryFlight.Do("discovery", func() (interface{}, error) {
+			toa.Lock.Lock()
+			defer toa.Lock.Unlock()
+
+			// check again after lock
+			if toa.DiscoveryDocument != nil {
+				return nil, nil
+			}
+
+			var jwks = &oidc.JwksHandler{
+				Policy:      toa.JwksPolicy,
+				OnReload:    toa.Metrics.jwksReloadRecorder("provider"),
+				Shared:      toa.isSharedCacheEnabled(),
+				SharedScope: toa.sharedCacheScope,
+				Clock:       toa.Clock,
+			}
 			toa.Jwks = jwks
-			toa.logger.Log(logging.LevelInfo, "Getting OIDC discovery document...")
+			toa.logger.Module(logging.ModuleOidc).Log(logging.LevelInfo, "Getting OIDC discovery document...")
 
-			oidcDiscoveryDocument, err := GetOidcDiscovery(toa.logger, toa.httpClient, parsedURL)
+			// Other requests share the result, so the discovery isn't cancelled with the request which started it
+			oidcDiscoveryDocument, err := toa.getOidcDiscovery(context.WithoutCancel(ctx), parsedURL)
+			toa.Metrics.RecordDiscovery(err == nil)
 			if err != nil {
-				toa.logger.Log(logging.LevelError, "Error while retrieving discovery document: %s", err.Error())
-				return err
+				toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Error while retrieving discovery document: %s", err.Error())
+				return nil, err
+			}
+
+			if err := toa.checkPkceSupport(oidcDiscoveryDocument); err != nil {
+				toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "%s", err.Error())
+				return nil, err
 			}
 
 			// Apply defaults
@@ -63,15 +130,19 @@ func (toa *TraefikOidcAuth) EnsureOidcDiscovery() error {
 				config.Provider.ValidIssuer = oidcDiscoveryDocument.Issuer
 			}
 			if config.Provider.ValidAudience == "" {
-				config.Provider.ValidAudience = config.Provider.ClientId
+				config.Provider.ValidAudience = config.Provider.getDefaultValidAudience()
 			}
 
-			toa.logger.Log(logging.LevelInfo, "OIDC Discovery successful. AuthEndPoint: %s", oidcDiscoveryDocument.AuthorizationEndpoint)
+			toa.logger.Module(logging.ModuleOidc).Log(logging.LevelInfo, "OIDC Discovery successful. AuthEndPoint: %s", oidcDiscoveryDocument.AuthorizationEndpoint)
 
 			toa.DiscoveryDocument = oidcDiscoveryDocument
+			toa.discoveredAt = toa.now()
 			toa.Jwks.Url = oidcDiscoveryDocument.JWKSURI
-		}
-		return nil
+
+			return nil, nil
+		})
+
+		return err
 	}
 
 	return nil
@@ -96,7 +167,8 @@ func (toa *TraefikOidcAuth) isCallbackRequest(req *http.Request) bool {
 	}
 
 	if utils.UrlIsAbsolute(toa.CallbackURL) {
-		if u.Scheme != toa.CallbackURL.Scheme || u.Host != toa.CallbackURL.Host {
+		// Host names are case-insensitive, eg. when users type Login.Example.com
+		if u.Scheme != toa.CallbackURL.Scheme || !strings.EqualFold(u.Host, toa.CallbackURL.Host) {
 			return false
 		}
 	}
@@ -105,55 +177,231 @@ func (toa *TraefikOidcAuth) isCallbackRequest(req *http.Request) bool {
 }
 
 func (toa *TraefikOidcAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// The reloaded configuration is published as a new handler, so it can't change during the request
+	if handler := toa.current(); handler != toa {
+		handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if toa.Config.HealthUri != "" && req.URL.Path == toa.Config.HealthUri {
+		toa.handleHealth(rw, req)
+		return
+	}
+	if toa.Config.ReadyUri != "" && req.URL.Path == toa.Config.ReadyUri {
+		toa.handleReady(rw, req)
+		return
+	}
+	if toa.isMetricsRequest(req) {
+		toa.handleMetrics(rw, req)
+		return
+	}
+	if toa.isDebugRequest(req) {
+		toa.handleDebug(rw, req)
+		return
+	}
+	if toa.isPolicyTestRequest(req) {
+		toa.handlePolicyTest(rw, req)
+		return
+	}
+
+	start := toa.now()
+
+	ctx, span := toa.Tracer.Start(toa.Tracer.Extract(req.Context(), req.Header), "oidc.request", tracing.SpanKindServer)
+	defer span.End()
+
+	if span != nil {
+		req = req.WithContext(ctx)
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		span.SetAttribute("server.address", req.Host)
+	}
+
+	traceId := getTraceId(span)
+	rw.Header().Set(errorPages.TraceIdHeader, traceId)
+
+	if toa.isAccessLogEnabled() {
+		accessLogWriter, accessLogReq, entry := toa.startAccessLog(rw, req, traceId)
+		defer toa.writeAccessLog(entry, accessLogWriter, start)
+
+		rw, req = accessLogWriter, accessLogReq
+	}
+
+	// Resolve the country once, so rules and logins don't need to look it up again
+	if country := toa.getCountry(req); country != "" {
+		req = req.WithContext(geoip.WithCountry(req.Context(), country))
+		span.SetAttribute("client.geo.country_iso_code", country)
+	}
+
+	if toa.isWellKnownRequest(req) {
+		toa.logger.Log(logging.LevelDebug, "Well-known path requested. Forwarding request without authentication.")
+		toa.recordRequestResult(req, span, requestResultBypassed, "well_known", start)
+
+		toa.sanitizeForUpstream(req)
+		toa.Tracer.Inject(req.Context(), req.Header)
+		toa.next.ServeHTTP(rw, req)
+		return
+	}
+
 	if toa.BypassAuthenticationRule != nil {
-		if toa.BypassAuthenticationRule.Match(toa.logger, req) {
-			toa.logger.Log(logging.LevelDebug, "BypassAuthenticationRule matched. Forwarding request without authentication.")
+		if toa.BypassAuthenticationRule.Match(toa.logger.Module(logging.ModuleRules), req) {
+			toa.logger.Module(logging.ModuleRules).Log(logging.LevelDebug, "BypassAuthenticationRule matched. Forwarding request without authentication.")
+			toa.recordRequestResult(req, span, requestResultBypassed, "bypass_rule", start)
 
 			// Forward the request
 			toa.sanitizeForUpstream(req)
+			toa.Tracer.Inject(req.Context(), req.Header)
 			toa.next.ServeHTTP(rw, req)
 			return
 		} else {
-			toa.logger.Log(logging.LevelDebug, "BypassAuthenticationRule not matched. Requiring authentication.")
+			toa.logger.Module(logging.ModuleRules).Log(logging.LevelDebug, "BypassAuthenticationRule not matched. Requiring authentication.")
 		}
 	}
 
-	err := toa.EnsureOidcDiscovery()
+	if !toa.checkRequestLimits(rw, req, span, start) {
+		return
+	}
 
-	if err != nil {
+	err := toa.EnsureOidcDiscovery(req.Context())
+
+	// New logins can still be handled by the secondary provider
+	if err != nil && toa.SecondaryProvider == nil {
 		toa.logger.Log(logging.LevelError, "Error getting oidc discovery: %s", err.Error())
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "discovery")
 		return
 	}
 
 	if toa.isCallbackRequest(req) {
+		if !toa.checkInternalUriMethod(rw, req, toa.getInternalUris().CallbackMethods) || !toa.checkRateLimit(rw, req, "callback") || !toa.checkLockout(rw, req) {
+			return
+		}
+
 		toa.handleCallback(rw, req)
 		return
 	}
 
-	if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) {
-		toa.redirectToProvider(rw, req)
+	if toa.isLoginRequest(req) {
+		if !toa.checkInternalUriMethod(rw, req, toa.getInternalUris().LoginMethods) {
+			return
+		}
+
+		if isJsonLoginRequest(req) {
+			toa.handleLoginPost(rw, req)
+		} else {
+			toa.redirectToProvider(rw, req)
+		}
 		return
 	}
 
+	// The session is only validated for the page, so the many assets of a page don't need to decrypt it again
+	if toa.isStaticAssetRequest(req) && toa.hasSessionCookie(req) {
+		toa.logger.Log(logging.LevelDebug, "Static asset requested with a session cookie. Forwarding request without validating the session.")
+		toa.recordRequestResult(req, span, requestResultBypassed, "static_asset", start)
+
+		toa.sanitizeForUpstream(req)
+		toa.Tracer.Inject(req.Context(), req.Header)
+		toa.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Locked out clients may not try any more tokens
+	if toa.hasExternalToken(req) && !toa.checkLockout(rw, req) {
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "locked_out", start)
+		return
+	}
+
+	authenticationStart := toa.now()
 	session, updateSession, claims, err := toa.getSessionForRequest(req)
+	toa.Metrics.RecordAuthentication(err == nil && session != nil, toa.now().Sub(authenticationStart))
 
 	if err == nil && session != nil {
+		claims = toa.mapClaims(claims)
+		toa.setAccessLogSubject(req, claims)
+
 		// Handle logout
-		if strings.HasPrefix(req.RequestURI, toa.Config.LogoutUri) {
+		if toa.isLogoutRequest(req) {
+			if !toa.checkInternalUriMethod(rw, req, toa.getInternalUris().LogoutMethods) {
+				return
+			}
+
 			toa.handleLogout(rw, req, session)
 			return
 		}
 
+		if toa.isConsentRequest(req) {
+			toa.handleConsent(rw, req, session)
+			return
+		}
+
+		if missingScopes := toa.getMissingScopes(req, session); len(missingScopes) > 0 {
+			if updateSession {
+				toa.storeSessionAndAttachCookie(session, rw)
+			}
+
+			toa.recordRequestResult(req, span, requestResultUnauthorized, "scope", start)
+			toa.handleMissingScopes(rw, req, session, missingScopes, claims)
+			return
+		}
+
+		if toa.isSessionManagementRequest(req) {
+			toa.handleSessionManagement(rw, req, session, claims)
+			return
+		}
+
 		// If this request is using external authentication by using a header or custom cookie,
 		// we need to validate the authorization on every request.
 		// Ensure the session is authorized
+		var decision *authorizationDecision
 		if session.Id == "AuthorizationHeader" || session.Id == "AuthorizationCookie" || toa.Config.Authorization.CheckOnEveryRequest {
-			session.IsAuthorized = isAuthorized(toa.logger, toa.Config.Authorization, claims)
+			decision = toa.isAuthorized(claims)
+			session.IsAuthorized = decision.Authorized
 		}
 
 		if !session.IsAuthorized {
-			toa.handleUnauthorized(rw, req)
+			if decision == nil {
+				// Only the result of the login is stored in the session, so the assertions are evaluated again for the details
+				decision = toa.isAuthorized(claims)
+			}
+
+			reason := decision.Reason
+			if reason == "" {
+				reason = authorizationReasonClaims
+			}
+
+			toa.recordAuthorizationDecision(req, claims, decision)
+			toa.recordRequestResult(req, span, requestResultUnauthorized, reason, start)
+			toa.handleUnauthorized(rw, req, claims, decision, "")
+			return
+		}
+
+		if !toa.hasConsent(session, claims) {
+			if updateSession {
+				toa.storeSessionAndAttachCookie(session, rw)
+			}
+
+			toa.recordRequestResult(req, span, requestResultUnauthorized, "consent", start)
+			toa.writeConsentPage(rw, req, session, claims)
+			return
+		}
+
+		if toa.isImpersonationRequest(req) {
+			toa.handleImpersonation(rw, req, session, claims)
+			return
+		}
+
+		var impersonationChanged bool
+		claims, impersonationChanged, err = toa.applyImpersonation(req, session, claims)
+		updateSession = updateSession || impersonationChanged
+		if err != nil {
+			if updateSession {
+				toa.storeSessionAndAttachCookie(session, rw)
+			}
+
+			toa.recordRequestResult(req, span, requestResultUnauthorized, "impersonation", start)
+			if errors.Is(err, errImpersonationConfirmationRequired) {
+				toa.writeImpersonationConfirmation(rw, req, session)
+			} else {
+				toa.handleUnauthorized(rw, req, claims, nil, "")
+			}
 			return
 		}
 
@@ -169,26 +417,95 @@ func (toa *TraefikOidcAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 			toa.storeSessionAndAttachCookie(session, rw)
 		}
 
+		toa.recordRequestResult(req, span, requestResultAuthenticated, getAuthenticationSource(session), start)
+
 		// Forward the request
 		toa.sanitizeForUpstream(req)
+		toa.Tracer.Inject(req.Context(), req.Header)
 		toa.next.ServeHTTP(rw, req)
 		return
 	} else {
 		toa.logger.Log(logging.LevelInfo, "Verifying token: %s", err.Error())
 	}
 
+	// Guests don't need the identity provider, so they are forwarded before checking its availability
+	if toa.isAnonymousAccessAllowed(req) {
+		toa.forwardAnonymously(rw, req, span, "anonymous_rule", start)
+		return
+	}
+
+	// Don't send users to a login page which isn't reachable anyway and keep the session for when the provider is back.
+	if toa.CircuitBreaker.IsOpen() && toa.SecondaryProvider == nil {
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "circuit_open", start)
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "circuit_open")
+		return
+	}
+	if toa.RenewalQueue != nil && errors.Is(err, ErrProviderUnavailable) {
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "provider_unavailable", start)
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "token_renewal")
+		return
+	}
+	// The session is kept, so it can be refreshed on a later request
+	if errors.Is(err, errRefreshQueueTimeout) {
+		toa.recordRequestResult(req, span, requestResultUnauthenticated, "refresh_queue_timeout", start)
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "refresh_queue")
+		return
+	}
+
 	// Clear the session cookie
 	clearChunkedCookie(toa.Config, rw, req, getSessionCookieName(toa.Config))
 
+	if errors.Is(err, errInvalidSession) && toa.handleExpiredSession(rw, req, span, start) {
+		return
+	}
+
+	toa.recordRequestResult(req, span, requestResultUnauthenticated, getUnauthenticatedReason(err), start)
 	toa.handleUnauthenticated(rw, req)
 }
 
+// recordRequestResult records the result of a request in the metrics and the span of the request.
+func (toa *TraefikOidcAuth) recordRequestResult(req *http.Request, span *tracing.Span, result string, reason string, start time.Time) {
+	toa.Metrics.RecordRequest(result, reason, toa.now().Sub(start))
+
+	if entry := getAccessLogEntry(req); entry != nil {
+		entry.Result = result
+		entry.Reason = reason
+	}
+
+	span.SetAttribute("oidc.result", result)
+	span.SetAttribute("oidc.reason", reason)
+}
+
+// getTraceId returns the id of the trace or a new random id, if tracing is disabled.
+func getTraceId(span *tracing.Span) string {
+	if traceId := span.TraceId(); traceId != "" {
+		return traceId
+	}
+
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// The time the background tasks of a replaced middleware get to send their queued data.
+const shutdownTimeout = 10 * time.Second
+
+// Shutdown sends all pending spans, metrics, webhook events and log lines. It is called when the context of the
+// middleware is cancelled, and by the standalone server when it stops.
+func (toa *TraefikOidcAuth) Shutdown(ctx context.Context) error {
+	err := errors.Join(toa.Tracer.Shutdown(ctx), toa.Metrics.Shutdown(ctx), toa.Webhook.Shutdown(ctx))
+
+	// The logs are released last, so they contain everything logged during the shutdown
+	logSinks := toa.logSinks
+	toa.logSinks = nil
+
+	return errors.Join(err, releaseLogSinks(ctx, logSinks))
+}
+
 func (toa *TraefikOidcAuth) sanitizeForUpstream(req *http.Request) {
 	// Remove all internal cookies from the request before forwarding
 	keepCookies := make([]*http.Cookie, 0)
 
 	for _, c := range req.Cookies() {
-		if !strings.HasPrefix(c.Name, toa.Config.CookieNamePrefix) {
+		if !strings.HasPrefix(c.Name, toa.Config.CookieNamePrefix) && !toa.Config.isOAuth2ProxyCookie(c.Name) {
 			keepCookies = append(keepCookies, c)
 		}
 	}
@@ -198,10 +515,22 @@ func (toa *TraefikOidcAuth) sanitizeForUpstream(req *http.Request) {
 	for _, c := range keepCookies {
 		req.AddCookie(c)
 	}
+
+	toa.logUpstreamHeaders(req)
 }
 
 func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.SessionState, claims map[string]interface{}) error {
+	// Headers may still override the Authorization header using a template
+	if err := toa.setUpstreamAuthorization(req, session, claims); err != nil {
+		return err
+	}
+
 	if toa.Config.Headers != nil {
+		_, span := toa.Tracer.Start(req.Context(), "oidc.attach_headers", tracing.SpanKindInternal)
+		defer span.End()
+
+		span.SetAttribute("oidc.headers.count", len(toa.Config.Headers))
+
 		evalContext := make(map[string]interface{})
 
 		evalContext["claims"] = claims
@@ -215,6 +544,7 @@ func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.Se
 					tpl, err := template.New("").Parse(header.Value)
 
 					if err != nil {
+						span.RecordError(fmt.Errorf("invalid template for header %s: %w", header.Name, err))
 						return err
 					}
 
@@ -227,6 +557,7 @@ func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.Se
 				if err == nil {
 					req.Header.Set(header.Name, renderedValue.String())
 				} else {
+					span.RecordError(fmt.Errorf("failed to render header %s: %w", header.Name, err))
 					req.Header.Set(header.Name, err.Error())
 				}
 			} else {
@@ -235,41 +566,124 @@ func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.Se
 		}
 	}
 
+	toa.attachOAuth2ProxyHeaders(req, session, claims)
+
 	return nil
 }
 
 func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Request) {
-	base64State := req.URL.Query().Get("state")
+	if req.Method == http.MethodPost && toa.getResponseMode() == responseModeFormPost {
+		if err := toa.readFormBody(rw, req); err != nil {
+			toa.writeBodyError(rw, req, err)
+			return
+		}
+	}
+
+	base64State := toa.getCallbackParameter(req, "state")
 	if base64State == "" {
 		toa.logger.Log(logging.LevelWarn, "State on callback request is missing.")
 		http.Error(rw, "State is missing", http.StatusInternalServerError)
 		return
 	}
 
-	state, err := oidc.DecodeState(base64State)
+	state, err := oidc.DecodeState(base64State, toa.Config.DecryptionKeys())
 	if err != nil {
 		toa.logger.Log(logging.LevelWarn, "State on callback request is invalid.")
+		toa.recordAuthenticationFailure(req, lockoutFailureCallback, "")
 		http.Error(rw, "State is invalid", http.StatusInternalServerError)
 		return
 	}
 
-	redirectUrl := state.RedirectUrl
+	// Every state may only be used once and only for a limited time, to prevent replaying of callback urls.
+	stateExpiresAt := time.Unix(state.IssuedAt, 0).Add(time.Duration(toa.Config.StateMaxAge) * time.Second)
+
+	if toa.now().After(stateExpiresAt) {
+		toa.logger.Log(logging.LevelWarn, "State on callback request is expired.")
+		http.Error(rw, "State is expired", http.StatusBadRequest)
+		return
+	}
+
+	if !toa.ConsumedStates.TryConsume(state.Id, stateExpiresAt) {
+		toa.logger.Log(logging.LevelWarn, "State on callback request has already been used.")
+		toa.recordAuthenticationFailure(req, lockoutFailureCallback, "")
+		http.Error(rw, "State has already been used", http.StatusBadRequest)
+		return
+	}
+
+	redirectUrl := appendPreservedQueryParameters(state.RedirectUrl, state.Parameters)
+
+	// The user isn't logged in at the provider anymore, so continue without a session.
+	// As the session cookie has been cleared, the next request is handled by UnauthorizedBehavior.
+	if state.Action == "Login" && state.Silent && toa.getCallbackParameter(req, "error") != "" {
+		toa.logger.Log(logging.LevelInfo, "Silent login failed: %s", toa.getCallbackParameter(req, "error"))
+		http.Redirect(rw, req, redirectUrl, http.StatusFound)
+		return
+	}
 
 	if state.Action == "Login" {
-		authCode := req.URL.Query().Get("code")
+		loginSucceeded := false
+		defer func() {
+			toa.Metrics.RecordLogin(loginSucceeded)
+		}()
+
+		// The provider reports errors, like a denied consent, instead of returning a code. See RFC 6749, section 4.1.2.1.
+		if errorCode := toa.getCallbackParameter(req, "error"); errorCode != "" {
+			toa.writeLoginFailedError(rw, req, redirectUrl, errorCode, toa.getCallbackParameter(req, "error_description"))
+			return
+		}
+
+		// The client may have moved since the login has been started
+		if !toa.checkLoginCountry(rw, req) {
+			return
+		}
+
+		authCode := toa.getCallbackParameter(req, "code")
 		if authCode == "" {
 			toa.logger.Log(logging.LevelWarn, "Code is missing.")
 			http.Error(rw, "Code is missing", http.StatusInternalServerError)
 			return
 		}
 
-		token, err := exchangeAuthCode(toa, req, authCode)
+		provider, err := toa.getProvider(req.Context(), state.Provider)
+		if err != nil {
+			toa.logger.Log(logging.LevelError, "The identity provider of the login is not available: %s", err.Error())
+			toa.writeProviderUnavailableError(rw, req, http.StatusBadGateway, "discovery")
+			return
+		}
+
+		if err := toa.validateAuthorizationResponse(req.Context(), req, provider, state, authCode); err != nil {
+			toa.logger.Log(logging.LevelError, "The authorization response is not valid: %s", err.Error())
+			if errors.Is(err, ErrProviderUnavailable) {
+				toa.writeProviderUnavailableError(rw, req, http.StatusBadGateway, "authorization_response")
+			} else {
+				toa.recordAuthenticationFailure(req, lockoutFailureCallback, "")
+				http.Error(rw, "The authorization response is not valid", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		token, err := exchangeAuthCode(toa, req, provider, authCode)
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "Exchange Auth Code: %s", err.Error())
-			http.Error(rw, "Failed to exchange auth code", http.StatusInternalServerError)
+			toa.recordProviderError(provider, err)
+			if errors.Is(err, ErrProviderUnavailable) {
+				toa.writeProviderUnavailableError(rw, req, http.StatusBadGateway, "token_exchange")
+			} else {
+				toa.recordAuthenticationFailure(req, lockoutFailureCallback, "")
+				http.Error(rw, "Failed to exchange auth code", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := validateTokenResponse(token, state); err != nil {
+			toa.logger.Log(logging.LevelError, "Returned token is not valid: %s", err.Error())
+			toa.recordAuthenticationFailure(req, lockoutFailureCallback, "")
+			http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
 			return
 		}
 
+		toa.warnAboutMissingRefreshToken(token, state.RememberMe)
+
 		usedToken := ""
 
 		if toa.Config.Provider.TokenValidation == "AccessToken" {
@@ -283,25 +697,41 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 		}
 
-		redactedToken := usedToken
-		if len(redactedToken) > 16 {
-			redactedToken = redactedToken[0:16] + " *** REDACTED ***"
-		}
-
 		var claims map[string]interface{}
 
 		if toa.Config.Provider.TokenValidation == "Introspection" {
-			_, claims, err = toa.introspectToken(usedToken)
+			_, claims, err = toa.introspectToken(req.Context(), provider, usedToken)
 		} else {
-			_, claims, err = toa.validateTokenLocally(usedToken)
+			_, claims, err = toa.validateTokenLocally(req.Context(), provider, usedToken)
 		}
 
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "Returned token is not valid: %s", err.Error())
-			http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
+			if errors.Is(err, ErrProviderUnavailable) {
+				toa.writeProviderUnavailableError(rw, req, http.StatusBadGateway, "token_validation")
+			} else {
+				toa.recordAuthenticationFailure(req, lockoutFailureCallback, getVerifiedSubject(err))
+				http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
+			}
 			return
 		}
 
+		// After too many failed attempts, the user has to enter the credentials at the provider again
+		if subject, _ := claims["sub"].(string); toa.isSubjectLockedOut(subject) {
+			if !state.PromptLogin {
+				toa.logger.Log(logging.LevelInfo, "Subject '%s' is locked out. Restarting the login with prompt=login.", subject)
+				toa.redirectToProviderWithParameters(rw, req, &loginParameters{
+					Prompt:      "login",
+					RememberMe:  state.RememberMe,
+					Popup:       state.Popup,
+					redirectUrl: redirectUrl,
+				})
+				return
+			}
+
+			toa.Lockout.Reset(lockoutKeySubject + ":" + subject)
+		}
+
 		if toa.Config.Provider.UseClaimsFromUserInfoBool {
 			subClaim, ok := claims["sub"].(string)
 			if !ok {
@@ -310,7 +740,7 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 				return
 			}
 
-			userInfoClaims, err := toa.getUserInfo(token.AccessToken, subClaim)
+			userInfoClaims, err := toa.getUserInfo(req.Context(), provider, token.AccessToken, subClaim)
 			if err != nil {
 				toa.logger.Log(logging.LevelError, "failed to fetch UserInfo: %s", err.Error())
 				http.Error(rw, "Failed to fetch UserInfo", http.StatusInternalServerError)
@@ -320,33 +750,50 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 			claims = mergeClaims(claims, userInfoClaims)
 		}
 
-		toa.logger.Log(logging.LevelInfo, "Exchange Auth Code completed. Token: %+v", redactedToken)
+		toa.logger.Log(logging.LevelInfo, "Exchange Auth Code completed.")
+
+		if missingClaims := toa.getMissingClaims(claims); len(missingClaims) > 0 {
+			toa.writeMissingClaimsError(rw, req, missingClaims)
+			return
+		}
+
+		claims = toa.mapClaims(claims)
 
-		isAuthorized := isAuthorized(toa.logger, toa.Config.Authorization, claims)
+		decision := toa.isAuthorized(claims)
+
+		// The upstream application can rely on the user to exist, once the session is created
+		if decision.Authorized {
+			if err := toa.Provisioner.EnsureProvisioned(req.Context(), claims); err != nil {
+				toa.logger.Log(logging.LevelError, "Failed to provision subject '%v': %s", claims["sub"], err.Error())
+				toa.writeProvisioningError(rw, req)
+				return
+			}
+		}
 
 		session := &session.SessionState{
 			Id:             session.GenerateSessionId(),
-			RefreshedAt:    time.Now(),
+			RefreshedAt:    toa.now(),
 			AccessToken:    token.AccessToken,
 			IdToken:        token.IdToken,
 			RefreshToken:   token.RefreshToken,
-			IsAuthorized:   isAuthorized,
+			IsAuthorized:   decision.Authorized,
 			TokenExpiresIn: token.ExpiresIn,
+			RememberMe:     state.RememberMe,
+			Provider:       state.Provider,
+		}
+
+		toa.bindSession(session, req)
+		toa.recordSessionDetails(session, req, claims)
+		toa.recordSessionScopes(session, state, token)
+
+		if country := toa.getCountry(req); country != "" {
+			toa.logger.Log(logging.LevelInfo, "Login of subject '%v' from country %s.", claims["sub"], country)
 		}
 
 		toa.storeSessionAndAttachCookie(session, rw)
+		toa.clearOAuth2ProxyCookies(rw, req)
 
-		http.SetCookie(rw, &http.Cookie{
-			Name:     getCodeVerifierCookieName(toa.Config),
-			Value:    "",
-			Expires:  time.Now().Add(-24 * time.Hour),
-			MaxAge:   -1,
-			Secure:   true,
-			HttpOnly: true,
-			Path:     toa.CallbackURL.Path,
-			Domain:   toa.CallbackURL.Host,
-			SameSite: http.SameSiteDefaultMode,
-		})
+		http.SetCookie(rw, makeCookieExpireImmediately(toa.createCodeVerifierCookie("")))
 
 		if redirectUrl != "" {
 			redirectUrl = utils.EnsureAbsoluteUrl(req, redirectUrl)
@@ -354,8 +801,18 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 			redirectUrl = utils.EnsureAbsoluteUrl(req, toa.Config.PostLoginRedirectUri)
 		}
 
-		if !isAuthorized {
-			toa.handleUnauthorized(rw, req)
+		loginSucceeded = true
+
+		if !decision.Authorized {
+			toa.recordAuthorizationDecision(req, claims, decision)
+
+			// The user wanted to access the redirect url, not the callback
+			toa.handleUnauthorized(rw, req, claims, decision, redirectUrl)
+			return
+		}
+
+		if state.Popup {
+			toa.writePopupCallbackPage(rw, req, redirectUrl)
 			return
 		}
 
@@ -373,10 +830,33 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 
 func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Request, session *session.SessionState) {
 	toa.logger.Log(logging.LevelInfo, "Logging out...")
+	toa.Metrics.RecordLogout()
+
+	if session != nil {
+		toa.Webhook.Emit(webhookEventLogout, map[string]interface{}{
+			"session_id": getPublicSessionId(session.Id),
+			"sub":        session.Subject,
+			"client_ip":  utils.GetClientIp(req),
+		})
+	}
+
+	if session != nil && toa.TokenCache != nil {
+		toa.TokenCache.Remove(session.Id)
+	}
+	if session != nil {
+		toa.deleteServerSideSession(session.Id)
+	}
+
+	provider, err := toa.getProvider(req.Context(), session.Provider)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "The identity provider of the session is not available: %s", err.Error())
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "discovery")
+		return
+	}
 
 	// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
 
-	endSessionURL, err := url.Parse(toa.DiscoveryDocument.EndSessionEndpoint)
+	endSessionURL, err := url.Parse(provider.DiscoveryDocument.EndSessionEndpoint)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Error while parsing the AuthorizationEndpoint: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -392,7 +872,7 @@ func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Reque
 	}
 
 	if redirectUriFromQuery != "" {
-		redirectUriFromQuery, err = utils.ValidateRedirectUri(redirectUriFromQuery, toa.Config.ValidPostLogoutRedirectUris)
+		redirectUriFromQuery, err = toa.validateRedirectUri(req, redirectUriFromQuery, toa.Config.ValidPostLogoutRedirectUris)
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "%s", err.Error())
 			http.Error(rw, err.Error(), http.StatusBadRequest)
@@ -404,29 +884,58 @@ func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Reque
 		}
 	}
 
-	state := &oidc.OidcState{
-		Action:      "Logout",
-		RedirectUrl: redirectUri,
-	}
+	state := oidc.NewState("Logout", redirectUri)
 
-	base64State, err := oidc.EncodeState(state)
+	base64State, err := oidc.EncodeState(state, toa.Config.EncryptionKey(), toa.Config.Cipher)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Failed to serialize state: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	endSessionURL.RawQuery = url.Values{
-		"client_id":                {toa.Config.Provider.ClientId},
+	logoutParameters := url.Values{
+		"client_id":                {provider.ClientId},
 		"post_logout_redirect_uri": {callbackUri},
 		"state":                    {base64State},
-		"id_token_hint":            {session.IdToken},
-	}.Encode()
+	}
+
+	// Providers like Keycloak reject an empty hint, eg. of a minimal session whose tokens aren't cached anymore
+	if session.IdToken != "" {
+		logoutParameters.Set("id_token_hint", session.IdToken)
+	}
+
+	endSessionURL.RawQuery = logoutParameters.Encode()
 
 	http.Redirect(rw, req, endSessionURL.String(), http.StatusFound)
 }
 
+// isApiRequest checks whether the request should be treated as a machine request,
+// which never gets redirected and always receives RFC 6750 responses.
+func (toa *TraefikOidcAuth) isApiRequest(req *http.Request) bool {
+	if toa.Config.UnauthorizedBehavior == "Bearer" {
+		return true
+	}
+
+	return toa.ApiRouteRule != nil && toa.ApiRouteRule.Match(toa.logger.Module(logging.ModuleRules), req)
+}
+
+func (toa *TraefikOidcAuth) hasBearerToken(req *http.Request) bool {
+	if toa.Config.AuthorizationHeader != nil && toa.Config.AuthorizationHeader.Name != "" &&
+		req.Header.Get(toa.Config.AuthorizationHeader.Name) != "" {
+		return true
+	}
+
+	return strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
 func (toa *TraefikOidcAuth) handleUnauthenticated(rw http.ResponseWriter, req *http.Request) {
+	// For API requests, never redirect
+	if toa.isApiRequest(req) {
+		toa.logger.Log(logging.LevelInfo, "API request detected, returning RFC 6750 error for unauthenticated request.")
+		toa.writeUnauthenticatedError(rw, req)
+		return
+	}
+
 	// For XHR requests, always return JSON error instead of redirecting
 	var jsHeaders map[string][]string
 	if toa.Config.JavaScriptRequestDetection != nil {
@@ -440,6 +949,13 @@ func (toa *TraefikOidcAuth) handleUnauthenticated(rw http.ResponseWriter, req *h
 	}
 
 	switch toa.Config.UnauthorizedBehavior {
+	case "Interstitial":
+		if utils.IsHtmlRequest(req) {
+			// Show a page which lets the user start the login manually
+			toa.writeInterstitialPage(rw, req)
+		} else {
+			toa.writeUnauthenticatedError(rw, req)
+		}
 	case "Challenge":
 		// Redirect to Identity Provider
 		toa.redirectToProvider(rw, req)
@@ -468,6 +984,17 @@ func (toa *TraefikOidcAuth) writeUnauthenticatedError(rw http.ResponseWriter, re
 	data["statusName"] = "Unauthorized"
 	data["description"] = "You're not authorized to access this resource. Please log in to continue."
 
+	if toa.isApiRequest(req) {
+		// Only include an error code if the client actually sent a token. See RFC 6750, section 3.1.
+		errorCode := ""
+		if toa.hasBearerToken(req) {
+			errorCode = "invalid_token"
+		}
+
+		errorPages.WriteBearerError(toa.logger, rw, errorCode, data)
+		return
+	}
+
 	// Check if it's an XHR request
 	var jsHeaders map[string][]string
 	if toa.Config.JavaScriptRequestDetection != nil {
@@ -488,7 +1015,32 @@ func (toa *TraefikOidcAuth) writeUnauthenticatedError(rw http.ResponseWriter, re
 	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthenticated, rw, req, data, jsHeaders)
 }
 
-func (toa *TraefikOidcAuth) handleUnauthorized(rw http.ResponseWriter, req *http.Request) {
+func (toa *TraefikOidcAuth) writeInterstitialPage(rw http.ResponseWriter, req *http.Request) {
+	authorizationUrl, ok := toa.createAuthorizationUrl(rw, req)
+	if !ok {
+		return
+	}
+
+	data := make(map[string]interface{})
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.2"
+	data["statusCode"] = http.StatusUnauthorized
+	data["statusName"] = "Sign in required"
+	data["description"] = "You need to sign in to access this resource."
+	data["primaryButtonText"] = "Continue"
+	data["primaryButtonUrl"] = authorizationUrl
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Interstitial, rw, req, data, jsHeaders)
+}
+
+// handleUnauthorized responds to a user who isn't allowed to access the requested url. The decision may be nil,
+// if the user has been denied for another reason than the claims. When requestedUrl is empty, the url of the request is used.
+func (toa *TraefikOidcAuth) handleUnauthorized(rw http.ResponseWriter, req *http.Request, claims map[string]interface{}, decision *authorizationDecision, requestedUrl string) {
 	// For XHR requests, always return JSON error instead of HTML
 	var jsHeaders map[string][]string
 	if toa.Config.JavaScriptRequestDetection != nil {
@@ -499,16 +1051,42 @@ func (toa *TraefikOidcAuth) handleUnauthorized(rw http.ResponseWriter, req *http
 		toa.logger.Log(logging.LevelInfo, "XHR request detected, returning JSON error for unauthorized request.")
 	}
 
-	toa.writeUnauthorizedError(rw, req)
+	toa.writeUnauthorizedError(rw, req, claims, decision, requestedUrl)
 }
 
-func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *http.Request) {
+func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *http.Request, claims map[string]interface{}, decision *authorizationDecision, requestedUrl string) {
+	if requestedUrl == "" {
+		requestedUrl = utils.EnsureAbsoluteUrl(req, req.URL.RequestURI())
+	}
+
 	data := make(map[string]interface{})
 
 	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
 	data["statusCode"] = http.StatusForbidden
 	data["statusName"] = "Forbidden"
 	data["description"] = "It seems like your account is not allowed to access this resource.\nTry to log in using a different account or log out by using one of the options below."
+	data["claims"] = claims
+	data["requestedUrl"] = requestedUrl
+
+	if toa.Config.Authorization != nil && toa.Config.Authorization.ExposeFailureDetails {
+		if decision != nil && decision.FailedAssertion != nil {
+			assertion := decision.FailedAssertion
+			description := describeFailedAssertion(assertion)
+
+			rw.Header().Set(authorizationFailureHeader, description)
+			data["failedAssertion"] = map[string]interface{}{
+				"claim":       assertion.Name,
+				"anyOf":       assertion.AnyOf,
+				"allOf":       assertion.AllOf,
+				"description": description,
+			}
+		}
+	}
+
+	if toa.isApiRequest(req) {
+		errorPages.WriteBearerError(toa.logger, rw, "insufficient_scope", data)
+		return
+	}
 
 	// Check if it's an XHR request
 	var jsHeaders map[string][]string
@@ -533,20 +1111,131 @@ func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *
 	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthorized, rw, req, data, jsHeaders)
 }
 
+func (toa *TraefikOidcAuth) writeProviderUnavailableError(rw http.ResponseWriter, req *http.Request, statusCode int, step string) {
+	toa.Metrics.RecordProviderUnavailable(step)
+
+	data := make(map[string]interface{})
+
+	if statusCode == http.StatusBadGateway {
+		data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.3"
+		data["statusName"] = "Bad Gateway"
+	} else {
+		data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.4"
+		data["statusName"] = "Service Unavailable"
+	}
+	data["statusCode"] = statusCode
+	data["description"] = "The identity provider is currently unavailable. Please try again later."
+
+	page := toa.Config.ErrorPages.ProviderUnavailable
+	if page.RetryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(page.RetryAfter))
+	}
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	if !utils.IsXHRRequestWithHeaders(req, jsHeaders) {
+		data["primaryButtonText"] = "Try again"
+		data["primaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, req.URL.RequestURI())
+	}
+
+	errorPages.WriteError(toa.logger, page, rw, req, data, jsHeaders)
+}
+
+// writeLoginFailedError tells the user why the provider didn't complete the login.
+// A denied consent is the user's decision, while all other errors are failures of the provider.
+func (toa *TraefikOidcAuth) writeLoginFailedError(rw http.ResponseWriter, req *http.Request, redirectUrl string, errorCode string, errorDescription string) {
+	data := make(map[string]interface{})
+
+	if errorCode == "access_denied" {
+		toa.logger.Log(logging.LevelInfo, "The login has been denied at the identity provider: %s", errorDescription)
+
+		data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
+		data["statusCode"] = http.StatusForbidden
+		data["statusName"] = "Forbidden"
+		data["description"] = "The login has been cancelled, because the access has been denied at the identity provider."
+	} else {
+		toa.logger.Log(logging.LevelWarn, "The identity provider returned the error %s on the callback: %s", errorCode, errorDescription)
+
+		data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.3"
+		data["statusCode"] = http.StatusBadGateway
+		data["statusName"] = "Bad Gateway"
+		data["description"] = "The identity provider was unable to complete the login. Please try again later."
+	}
+
+	data["providerError"] = errorCode
+	data["providerErrorDescription"] = errorDescription
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	if !utils.IsXHRRequestWithHeaders(req, jsHeaders) && redirectUrl != "" {
+		data["primaryButtonText"] = "Try again"
+		data["primaryButtonUrl"] = redirectUrl
+	}
+
+	page := toa.Config.ErrorPages.LoginFailed
+	if page == nil {
+		page = &errorPages.ErrorPageConfig{}
+	}
+
+	errorPages.WriteError(toa.logger, page, rw, req, data, jsHeaders)
+}
+
 func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http.Request) {
+	toa.redirectToProviderWithParameters(rw, req, toa.getLoginParameters(req))
+}
+
+func (toa *TraefikOidcAuth) redirectToProviderWithParameters(rw http.ResponseWriter, req *http.Request, parameters *loginParameters) {
+	if !toa.checkRateLimit(rw, req, "login") {
+		return
+	}
+
+	if toa.isEmbeddedRequest(req) {
+		toa.logger.Log(logging.LevelInfo, "Request from an iframe detected. Starting the login in the top-level window.")
+		toa.writeTopLevelRedirectPage(rw, req)
+		return
+	}
+
 	toa.logger.Log(logging.LevelInfo, "Redirecting to OIDC provider...")
+
+	authorizationUrl, ok := toa.createAuthorizationUrlWithParameters(rw, req, parameters)
+	if !ok {
+		return
+	}
+
+	http.Redirect(rw, req, authorizationUrl, http.StatusFound)
+}
+
+// createAuthorizationUrl builds the url of the provider's authorization endpoint and attaches all required cookies.
+// In case of an error, an error response is written and false is returned.
+func (toa *TraefikOidcAuth) createAuthorizationUrl(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	return toa.createAuthorizationUrlWithParameters(rw, req, toa.getLoginParameters(req))
+}
+
+func (toa *TraefikOidcAuth) createAuthorizationUrlWithParameters(rw http.ResponseWriter, req *http.Request, parameters *loginParameters) (string, bool) {
 	var redirectUrl string
 
 	// If the user specified one on the /login request, use this one
-	redirectUriFromQuery, err := utils.ValidateRedirectUri(req.URL.Query().Get("redirect_uri"), toa.Config.ValidPostLoginRedirectUris)
+	redirectUriFromQuery, err := toa.validateRedirectUri(req, parameters.RedirectUri, toa.Config.ValidPostLoginRedirectUris)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "%s", err.Error())
 		http.Error(rw, err.Error(), http.StatusBadRequest)
-		return
+		return "", false
+	}
+
+	if !toa.checkLoginCountry(rw, req) || !toa.checkLockout(rw, req) {
+		return "", false
 	}
 
-	if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) && redirectUriFromQuery != "" {
-		redirectUrl = redirectUriFromQuery
+	if parameters.redirectUrl != "" {
+		redirectUrl = parameters.redirectUrl
+	} else if toa.isLoginRequest(req) && redirectUriFromQuery != "" {
+		redirectUrl = utils.EnsureAbsoluteUrl(req, redirectUriFromQuery)
 	} else if toa.Config.PostLoginRedirectUri != "" {
 		redirectUrl = utils.EnsureAbsoluteUrl(req, toa.Config.PostLoginRedirectUri)
 	} else {
@@ -554,83 +1243,150 @@ func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http
 		redirectUrl = fmt.Sprintf("%s%s", host, req.RequestURI)
 
 		// Special case: If someone just calls /login but doesn't provide a redirect_uri, we go to / instead of /login again.
-		if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) {
+		if toa.isLoginRequest(req) {
 			redirectUrl = host
 		}
 	}
 
 	callbackUrl := toa.GetAbsoluteCallbackURL(req).String()
 
-	state := oidc.OidcState{
-		Action:      "Login",
-		RedirectUrl: redirectUrl,
+	provider, err := toa.selectProvider(req.Context())
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "No identity provider is available: %s", err.Error())
+		toa.writeProviderUnavailableError(rw, req, http.StatusServiceUnavailable, "discovery")
+		return "", false
+	}
+
+	state := oidc.NewState("Login", redirectUrl)
+	state.RememberMe = parameters.RememberMe
+	state.Silent = parameters.Prompt == "none"
+	state.PromptLogin = parameters.Prompt == "login"
+	state.Popup = parameters.Popup
+	if parameters.redirectUrl == "" {
+		state.Parameters = toa.getPreservedQueryParameters(req)
+	}
+
+	scopes := toa.Config.Scopes
+	if len(parameters.scopes) > 0 {
+		scopes = parameters.scopes
+		state.Scopes = parameters.scopes
+	}
+
+	// Remember the provider, so the callback and the session use the same one
+	if provider.Name != providerPrimary {
+		state.Provider = provider.Name
+	}
+
+	// Tokens returned on the callback must be bound to this login
+	if toa.isHybridFlow() {
+		nonce, err := randomBytesInHex(16)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+
+		state.Nonce = nonce
 	}
 
-	stateBase64, err := oidc.EncodeState(&state)
+	stateBase64, err := oidc.EncodeState(state, toa.Config.EncryptionKey(), toa.Config.Cipher)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Failed to serialize state: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
-	toa.logger.Log(logging.LevelDebug, "AuthorizationEndPoint: %s", toa.DiscoveryDocument.AuthorizationEndpoint)
+	toa.logger.Log(logging.LevelDebug, "AuthorizationEndPoint: %s", provider.DiscoveryDocument.AuthorizationEndpoint)
 
-	authorizationEndpointUrl, err := url.Parse(toa.DiscoveryDocument.AuthorizationEndpoint)
+	authorizationEndpointUrl, err := url.Parse(provider.DiscoveryDocument.AuthorizationEndpoint)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Error while parsing the AuthorizationEndpoint: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
+	scopes = toa.addOfflineAccessScope(scopes, provider.DiscoveryDocument, state.RememberMe)
+
 	urlValues := url.Values{
-		"response_type": {"code"},
-		"scope":         {strings.Join(toa.Config.Scopes, " ")},
-		"client_id":     {toa.Config.Provider.ClientId},
+		"response_type": {toa.getResponseType()},
+		"scope":         {strings.Join(scopes, " ")},
+		"client_id":     {provider.ClientId},
 		"redirect_uri":  {callbackUrl},
 		"state":         {stateBase64},
 	}
 
-	if prompt := req.URL.Query().Get("prompt"); prompt != "" {
-		urlValues.Add("prompt", prompt)
+	if toa.Config.Provider.ResponseMode != "" || toa.isHybridFlow() {
+		urlValues.Add("response_mode", toa.getResponseMode())
+	}
+	if state.Nonce != "" {
+		urlValues.Add("nonce", state.Nonce)
+	}
+
+	if parameters.Prompt != "" {
+		urlValues.Add("prompt", parameters.Prompt)
+	}
+	if parameters.LoginHint != "" {
+		urlValues.Add("login_hint", parameters.LoginHint)
+	}
+	if parameters.IdpHint != "" && toa.Config.Provider.IdpHintParameter != "" {
+		urlValues.Add(toa.Config.Provider.IdpHintParameter, parameters.IdpHint)
+	}
+	toa.Config.Provider.addAudience(urlValues)
+
+	if hd := getHostedDomainParameter(toa.Config.Provider.HostedDomains); hd != "" {
+		urlValues.Add("hd", hd)
 	}
 
 	if toa.Config.Provider.UsePkceBool {
 		codeVerifier, err := randomBytesInHex(32)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
+			return "", false
 		}
 
-		sha2 := sha256.New()
-		if _, writeErr := io.WriteString(sha2, codeVerifier); writeErr != nil {
-			http.Error(rw, writeErr.Error(), http.StatusInternalServerError)
-			return
-		}
-		codeChallenge := base64.RawURLEncoding.EncodeToString(sha2.Sum(nil))
-
-		urlValues.Add("code_challenge_method", "S256")
-		urlValues.Add("code_challenge", codeChallenge)
+		urlValues.Add("code_challenge_method", toa.Config.Provider.PkceMethod)
+		urlValues.Add("code_challenge", getCodeChallenge(codeVerifier, toa.Config.Provider.PkceMethod))
 
-		encryptedCodeVerifier, err := utils.Encrypt(codeVerifier, toa.Config.Secret)
+		encryptedCodeVerifier, err := utils.EncryptWithCipher(codeVerifier, toa.Config.EncryptionKey(), toa.Config.Cipher)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
+			return "", false
 		}
 
-		// TODO: Make configurable
-		// TODO does this need domain tweaks?  it is in the login flow
-		http.SetCookie(rw, &http.Cookie{
-			Name:     getCodeVerifierCookieName(toa.Config),
-			Value:    encryptedCodeVerifier,
-			Secure:   true,
-			HttpOnly: true,
-			Path:     toa.CallbackURL.Path,
-			Domain:   toa.CallbackURL.Host,
-			SameSite: http.SameSiteDefaultMode,
-		})
+		http.SetCookie(rw, toa.createCodeVerifierCookie(encryptedCodeVerifier))
 	}
 
 	authorizationEndpointUrl.RawQuery = urlValues.Encode()
 
-	http.Redirect(rw, req, authorizationEndpointUrl.String(), http.StatusFound)
+	return authorizationEndpointUrl.String(), true
+}
+
+// isRememberMeRequested checks whether the user asked for a persistent session on the login endpoint.
+func (toa *TraefikOidcAuth) isRememberMeRequested(req *http.Request) bool {
+	if toa.Config.RememberMe == nil || !toa.Config.RememberMe.Enabled {
+		return false
+	}
+
+	if !toa.isLoginRequest(req) {
+		return false
+	}
+
+	return isTrueParameter(req.FormValue("remember_me"))
+}
+
+// isPopupRequested checks whether the login has been opened in a popup, which should be closed after the callback.
+func (toa *TraefikOidcAuth) isPopupRequested(req *http.Request) bool {
+	if toa.Config.PopupCallback == nil || !toa.Config.PopupCallback.Enabled {
+		return false
+	}
+
+	return isTrueParameter(req.URL.Query().Get("popup"))
+}
+
+func isTrueParameter(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "1", "on", "yes":
+		return true
+	default:
+		return false
+	}
 }
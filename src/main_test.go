@@ -0,0 +1,203 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+)
+
+func newTestOidcAuth(config *Config) *TraefikOidcAuth {
+	defaults := CreateConfig()
+
+	if config.Provider == nil {
+		config.Provider = defaults.Provider
+	}
+	if config.ErrorPages == nil {
+		config.ErrorPages = defaults.ErrorPages
+	}
+	if config.AuthorizationHeader == nil {
+		config.AuthorizationHeader = defaults.AuthorizationHeader
+	}
+	if config.LogoutUri == "" {
+		config.LogoutUri = defaults.LogoutUri
+	}
+	if config.Secret == "" {
+		config.Secret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	}
+	if config.StateMaxAge == 0 {
+		config.StateMaxAge = defaults.StateMaxAge
+	}
+
+	return &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: config,
+	}
+}
+
+func TestApiRouteRuleReturnsBearerChallenge(t *testing.T) {
+	toa := newTestOidcAuth(&Config{UnauthorizedBehavior: "Challenge"})
+
+	apiRouteRule, err := rules.ParseRequestCondition("PathPrefix(`/api`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toa.ApiRouteRule = apiRouteRule
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/items", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.handleUnauthenticated(rw, req)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, but got %d", rw.Code)
+	}
+	if rw.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("Expected a plain Bearer challenge, but got '%s'", rw.Header().Get("WWW-Authenticate"))
+	}
+	if rw.Header().Get("Location") != "" {
+		t.Error("Expected no redirect for API requests")
+	}
+}
+
+func TestApiRouteRuleReportsInvalidToken(t *testing.T) {
+	toa := newTestOidcAuth(&Config{UnauthorizedBehavior: "Bearer"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	rw := httptest.NewRecorder()
+
+	toa.handleUnauthenticated(rw, req)
+
+	expected := `Bearer error="invalid_token", error_description="You're not authorized to access this resource. Please log in to continue."`
+	if rw.Header().Get("WWW-Authenticate") != expected {
+		t.Errorf("Expected challenge '%s', but got '%s'", expected, rw.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestApiRouteRuleReportsInsufficientScope(t *testing.T) {
+	toa := newTestOidcAuth(&Config{UnauthorizedBehavior: "Bearer"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	rw := httptest.NewRecorder()
+
+	toa.handleUnauthorized(rw, req, nil, nil, "")
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", rw.Code)
+	}
+	if rw.Header().Get("WWW-Authenticate") == "" {
+		t.Error("Expected a WWW-Authenticate header")
+	}
+}
+
+func TestUnavailableProviderShowsErrorPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	toa := newTestOidcAuth(&Config{})
+	toa.httpClient = server.Client()
+	toa.ProviderURL, _ = url.Parse(server.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After header to be 30, but got '%s'", rw.Header().Get("Retry-After"))
+	}
+	if rw.Header().Get("Content-Type") != "application/json+problem" {
+		t.Errorf("Expected problem details, but got content type '%s'", rw.Header().Get("Content-Type"))
+	}
+}
+
+func TestInterstitialPageLinksToProvider(t *testing.T) {
+	toa := newTestOidcAuth(&Config{UnauthorizedBehavior: "Interstitial"})
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{
+		AuthorizationEndpoint: "https://idp.example.com/authorize",
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.handleUnauthenticated(rw, req)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Location") != "" {
+		t.Error("Expected no redirect")
+	}
+	if !strings.Contains(rw.Body.String(), "https://idp.example.com/authorize?") {
+		t.Error("Expected the page to link to the authorization endpoint")
+	}
+}
+
+func TestRememberMeRequestsOfflineAccessAndPersistentCookie(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		LoginUri: "/login",
+		Scopes:   []string{"openid"},
+		RememberMe: &RememberMeConfig{
+			Enabled:              true,
+			MaxAge:               3600,
+			RequestOfflineAccess: true,
+		},
+	})
+	toa.CallbackURL, _ = url.Parse("/oidc/callback")
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{
+		AuthorizationEndpoint: "https://idp.example.com/authorize",
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/login?remember_me=true", nil)
+	rw := httptest.NewRecorder()
+
+	authorizationUrl, ok := toa.createAuthorizationUrl(rw, req)
+	if !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	parsedUrl, _ := url.Parse(authorizationUrl)
+	if parsedUrl.Query().Get("scope") != "openid offline_access" {
+		t.Errorf("Expected offline_access to be requested, but got scope '%s'", parsedUrl.Query().Get("scope"))
+	}
+
+	state, err := oidc.DecodeState(parsedUrl.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.RememberMe {
+		t.Error("Expected remember me to be stored in the state")
+	}
+
+	if len(toa.Config.Scopes) != 1 {
+		t.Error("Expected the configured scopes to be left untouched")
+	}
+}
+
+func TestRememberMeIsIgnoredWhenDisabled(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		LoginUri:   "/login",
+		RememberMe: &RememberMeConfig{Enabled: false},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/login?remember_me=true", nil)
+
+	if toa.isRememberMeRequested(req) {
+		t.Error("Expected remember me to be ignored")
+	}
+}
@@ -0,0 +1,503 @@
+package src
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/metrics"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The results recorded for requests passing the middleware.
+const (
+	requestResultBypassed        = "bypassed"
+	requestResultAuthenticated   = "authenticated"
+	requestResultUnauthenticated = "unauthenticated"
+	requestResultUnauthorized    = "unauthorized"
+	requestResultAnonymous       = "anonymous"
+)
+
+// MetricsCollector records the metrics of a middleware instance.
+// All methods may be called on a nil collector, in which case nothing is recorded.
+type MetricsCollector struct {
+	Registry *metrics.Registry
+	Exporter *metrics.PrometheusExporter
+
+	allowedNetworks []*net.IPNet
+
+	// Pushes the metrics to StatsD, if configured
+	statsD *metrics.StatsDSink
+
+	requests      *metrics.Counter
+	logins        *metrics.Counter
+	logouts       *metrics.Counter
+	tokenRenewals *metrics.Counter
+
+	jwksLookups               *metrics.Counter
+	jwksReloads               *metrics.Counter
+	jwksKeys                  *metrics.Gauge
+	jwksKeyInfo               *metrics.Gauge
+	jwksIgnoredKeys           *metrics.Gauge
+	jwksLastReload            *metrics.Gauge
+	introspectionCacheLookups *metrics.Counter
+	discoveries               *metrics.Counter
+	circuitBreakerState       *metrics.Gauge
+	circuitBreakerTransitions *metrics.Counter
+	providerFailovers         *metrics.Counter
+	lockoutFailures           *metrics.Counter
+	lockouts                  *metrics.Counter
+	providerUnavailable       *metrics.Counter
+	rateLimited               *metrics.Counter
+	sessionsRegenerated       *metrics.Counter
+
+	requestDuration         *metrics.Histogram
+	authenticationDuration  *metrics.Histogram
+	providerRequestDuration *metrics.Histogram
+
+	buildInfo *metrics.Gauge
+}
+
+// CreateMetricsCollector creates the collector of a middleware instance.
+// The name of the middleware and the provider are added as labels to all metrics.
+func CreateMetricsCollector(config *MetricsConfig, middlewareName string, provider string) (*MetricsCollector, error) {
+	buckets := config.Buckets
+	if len(buckets) == 0 {
+		buckets = metrics.DefaultBuckets
+	}
+
+	if err := metrics.ValidateBuckets(buckets); err != nil {
+		return nil, err
+	}
+
+	registry := metrics.CreateRegistry("traefik_oidc_auth",
+		metrics.Label{Name: "middleware", Value: middlewareName},
+		metrics.Label{Name: "provider", Value: provider},
+	)
+
+	var statsD *metrics.StatsDSink
+	if config.StatsD != nil && config.StatsD.Address != "" {
+		if config.StatsD.FlushInterval <= 0 {
+			return nil, errors.New("the StatsD flush interval must be greater than 0")
+		}
+
+		sink, err := metrics.CreateStatsDSink(config.StatsD.Address, config.StatsD.Prefix, config.StatsD.DogStatsD, config.StatsD.Tags, time.Duration(config.StatsD.FlushInterval)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+
+		registry.SetSink(sink)
+		statsD = sink
+	}
+
+	collector := &MetricsCollector{
+		Registry: registry,
+		Exporter: metrics.CreatePrometheusExporter(registry),
+
+		requests:      registry.NewCounter("requests_total", "The number of requests handled by the middleware.", "result", "reason"),
+		logins:        registry.NewCounter("logins_total", "The number of completed login callbacks.", "result"),
+		logouts:       registry.NewCounter("logouts_total", "The number of started logouts."),
+		tokenRenewals: registry.NewCounter("token_renewals_total", "The number of token renewals using a refresh token.", "result"),
+
+		jwksLookups:               registry.NewCounter("jwks_cache_lookups_total", "The number of token signature verifications, by whether the key was found in the cached JWKS.", "result"),
+		jwksReloads:               registry.NewCounter("jwks_reloads_total", "The number of attempts to reload a JWKS.", "source", "result"),
+		jwksKeys:                  registry.NewGauge("jwks_keys", "The number of supported keys in a JWKS.", "source"),
+		jwksKeyInfo:               registry.NewGauge("jwks_key_info", "Whether the key with the given id is currently accepted from a JWKS.", "source", "kid"),
+		jwksIgnoredKeys:           registry.NewGauge("jwks_ignored_keys", "The number of keys of a JWKS which have been ignored, eg. because of their use, alg or the key limit.", "source"),
+		jwksLastReload:            registry.NewGauge("jwks_last_reload_timestamp_seconds", "The unix time of the last successful reload of a JWKS.", "source"),
+		introspectionCacheLookups: registry.NewCounter("introspection_cache_lookups_total", "The number of lookups in the introspection cache.", "result"),
+		discoveries:               registry.NewCounter("discovery_requests_total", "The number of attempts to fetch the discovery document of the provider.", "result"),
+		circuitBreakerState:       registry.NewGauge("circuit_breaker_state", "Whether the circuit breaker of the provider is in the given state.", "state"),
+		circuitBreakerTransitions: registry.NewCounter("circuit_breaker_transitions_total", "The number of times the circuit breaker of the provider changed into the given state.", "state"),
+		providerFailovers:         registry.NewCounter("provider_failovers_total", "The number of times new logins were switched to the given provider, either primary or secondary.", "target"),
+		lockoutFailures:           registry.NewCounter("lockout_failures_total", "The number of failed authentication attempts counted towards the lockout, by whether a callback or a token failed.", "reason"),
+		lockouts:                  registry.NewCounter("lockouts_total", "The number of times a client ip or subject has been locked out.", "key"),
+		providerUnavailable:       registry.NewCounter("provider_unavailable_total", "The number of requests answered with the provider unavailable error, by the step which failed.", "step"),
+		rateLimited:               registry.NewCounter("rate_limited_total", "The number of requests rejected by the rate limit, by endpoint.", "endpoint"),
+		sessionsRegenerated:       registry.NewCounter("session_regenerated_total", "The number of session ids regenerated, because the claims changed after a token renewal."),
+
+		requestDuration:         registry.NewHistogram("request_duration_seconds", "The time the middleware spent on a request, excluding the upstream service.", buckets, "result"),
+		authenticationDuration:  registry.NewHistogram("authentication_duration_seconds", "The time spent validating the session or token of a request, including token renewals.", buckets, "result"),
+		providerRequestDuration: registry.NewHistogram("provider_request_duration_seconds", "The duration of requests to the identity provider.", buckets, "endpoint"),
+
+		buildInfo: registry.NewGauge("build_info", "Always 1. Labeled with the version of the plugin and the Go version it is running on.", "version", "goversion"),
+	}
+
+	collector.buildInfo.Set(1, Version, runtime.Version())
+
+	allowedNetworks, err := parseSourceRanges(config.AllowedSourceRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	collector.allowedNetworks = allowedNetworks
+	collector.statsD = statsD
+
+	return collector, nil
+}
+
+// Shutdown sends the values queued for StatsD and stops the sink.
+func (collector *MetricsCollector) Shutdown(ctx context.Context) error {
+	if collector == nil || collector.statsD == nil {
+		return nil
+	}
+
+	return collector.statsD.Shutdown(ctx)
+}
+
+// RecordRequest records the result of a request. The reason describes why the result was chosen, eg. "no_session".
+func (collector *MetricsCollector) RecordRequest(result string, reason string, duration time.Duration) {
+	if collector == nil {
+		return
+	}
+
+	collector.requests.Inc(result, reason)
+	collector.requestDuration.Observe(duration.Seconds(), result)
+}
+
+func (collector *MetricsCollector) RecordJwksLookup(hit bool) {
+	if collector == nil {
+		return
+	}
+
+	collector.jwksLookups.Inc(hitLabel(hit))
+}
+
+// jwksReloadRecorder returns the OnReload callback of a JWKS handler, or nil if metrics are disabled.
+// The source is either "provider" or the issuer of a trusted issuer.
+// Keys which have been removed from the JWKS are set to 0.
+func (collector *MetricsCollector) jwksReloadRecorder(source string) func(err error, keyIds []string, ignoredCount int) {
+	if collector == nil {
+		return nil
+	}
+
+	// The callback is always called while the JWKS handler is locked
+	var previousKeyIds []string
+
+	return func(err error, keyIds []string, ignoredCount int) {
+		collector.jwksReloads.Inc(source, resultLabel(err == nil))
+
+		if err == nil {
+			collector.jwksKeys.Set(float64(len(keyIds)), source)
+			collector.jwksIgnoredKeys.Set(float64(ignoredCount), source)
+			collector.jwksLastReload.Set(float64(time.Now().Unix()), source)
+
+			for _, kid := range previousKeyIds {
+				if !slices.Contains(keyIds, kid) {
+					collector.jwksKeyInfo.Set(0, source, kid)
+				}
+			}
+			for _, kid := range keyIds {
+				collector.jwksKeyInfo.Set(1, source, kid)
+			}
+
+			previousKeyIds = keyIds
+		}
+	}
+}
+
+func (collector *MetricsCollector) RecordIntrospectionCacheLookup(hit bool) {
+	if collector == nil {
+		return
+	}
+
+	collector.introspectionCacheLookups.Inc(hitLabel(hit))
+}
+
+func (collector *MetricsCollector) RecordDiscovery(success bool) {
+	if collector == nil {
+		return
+	}
+
+	collector.discoveries.Inc(resultLabel(success))
+}
+
+// RecordCircuitBreakerState records a change of the state of the circuit breaker.
+func (collector *MetricsCollector) RecordCircuitBreakerState(state string) {
+	if collector == nil {
+		return
+	}
+
+	collector.setCircuitBreakerState(state)
+	collector.circuitBreakerTransitions.Inc(state)
+}
+
+func (collector *MetricsCollector) setCircuitBreakerState(state string) {
+	for _, s := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+
+		collector.circuitBreakerState.Set(value, s)
+	}
+}
+
+// RecordProviderFailover records that new logins are now sent to the given provider.
+func (collector *MetricsCollector) RecordProviderFailover(target string) {
+	if collector == nil {
+		return
+	}
+
+	collector.providerFailovers.Inc(target)
+}
+
+func (collector *MetricsCollector) RecordAuthentication(success bool, duration time.Duration) {
+	if collector == nil {
+		return
+	}
+
+	collector.authenticationDuration.Observe(duration.Seconds(), resultLabel(success))
+}
+
+func (collector *MetricsCollector) RecordProviderRequest(endpoint string, duration time.Duration) {
+	if collector == nil {
+		return
+	}
+
+	collector.providerRequestDuration.Observe(duration.Seconds(), endpoint)
+}
+
+func (collector *MetricsCollector) RecordLockoutFailure(reason string) {
+	if collector == nil {
+		return
+	}
+
+	collector.lockoutFailures.Inc(reason)
+}
+
+func (collector *MetricsCollector) RecordLockout(key string) {
+	if collector == nil {
+		return
+	}
+
+	collector.lockouts.Inc(key)
+}
+
+// RecordProviderUnavailable records that a request has been answered with the provider unavailable error,
+// because the given step failed, eg. discovery or token_exchange.
+func (collector *MetricsCollector) RecordProviderUnavailable(step string) {
+	if collector == nil {
+		return
+	}
+
+	collector.providerUnavailable.Inc(step)
+}
+
+func (collector *MetricsCollector) RecordRateLimited(endpoint string) {
+	if collector == nil {
+		return
+	}
+
+	collector.rateLimited.Inc(endpoint)
+}
+
+func (collector *MetricsCollector) RecordSessionRegenerated() {
+	if collector == nil {
+		return
+	}
+
+	collector.sessionsRegenerated.Inc()
+}
+
+func (collector *MetricsCollector) RecordLogin(success bool) {
+	if collector == nil {
+		return
+	}
+
+	collector.logins.Inc(resultLabel(success))
+}
+
+func (collector *MetricsCollector) RecordLogout() {
+	if collector == nil {
+		return
+	}
+
+	collector.logouts.Inc()
+}
+
+func (collector *MetricsCollector) RecordTokenRenewal(success bool) {
+	if collector == nil {
+		return
+	}
+
+	collector.tokenRenewals.Inc(resultLabel(success))
+}
+
+// getAuthenticationSource returns the reason label for an authenticated request.
+func getAuthenticationSource(state *session.SessionState) string {
+	switch state.Id {
+	case "AuthorizationHeader":
+		return "authorization_header"
+	case "AuthorizationCookie":
+		return "authorization_cookie"
+	default:
+		return "session"
+	}
+}
+
+// getUnauthenticatedReason returns the reason label for an unauthenticated request.
+func getUnauthenticatedReason(err error) string {
+	switch {
+	case errors.Is(err, errNoSession):
+		return "no_session"
+	case errors.Is(err, errInvalidToken):
+		return "invalid_token"
+	case errors.Is(err, errInvalidSession):
+		return "invalid_session"
+	default:
+		return "unknown"
+	}
+}
+
+func hitLabel(hit bool) string {
+	if hit {
+		return "hit"
+	}
+
+	return "miss"
+}
+
+func resultLabel(success bool) string {
+	if success {
+		return "success"
+	}
+
+	return "failure"
+}
+
+// providerMetricsTransport measures the duration of all requests to the identity provider.
+type providerMetricsTransport struct {
+	next http.RoundTripper
+	toa  *TraefikOidcAuth
+}
+
+func (transport *providerMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := transport.toa.now()
+	resp, err := transport.next.RoundTrip(req)
+	transport.toa.Metrics.RecordProviderRequest(transport.toa.getProviderEndpointName(req.URL), transport.toa.now().Sub(start))
+
+	return resp, err
+}
+
+// getProviderEndpointName maps the url of a request to the identity provider to a name with a low cardinality.
+func (toa *TraefikOidcAuth) getProviderEndpointName(u *url.URL) string {
+	if strings.HasSuffix(u.Path, "/.well-known/openid-configuration") {
+		return "discovery"
+	}
+
+	requestUrl := *u
+	requestUrl.RawQuery = ""
+	requestUrl.Fragment = ""
+
+	for _, document := range []*oidc.OidcDiscovery{toa.DiscoveryDocument, toa.SecondaryProvider.getDiscoveryDocument()} {
+		if document == nil {
+			continue
+		}
+
+		switch requestUrl.String() {
+		case document.TokenEndpoint:
+			return "token"
+		case document.UserinfoEndpoint:
+			return "userinfo"
+		case document.JWKSURI:
+			return "jwks"
+		case document.IntrospectionEndpoint:
+			return "introspection"
+		}
+	}
+
+	for _, issuer := range toa.TrustedIssuers {
+		if issuer.Jwks.Url == requestUrl.String() {
+			return "jwks"
+		}
+	}
+
+	return "other"
+}
+
+func (toa *TraefikOidcAuth) isMetricsRequest(req *http.Request) bool {
+	return toa.Metrics != nil && toa.Config.Metrics.Path != "" && req.URL.Path == toa.Config.Metrics.Path
+}
+
+// handleMetrics serves the metrics in the Prometheus text format, if the client is allowed to read them.
+func (toa *TraefikOidcAuth) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	if !toa.checkEndpointAccess(rw, req, "metrics", toa.Metrics.allowedNetworks, toa.Config.Metrics.Token) {
+		return
+	}
+
+	rw.Header().Set("Content-Type", metrics.PrometheusContentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+
+	if err := toa.Metrics.Exporter.Export(rw); err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to write the metrics: %s", err.Error())
+	}
+}
+
+// checkEndpointAccess restricts an internal endpoint, like the metrics, to the allowed networks and
+// requires the bearer token, if one is configured. Returns false, if the access has been denied.
+func (toa *TraefikOidcAuth) checkEndpointAccess(rw http.ResponseWriter, req *http.Request, name string, allowedNetworks []*net.IPNet, token string) bool {
+	if !isAllowedSource(req, allowedNetworks) {
+		toa.logger.Log(logging.LevelWarn, "Denied access to the %s from %s.", name, utils.GetClientIp(req))
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if token != "" {
+		providedToken, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+		if !found || subtle.ConstantTimeCompare([]byte(providedToken), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseSourceRanges(sourceRanges []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, sourceRange := range sourceRanges {
+		_, network, err := net.ParseCIDR(sourceRange)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isAllowedSource checks whether the client ip is in one of the networks. All clients are allowed without networks.
+func isAllowedSource(req *http.Request, allowedNetworks []*net.IPNet) bool {
+	if len(allowedNetworks) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(utils.GetClientIp(req))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
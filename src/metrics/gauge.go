@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Gauge is a value which can go up and down, optionally partitioned by labels.
+type Gauge struct {
+	Name       string
+	Help       string
+	LabelNames []string
+
+	registry *Registry
+
+	// The lock only guards the map. Values are updated atomically, so recording only takes a shared lock.
+	lock   sync.RWMutex
+	values map[string]*counterValue
+}
+
+func (registry *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	gauge := &Gauge{
+		Name:       name,
+		Help:       help,
+		LabelNames: labelNames,
+		registry:   registry,
+		values:     make(map[string]*counterValue),
+	}
+
+	registry.register(gauge)
+
+	return gauge
+}
+
+func (gauge *Gauge) MetricName() string {
+	return gauge.Name
+}
+
+// Set sets the gauge to value. The label values must be in the same order as the label names.
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	gauge.lock.RLock()
+	current, ok := gauge.values[key]
+	gauge.lock.RUnlock()
+
+	if !ok {
+		gauge.lock.Lock()
+		current, ok = gauge.values[key]
+		if !ok {
+			current = &counterValue{labelValues: labelValues}
+			gauge.values[key] = current
+		}
+		gauge.lock.Unlock()
+	}
+
+	storeFloat64(&current.valueBits, value)
+
+	if sink := gauge.registry.sink; sink != nil {
+		sink.Gauge(gauge.Name, value, gauge.registry.labels(gauge.LabelNames, labelValues))
+	}
+}
+
+// Samples returns a snapshot of all values, sorted by their label values.
+func (gauge *Gauge) Samples() []CounterSample {
+	gauge.lock.RLock()
+
+	samples := make([]CounterSample, 0, len(gauge.values))
+	for _, value := range gauge.values {
+		samples = append(samples, CounterSample{LabelValues: value.labelValues, Value: loadFloat64(&value.valueBits)})
+	}
+
+	gauge.lock.RUnlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return labelKey(samples[i].LabelValues) < labelKey(samples[j].LabelValues)
+	})
+
+	return samples
+}
+
+func storeFloat64(addr *uint64, value float64) {
+	atomic.StoreUint64(addr, math.Float64bits(value))
+}
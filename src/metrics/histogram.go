@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds in seconds used for latency histograms, unless configured otherwise.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets, optionally partitioned by labels.
+// Unlike quantiles computed by every instance, the buckets can be aggregated across instances.
+type Histogram struct {
+	Name       string
+	Help       string
+	LabelNames []string
+	// The upper bounds of the buckets in ascending order, without +Inf.
+	Buckets []float64
+
+	registry *Registry
+
+	// The lock only guards the map. Values are updated atomically, so recording only takes a shared lock.
+	lock   sync.RWMutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// The bits of the float64 sum. Must be the first field to be 64-bit aligned for atomic access.
+	sumBits     uint64
+	labelValues []string
+	// The number of observations per bucket. The last entry counts the observations above the last bound.
+	bucketCounts []uint64
+}
+
+// HistogramSample is a snapshot of a single labeled value of a histogram.
+type HistogramSample struct {
+	LabelValues []string
+	// The cumulative number of observations less than or equal to the bound of each bucket.
+	CumulativeCounts []uint64
+	Sum              float64
+	Count            uint64
+}
+
+// ValidateBuckets checks whether the bucket bounds are positive and strictly ascending.
+func ValidateBuckets(buckets []float64) error {
+	for i, bound := range buckets {
+		if bound <= 0 {
+			return errors.New("bucket bounds must be greater than 0")
+		}
+		if i > 0 && bound <= buckets[i-1] {
+			return errors.New("bucket bounds must be in ascending order")
+		}
+	}
+
+	return nil
+}
+
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{
+		Name:       name,
+		Help:       help,
+		LabelNames: labelNames,
+		Buckets:    buckets,
+		registry:   registry,
+		values:     make(map[string]*histogramValue),
+	}
+
+	registry.register(histogram)
+
+	return histogram
+}
+
+func (histogram *Histogram) MetricName() string {
+	return histogram.Name
+}
+
+// Observe records a single value. The label values must be in the same order as the label names.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	bucket := sort.SearchFloat64s(histogram.Buckets, value)
+
+	key := labelKey(labelValues)
+
+	histogram.lock.RLock()
+	current, ok := histogram.values[key]
+	histogram.lock.RUnlock()
+
+	if !ok {
+		histogram.lock.Lock()
+		current, ok = histogram.values[key]
+		if !ok {
+			current = &histogramValue{
+				labelValues:  labelValues,
+				bucketCounts: make([]uint64, len(histogram.Buckets)+1),
+			}
+			histogram.values[key] = current
+		}
+		histogram.lock.Unlock()
+	}
+
+	atomic.AddUint64(&current.bucketCounts[bucket], 1)
+	addFloat64(&current.sumBits, value)
+
+	if sink := histogram.registry.sink; sink != nil {
+		sink.Observe(histogram.Name, value, histogram.registry.labels(histogram.LabelNames, labelValues))
+	}
+}
+
+// Samples returns a snapshot of all values, sorted by their label values.
+func (histogram *Histogram) Samples() []HistogramSample {
+	histogram.lock.RLock()
+
+	samples := make([]HistogramSample, 0, len(histogram.values))
+	for _, value := range histogram.values {
+		cumulativeCounts := make([]uint64, len(histogram.Buckets))
+
+		// The count is derived from the buckets, so the +Inf bucket always matches it,
+		// even if observations are recorded concurrently.
+		var cumulative uint64
+		for i := range value.bucketCounts {
+			cumulative += atomic.LoadUint64(&value.bucketCounts[i])
+			if i < len(cumulativeCounts) {
+				cumulativeCounts[i] = cumulative
+			}
+		}
+
+		samples = append(samples, HistogramSample{
+			LabelValues:      value.labelValues,
+			CumulativeCounts: cumulativeCounts,
+			Sum:              loadFloat64(&value.sumBits),
+			Count:            cumulative,
+		})
+	}
+
+	histogram.lock.RUnlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return labelKey(samples[i].LabelValues) < labelKey(samples[j].LabelValues)
+	})
+
+	return samples
+}
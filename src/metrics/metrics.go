@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds all metrics of a middleware instance.
+type Registry struct {
+	// The prefix of all metric names when exported to Prometheus, eg. "traefik_oidc_auth".
+	Namespace string
+	// Labels which are added to every sample, eg. the name of the middleware.
+	ConstLabels []Label
+
+	lock    sync.Mutex
+	metrics []Metric
+	sink    Sink
+}
+
+// Sink receives every recorded value as it happens, eg. to push it to a StatsD server.
+type Sink interface {
+	Count(name string, delta float64, labels []Label)
+	Gauge(name string, value float64, labels []Label)
+	Observe(name string, value float64, labels []Label)
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Metric is either a *Counter, a *Gauge or a *Histogram.
+type Metric interface {
+	MetricName() string
+}
+
+func CreateRegistry(namespace string, constLabels ...Label) *Registry {
+	return &Registry{Namespace: namespace, ConstLabels: constLabels}
+}
+
+// SetSink sets the sink which receives all recorded values. It must be called before any value is recorded.
+func (registry *Registry) SetSink(sink Sink) {
+	registry.sink = sink
+}
+
+// labels returns the constant labels followed by the labels of a single value.
+func (registry *Registry) labels(labelNames []string, labelValues []string) []Label {
+	labels := make([]Label, 0, len(registry.ConstLabels)+len(labelNames))
+	labels = append(labels, registry.ConstLabels...)
+
+	for i, name := range labelNames {
+		if i < len(labelValues) {
+			labels = append(labels, Label{Name: name, Value: labelValues[i]})
+		}
+	}
+
+	return labels
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by labels.
+type Counter struct {
+	Name       string
+	Help       string
+	LabelNames []string
+
+	registry *Registry
+
+	// The lock only guards the map. Values are updated atomically, so recording only takes a shared lock.
+	lock   sync.RWMutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	// The bits of the float64 value. Must be the first field to be 64-bit aligned for atomic access.
+	valueBits   uint64
+	labelValues []string
+}
+
+// CounterSample is a snapshot of a single labeled value of a counter.
+type CounterSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+func (registry *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{
+		Name:       name,
+		Help:       help,
+		LabelNames: labelNames,
+		registry:   registry,
+		values:     make(map[string]*counterValue),
+	}
+
+	registry.register(counter)
+
+	return counter
+}
+
+func (registry *Registry) register(metric Metric) {
+	registry.lock.Lock()
+	registry.metrics = append(registry.metrics, metric)
+	registry.lock.Unlock()
+}
+
+// Metrics returns all registered metrics in the order they have been registered.
+func (registry *Registry) Metrics() []Metric {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	return append([]Metric{}, registry.metrics...)
+}
+
+func (counter *Counter) MetricName() string {
+	return counter.Name
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add increases the counter by delta. The label values must be in the same order as the label names.
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	key := labelKey(labelValues)
+
+	counter.lock.RLock()
+	value, ok := counter.values[key]
+	counter.lock.RUnlock()
+
+	if !ok {
+		counter.lock.Lock()
+		value, ok = counter.values[key]
+		if !ok {
+			value = &counterValue{labelValues: labelValues}
+			counter.values[key] = value
+		}
+		counter.lock.Unlock()
+	}
+
+	addFloat64(&value.valueBits, delta)
+
+	if sink := counter.registry.sink; sink != nil {
+		sink.Count(counter.Name, delta, counter.registry.labels(counter.LabelNames, labelValues))
+	}
+}
+
+// Samples returns a snapshot of all values, sorted by their label values.
+func (counter *Counter) Samples() []CounterSample {
+	counter.lock.RLock()
+
+	samples := make([]CounterSample, 0, len(counter.values))
+	for _, value := range counter.values {
+		samples = append(samples, CounterSample{LabelValues: value.labelValues, Value: loadFloat64(&value.valueBits)})
+	}
+
+	counter.lock.RUnlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return labelKey(samples[i].LabelValues) < labelKey(samples[j].LabelValues)
+	})
+
+	return samples
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// addFloat64 atomically adds delta to the float64 stored as bits in addr.
+func addFloat64(addr *uint64, delta float64) {
+	for {
+		oldBits := atomic.LoadUint64(addr)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + delta)
+
+		if atomic.CompareAndSwapUint64(addr, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+func loadFloat64(addr *uint64) float64 {
+	return math.Float64frombits(atomic.LoadUint64(addr))
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentRecording(t *testing.T) {
+	registry := CreateRegistry("")
+	counter := registry.NewCounter("requests_total", "The number of requests.", "result")
+	histogram := registry.NewHistogram("duration_seconds", "The duration.", []float64{0.5}, "result")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				counter.Inc("success")
+				histogram.Observe(0.25, "success")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value := counter.Samples()[0].Value; value != 8000 {
+		t.Errorf("Expected the counter to be 8000, but got %v", value)
+	}
+
+	sample := histogram.Samples()[0]
+	if sample.Count != 8000 || sample.CumulativeCounts[0] != 8000 || sample.Sum != 2000 {
+		t.Errorf("Unexpected histogram sample %+v", sample)
+	}
+}
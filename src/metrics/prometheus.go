@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusExporter writes the metrics of a registry in the Prometheus text exposition format.
+type PrometheusExporter struct {
+	registry *Registry
+}
+
+func CreatePrometheusExporter(registry *Registry) *PrometheusExporter {
+	return &PrometheusExporter{registry: registry}
+}
+
+func (exporter *PrometheusExporter) Export(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+
+	for _, metric := range exporter.registry.Metrics() {
+		switch m := metric.(type) {
+		case *Counter:
+			writeCounter(writer, exporter.registry, m)
+		case *Gauge:
+			writeGauge(writer, exporter.registry, m)
+		case *Histogram:
+			writeHistogram(writer, exporter.registry, m)
+		}
+	}
+
+	return writer.Flush()
+}
+
+func writeCounter(writer *bufio.Writer, registry *Registry, counter *Counter) {
+	name := prometheusName(registry.Namespace, counter.Name)
+
+	writeHeader(writer, name, counter.Help, "counter")
+
+	for _, sample := range counter.Samples() {
+		writer.WriteString(name)
+		writeLabels(writer, registry.ConstLabels, counter.LabelNames, sample.LabelValues, "", "")
+		writer.WriteString(" " + formatValue(sample.Value) + "\n")
+	}
+}
+
+func writeGauge(writer *bufio.Writer, registry *Registry, gauge *Gauge) {
+	name := prometheusName(registry.Namespace, gauge.Name)
+
+	writeHeader(writer, name, gauge.Help, "gauge")
+
+	for _, sample := range gauge.Samples() {
+		writer.WriteString(name)
+		writeLabels(writer, registry.ConstLabels, gauge.LabelNames, sample.LabelValues, "", "")
+		writer.WriteString(" " + formatValue(sample.Value) + "\n")
+	}
+}
+
+func writeHistogram(writer *bufio.Writer, registry *Registry, histogram *Histogram) {
+	name := prometheusName(registry.Namespace, histogram.Name)
+	constLabels := registry.ConstLabels
+
+	writeHeader(writer, name, histogram.Help, "histogram")
+
+	for _, sample := range histogram.Samples() {
+		for i, bound := range histogram.Buckets {
+			writer.WriteString(name + "_bucket")
+			writeLabels(writer, constLabels, histogram.LabelNames, sample.LabelValues, "le", formatValue(bound))
+			writer.WriteString(" " + strconv.FormatUint(sample.CumulativeCounts[i], 10) + "\n")
+		}
+
+		writer.WriteString(name + "_bucket")
+		writeLabels(writer, constLabels, histogram.LabelNames, sample.LabelValues, "le", "+Inf")
+		writer.WriteString(" " + strconv.FormatUint(sample.Count, 10) + "\n")
+
+		writer.WriteString(name + "_sum")
+		writeLabels(writer, constLabels, histogram.LabelNames, sample.LabelValues, "", "")
+		writer.WriteString(" " + formatValue(sample.Sum) + "\n")
+
+		writer.WriteString(name + "_count")
+		writeLabels(writer, constLabels, histogram.LabelNames, sample.LabelValues, "", "")
+		writer.WriteString(" " + strconv.FormatUint(sample.Count, 10) + "\n")
+	}
+}
+
+func writeHeader(writer *bufio.Writer, name string, help string, metricType string) {
+	writer.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	writer.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func prometheusName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+
+	return namespace + "_" + name
+}
+
+// writeLabels writes the label set of a sample, starting with the constant labels.
+// The extra label is appended if its name is not empty, eg. "le" for buckets.
+func writeLabels(writer *bufio.Writer, constLabels []Label, labelNames []string, labelValues []string, extraName string, extraValue string) {
+	labels := append([]Label{}, constLabels...)
+
+	for i, name := range labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+
+	if extraName != "" {
+		labels = append(labels, Label{Name: extraName, Value: extraValue})
+	}
+
+	if len(labels) == 0 {
+		return
+	}
+
+	writer.WriteString("{")
+
+	for i, label := range labels {
+		if i > 0 {
+			writer.WriteString(",")
+		}
+
+		writer.WriteString(label.Name + "=\"" + escapeLabelValue(label.Value) + "\"")
+	}
+
+	writer.WriteString("}")
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// In contrast to label values, quotes must not be escaped in HELP lines.
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
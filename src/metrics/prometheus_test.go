@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrometheusExporterWritesCounters(t *testing.T) {
+	registry := CreateRegistry("")
+
+	requests := registry.NewCounter("requests_total", "The number of requests.", "result")
+	requests.Inc("unauthenticated")
+	requests.Inc("authenticated")
+	requests.Add(2, "authenticated")
+	requests.Inc("quote\"d")
+
+	logouts := registry.NewCounter("logouts_total", "The number of logouts.")
+	logouts.Inc()
+
+	var output bytes.Buffer
+	if err := CreatePrometheusExporter(registry).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP requests_total The number of requests.
+# TYPE requests_total counter
+requests_total{result="authenticated"} 3
+requests_total{result="quote\"d"} 1
+requests_total{result="unauthenticated"} 1
+# HELP logouts_total The number of logouts.
+# TYPE logouts_total counter
+logouts_total 1
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
+
+func TestPrometheusExporterWritesCumulativeHistogramBuckets(t *testing.T) {
+	registry := CreateRegistry("")
+
+	duration := registry.NewHistogram("duration_seconds", "The duration.", []float64{0.1, 1}, "result")
+	duration.Observe(0.05, "success")
+	duration.Observe(0.1, "success")
+	duration.Observe(0.5, "success")
+	duration.Observe(3, "success")
+
+	var output bytes.Buffer
+	if err := CreatePrometheusExporter(registry).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP duration_seconds The duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{result="success",le="0.1"} 2
+duration_seconds_bucket{result="success",le="1"} 3
+duration_seconds_bucket{result="success",le="+Inf"} 4
+duration_seconds_sum{result="success"} 3.65
+duration_seconds_count{result="success"} 4
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
+
+func TestValidateBuckets(t *testing.T) {
+	if err := ValidateBuckets(DefaultBuckets); err != nil {
+		t.Errorf("Expected the default buckets to be valid: %s", err.Error())
+	}
+	if ValidateBuckets([]float64{1, 0.5}) == nil {
+		t.Error("Expected unordered buckets to be rejected")
+	}
+	if ValidateBuckets([]float64{0, 1}) == nil {
+		t.Error("Expected a zero bound to be rejected")
+	}
+}
+
+func TestPrometheusExporterWritesConstLabels(t *testing.T) {
+	registry := CreateRegistry("", Label{Name: "middleware", Value: "oidc@file"})
+
+	registry.NewCounter("logouts_total", "The number of logouts.").Inc()
+	registry.NewCounter("requests_total", "The number of requests.", "result").Inc("authenticated")
+
+	var output bytes.Buffer
+	if err := CreatePrometheusExporter(registry).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP logouts_total The number of logouts.
+# TYPE logouts_total counter
+logouts_total{middleware="oidc@file"} 1
+# HELP requests_total The number of requests.
+# TYPE requests_total counter
+requests_total{middleware="oidc@file",result="authenticated"} 1
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
+
+func TestPrometheusExporterWritesGauges(t *testing.T) {
+	registry := CreateRegistry("oidc")
+
+	keys := registry.NewGauge("jwks_keys", "The number of keys.", "source")
+	keys.Set(3, "provider")
+	keys.Set(2, "provider")
+
+	var output bytes.Buffer
+	if err := CreatePrometheusExporter(registry).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP oidc_jwks_keys The number of keys.
+# TYPE oidc_jwks_keys gauge
+oidc_jwks_keys{source="provider"} 2
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
+
+func TestPrometheusExporterEscapesHelp(t *testing.T) {
+	registry := CreateRegistry("")
+
+	registry.NewCounter("logouts_total", "The number of \"logouts\",\nseparated by C:\\path.").Inc()
+
+	var output bytes.Buffer
+	if err := CreatePrometheusExporter(registry).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP logouts_total The number of "logouts",\nseparated by C:\\path.
+# TYPE logouts_total counter
+logouts_total 1
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum size of a single UDP packet, which fits into the common ethernet MTU.
+const statsDMaxPacketSize = 1432
+
+// The number of lines which may be queued before new values are dropped.
+const statsDQueueSize = 4096
+
+// StatsDSink sends all recorded values to a StatsD server using UDP.
+// Counters are sent as counts, gauges as gauges and histograms as timers in milliseconds.
+// Values are sent in batches and dropped when the queue is full, so recording never blocks a request.
+type StatsDSink struct {
+	conn   net.Conn
+	prefix string
+	// Whether to send the labels as DogStatsD tags.
+	sendTags bool
+	tags     []string
+
+	lines chan string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// CreateStatsDSink creates a sink sending to the address, eg. "localhost:8125".
+// The extra tags, eg. "env:prod", are added to every value when tags are enabled.
+func CreateStatsDSink(address string, prefix string, sendTags bool, tags []string, flushInterval time.Duration) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &StatsDSink{
+		conn:     conn,
+		prefix:   prefix,
+		sendTags: sendTags,
+		tags:     tags,
+		lines:    make(chan string, statsDQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go sink.run(flushInterval)
+
+	return sink, nil
+}
+
+func (sink *StatsDSink) Count(name string, delta float64, labels []Label) {
+	sink.enqueue(sink.prefix + statsDName(name) + ":" + formatValue(delta) + "|c" + sink.formatTags(labels))
+}
+
+func (sink *StatsDSink) Gauge(name string, value float64, labels []Label) {
+	sink.enqueue(sink.prefix + statsDName(name) + ":" + formatValue(value) + "|g" + sink.formatTags(labels))
+}
+
+func (sink *StatsDSink) Observe(name string, value float64, labels []Label) {
+	// Histograms record seconds, but timers are expected in milliseconds
+	sink.enqueue(sink.prefix + statsDName(name) + ":" + formatValue(value*1000) + "|ms" + sink.formatTags(labels))
+}
+
+func (sink *StatsDSink) enqueue(line string) {
+	select {
+	case sink.lines <- line:
+	default:
+	}
+}
+
+func (sink *StatsDSink) formatTags(labels []Label) string {
+	if !sink.sendTags || (len(labels) == 0 && len(sink.tags) == 0) {
+		return ""
+	}
+
+	tags := make([]string, 0, len(labels)+len(sink.tags))
+	for _, label := range labels {
+		tags = append(tags, label.Name+":"+escapeStatsDTag(label.Value))
+	}
+	tags = append(tags, sink.tags...)
+
+	return "|#" + strings.Join(tags, ",")
+}
+
+// Shutdown sends all queued values and closes the connection. Values recorded afterwards are dropped.
+func (sink *StatsDSink) Shutdown(ctx context.Context) error {
+	sink.stopOnce.Do(func() { close(sink.stop) })
+
+	select {
+	case <-sink.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches the queued lines into packets and sends them when a packet is full or the flush interval elapsed.
+func (sink *StatsDSink) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var packet strings.Builder
+
+	flush := func() {
+		if packet.Len() > 0 {
+			_, _ = sink.conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+	}
+
+	add := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsDMaxPacketSize {
+			flush()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteString("\n")
+		}
+		packet.WriteString(line)
+	}
+
+	for {
+		select {
+		case line := <-sink.lines:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-sink.stop:
+			for len(sink.lines) > 0 {
+				add(<-sink.lines)
+			}
+			flush()
+
+			sink.conn.Close()
+			close(sink.stopped)
+			return
+		}
+	}
+}
+
+// statsDName removes the unit suffixes, which are part of the Prometheus naming conventions.
+// The type of a StatsD metric is sent along with its value instead.
+func statsDName(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	name = strings.TrimSuffix(name, "_seconds")
+
+	return name
+}
+
+var statsDTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+func escapeStatsDTag(value string) string {
+	return statsDTagEscaper.Replace(value)
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDSinkSendsBatchedLines(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := CreateStatsDSink(listener.LocalAddr().String(), "oidc.", true, []string{"env:test"}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := CreateRegistry("traefik_oidc_auth", Label{Name: "middleware", Value: "oidc@file"})
+	registry.SetSink(sink)
+
+	registry.NewCounter("requests_total", "The number of requests.", "result").Inc("authenticated")
+	registry.NewHistogram("request_duration_seconds", "The duration.", DefaultBuckets).Observe(0.25)
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	received := ""
+	buffer := make([]byte, statsDMaxPacketSize)
+	for strings.Count(received, "\n") < 1 {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("Expected both values to be sent, but got %q: %s", received, err.Error())
+		}
+		if received != "" {
+			received += "\n"
+		}
+		received += string(buffer[:n])
+	}
+
+	expected := "oidc.requests:1|c|#middleware:oidc@file,result:authenticated,env:test\noidc.request_duration:250|ms|#middleware:oidc@file,env:test"
+	if received != expected {
+		t.Errorf("Expected %q, but got %q", expected, received)
+	}
+}
+
+func TestStatsDSinkFlushesOnShutdown(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The values must be sent on shutdown, not after the flush interval
+	sink, err := CreateStatsDSink(listener.LocalAddr().String(), "oidc.", false, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.Count("logins_total", 1, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := sink.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buffer := make([]byte, statsDMaxPacketSize)
+	n, _, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("Expected the queued value to be sent: %s", err.Error())
+	}
+	if string(buffer[:n]) != "oidc.logins:1|c" {
+		t.Errorf("Expected the login to be sent, but got %q", string(buffer[:n]))
+	}
+
+	// Values recorded after the shutdown are dropped and a second shutdown has no effect
+	sink.Count("logins_total", 1, nil)
+	if err := sink.Shutdown(ctx); err != nil {
+		t.Errorf("Expected the second shutdown to succeed, but got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func newTestMetricsOidcAuth(t *testing.T, metricsConfig *MetricsConfig) *TraefikOidcAuth {
+	collector, err := CreateMetricsCollector(metricsConfig, "oidc@file", "https://idp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{Metrics: metricsConfig})
+	toa.Metrics = collector
+
+	return toa
+}
+
+func TestMetricsEndpointServesPrometheusFormat(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+
+	toa.Metrics.RecordRequest(requestResultUnauthenticated, getUnauthenticatedReason(errNoSession), 30*time.Millisecond)
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), `traefik_oidc_auth_requests_total{middleware="oidc@file",provider="https://idp.example.com",result="unauthenticated",reason="no_session"} 1`) {
+		t.Errorf("Expected the unauthenticated request to be counted, but got:\n%s", rw.Body.String())
+	}
+	if !strings.Contains(rw.Body.String(), `traefik_oidc_auth_request_duration_seconds_bucket{middleware="oidc@file",provider="https://idp.example.com",result="unauthenticated",le="0.05"} 1`) {
+		t.Errorf("Expected the duration to be observed, but got:\n%s", rw.Body.String())
+	}
+}
+
+func TestUnavailableProviderIsCountedByStep(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+	toa.httpClient = server.Client()
+	toa.ProviderURL, _ = url.Parse(server.URL)
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	if !strings.Contains(rw.Body.String(), `traefik_oidc_auth_provider_unavailable_total{middleware="oidc@file",provider="https://idp.example.com",step="discovery"} 1`) {
+		t.Errorf("Expected the failed discovery to be counted, but got:\n%s", rw.Body.String())
+	}
+}
+
+func TestStatsDSinkIsStoppedWhenTheMiddlewareFailsToStart(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.Metrics.Enabled = true
+	config.Metrics.StatsD.Address = listener.LocalAddr().String()
+	config.Metrics.StatsD.FlushInterval = 3600
+	config.Debug.Enabled = true
+
+	if _, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Fatal("Expected the debug endpoint without Token or AllowedSourceRanges to be rejected")
+	}
+
+	// The buffered values are only sent before the flush interval, if the sink has been shut down
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buffer := make([]byte, 1432)
+	if _, _, err := listener.ReadFrom(buffer); err != nil {
+		t.Errorf("Expected the StatsD sink to be shut down: %s", err.Error())
+	}
+}
+
+func TestProviderEndpointNames(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{
+		TokenEndpoint: "https://idp.example.com/token",
+		JWKSURI:       "https://idp.example.com/jwks",
+	}
+
+	tests := map[string]string{
+		"https://idp.example.com/.well-known/openid-configuration": "discovery",
+		"https://idp.example.com/token":                            "token",
+		"https://idp.example.com/jwks?v=1":                         "jwks",
+		"https://idp.example.com/unknown":                          "other",
+	}
+
+	for rawUrl, expected := range tests {
+		u, _ := url.Parse(rawUrl)
+
+		if name := toa.getProviderEndpointName(u); name != expected {
+			t.Errorf("Expected %s for %s, but got %s", expected, rawUrl, name)
+		}
+	}
+}
+
+func TestMetricsEndpointRequiresToken(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics", Token: "secret-token"})
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a token, but got %d", rw.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with a valid token, but got %d", rw.Code)
+	}
+}
+
+func TestMetricsEndpointChecksSourceRanges(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics", AllowedSourceRanges: []string{"10.0.0.0/8"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil)
+	req.RemoteAddr = "192.168.1.10:1234"
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a foreign network, but got %d", rw.Code)
+	}
+
+	req.RemoteAddr = "10.1.2.3:1234"
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for an allowed network, but got %d", rw.Code)
+	}
+}
+
+func TestCreateMetricsCollectorRejectsInvalidConfig(t *testing.T) {
+	if _, err := CreateMetricsCollector(&MetricsConfig{AllowedSourceRanges: []string{"not-a-cidr"}}, "", ""); err == nil {
+		t.Error("Expected an invalid source range to be rejected")
+	}
+	if _, err := CreateMetricsCollector(&MetricsConfig{Buckets: []float64{1, 0.5}}, "", ""); err == nil {
+		t.Error("Expected unordered buckets to be rejected")
+	}
+}
+
+func TestUnauthenticatedReasons(t *testing.T) {
+	tests := map[error]string{
+		errNoSession: "no_session",
+		fmt.Errorf("%w: failed to validate session ticket: expired", errInvalidSession):               "invalid_session",
+		fmt.Errorf("%w: failed to validate token from AuthorizationHeader: expired", errInvalidToken): "invalid_token",
+		errors.New("something else"): "unknown",
+	}
+
+	for err, expected := range tests {
+		if reason := getUnauthenticatedReason(err); reason != expected {
+			t.Errorf("Expected %s for %s, but got %s", expected, err.Error(), reason)
+		}
+	}
+}
+
+func TestJwksReloadMetrics(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+
+	onReload := toa.Metrics.jwksReloadRecorder("provider")
+	onReload(nil, []string{"key-1", "key-2"}, 1)
+	onReload(nil, []string{"key-2", "key-3"}, 0)
+	onReload(errors.New("unreachable"), nil, 0)
+
+	if (*MetricsCollector)(nil).jwksReloadRecorder("provider") != nil {
+		t.Error("Expected no callback when metrics are disabled")
+	}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	for _, expected := range []string{
+		`traefik_oidc_auth_jwks_reloads_total{middleware="oidc@file",provider="https://idp.example.com",source="provider",result="success"} 2`,
+		`traefik_oidc_auth_jwks_reloads_total{middleware="oidc@file",provider="https://idp.example.com",source="provider",result="failure"} 1`,
+		`traefik_oidc_auth_jwks_keys{middleware="oidc@file",provider="https://idp.example.com",source="provider"} 2`,
+		`traefik_oidc_auth_jwks_ignored_keys{middleware="oidc@file",provider="https://idp.example.com",source="provider"} 0`,
+		`traefik_oidc_auth_jwks_key_info{middleware="oidc@file",provider="https://idp.example.com",source="provider",kid="key-1"} 0`,
+		`traefik_oidc_auth_jwks_key_info{middleware="oidc@file",provider="https://idp.example.com",source="provider",kid="key-3"} 1`,
+	} {
+		if !strings.Contains(rw.Body.String(), expected) {
+			t.Errorf("Expected %s, but got:\n%s", expected, rw.Body.String())
+		}
+	}
+}
+
+func TestMetricsIncludeBuildInfo(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	expected := fmt.Sprintf(`traefik_oidc_auth_build_info{middleware="oidc@file",provider="https://idp.example.com",version="%s",goversion="%s"} 1`, Version, runtime.Version())
+	if !strings.Contains(rw.Body.String(), expected) {
+		t.Errorf("Expected the build info, but got:\n%s", rw.Body.String())
+	}
+}
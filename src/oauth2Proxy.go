@@ -0,0 +1,121 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+// The headers oauth2-proxy returns from its auth endpoint.
+const (
+	oauth2ProxyUserHeader              = "X-Auth-Request-User"
+	oauth2ProxyEmailHeader             = "X-Auth-Request-Email"
+	oauth2ProxyPreferredUsernameHeader = "X-Auth-Request-Preferred-Username"
+	oauth2ProxyGroupsHeader            = "X-Auth-Request-Groups"
+	oauth2ProxyAccessTokenHeader       = "X-Auth-Request-Access-Token"
+)
+
+// attachOAuth2ProxyHeaders sets the identity headers like oauth2-proxy does, so upstream services don't need to be changed
+// when migrating. Headers whose claim is missing are removed, so they can't be sent by the client.
+func (toa *TraefikOidcAuth) attachOAuth2ProxyHeaders(req *http.Request, session *session.SessionState, claims map[string]interface{}) {
+	config := toa.Config.OAuth2Proxy
+	if config == nil || !config.Enabled {
+		return
+	}
+
+	values := map[string]string{
+		oauth2ProxyUserHeader:              claimToHeaderValue(claims[config.UserClaim]),
+		oauth2ProxyEmailHeader:             claimToHeaderValue(claims[config.EmailClaim]),
+		oauth2ProxyPreferredUsernameHeader: claimToHeaderValue(claims["preferred_username"]),
+		oauth2ProxyGroupsHeader:            claimToHeaderValue(claims[config.GroupsClaim]),
+		oauth2ProxyAccessTokenHeader:       "",
+	}
+
+	if config.PassAccessToken {
+		values[oauth2ProxyAccessTokenHeader] = session.AccessToken
+	}
+
+	for name, value := range values {
+		if value == "" {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+}
+
+// claimToHeaderValue formats a claim like oauth2-proxy. Lists, like groups, are joined by a comma.
+func claimToHeaderValue(claim interface{}) string {
+	switch value := claim.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// isOAuth2ProxyCookie checks whether the cookie has been set by oauth2-proxy, ie. its session cookie,
+// one of its chunks (_oauth2_proxy_0, _oauth2_proxy_1, ...) or its CSRF cookie.
+func (config *Config) isOAuth2ProxyCookie(name string) bool {
+	if config.OAuth2Proxy == nil || config.OAuth2Proxy.CookieName == "" {
+		return false
+	}
+
+	cookieName := config.OAuth2Proxy.CookieName
+
+	return name == cookieName || strings.HasPrefix(name, cookieName+"_")
+}
+
+// clearOAuth2ProxyCookies expires the cookies left over from oauth2-proxy, once the user has a session of this middleware.
+func (toa *TraefikOidcAuth) clearOAuth2ProxyCookies(rw http.ResponseWriter, req *http.Request) {
+	for _, c := range req.Cookies() {
+		if !toa.Config.isOAuth2ProxyCookie(c.Name) {
+			continue
+		}
+
+		http.SetCookie(rw, makeCookieExpireImmediately(&http.Cookie{
+			Name:   c.Name,
+			Path:   "/",
+			Domain: toa.Config.SessionCookie.Domain,
+		}))
+	}
+}
+
+// UpstreamHeaderNames returns the names of all identity headers set by the middleware.
+func (config *Config) UpstreamHeaderNames() []string {
+	var names []string
+
+	for _, header := range config.Headers {
+		names = append(names, header.Name)
+	}
+
+	if config.Impersonation != nil && config.Impersonation.Enabled {
+		names = append(names, config.Impersonation.ImpersonatorHeader)
+	}
+
+	if config.AnonymousAccess != nil {
+		for _, header := range config.AnonymousAccess.Headers {
+			names = append(names, header.Name)
+		}
+	}
+
+	if config.UpstreamAuthorization != "" {
+		names = append(names, "Authorization")
+	}
+
+	if config.OAuth2Proxy != nil && config.OAuth2Proxy.Enabled {
+		names = append(names, oauth2ProxyUserHeader, oauth2ProxyEmailHeader, oauth2ProxyPreferredUsernameHeader, oauth2ProxyGroupsHeader, oauth2ProxyAccessTokenHeader)
+	}
+
+	return names
+}
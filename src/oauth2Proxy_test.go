@@ -0,0 +1,72 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func TestOAuth2ProxyHeadersAreAttached(t *testing.T) {
+	toa := newTestOidcAuth(&Config{OAuth2Proxy: CreateConfig().OAuth2Proxy})
+	toa.Config.OAuth2Proxy.Enabled = true
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(oauth2ProxyPreferredUsernameHeader, "spoofed")
+	req.Header.Set(oauth2ProxyAccessTokenHeader, "spoofed")
+
+	claims := map[string]interface{}{
+		"sub":    "12345",
+		"email":  "jane@example.com",
+		"groups": []interface{}{"admins", "users"},
+	}
+
+	if err := toa.attachHeaders(req, &session.SessionState{AccessToken: "access-token"}, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		oauth2ProxyUserHeader:              "12345",
+		oauth2ProxyEmailHeader:             "jane@example.com",
+		oauth2ProxyGroupsHeader:            "admins,users",
+		oauth2ProxyPreferredUsernameHeader: "",
+		oauth2ProxyAccessTokenHeader:       "",
+	}
+
+	for name, value := range expected {
+		if actual := req.Header.Get(name); actual != value {
+			t.Errorf("Expected %s to be '%s', but got '%s'", name, value, actual)
+		}
+	}
+
+	toa.Config.OAuth2Proxy.PassAccessToken = true
+	toa.attachHeaders(req, &session.SessionState{AccessToken: "access-token"}, claims)
+
+	if actual := req.Header.Get(oauth2ProxyAccessTokenHeader); actual != "access-token" {
+		t.Errorf("Expected the access token to be passed, but got '%s'", actual)
+	}
+}
+
+func TestOAuth2ProxyCookiesAreRecognized(t *testing.T) {
+	toa := newTestOidcAuth(&Config{CookieNamePrefix: "TraefikOidcAuth", OAuth2Proxy: &OAuth2ProxyConfig{CookieName: "_oauth2_proxy"}})
+	toa.Config.SessionCookie = CreateConfig().SessionCookie
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, name := range []string{"_oauth2_proxy", "_oauth2_proxy_0", "_oauth2_proxy_csrf", "app"} {
+		req.AddCookie(&http.Cookie{Name: name, Value: "value"})
+	}
+
+	rw := httptest.NewRecorder()
+	toa.clearOAuth2ProxyCookies(rw, req)
+
+	if cleared := len(rw.Result().Cookies()); cleared != 3 {
+		t.Errorf("Expected the 3 cookies of oauth2-proxy to be cleared, but got %d", cleared)
+	}
+
+	toa.sanitizeForUpstream(req)
+
+	if cookies := req.Cookies(); len(cookies) != 1 || cookies[0].Name != "app" {
+		t.Errorf("Expected only the cookie of the app to be forwarded, but got %v", cookies)
+	}
+}
@@ -0,0 +1,81 @@
+package src
+
+import (
+	"slices"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+const offlineAccessScope = "offline_access"
+
+// The ways the offline_access scope is requested.
+const (
+	offlineAccessAuto   = "Auto"
+	offlineAccessAlways = "Always"
+	offlineAccessNever  = "Never"
+)
+
+func isValidOfflineAccess(offlineAccess string) bool {
+	switch offlineAccess {
+	case offlineAccessAuto, offlineAccessAlways, offlineAccessNever:
+		return true
+	default:
+		return false
+	}
+}
+
+// requiresRefreshToken checks whether sessions depend on a refresh token, because the tokens are kept
+// on the server or the session outlives the tokens.
+func (toa *TraefikOidcAuth) requiresRefreshToken(rememberMe bool) bool {
+	config := toa.Config
+
+	if config.SessionCookie != nil && config.SessionCookie.Minimal {
+		return true
+	}
+	if config.SessionStorage != nil && config.SessionStorage.Type == "Memory" {
+		return true
+	}
+
+	return rememberMe && config.RememberMe != nil && config.RememberMe.Enabled
+}
+
+// addOfflineAccessScope adds the offline_access scope, if a refresh token is required and the provider needs the scope
+// to issue one. Providers which don't list the scope in their discovery document, eg. Google, issue refresh tokens
+// differently and may reject unknown scopes.
+func (toa *TraefikOidcAuth) addOfflineAccessScope(scopes []string, discovery *oidc.OidcDiscovery, rememberMe bool) []string {
+	if slices.Contains(scopes, offlineAccessScope) {
+		return scopes
+	}
+
+	add := false
+
+	switch toa.Config.Provider.OfflineAccess {
+	case offlineAccessAlways:
+		add = true
+	case offlineAccessNever:
+		add = false
+	default:
+		add = toa.requiresRefreshToken(rememberMe) && discovery != nil && slices.Contains(discovery.ScopesSupported, offlineAccessScope)
+	}
+
+	// Explicitly requested for remember me sessions, regardless of the discovery document
+	if rememberMe && toa.Config.RememberMe != nil && toa.Config.RememberMe.RequestOfflineAccess && toa.Config.Provider.OfflineAccess != offlineAccessNever {
+		add = true
+	}
+
+	if !add {
+		return scopes
+	}
+
+	return append(slices.Clone(scopes), offlineAccessScope)
+}
+
+// warnAboutMissingRefreshToken logs a hint, when the provider didn't issue a refresh token although the sessions depend on it.
+func (toa *TraefikOidcAuth) warnAboutMissingRefreshToken(token *oidc.OidcTokenResponse, rememberMe bool) {
+	if token.RefreshToken != "" || !toa.requiresRefreshToken(rememberMe) {
+		return
+	}
+
+	toa.logger.Log(logging.LevelWarn, "The identity provider didn't issue a refresh token, although the session requires one. The session ends when its tokens expire. Make sure the client is allowed to use refresh tokens at the provider or set Provider.OfflineAccess to Always.")
+}
@@ -0,0 +1,47 @@
+package src
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestOfflineAccessIsAddedWhenRefreshTokensAreRequired(t *testing.T) {
+	supported := &oidc.OidcDiscovery{ScopesSupported: []string{"openid", "offline_access"}}
+	unsupported := &oidc.OidcDiscovery{ScopesSupported: []string{"openid"}}
+
+	tests := []struct {
+		name          string
+		offlineAccess string
+		storage       string
+		discovery     *oidc.OidcDiscovery
+		expected      string
+	}{
+		{"cookie sessions don't need it", offlineAccessAuto, "Cookie", supported, "openid"},
+		{"memory sessions need it", offlineAccessAuto, "Memory", supported, "openid offline_access"},
+		{"unsupported by the provider", offlineAccessAuto, "Memory", unsupported, "openid"},
+		{"always", offlineAccessAlways, "Cookie", unsupported, "openid offline_access"},
+		{"never", offlineAccessNever, "Memory", supported, "openid"},
+	}
+
+	for _, test := range tests {
+		toa := newTestOidcAuth(&Config{SessionStorage: &SessionStorageConfig{Type: test.storage}})
+		toa.Config.Provider.OfflineAccess = test.offlineAccess
+
+		scopes := toa.addOfflineAccessScope([]string{"openid"}, test.discovery, false)
+
+		if strings.Join(scopes, " ") != test.expected {
+			t.Errorf("%s: Expected '%s', but got '%s'", test.name, test.expected, strings.Join(scopes, " "))
+		}
+	}
+}
+
+func TestOfflineAccessIsNotAddedTwice(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.Config.Provider.OfflineAccess = offlineAccessAlways
+
+	if scopes := toa.addOfflineAccessScope([]string{"openid", "offline_access"}, nil, false); len(scopes) != 2 {
+		t.Errorf("Expected the scopes to be unchanged, but got %v", scopes)
+	}
+}
@@ -1,6 +1,7 @@
 package src
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -10,16 +11,21 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
-func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerUrl *url.URL) (*oidc.OidcDiscovery, error) {
+// ErrProviderUnavailable indicates that the identity provider could not be reached or failed to respond properly.
+var ErrProviderUnavailable = errors.New("identity provider is unavailable")
+
+func GetOidcDiscovery(ctx context.Context, logger *logging.Logger, httpClient *http.Client, providerUrl *url.URL) (*oidc.OidcDiscovery, error) {
 	wellKnownUrl := *providerUrl
 
 	wellKnownUrl.Path = path.Join(wellKnownUrl.Path, ".well-known/openid-configuration")
@@ -34,11 +40,16 @@ func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerU
 	// client := &http.Client{Transport: tr}
 
 	// Make HTTP GET request to the OpenID provider's discovery endpoint
-	resp, err := httpClient.Get(wellKnownUrl.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnownUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		logger.Log(logging.LevelError, "http-get discovery endpoints - Err: %s", err.Error())
-		return nil, errors.New("HTTP GET error")
+		return nil, fmt.Errorf("%w: HTTP GET error", ErrProviderUnavailable)
 	}
 
 	defer resp.Body.Close()
@@ -46,7 +57,7 @@ func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerU
 	// Check if the response status code is successful
 	if resp.StatusCode >= 300 {
 		logger.Log(logging.LevelError, "http-get OIDC discovery endpoints - http status code: %s", resp.Status)
-		return nil, errors.New("HTTP error - Status code: " + resp.Status)
+		return nil, fmt.Errorf("%w: HTTP error - Status code: %s", ErrProviderUnavailable, resp.Status)
 	}
 
 	// Decode the JSON response
@@ -71,19 +82,16 @@ func randomBytesInHex(count int) (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
-func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode string) (*oidc.OidcTokenResponse, error) {
+func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, provider *IdentityProvider, authCode string) (*oidc.OidcTokenResponse, error) {
 	redirectUrl := oidcAuth.GetAbsoluteCallbackURL(req).String()
 
 	urlValues := url.Values{
 		"grant_type":   {"authorization_code"},
-		"client_id":    {oidcAuth.Config.Provider.ClientId},
+		"client_id":    {provider.ClientId},
 		"code":         {authCode},
 		"redirect_uri": {redirectUrl},
 	}
-
-	if oidcAuth.Config.Provider.ClientSecret != "" {
-		urlValues.Add("client_secret", oidcAuth.Config.Provider.ClientSecret)
-	}
+	oidcAuth.Config.Provider.addAudience(urlValues)
 
 	if oidcAuth.ClientJwtPrivateKey != nil {
 		clientAssertionToken, err := oidcAuth.getClientAssertionJwtToken()
@@ -101,7 +109,7 @@ func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode str
 			return nil, err
 		}
 
-		codeVerifier, err := utils.Decrypt(codeVerifierCookie.Value, oidcAuth.Config.Secret)
+		codeVerifier, err := utils.DecryptWithSecrets(codeVerifierCookie.Value, oidcAuth.Config.DecryptionKeys())
 		if err != nil {
 			return nil, err
 		}
@@ -109,17 +117,20 @@ func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode str
 		urlValues.Add("code_verifier", codeVerifier)
 	}
 
-	resp, err := oidcAuth.httpClient.PostForm(oidcAuth.DiscoveryDocument.TokenEndpoint, urlValues)
+	resp, err := oidcAuth.postForm(req.Context(), provider, provider.DiscoveryDocument.TokenEndpoint, urlValues, oidcAuth.Config.Provider.TokenRequest, oidcAuth.getTokenEndpointAuthMethod(clientSecretPost))
 
 	if err != nil {
 		oidcAuth.logger.Log(logging.LevelError, "exchangeAuthCode: couldn't POST to Provider: %s", err.Error())
-		return nil, err
+		return nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, err.Error())
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		oidcAuth.logger.Log(logging.LevelError, "exchangeAuthCode: received bad HTTP response from Provider (Status: %d): %s", resp.StatusCode, string(body))
+		if resp.StatusCode >= 500 {
+			return nil, fmt.Errorf("%w: invalid status code %d", ErrProviderUnavailable, resp.StatusCode)
+		}
 		return nil, errors.New("invalid status code")
 	}
 
@@ -133,42 +144,80 @@ func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode str
 	return tokenResponse, nil
 }
 
-func (toa *TraefikOidcAuth) validateTokenLocally(tokenString string) (bool, map[string]interface{}, error) {
-	claims := jwt.MapClaims{}
+func (toa *TraefikOidcAuth) validateTokenLocally(ctx context.Context, provider *IdentityProvider, tokenString string) (bool, map[string]interface{}, error) {
+	return toa.validateJwt(ctx, provider.Jwks, tokenString, toa.getTokenValidationOptions(provider))
+}
 
-	err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, false)
-	if err != nil {
-		return false, nil, err
-	}
+// validateStaleTokenLocally validates the token like validateTokenLocally, but accepts tokens which expired up to maxStaleness ago.
+func (toa *TraefikOidcAuth) validateStaleTokenLocally(ctx context.Context, provider *IdentityProvider, tokenString string, maxStaleness time.Duration) (bool, map[string]interface{}, error) {
+	return toa.validateJwt(ctx, provider.Jwks, tokenString, append(toa.getTokenValidationOptions(provider), jwt.WithLeeway(maxStaleness)))
+}
 
+func (toa *TraefikOidcAuth) getTokenValidationOptions(provider *IdentityProvider) []jwt.ParserOption {
 	options := []jwt.ParserOption{
 		jwt.WithExpirationRequired(),
 	}
 
 	if toa.Config.Provider.ValidateIssuerBool {
-		options = append(options, jwt.WithIssuer(toa.Config.Provider.ValidIssuer))
+		options = append(options, jwt.WithIssuer(provider.ValidIssuer))
 	}
 	if toa.Config.Provider.ValidateAudienceBool {
-		options = append(options, jwt.WithAudience(toa.Config.Provider.ValidAudience))
+		options = append(options, jwt.WithAudience(provider.ValidAudience))
+	}
+
+	return options
+}
+
+// rejectedTokenError is returned for tokens with a valid signature, but invalid claims.
+type rejectedTokenError struct {
+	subject string
+	err     error
+}
+
+func (e *rejectedTokenError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectedTokenError) Unwrap() error {
+	return e.err
+}
+
+// validateJwt verifies the signature of the token against the given JWKS.
+// If the verification fails, the JWKS will be reloaded once to handle key rotations.
+func (toa *TraefikOidcAuth) validateJwt(ctx context.Context, jwks *oidc.JwksHandler, tokenString string, options []jwt.ParserOption) (bool, map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+
+	err := jwks.EnsureLoaded(ctx, toa.logger.Module(logging.ModuleOidc), toa.httpClient, false)
+	if err != nil {
+		return false, nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, err.Error())
 	}
 
-	parser := jwt.NewParser(options...)
+	parser := jwt.NewParser(append(options, jwt.WithTimeFunc(toa.now))...)
 
-	_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+	_, err = parser.ParseWithClaims(tokenString, claims, jwks.Keyfunc)
+
+	// The token is unverifiable, if its key is not in the cached JWKS
+	toa.Metrics.RecordJwksLookup(!errors.Is(err, jwt.ErrTokenUnverifiable))
 
 	if err != nil {
-		err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, true)
+		err := jwks.EnsureLoaded(ctx, toa.logger.Module(logging.ModuleOidc), toa.httpClient, true)
 		if err != nil {
-			return false, nil, err
+			return false, nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, err.Error())
 		}
 
-		_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+		_, err = parser.ParseWithClaims(tokenString, claims, jwks.Keyfunc)
 
 		if err != nil {
 			if errors.Is(err, jwt.ErrTokenExpired) || err.Error() == "token has invalid claims: token is expired" {
-				toa.logger.Log(logging.LevelInfo, "The token is expired.")
+				toa.logger.Module(logging.ModuleOidc).Log(logging.LevelInfo, "The token is expired.")
 			} else {
-				toa.logger.Log(logging.LevelError, "Failed to parse token: %v", err)
+				toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Failed to parse token: %v", err)
+			}
+
+			// The signature is checked before the claims, so the subject of the token is authentic
+			if errors.Is(err, jwt.ErrTokenInvalidClaims) {
+				subject, _ := claims["sub"].(string)
+				return false, nil, &rejectedTokenError{subject: subject, err: err}
 			}
 
 			return false, nil, err
@@ -178,7 +227,7 @@ func (toa *TraefikOidcAuth) validateTokenLocally(tokenString string) (bool, map[
 	return true, claims, nil
 }
 
-func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]interface{}, error) {
+func (toa *TraefikOidcAuth) introspectToken(ctx context.Context, provider *IdentityProvider, token string) (bool, map[string]interface{}, error) {
 	data := url.Values{
 		"token": {token},
 	}
@@ -195,29 +244,16 @@ func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]inte
 
 	//log(toa.Config.LogLevel, LogLevelDebug, "Token: %s", token)
 
-	endpoint := toa.DiscoveryDocument.IntrospectionEndpoint
+	endpoint := provider.DiscoveryDocument.IntrospectionEndpoint
 
-	//if endpoint == "" {
-	//	endpoint = toa.DiscoveryDocument.UserinfoEndpoint
-	//}
-
-	req, err := http.NewRequest(
-		http.MethodPost,
-		endpoint,
-		strings.NewReader(data.Encode()),
-	)
-
-	if err != nil {
-		return false, nil, err
+	if endpoint == "" {
+		return false, nil, errors.New("introspection_endpoint is not set")
 	}
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(toa.Config.Provider.ClientId, toa.Config.Provider.ClientSecret)
-
-	resp, err := toa.httpClient.Do(req)
+	resp, err := toa.postForm(ctx, provider, endpoint, data, toa.Config.Provider.IntrospectionRequest, toa.getTokenEndpointAuthMethod(clientSecretBasic))
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Error on introspection request: %s", err.Error())
-		return false, nil, err
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Error on introspection request: %s", err.Error())
+		return false, nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, err.Error())
 	}
 
 	defer resp.Body.Close()
@@ -226,7 +262,7 @@ func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]inte
 	err = json.NewDecoder(resp.Body).Decode(&introspectResponse)
 
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Failed to decode introspection response: %s", err.Error())
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Failed to decode introspection response: %s", err.Error())
 		return false, nil, err
 	}
 
@@ -240,36 +276,46 @@ func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]inte
 	}
 }
 
-func (toa *TraefikOidcAuth) renewToken(refreshToken string) (*oidc.OidcTokenResponse, error) {
+func (toa *TraefikOidcAuth) renewToken(ctx context.Context, provider *IdentityProvider, refreshToken string) (*oidc.OidcTokenResponse, error) {
+	ctx, span := toa.Tracer.Start(ctx, "oidc.token_refresh", tracing.SpanKindInternal)
+	defer span.End()
+
 	urlValues := url.Values{
 		"grant_type":    {"refresh_token"},
-		"client_id":     {toa.Config.Provider.ClientId},
+		"client_id":     {provider.ClientId},
 		"scope":         {strings.Join(toa.Config.Scopes, " ")},
 		"refresh_token": {refreshToken},
 	}
+	toa.Config.Provider.addAudience(urlValues)
 
-	if toa.Config.Provider.ClientSecret != "" {
-		urlValues.Add("client_secret", toa.Config.Provider.ClientSecret)
-	}
-
-	resp, err := toa.httpClient.PostForm(toa.DiscoveryDocument.TokenEndpoint, urlValues)
+	resp, err := toa.postForm(ctx, provider, provider.DiscoveryDocument.TokenEndpoint, urlValues, toa.Config.Provider.TokenRequest, toa.getTokenEndpointAuthMethod(clientSecretPost))
 
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "renewToken: couldn't POST to Provider: %s", err.Error())
-		return nil, err
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "renewToken: couldn't POST to Provider: %s", err.Error())
+		span.RecordError(err)
+		return nil, fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		toa.logger.Log(logging.LevelError, "renewToken: received bad HTTP response from Provider: %s", string(body))
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "renewToken: received bad HTTP response from Provider: %s", string(body))
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		span.RecordError(errors.New("invalid status code"))
+
+		// Server errors are temporary, while client errors like an invalid_grant mean that the refresh token is not valid anymore
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w: invalid status code %d", ErrProviderUnavailable, resp.StatusCode)
+		}
+
 		return nil, errors.New("invalid status code")
 	}
 
 	tokenResponse := &oidc.OidcTokenResponse{}
 	err = json.NewDecoder(resp.Body).Decode(tokenResponse)
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "renewToken: couldn't decode OidcTokenResponse: %s", err.Error())
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "renewToken: couldn't decode OidcTokenResponse: %s", err.Error())
+		span.RecordError(err)
 		return nil, err
 	}
 
@@ -296,12 +342,12 @@ func (toa *TraefikOidcAuth) getClientAssertionJwtToken() (string, error) {
 	return clientAssertionJwt, nil
 }
 
-func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject string) (map[string]interface{}, error) {
-	if toa.DiscoveryDocument.UserinfoEndpoint == "" {
+func (toa *TraefikOidcAuth) getUserInfo(ctx context.Context, provider *IdentityProvider, accessToken string, idTokenSubject string) (map[string]interface{}, error) {
+	if provider.DiscoveryDocument.UserinfoEndpoint == "" {
 		return nil, errors.New("userinfo_endpoint is not set")
 	}
 
-	req, err := http.NewRequest("GET", toa.DiscoveryDocument.UserinfoEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.DiscoveryDocument.UserinfoEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -318,7 +364,7 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 			return nil, errors.New("token is not valid")
 		}
 		body, _ := io.ReadAll(resp.Body)
-		toa.logger.Log(logging.LevelError, "getUserInfo: received bad HTTP response from Provider (Status: %d): %s", resp.StatusCode, string(body))
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "getUserInfo: received bad HTTP response from Provider (Status: %d): %s", resp.StatusCode, string(body))
 		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
 	}
 
@@ -331,43 +377,31 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 		if err != nil {
 			return nil, err
 		}
-		tokenString := string(body)
-
-		claims := jwt.MapClaims{}
-
-		err = toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, false)
-		if err != nil {
-			return nil, err
-		}
+		tokenString := strings.TrimSpace(string(body))
 
+		// Signed userinfo responses don't need to expire. See OpenID Connect Core, section 5.3.2.
 		options := []jwt.ParserOption{}
 
 		if toa.Config.Provider.ValidateIssuerBool {
-			options = append(options, jwt.WithIssuer(toa.Config.Provider.ValidIssuer))
+			options = append(options, jwt.WithIssuer(provider.ValidIssuer))
 		}
 
-		parser := jwt.NewParser(options...)
-
-		_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
-
+		_, claims, err := toa.validateJwt(ctx, provider.Jwks, tokenString, options)
 		if err != nil {
-			err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, true)
-			if err != nil {
-				return nil, err
-			}
-
-			_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+			toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "Failed to parse userinfo token: %v", err)
+			return nil, err
+		}
 
-			if err != nil {
-				toa.logger.Log(logging.LevelError, "Failed to parse userinfo token: %v", err)
-				return nil, err
-			}
+		// If the response names an audience, it must have been issued for this client
+		if audience, _ := jwt.MapClaims(claims).GetAudience(); len(audience) > 0 && !slices.Contains(audience, provider.ClientId) {
+			return nil, fmt.Errorf("the userinfo token has been issued for the audience %v", []string(audience))
 		}
+
 		userInfoClaims = claims
 	case strings.HasPrefix(contentType, "application/json"):
 		err = json.NewDecoder(resp.Body).Decode(&userInfoClaims)
 		if err != nil {
-			toa.logger.Log(logging.LevelError, "getUserInfo: couldn't decode OidcTokenResponse: %s", err.Error())
+			toa.logger.Module(logging.ModuleOidc).Log(logging.LevelError, "getUserInfo: couldn't decode OidcTokenResponse: %s", err.Error())
 			return nil, err
 		}
 	default:
@@ -376,12 +410,12 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 
 	userInfoSub, ok := userInfoClaims["sub"].(string)
 	if !ok {
-		toa.logger.Log(logging.LevelWarn, "getUserInfo: 'sub' claim in userinfo response is not a string or missing, discarding userinfo response")
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelWarn, "getUserInfo: 'sub' claim in userinfo response is not a string or missing, discarding userinfo response")
 		return map[string]interface{}{}, nil
 	}
 
 	if userInfoSub != idTokenSubject {
-		toa.logger.Log(logging.LevelWarn, "getUserInfo: mismatch between 'sub' in userinfo response (%s) and 'sub' in id_token (%s), discarding userinfo response", userInfoSub, idTokenSubject)
+		toa.logger.Module(logging.ModuleOidc).Log(logging.LevelWarn, "getUserInfo: mismatch between 'sub' in userinfo response (%s) and 'sub' in id_token (%s), discarding userinfo response", userInfoSub, idTokenSubject)
 		return map[string]interface{}{}, nil
 	}
 
@@ -416,3 +450,12 @@ func mergeClaims(tokenClaims, userInfoClaims map[string]interface{}) map[string]
 
 	return mergedClaims
 }
+
+// getClientSecret returns the client secret, either from the config or from the ClientSecretFile.
+func (toa *TraefikOidcAuth) getClientSecret() string {
+	if toa.ClientSecretFile != nil {
+		return toa.ClientSecretFile.Value()
+	}
+
+	return toa.Config.Provider.ClientSecret
+}
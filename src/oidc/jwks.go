@@ -1,13 +1,16 @@
 package oidc
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -17,16 +20,48 @@ import (
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+// The maximum size of a JWKS document, to protect against bloated documents.
+const maxJwksSize = 1024 * 1024
+
 type JwksHandler struct {
 	Url       string
 	RsaKeys   []*RsaKey
 	EcdsaKeys []*EcdsaKey
 	CacheDate time.Time
 
+	// Restricts the accepted keys. All supported signing keys are accepted when nil.
+	Policy *JwksPolicy
+
+	// An optional callback, which is called after every attempt to reload the keys
+	// with the ids of the accepted keys and the number of ignored keys.
+	OnReload func(err error, keyIds []string, ignoredCount int)
+
+	// Whether fetched key sets are shared with other handlers of the process with the same url.
+	// The keys are still extracted by every handler, so each one applies its own policy.
+	Shared bool
+
+	// Key sets are only shared between handlers of the same scope, eg. handlers using the same TLS and proxy settings.
+	SharedScope string
+
+	// Provides the time for the expiry of the cached keys. The system clock is used when nil.
+	Clock utils.Clock
+
 	Lock sync.RWMutex
+
+	// Collapses concurrent reloads, eg. after a key rotation, into a single request
+	flight utils.SingleFlight
+}
+
+// JwksPolicy restricts the keys which are accepted from a JWKS.
+type JwksPolicy struct {
+	// The maximum number of accepted keys. Additional keys are ignored. 0 means unlimited.
+	MaxKeys int
+	// The allowed values of the alg parameter. Keys without an alg are always accepted. Empty allows all algorithms.
+	AllowedAlgorithms []string
 }
 
 type JwksKey struct {
+	Alg string `json:"alg,omitempty"`
 	Crv string `json:"crv,omitempty"`
 	E   string `json:"e,omitempty"`
 	Kid string `json:"kid"`
@@ -43,79 +78,170 @@ type JwksKeys struct {
 
 type RsaKey struct {
 	kid string
+	alg string
 	key *rsa.PublicKey
 }
 
 type EcdsaKey struct {
 	kid string
+	alg string
 	key *ecdsa.PublicKey
 }
 
-func (h *JwksHandler) EnsureLoaded(logger *logging.Logger, httpClient *http.Client, forceReload bool) error {
-	h.Lock.Lock()
-	defer h.Lock.Unlock()
-
-	now := time.Now()
-	maxCacheTimeout := now.Add(-6 * time.Hour)
-	minCacheTimeout := now.Add(-5 * time.Minute)
-
-	reload := h.RsaKeys == nil && h.EcdsaKeys == nil
-
-	if h.CacheDate.Compare(maxCacheTimeout) == -1 {
-		reload = true
+// EnsureLoaded loads the keys, if they haven't been loaded yet or the cache is outdated.
+// Concurrent callers share a single request and its result.
+func (h *JwksHandler) EnsureLoaded(ctx context.Context, logger *logging.Logger, httpClient *http.Client, forceReload bool) error {
+	if !h.needsReload(forceReload) {
+		return nil
 	}
 
-	if forceReload && h.CacheDate.Compare(minCacheTimeout) == -1 {
-		reload = true
-	}
+	_, err, _ := h.flight.Do(h.Url, func() (interface{}, error) {
+		// The keys may have just been reloaded by the previous call
+		if !h.needsReload(forceReload) {
+			return nil, nil
+		}
 
-	if reload {
 		logger.Log(logging.LevelInfo, "Reloading JWKS...")
 
-		err := h.loadKeys(httpClient)
+		// Other requests share the result, so the reload isn't cancelled with the request which started it
+		ignoredCount, err := h.loadKeys(context.WithoutCancel(ctx), logger, httpClient)
 		if err != nil {
 			logger.Log(logging.LevelError, "Error loading JWKS: %v", err)
 		} else {
 			logger.Log(logging.LevelInfo, "...JWKS reloaded :)")
 		}
 
-		return err
+		if h.OnReload != nil {
+			h.OnReload(err, h.KeyIds(), ignoredCount)
+		}
+
+		return nil, err
+	})
+
+	return err
+}
+
+func (h *JwksHandler) needsReload(forceReload bool) bool {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	now := h.now()
+	maxCacheTimeout := now.Add(-6 * time.Hour)
+	minCacheTimeout := now.Add(-5 * time.Minute)
+
+	if h.RsaKeys == nil && h.EcdsaKeys == nil {
+		return true
 	}
 
-	return nil
+	if h.CacheDate.Compare(maxCacheTimeout) == -1 {
+		return true
+	}
+
+	return forceReload && h.CacheDate.Compare(minCacheTimeout) == -1
+}
+
+func (h *JwksHandler) clock() utils.Clock {
+	if h.Clock == nil {
+		return utils.SystemClock
+	}
+
+	return h.Clock
 }
 
-func (h *JwksHandler) loadKeys(httpClient *http.Client) error {
-	resp, err := httpClient.Get(h.Url)
+func (h *JwksHandler) now() time.Time {
+	return h.clock().Now()
+}
+
+func (h *JwksHandler) loadKeys(ctx context.Context, logger *logging.Logger, httpClient *http.Client) (int, error) {
+	var body []byte
+	var fetchedAt time.Time
+	var err error
+
+	if h.Shared {
+		h.Lock.RLock()
+		cacheDate := h.CacheDate
+		h.Lock.RUnlock()
 
+		body, fetchedAt, err = sharedKeySets.get(ctx, httpClient, h.clock(), h.SharedScope, h.Url, cacheDate)
+	} else {
+		body, err = fetchKeySet(ctx, httpClient, h.Url)
+		fetchedAt = h.now()
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer resp.Body.Close()
-
 	loaded := JwksKeys{}
-	err = json.NewDecoder(resp.Body).Decode(&loaded)
+	err = json.Unmarshal(body, &loaded)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	rsaKeys, ecdsaKeys, err := extractKeys(&loaded)
+	rsaKeys, ecdsaKeys, ignoredCount, err := extractKeys(logger, &loaded, h.Policy)
 	if err != nil {
-		return err
+		return ignoredCount, err
 	}
 
+	h.Lock.Lock()
 	h.RsaKeys = rsaKeys
 	h.EcdsaKeys = ecdsaKeys
-	h.CacheDate = time.Now()
+	h.CacheDate = fetchedAt
+	h.Lock.Unlock()
 
-	return nil
+	return ignoredCount, nil
+}
+
+func fetchKeySet(ctx context.Context, httpClient *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJwksSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxJwksSize {
+		return nil, fmt.Errorf("the JWKS exceeds the maximum size of %d bytes", maxJwksSize)
+	}
+
+	return body, nil
+}
+
+// KeyIds returns the ids of all accepted keys.
+func (h *JwksHandler) KeyIds() []string {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	keyIds := make([]string, 0, len(h.RsaKeys)+len(h.EcdsaKeys))
+
+	for _, k := range h.RsaKeys {
+		keyIds = append(keyIds, k.kid)
+	}
+	for _, k := range h.EcdsaKeys {
+		keyIds = append(keyIds, k.kid)
+	}
+
+	return keyIds
 }
 
 func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("the token doesn't contain a kid")
+	}
+
 	if strings.HasPrefix(token.Method.Alg(), "RS") {
-		k, err := h.getRsaKey(token.Header["kid"].(string))
+		k, err := h.getRsaKey(kid, token.Method.Alg())
 
 		if err != nil {
 			return nil, err
@@ -126,7 +252,7 @@ func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
 
 	if strings.HasPrefix(token.Method.Alg(), "EC") ||
 		strings.HasPrefix(token.Method.Alg(), "ES") {
-		k, err := h.getEcdsaKey(token.Header["kid"].(string))
+		k, err := h.getEcdsaKey(kid, token.Method.Alg())
 
 		if err != nil {
 			return nil, err
@@ -138,19 +264,28 @@ func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
 	return nil, fmt.Errorf("unsupported algorithm %s", token.Method.Alg())
 }
 
-func (h *JwksHandler) getRsaKey(kid string) (*rsa.PublicKey, error) {
+// getRsaKey returns the key with the given id. A key which specifies an alg may only be used with this algorithm.
+func (h *JwksHandler) getRsaKey(kid string, alg string) (*rsa.PublicKey, error) {
 	k := h.findRsaKey(kid)
 
 	if k != nil {
+		if k.alg != "" && k.alg != alg {
+			return nil, fmt.Errorf("the key %s may not be used with %s", kid, alg)
+		}
+
 		return k.key, nil
 	}
 
 	return nil, errors.New("unknown kid " + kid)
 }
-func (h *JwksHandler) getEcdsaKey(kid string) (*ecdsa.PublicKey, error) {
+func (h *JwksHandler) getEcdsaKey(kid string, alg string) (*ecdsa.PublicKey, error) {
 	k := h.findEcdsaKey(kid)
 
 	if k != nil {
+		if k.alg != "" && k.alg != alg {
+			return nil, fmt.Errorf("the key %s may not be used with %s", kid, alg)
+		}
+
 		return k.key, nil
 	}
 
@@ -158,6 +293,9 @@ func (h *JwksHandler) getEcdsaKey(kid string) (*ecdsa.PublicKey, error) {
 }
 
 func (h *JwksHandler) findRsaKey(kid string) *RsaKey {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
 	for i := 0; i < len(h.RsaKeys); i++ {
 		if kid == h.RsaKeys[i].kid {
 			return h.RsaKeys[i]
@@ -167,6 +305,9 @@ func (h *JwksHandler) findRsaKey(kid string) *RsaKey {
 	return nil
 }
 func (h *JwksHandler) findEcdsaKey(kid string) *EcdsaKey {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
 	for i := 0; i < len(h.EcdsaKeys); i++ {
 		if kid == h.EcdsaKeys[i].kid {
 			return h.EcdsaKeys[i]
@@ -176,35 +317,73 @@ func (h *JwksHandler) findEcdsaKey(kid string) *EcdsaKey {
 	return nil
 }
 
-func extractKeys(keys *JwksKeys) ([]*RsaKey, []*EcdsaKey, error) {
+// extractKeys returns the supported signing keys, which are allowed by the policy, and the number of ignored keys.
+func extractKeys(logger *logging.Logger, keys *JwksKeys, policy *JwksPolicy) ([]*RsaKey, []*EcdsaKey, int, error) {
 	var rsaKeys []*RsaKey
 	var ecdsaKeys []*EcdsaKey
+	ignoredCount := 0
 
 	for i := 0; i < len(keys.Keys); i++ {
 		k := keys.Keys[i]
 
-		if k.Use == "sig" {
-			if k.Kty == "RSA" {
-				extracted, err := extractRsaKey(&k)
+		if reason := getIgnoreReason(&k, policy, len(rsaKeys)+len(ecdsaKeys)); reason != "" {
+			logger.Log(logging.LevelDebug, "Ignoring JWKS key %s: %s", k.Kid, reason)
+			ignoredCount++
+			continue
+		}
 
-				if err == nil {
-					rsaKeys = append(rsaKeys, extracted)
-				}
-			} else if k.Kty == "EC" {
-				extracted, err := extractEcdsaKey(&k)
+		var err error
 
-				if err == nil {
-					ecdsaKeys = append(ecdsaKeys, extracted)
-				}
+		if k.Kty == "RSA" {
+			var extracted *RsaKey
+			if extracted, err = extractRsaKey(&k); err == nil {
+				rsaKeys = append(rsaKeys, extracted)
 			}
+		} else {
+			var extracted *EcdsaKey
+			if extracted, err = extractEcdsaKey(&k); err == nil {
+				ecdsaKeys = append(ecdsaKeys, extracted)
+			}
+		}
+
+		if err != nil {
+			logger.Log(logging.LevelDebug, "Ignoring JWKS key %s: %s", k.Kid, err.Error())
+			ignoredCount++
+			continue
 		}
+
+		logger.Log(logging.LevelDebug, "Accepted JWKS key %s (%s %s)", k.Kid, k.Kty, k.Alg)
 	}
 
 	if len(ecdsaKeys) == 0 && len(rsaKeys) == 0 {
-		return nil, nil, errors.New("no public Keys found")
+		return nil, nil, ignoredCount, errors.New("no public Keys found")
 	}
 
-	return rsaKeys, ecdsaKeys, nil
+	return rsaKeys, ecdsaKeys, ignoredCount, nil
+}
+
+// getIgnoreReason returns why a key is not accepted, or an empty string if it is.
+// Keys without a use are accepted, as the parameter is optional according to RFC 7517.
+func getIgnoreReason(key *JwksKey, policy *JwksPolicy, acceptedCount int) string {
+	if key.Use != "" && key.Use != "sig" {
+		return fmt.Sprintf("use is %s", key.Use)
+	}
+	if key.Kty != "RSA" && key.Kty != "EC" {
+		return fmt.Sprintf("unsupported key type %s", key.Kty)
+	}
+
+	if policy == nil {
+		return ""
+	}
+
+	if key.Alg != "" && len(policy.AllowedAlgorithms) > 0 && !slices.Contains(policy.AllowedAlgorithms, key.Alg) {
+		return fmt.Sprintf("algorithm %s is not allowed", key.Alg)
+	}
+	if policy.MaxKeys > 0 && acceptedCount >= policy.MaxKeys {
+		return fmt.Sprintf("the maximum of %d keys has been reached", policy.MaxKeys)
+	}
+
+	return ""
 }
 func extractRsaKey(key *JwksKey) (*RsaKey, error) {
 	decodedN, err := utils.ParseBigInt(key.N)
@@ -221,6 +400,7 @@ func extractRsaKey(key *JwksKey) (*RsaKey, error) {
 
 	return &RsaKey{
 		kid: key.Kid,
+		alg: key.Alg,
 		key: &rsa.PublicKey{
 			N: decodedN,
 			E: decodedE},
@@ -239,10 +419,16 @@ func extractEcdsaKey(key *JwksKey) (*EcdsaKey, error) {
 		return nil, err
 	}
 
+	curve := getEllipticCurve(key.Crv)
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+	}
+
 	return &EcdsaKey{
 		kid: key.Kid,
+		alg: key.Alg,
 		key: &ecdsa.PublicKey{
-			Curve: getEllipticCurve(key.Crv),
+			Curve: curve,
 			X:     decodedX,
 			Y:     decodedY},
 	}, nil
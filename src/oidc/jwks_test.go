@@ -0,0 +1,151 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func newTestRsaJwksKey(kid string, use string, alg string) JwksKey {
+	return JwksKey{Kid: kid, Kty: "RSA", Use: use, Alg: alg, N: "sXchDaQebHnPiGvyDOAT4saGEUetSyo9MKLOoWFsueri23bOdgWp4Dy1WlUzewbgBHod5pcM9H95GQRV3JDXboIRROSBigeC5yjU1hGzHHyXss8UDprecbAYxknTcQkhslANGRUZmdTOQ5qTRsLAt6BTYuyvVRdhS8exSZEy_c4gs_7svlJJQ4H9_NxsiIoLwAEk7-Q3UXERGYw_75IDrGA84-lA_-Ct4eTlXHBIY2EaV7t7LjJaynVJCpkv4LKjTTAumiGUIuQhrNhZLuF_RJLqHpM2kgWFLU7-VTdL1VbC2tejvcI2BlMkEpk1BzBZI0KQB0GaDWFLN-aEAw3vRw", E: "AQAB"}
+}
+
+func TestExtractKeysIgnoresKeysWhichAreNotUsedForSignatures(t *testing.T) {
+	keys := &JwksKeys{Keys: []JwksKey{
+		newTestRsaJwksKey("sig", "sig", "RS256"),
+		newTestRsaJwksKey("enc", "enc", "RSA-OAEP"),
+		newTestRsaJwksKey("no-use", "", ""),
+		{Kid: "oct", Kty: "oct"},
+	}}
+
+	rsaKeys, _, ignoredCount, err := extractKeys(logging.CreateLogger(logging.LevelError), keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rsaKeys) != 2 || rsaKeys[0].kid != "sig" || rsaKeys[1].kid != "no-use" {
+		t.Errorf("Expected the keys sig and no-use to be accepted, but got %d keys", len(rsaKeys))
+	}
+	if ignoredCount != 2 {
+		t.Errorf("Expected 2 ignored keys, but got %d", ignoredCount)
+	}
+}
+
+func TestExtractKeysAppliesPolicy(t *testing.T) {
+	keys := &JwksKeys{Keys: []JwksKey{
+		newTestRsaJwksKey("rs512", "sig", "RS512"),
+		newTestRsaJwksKey("rs256", "sig", "RS256"),
+		newTestRsaJwksKey("no-alg", "sig", ""),
+		newTestRsaJwksKey("too-many", "sig", "RS256"),
+	}}
+
+	rsaKeys, _, ignoredCount, err := extractKeys(logging.CreateLogger(logging.LevelError), keys, &JwksPolicy{
+		MaxKeys:           2,
+		AllowedAlgorithms: []string{"RS256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rsaKeys) != 2 || rsaKeys[0].kid != "rs256" || rsaKeys[1].kid != "no-alg" {
+		t.Errorf("Expected the keys rs256 and no-alg to be accepted, but got %d keys", len(rsaKeys))
+	}
+	if ignoredCount != 2 {
+		t.Errorf("Expected 2 ignored keys, but got %d", ignoredCount)
+	}
+}
+
+func TestExtractKeysFailsWithoutAcceptedKeys(t *testing.T) {
+	keys := &JwksKeys{Keys: []JwksKey{
+		newTestRsaJwksKey("enc", "enc", "RSA-OAEP"),
+	}}
+
+	if _, _, _, err := extractKeys(logging.CreateLogger(logging.LevelError), keys, nil); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestKeyfuncRejectsAlgorithmMismatch(t *testing.T) {
+	key := newTestRsaJwksKey("key", "sig", "RS512")
+	extracted, err := extractRsaKey(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &JwksHandler{RsaKeys: []*RsaKey{extracted}}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS512, jwt.MapClaims{})
+	token.Header["kid"] = "key"
+	if _, err := handler.Keyfunc(token); err != nil {
+		t.Errorf("Expected the key to be usable with RS512, but got %s", err.Error())
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{})
+	token.Header["kid"] = "key"
+	if _, err := handler.Keyfunc(token); err == nil {
+		t.Error("Expected the key to be rejected for RS256")
+	}
+}
+
+func TestKeyfuncRejectsTokensWithoutKid(t *testing.T) {
+	handler := &JwksHandler{}
+
+	for _, kid := range []interface{}{nil, 42} {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{})
+		if kid != nil {
+			token.Header["kid"] = kid
+		}
+
+		if _, err := handler.Keyfunc(token); err == nil {
+			t.Errorf("Expected a token with kid %v to be rejected", kid)
+		}
+	}
+}
+
+func TestConcurrentReloadsShareASingleRequest(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+
+		_ = json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{newTestRsaJwksKey("key", "sig", "RS256")}})
+	}))
+	defer server.Close()
+
+	handler := &JwksHandler{Url: server.URL}
+	logger := logging.CreateLogger(logging.LevelError)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := handler.EnsureLoaded(context.Background(), logger, server.Client(), false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Give all callers the chance to join the request in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected a single request, but got %d", requests)
+	}
+	if handler.findRsaKey("key") == nil {
+		t.Error("Expected the key to be loaded")
+	}
+}
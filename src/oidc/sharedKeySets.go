@@ -0,0 +1,87 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// How long a fetched key set is reused by other handlers. This matches the minimum interval of forced reloads,
+// so a handler reloading the keys after a key rotation gets at most the same delay as without sharing.
+const sharedKeySetMaxAge = 5 * time.Minute
+
+// The key sets fetched by all handlers of the process. Traefik creates a new instance of the middleware for
+// every router and on every change of the dynamic configuration, which would otherwise all fetch the same JWKS.
+var sharedKeySets = &keySetCache{entries: map[string]*sharedKeySet{}}
+
+type keySetCache struct {
+	lock    sync.Mutex
+	entries map[string]*sharedKeySet
+	flight  utils.SingleFlight
+}
+
+type sharedKeySet struct {
+	body      []byte
+	fetchedAt time.Time
+}
+
+// get returns the key set of the url. A key set fetched by another handler of the same scope is reused, if it is
+// recent and newer than the keys of the calling handler, which were fetched at notBefore. Otherwise, the key set is fetched.
+func (c *keySetCache) get(ctx context.Context, httpClient *http.Client, clock utils.Clock, scope string, url string, notBefore time.Time) ([]byte, time.Time, error) {
+	key := scope + " " + url
+
+	if entry := c.lookup(key, notBefore, clock); entry != nil {
+		return entry.body, entry.fetchedAt, nil
+	}
+
+	result, err, _ := c.flight.Do(key, func() (interface{}, error) {
+		// Another handler may have just fetched the key set
+		if entry := c.lookup(key, notBefore, clock); entry != nil {
+			return entry, nil
+		}
+
+		// Other handlers share the result, so the fetch isn't cancelled with the request which started it
+		body, err := fetchKeySet(context.WithoutCancel(ctx), httpClient, url)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &sharedKeySet{body: body, fetchedAt: clock.Now()}
+
+		c.lock.Lock()
+		c.entries[key] = entry
+		c.lock.Unlock()
+
+		return entry, nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	entry := result.(*sharedKeySet)
+
+	return entry.body, entry.fetchedAt, nil
+}
+
+func (c *keySetCache) lookup(key string, notBefore time.Time, clock utils.Clock) *sharedKeySet {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !entry.fetchedAt.After(notBefore) || clock.Now().Sub(entry.fetchedAt) > sharedKeySetMaxAge {
+		return nil
+	}
+
+	return entry
+}
+
+// SharedKeySetCount returns the number of key sets shared between the handlers of the process.
+func SharedKeySetCount() int {
+	sharedKeySets.lock.Lock()
+	defer sharedKeySets.lock.Unlock()
+
+	return len(sharedKeySets.entries)
+}
@@ -0,0 +1,124 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestSharedHandlersFetchTheKeySetOnce(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{newTestRsaJwksKey("rs256", "sig", "RS256"), newTestRsaJwksKey("rs384", "sig", "RS384")}})
+	}))
+	defer server.Close()
+
+	logger := logging.CreateLogger(logging.LevelError)
+
+	first := &JwksHandler{Url: server.URL, Shared: true}
+	second := &JwksHandler{Url: server.URL, Shared: true, Policy: &JwksPolicy{AllowedAlgorithms: []string{"RS384"}}}
+
+	for _, handler := range []*JwksHandler{first, second} {
+		if err := handler.EnsureLoaded(context.Background(), logger, server.Client(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected the key set to be fetched once, but got %d requests", atomic.LoadInt32(&requests))
+	}
+	if len(first.KeyIds()) != 2 || len(second.KeyIds()) != 1 {
+		t.Errorf("Expected every handler to apply its own policy, but got %v and %v", first.KeyIds(), second.KeyIds())
+	}
+}
+
+func TestSharedKeySetIsOnlyUsedWhenNewer(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{newTestRsaJwksKey("sig", "sig", "RS256")}})
+	}))
+	defer server.Close()
+
+	if _, _, err := sharedKeySets.get(context.Background(), server.Client(), utils.SystemClock, "", server.URL, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handler which already has these keys, eg. after a key rotation, must fetch them again
+	_, fetchedAt, err := sharedKeySets.get(context.Background(), server.Client(), utils.SystemClock, "", server.URL, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Expected the key set to be fetched again, but got %d requests", atomic.LoadInt32(&requests))
+	}
+	if time.Since(fetchedAt) > time.Second {
+		t.Errorf("Expected the fetch time of the new key set, but got %v", fetchedAt)
+	}
+}
+
+func TestSharedKeySetsAreScoped(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{newTestRsaJwksKey("sig", "sig", "RS256")}})
+	}))
+	defer server.Close()
+
+	for _, scope := range []string{"scope-a", "scope-b", "scope-a"} {
+		if _, _, err := sharedKeySets.get(context.Background(), server.Client(), utils.SystemClock, scope, server.URL, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Expected the key set to be fetched once per scope, but got %d requests", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestSharedKeySetFetchIsNotCancelledWithTheFirstRequest(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{newTestRsaJwksKey("sig", "sig", "RS256")}})
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		_, _, err := sharedKeySets.get(ctx, server.Client(), utils.SystemClock, "cancelled", server.URL, time.Time{})
+		done <- err
+	}()
+
+	// The second handler joins the fetch started by the first one
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, _, err := sharedKeySets.get(context.Background(), server.Client(), utils.SystemClock, "cancelled", server.URL, time.Time{})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Expected the shared fetch to succeed, but got %v", err)
+		}
+	}
+}
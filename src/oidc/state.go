@@ -3,33 +3,83 @@ package oidc
 import (
 	"encoding/base64"
 	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 type OidcState struct {
+	Id          string `json:"id"`
+	IssuedAt    int64  `json:"iat"`
 	Action      string `json:"action"`
 	RedirectUrl string `json:"redirect_url"`
+	RememberMe  bool   `json:"remember_me,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	// Whether the login has been started with prompt=none, so the provider may answer with an error instead of a code.
+	Silent bool `json:"silent,omitempty"`
+	// Whether the login has been started with prompt=login, so the user had to enter the credentials again.
+	PromptLogin bool `json:"prompt_login,omitempty"`
+	// Whether the login has been opened in a popup, which notifies its opener instead of redirecting.
+	Popup bool `json:"popup,omitempty"`
+	// The session which is allowed to use the state. Used for actions of an existing session, like Consent.
+	SessionId string `json:"session_id,omitempty"`
+	// The user whose impersonation is confirmed by the Impersonate action.
+	ImpersonatedUser string `json:"impersonated_user,omitempty"`
+	// The scopes requested from the provider, when they differ from the configured ones.
+	Scopes []string `json:"scopes,omitempty"`
+	// The nonce sent with the authorization request, which must be contained in the returned id token.
+	Nonce string `json:"nonce,omitempty"`
+	// Query parameters of the original request, which are appended to the redirect url after the login.
+	Parameters map[string][]string `json:"params,omitempty"`
+}
+
+// NewState creates a new state with a unique id.
+func NewState(action string, redirectUrl string) *OidcState {
+	return &OidcState{
+		Id:          uuid.New().String(),
+		IssuedAt:    time.Now().Unix(),
+		Action:      action,
+		RedirectUrl: redirectUrl,
+	}
 }
 
-func EncodeState(state *OidcState) (string, error) {
+// EncodeState serializes and encrypts the state, so it cannot be tampered with.
+func EncodeState(state *OidcState, secret string, cipherName string) (string, error) {
 	stateBytes, err := json.Marshal(state)
 
 	if err != nil {
 		return "", err
 	}
 
-	stateBase64 := base64.RawURLEncoding.EncodeToString(stateBytes)
+	encryptedState, err := utils.EncryptWithCipher(string(stateBytes), secret, cipherName)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedState)
+	if err != nil {
+		return "", err
+	}
+
+	stateBase64 := base64.RawURLEncoding.EncodeToString(encryptedBytes)
 	return stateBase64, nil
 }
 
-func DecodeState(base64State string) (*OidcState, error) {
-	stateBytes, err := base64.RawURLEncoding.DecodeString(base64State)
+func DecodeState(base64State string, secrets []string) (*OidcState, error) {
+	encryptedBytes, err := base64.RawURLEncoding.DecodeString(base64State)
+
+	if err != nil {
+		return nil, err
+	}
 
+	stateJson, err := utils.DecryptWithSecrets(base64.StdEncoding.EncodeToString(encryptedBytes), secrets)
 	if err != nil {
 		return nil, err
 	}
 
 	var state OidcState
-	err2 := json.Unmarshal(stateBytes, &state)
+	err2 := json.Unmarshal([]byte(stateJson), &state)
 	if err2 != nil {
 		return nil, err2
 	}
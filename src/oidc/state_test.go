@@ -0,0 +1,45 @@
+package oidc
+
+import (
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+const testSecret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+func TestEncodeDecodeStateRoundtrip(t *testing.T) {
+	state := NewState("Login", "https://example.com/page")
+
+	encoded, err := EncodeState(state, testSecret, utils.CipherAesGcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeState(encoded, []string{testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Id != state.Id || decoded.IssuedAt != state.IssuedAt || decoded.Action != "Login" || decoded.RedirectUrl != "https://example.com/page" {
+		t.Errorf("Expected %+v, but got %+v", state, decoded)
+	}
+}
+
+func TestDecodeStateRejectsTamperedState(t *testing.T) {
+	encoded, err := EncodeState(NewState("Login", "https://example.com/page"), testSecret, utils.CipherXAesGcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(encoded)
+	tampered[len(tampered)/2] ^= 1
+
+	if _, err := DecodeState(string(tampered), []string{testSecret}); err == nil {
+		t.Error("Expected tampered state to be rejected")
+	}
+
+	if _, err := DecodeState(encoded, []string{"00000000000000000000000000000000"}); err == nil {
+		t.Error("Expected state encrypted with another secret to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package src
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
@@ -10,10 +11,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 func newGetUserInfoTest(t *testing.T, handler http.HandlerFunc) (*TraefikOidcAuth, *httptest.Server) {
@@ -53,7 +56,7 @@ func TestGetUserInfo_Success_JSON(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -75,7 +78,7 @@ func TestGetUserInfo_Unauthorized(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
@@ -96,7 +99,7 @@ func TestGetUserInfo_SubMismatch(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -113,7 +116,7 @@ func TestGetUserInfo_NoEndpoint(t *testing.T) {
 	toa.DiscoveryDocument.UserinfoEndpoint = ""
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
@@ -157,11 +160,12 @@ func TestGetUserInfo_Success_JWT(t *testing.T) {
 	// Setup JWKS for JWT verification
 	jwksServer := setupJWKS(t, toa, privateKey)
 	defer jwksServer.Close()
+	toa.Config.Provider.ClientId = "test-audience"
 	toa.Config.Provider.ValidateIssuerBool = true
 	toa.Config.Provider.ValidIssuer = "https://issuer.example.com"
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -180,6 +184,39 @@ func TestGetUserInfo_Success_JWT(t *testing.T) {
 	}
 }
 
+func TestGetUserInfo_JWTForOtherAudience(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"aud": "other-client",
+	})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwt")
+		fmt.Fprint(w, signedToken)
+	})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+	toa.Config.Provider.ClientId = "my-client"
+
+	_, err = toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", "12345")
+
+	if err == nil {
+		t.Fatal("Expected a userinfo token for another client to be rejected")
+	}
+}
+
 func TestMergeClaims_BasicMerging(t *testing.T) {
 	tokenClaims := map[string]interface{}{
 		"sub":   "12345",
@@ -419,7 +456,7 @@ func TestGetUserInfo_InvalidJWT(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), toa.primaryProvider(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
@@ -453,3 +490,42 @@ func setupJWKS(t *testing.T, toa *TraefikOidcAuth, privateKey *rsa.PrivateKey) *
 	toa.Jwks.Url = jwksServer.URL
 	return jwksServer
 }
+
+func TestValidateJwtUsesClock(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	clock := utils.NewFakeClock(time.Now())
+	toa.Clock = clock
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": clock.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _, err := toa.validateTokenLocally(context.Background(), toa.primaryProvider(), signedToken); !ok {
+		t.Fatalf("Expected the token to be valid, but got %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	if ok, _, _ := toa.validateTokenLocally(context.Background(), toa.primaryProvider(), signedToken); ok {
+		t.Error("Expected the token to be expired")
+	}
+	if ok, _, err := toa.validateStaleTokenLocally(context.Background(), toa.primaryProvider(), signedToken, 5*time.Minute); !ok {
+		t.Errorf("Expected the stale token to be accepted within the leeway, but got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+// The methods to derive the code challenge from the code verifier. See RFC 7636, section 4.2.
+const (
+	pkceMethodS256  = "S256"
+	pkceMethodPlain = "plain"
+)
+
+func isValidPkceMethod(method string) bool {
+	return method == pkceMethodS256 || method == pkceMethodPlain
+}
+
+func getCodeChallenge(codeVerifier string, method string) string {
+	if method == pkceMethodPlain {
+		return codeVerifier
+	}
+
+	hash := sha256.Sum256([]byte(codeVerifier))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// checkPkceSupport fails, if PKCE support is required, but the provider doesn't advertise the configured method.
+func (toa *TraefikOidcAuth) checkPkceSupport(document *oidc.OidcDiscovery) error {
+	provider := toa.Config.Provider
+
+	if !provider.UsePkceBool || !provider.RequirePkceSupport {
+		return nil
+	}
+
+	if !slices.Contains(document.CodeChallengeMethodsSupported, provider.PkceMethod) {
+		return fmt.Errorf("the provider doesn't support the PKCE method %s, it only supports %v", provider.PkceMethod, document.CodeChallengeMethodsSupported)
+	}
+
+	return nil
+}
+
+// createCodeVerifierCookie creates the cookie, which keeps the code verifier until the callback.
+// It is only sent to the callback.
+func (toa *TraefikOidcAuth) createCodeVerifierCookie(value string) *http.Cookie {
+	config := toa.Config.PkceCookie
+	if config == nil {
+		config = &PkceCookieConfig{Secure: true}
+	}
+
+	return &http.Cookie{
+		Name:        getCodeVerifierCookieName(toa.Config),
+		Value:       value,
+		MaxAge:      config.MaxAge,
+		Secure:      config.Secure,
+		HttpOnly:    true,
+		Path:        toa.CallbackURL.Path,
+		Domain:      toa.getCodeVerifierCookieDomain(),
+		SameSite:    toa.getCodeVerifierCookieSameSite(),
+		Partitioned: toa.Config.SessionCookie.Partitioned,
+	}
+}
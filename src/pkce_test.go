@@ -0,0 +1,128 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestGetCodeChallenge(t *testing.T) {
+	// See RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	if challenge := getCodeChallenge(verifier, pkceMethodS256); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Unexpected S256 challenge '%s'", challenge)
+	}
+	if challenge := getCodeChallenge(verifier, pkceMethodPlain); challenge != verifier {
+		t.Errorf("Expected the plain challenge to be the verifier, but got '%s'", challenge)
+	}
+}
+
+func TestCheckPkceSupport(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.Config.Provider.UsePkceBool = true
+	toa.Config.Provider.PkceMethod = pkceMethodS256
+	toa.Config.Provider.RequirePkceSupport = true
+
+	if err := toa.checkPkceSupport(&oidc.OidcDiscovery{CodeChallengeMethodsSupported: []string{"plain", "S256"}}); err != nil {
+		t.Errorf("Expected S256 to be supported, but got %v", err)
+	}
+	if err := toa.checkPkceSupport(&oidc.OidcDiscovery{CodeChallengeMethodsSupported: []string{"plain"}}); err == nil {
+		t.Error("Expected a provider without S256 to be rejected")
+	}
+
+	toa.Config.Provider.RequirePkceSupport = false
+	if err := toa.checkPkceSupport(&oidc.OidcDiscovery{}); err != nil {
+		t.Errorf("Expected the support not to be checked, but got %v", err)
+	}
+}
+
+func TestPkceIsEnabledForPublicClients(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientSecret string
+		usePkce      string
+		expected     bool
+	}{
+		{"public client", "", "", true},
+		{"confidential client", "secret", "", false},
+		{"explicitly disabled", "", "false", false},
+	}
+
+	for _, test := range tests {
+		config := CreateConfig()
+		config.Provider.Url = "https://idp.example.com"
+		config.Provider.ClientId = "client"
+		config.Provider.ClientSecret = test.clientSecret
+		config.Provider.UsePkce = test.usePkce
+
+		if _, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test"); err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Provider.UsePkceBool != test.expected {
+			t.Errorf("%s: Expected UsePkce to be %v", test.name, test.expected)
+		}
+	}
+}
+
+func TestValidateReportsMissingPkceSupport(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer":"` + server.URL + `","jwks_uri":"` + server.URL + `/jwks","code_challenge_methods_supported":["plain"]}`))
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Provider.Url = server.URL
+	config.Provider.ClientId = "client"
+	config.Provider.RequirePkceSupport = true
+	config.SharedCache.Enabled = false
+
+	if len(Validate(context.Background(), config, true)) != 1 {
+		t.Error("Expected the missing PKCE support to be reported")
+	}
+}
+
+func TestCodeVerifierCookieConfiguration(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.Provider.UsePkceBool = true
+	toa.Config.Provider.PkceMethod = pkceMethodS256
+	toa.Config.SessionCookie = &SessionCookieConfig{}
+	toa.CallbackURL, _ = url.Parse("https://auth.example.com/oidc/callback")
+
+	toa.Config.PkceCookie = &PkceCookieConfig{Secure: true}
+	cookie := toa.createCodeVerifierCookie("verifier")
+	if !cookie.Secure || cookie.Domain != "auth.example.com" || cookie.Path != "/oidc/callback" || cookie.MaxAge != 0 || cookie.SameSite != http.SameSiteDefaultMode {
+		t.Errorf("Expected the default cookie to be bound to the callback, but got %v", cookie)
+	}
+
+	toa.Config.PkceCookie = &PkceCookieConfig{Domain: "example.com", SameSite: "lax", MaxAge: 300}
+	rw := httptest.NewRecorder()
+	if _, ok := toa.createAuthorizationUrl(rw, httptest.NewRequest(http.MethodGet, "/login", nil)); !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected the code verifier cookie, but got %v", cookies)
+	}
+	if cookies[0].Secure || cookies[0].Domain != "example.com" || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].MaxAge != 300 {
+		t.Errorf("Expected the configured cookie, but got %v", cookies[0])
+	}
+}
+
+func TestSameSiteNonePkceCookieMustBeSecure(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.PkceCookie = &PkceCookieConfig{SameSite: "none"}
+
+	if _, err := createTraefikOidcAuth(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected an insecure cookie with SameSite=None to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The maximum size of the claims document, which can be sent to the policy test endpoint.
+const maxPolicyTestBodySize = 1 << 20
+
+type policyTestResponse struct {
+	Authorized bool                   `json:"authorized"`
+	Trace      []policyTestStep       `json:"trace"`
+	Claims     map[string]interface{} `json:"claims"`
+}
+
+type policyTestStep struct {
+	Claim       string   `json:"claim"`
+	AnyOf       []string `json:"anyOf,omitempty"`
+	AllOf       []string `json:"allOf,omitempty"`
+	Found       bool     `json:"found"`
+	Passed      bool     `json:"passed"`
+	Expectation string   `json:"expectation"`
+}
+
+func (toa *TraefikOidcAuth) isPolicyTestRequest(req *http.Request) bool {
+	config := toa.Config.Debug
+
+	return config != nil && config.Enabled && config.PolicyTestPath != "" && req.URL.Path == config.PolicyTestPath
+}
+
+// handlePolicyTest evaluates the authorization rules against the posted claims and returns the decision
+// together with the result of each assertion, so policy changes can be tested before they are rolled out.
+func (toa *TraefikOidcAuth) handlePolicyTest(rw http.ResponseWriter, req *http.Request) {
+	if !toa.checkEndpointAccess(rw, req, "policy test endpoint", toa.debugNetworks, toa.Config.Debug.Token) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxPolicyTestBodySize)).Decode(&claims); err != nil {
+		toa.logger.Log(logging.LevelInfo, "Invalid claims document sent to the policy test endpoint: %s", err.Error())
+		http.Error(rw, "The body must be a JSON object with the claims.", http.StatusBadRequest)
+		return
+	}
+
+	response := toa.testPolicy(claims)
+
+	body, _ := json.Marshal(response)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+
+	_, _ = rw.Write(body)
+}
+
+// testPolicy evaluates the claim mappings, the hosted domains and all claim assertions. In contrast to
+// isAuthorized, the evaluation doesn't stop at the first failed assertion.
+func (toa *TraefikOidcAuth) testPolicy(claims map[string]interface{}) *policyTestResponse {
+	claims = toa.mapClaims(claims)
+
+	response := &policyTestResponse{
+		Authorized: true,
+		Trace:      []policyTestStep{},
+		Claims:     claims,
+	}
+
+	addStep := func(assertion *ClaimAssertion, found bool, passed bool) {
+		response.Trace = append(response.Trace, policyTestStep{
+			Claim:       assertion.Name,
+			AnyOf:       assertion.AnyOf,
+			AllOf:       assertion.AllOf,
+			Found:       found,
+			Passed:      passed,
+			Expectation: describeFailedAssertion(assertion),
+		})
+
+		if !passed {
+			response.Authorized = false
+		}
+	}
+
+	if domains := toa.Config.Provider.HostedDomains; len(domains) > 0 {
+		_, found := claims["hd"]
+		addStep(&ClaimAssertion{Name: "hd", AnyOf: domains}, found, isHostedDomainAllowed(domains, claims))
+	}
+
+	if len(toa.Config.Authorization.AssertClaims) == 0 {
+		return response
+	}
+
+	parsed, err := json.Marshal(claims)
+	if err != nil {
+		addStep(&ClaimAssertion{}, false, false)
+		return response
+	}
+
+	for i := range toa.Config.Authorization.AssertClaims {
+		assertion := &toa.Config.Authorization.AssertClaims[i]
+
+		addStep(assertion, hasClaim(parsed, assertion.Name), evaluateClaimAssertion(toa.logger, assertion, parsed, claims))
+	}
+
+	return response
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postPolicyTest(toa *TraefikOidcAuth, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oidc/debug/policy", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestPolicyTestRequiresToken(t *testing.T) {
+	toa := newDebugTest()
+
+	if rw := postPolicyTest(toa, "", `{}`); rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", rw.Code)
+	}
+}
+
+func TestPolicyTestTracesEveryAssertion(t *testing.T) {
+	toa := newDebugTest()
+	toa.Config.Authorization.AssertClaims = []ClaimAssertion{
+		{Name: "email"},
+		{Name: "roles", AnyOf: []string{"owner", "auditor"}},
+		{Name: "groups", AllOf: []string{"admins"}},
+	}
+
+	rw := postPolicyTest(toa, "debug-token", `{"email":"alice@example.com","roles":["auditor"]}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+
+	response := &policyTestResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Authorized {
+		t.Error("Expected the claims not to be authorized")
+	}
+	if len(response.Trace) != 3 {
+		t.Fatalf("Expected a step for each assertion, but got %+v", response.Trace)
+	}
+
+	expected := []struct {
+		found  bool
+		passed bool
+	}{{true, true}, {true, true}, {false, false}}
+
+	for i, step := range response.Trace {
+		if step.Found != expected[i].found || step.Passed != expected[i].passed {
+			t.Errorf("Unexpected result for claim %s: %+v", step.Claim, step)
+		}
+	}
+	if response.Trace[2].Expectation != "claim groups must contain all of [admins]" {
+		t.Errorf("Unexpected expectation: %s", response.Trace[2].Expectation)
+	}
+}
+
+func TestPolicyTestRejectsInvalidRequests(t *testing.T) {
+	toa := newDebugTest()
+
+	if rw := postPolicyTest(toa, "debug-token", `["not", "an", "object"]`); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", rw.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/debug/policy", nil)
+	req.Header.Set("Authorization", "Bearer debug-token")
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,65 @@
+package src
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The page posts the message to the opener, so the SPA can continue, and closes itself.
+// If the page hasn't been opened as a popup, it navigates to the redirect url like a regular login.
+var popupCallbackTemplate = template.Must(template.New("popup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Login completed</title>
+</head>
+<body>
+<script>
+if (window.opener) {
+	window.opener.postMessage({{ .message }}, {{ .targetOrigin }});
+	window.close();
+} else {
+	window.location.replace({{ .redirectUrl }});
+}
+</script>
+<noscript><a href="{{ .redirectUrl }}">Continue</a></noscript>
+</body>
+</html>
+`))
+
+// writePopupCallbackPage completes a login which has been opened in a popup.
+// The message is only posted to the origin of the redirect url, which has been validated when the login was started.
+func (toa *TraefikOidcAuth) writePopupCallbackPage(rw http.ResponseWriter, req *http.Request, redirectUrl string) {
+	parsedUrl, err := url.Parse(redirectUrl)
+	if err != nil || parsedUrl.Scheme == "" || parsedUrl.Host == "" {
+		toa.logger.Log(logging.LevelWarn, "Invalid redirect url for the popup callback. Redirecting instead.")
+		http.Redirect(rw, req, redirectUrl, http.StatusFound)
+		return
+	}
+
+	var page bytes.Buffer
+	err = popupCallbackTemplate.Execute(&page, map[string]interface{}{
+		"message": map[string]interface{}{
+			"type":         toa.Config.PopupCallback.MessageType,
+			"success":      true,
+			"redirect_url": redirectUrl,
+		},
+		"targetOrigin": parsedUrl.Scheme + "://" + parsedUrl.Host,
+		"redirectUrl":  redirectUrl,
+	})
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Error while rendering the popup callback page: %s", err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+
+	_, _ = rw.Write(page.Bytes())
+}
@@ -0,0 +1,55 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestPopupIsStoredInTheState(t *testing.T) {
+	toa := newLoginTest()
+
+	for _, enabled := range []bool{true, false} {
+		toa.Config.PopupCallback = &PopupCallbackConfig{Enabled: enabled}
+
+		req := httptest.NewRequest(http.MethodGet, "/login?popup=true", nil)
+		authorizationUrl, ok := toa.createAuthorizationUrl(httptest.NewRecorder(), req)
+		if !ok {
+			t.Fatal("Expected an authorization url")
+		}
+
+		parsedUrl, _ := url.Parse(authorizationUrl)
+		state, err := oidc.DecodeState(parsedUrl.Query().Get("state"), toa.Config.DecryptionKeys())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state.Popup != enabled {
+			t.Errorf("Expected popup to be %t, but got %t", enabled, state.Popup)
+		}
+	}
+}
+
+func TestPopupCallbackPagePostsMessageToOpener(t *testing.T) {
+	toa := newTestOidcAuth(&Config{PopupCallback: CreateConfig().PopupCallback})
+
+	rw := httptest.NewRecorder()
+	toa.writePopupCallbackPage(rw, httptest.NewRequest(http.MethodGet, "/oidc/callback", nil), "https://app.example.com/dashboard?tab=1")
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+
+	body := rw.Body.String()
+
+	if !strings.Contains(body, `window.opener.postMessage({"redirect_url":"https://app.example.com/dashboard?tab=1","success":true,"type":"traefik-oidc-auth:login"}, "https://app.example.com")`) {
+		t.Errorf("Expected the message to be posted to the origin of the redirect url, but got %s", body)
+	}
+	if !strings.Contains(body, "window.close()") {
+		t.Error("Expected the popup to close itself")
+	}
+}
@@ -0,0 +1,78 @@
+package src
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Longer values are not preserved, as the state is sent to the provider as part of the url.
+const maxPreservedParameterLength = 1024
+
+// getPreservedQueryParameters collects the query parameters of the request, which match PreservedQueryParameters.
+func (toa *TraefikOidcAuth) getPreservedQueryParameters(req *http.Request) map[string][]string {
+	if len(toa.Config.PreservedQueryParameters) == 0 {
+		return nil
+	}
+
+	var parameters map[string][]string
+
+	for name, values := range req.URL.Query() {
+		if !matchesPreservedQueryParameter(name, toa.Config.PreservedQueryParameters) {
+			continue
+		}
+
+		for _, value := range values {
+			if len(value) > maxPreservedParameterLength {
+				continue
+			}
+
+			if parameters == nil {
+				parameters = make(map[string][]string)
+			}
+			parameters[name] = append(parameters[name], value)
+		}
+	}
+
+	return parameters
+}
+
+func matchesPreservedQueryParameter(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendPreservedQueryParameters adds the parameters to the redirect url.
+// Parameters which are already part of the url are kept as they are.
+func appendPreservedQueryParameters(redirectUrl string, parameters map[string][]string) string {
+	if len(parameters) == 0 {
+		return redirectUrl
+	}
+
+	parsed, err := url.Parse(redirectUrl)
+	if err != nil {
+		return redirectUrl
+	}
+
+	query := parsed.Query()
+	for name, values := range parameters {
+		if query.Has(name) {
+			continue
+		}
+
+		query[name] = values
+	}
+
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
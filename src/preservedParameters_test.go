@@ -0,0 +1,47 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestPreservedQueryParametersSurviveTheLogin(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.PostLoginRedirectUri = "https://app.example.com/welcome"
+	toa.Config.PreservedQueryParameters = []string{"invite_token", "utm_*"}
+
+	rw := httptest.NewRecorder()
+	toa.redirectToProvider(rw, httptest.NewRequest(http.MethodGet, "/login?invite_token=abc&utm_source=mail&utm_medium=link&other=1", nil))
+
+	authorizationUrl, _ := url.Parse(rw.Header().Get("Location"))
+
+	state, err := oidc.DecodeState(authorizationUrl.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirectUrl, _ := url.Parse(appendPreservedQueryParameters(state.RedirectUrl, state.Parameters))
+	query := redirectUrl.Query()
+
+	if query.Get("invite_token") != "abc" || query.Get("utm_source") != "mail" || query.Get("utm_medium") != "link" {
+		t.Errorf("Expected the configured parameters to be preserved, but got %s", redirectUrl)
+	}
+	if query.Has("other") {
+		t.Errorf("Expected other parameters not to be preserved, but got %s", redirectUrl)
+	}
+}
+
+func TestAppendPreservedQueryParametersKeepsExistingParameters(t *testing.T) {
+	redirectUrl := appendPreservedQueryParameters("https://app.example.com/page?utm_source=direct", map[string][]string{
+		"utm_source":   {"mail"},
+		"invite_token": {"abc"},
+	})
+
+	if redirectUrl != "https://app.example.com/page?invite_token=abc&utm_source=direct" {
+		t.Errorf("Unexpected redirect url %s", redirectUrl)
+	}
+}
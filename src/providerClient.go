@@ -0,0 +1,238 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// createProviderTlsConfig creates the TLS configuration of the connections to the provider.
+func createProviderTlsConfig(config *ProviderConfig, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerifyBool,
+		RootCAs:            rootCAs,
+		ServerName:         config.TlsServerName,
+	}
+
+	if config.TlsMinVersion != "" {
+		version, ok := tlsVersions[config.TlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version '%s', must be one of 1.0, 1.1, 1.2 or 1.3", config.TlsMinVersion)
+		}
+
+		tlsConfig.MinVersion = version
+	}
+
+	if len(config.TlsCipherSuites) > 0 {
+		available := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			available[suite.Name] = suite.ID
+		}
+
+		for _, name := range config.TlsCipherSuites {
+			id, ok := available[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS cipher suite '%s'", name)
+			}
+
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// getProviderClientFingerprint returns a hash of the settings, which affect how the provider is connected to.
+// Responses fetched with one client must not be shared with a client using another CA bundle or proxy.
+func getProviderClientFingerprint(config *ProviderConfig, caBundleData []byte) string {
+	hash := sha256.New()
+
+	for _, value := range []string{
+		strconv.FormatBool(config.InsecureSkipVerifyBool),
+		string(caBundleData),
+		config.TlsMinVersion,
+		strings.Join(config.TlsCipherSuites, ","),
+		config.TlsServerName,
+		config.HttpProxy,
+		config.HttpsProxy,
+		config.NoProxy,
+	} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func validateProviderClientConfig(config *ProviderConfig) error {
+	if timeouts := config.Timeouts; timeouts != nil {
+		for _, timeout := range []float64{timeouts.Default, timeouts.Discovery, timeouts.Token, timeouts.Jwks, timeouts.Introspection, timeouts.Userinfo} {
+			if timeout < 0 {
+				return errors.New("timeouts must not be negative")
+			}
+		}
+	}
+
+	if retry := config.Retry; retry != nil {
+		if retry.MaxAttempts < 1 {
+			return errors.New("the maximum number of attempts must be at least 1")
+		}
+		if retry.InitialBackoff < 0 || retry.MaxBackoff < 0 {
+			return errors.New("the backoff must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// providerClientTransport applies the configured timeouts to all requests to the identity provider
+// and retries idempotent requests with an exponential backoff.
+type providerClientTransport struct {
+	next     http.RoundTripper
+	toa      *TraefikOidcAuth
+	timeouts *ProviderTimeoutsConfig
+	retry    *ProviderRetryConfig
+}
+
+func (transport *providerClientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := transport.toa.getProviderEndpointName(req.URL)
+	timeout := transport.getTimeout(endpoint)
+
+	maxAttempts := 1
+	if isIdempotentRequest(req) && transport.retry != nil && transport.retry.MaxAttempts > 1 {
+		maxAttempts = transport.retry.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := transport.roundTripWithTimeout(req, timeout)
+
+		if attempt >= maxAttempts || !isRetryable(req, resp, err) {
+			return resp, err
+		}
+
+		if err != nil {
+			transport.toa.logger.Log(logging.LevelWarn, "Request to %s endpoint failed (attempt %d of %d): %s", endpoint, attempt, maxAttempts, err.Error())
+		} else {
+			transport.toa.logger.Log(logging.LevelWarn, "Request to %s endpoint failed with status %d (attempt %d of %d)", endpoint, resp.StatusCode, attempt, maxAttempts)
+
+			// Drain the body, so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(transport.getBackoff(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (transport *providerClientTransport) roundTripWithTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return transport.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+
+	resp, err := transport.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+
+	// The timeout also applies to reading the body, so it may only be cancelled once the body is closed
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+func (transport *providerClientTransport) getTimeout(endpoint string) time.Duration {
+	if transport.timeouts == nil {
+		return 0
+	}
+
+	seconds := 0.0
+
+	switch endpoint {
+	case "discovery":
+		seconds = transport.timeouts.Discovery
+	case "token":
+		seconds = transport.timeouts.Token
+	case "jwks":
+		seconds = transport.timeouts.Jwks
+	case "introspection":
+		seconds = transport.timeouts.Introspection
+	case "userinfo":
+		seconds = transport.timeouts.Userinfo
+	}
+
+	if seconds <= 0 {
+		seconds = transport.timeouts.Default
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// getBackoff returns an exponential backoff with full jitter.
+func (transport *providerClientTransport) getBackoff(attempt int) time.Duration {
+	backoff := transport.retry.InitialBackoff * math.Pow(2, float64(attempt-1))
+	if transport.retry.MaxBackoff > 0 && backoff > transport.retry.MaxBackoff {
+		backoff = transport.retry.MaxBackoff
+	}
+
+	return time.Duration(rand.Float64() * backoff * float64(time.Second))
+}
+
+// isIdempotentRequest returns whether a request can safely be sent again.
+// Requests to the token endpoint are never retried, as refresh tokens may only be used once.
+func isIdempotentRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Don't retry when the request of the user has been cancelled
+		return req.Context().Err() == nil && !errors.Is(err, context.Canceled)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
@@ -0,0 +1,160 @@
+package src
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func createTestProviderClient(timeouts *ProviderTimeoutsConfig, retry *ProviderRetryConfig) *http.Client {
+	toa := newTestOidcAuth(&Config{})
+
+	return &http.Client{
+		Transport: &providerClientTransport{
+			next:     http.DefaultTransport,
+			toa:      toa,
+			timeouts: timeouts,
+			retry:    retry,
+		},
+	}
+}
+
+func TestProviderClientRetriesIdempotentRequests(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := createTestProviderClient(nil, &ProviderRetryConfig{MaxAttempts: 3, InitialBackoff: 0.001, MaxBackoff: 0.01})
+
+	resp, err := client.Get(server.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || attempts != 3 {
+		t.Errorf("Expected success after 3 attempts, but got status %d after %d attempts", resp.StatusCode, attempts)
+	}
+}
+
+func TestProviderClientDoesNotRetryPostRequests(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := createTestProviderClient(nil, &ProviderRetryConfig{MaxAttempts: 3, InitialBackoff: 0.001, MaxBackoff: 0.01})
+
+	resp, err := client.Post(server.URL+"/token", "application/x-www-form-urlencoded", strings.NewReader("grant_type=refresh_token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Errorf("Expected a single attempt, but got status %d after %d attempts", resp.StatusCode, attempts)
+	}
+}
+
+func TestProviderClientAppliesTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := createTestProviderClient(&ProviderTimeoutsConfig{Default: 10, Discovery: 0.05}, &ProviderRetryConfig{MaxAttempts: 1})
+
+	start := time.Now()
+	_, err := client.Get(server.URL + "/.well-known/openid-configuration")
+
+	if err == nil {
+		t.Fatal("Expected the request to time out")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the discovery timeout to be used, but the request took %s", time.Since(start))
+	}
+}
+
+func TestValidateProviderClientConfig(t *testing.T) {
+	if err := validateProviderClientConfig(CreateConfig().Provider); err != nil {
+		t.Errorf("Expected the defaults to be valid, but got %s", err.Error())
+	}
+	if validateProviderClientConfig(&ProviderConfig{Retry: &ProviderRetryConfig{MaxAttempts: 0}}) == nil {
+		t.Error("Expected 0 attempts to be rejected")
+	}
+	if validateProviderClientConfig(&ProviderConfig{Timeouts: &ProviderTimeoutsConfig{Token: -1}}) == nil {
+		t.Error("Expected a negative timeout to be rejected")
+	}
+}
+
+func TestCreateProviderTlsConfig(t *testing.T) {
+	tlsConfig, err := createProviderTlsConfig(&ProviderConfig{
+		TlsMinVersion:   "1.3",
+		TlsCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		TlsServerName:   "idp.example.com",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS13 || tlsConfig.ServerName != "idp.example.com" {
+		t.Errorf("Unexpected TLS configuration %+v", tlsConfig)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+
+	if _, err := createProviderTlsConfig(&ProviderConfig{TlsMinVersion: "1.4"}, nil); err == nil {
+		t.Error("Expected an unknown TLS version to be rejected")
+	}
+	if _, err := createProviderTlsConfig(&ProviderConfig{TlsCipherSuites: []string{"TLS_UNKNOWN"}}, nil); err == nil {
+		t.Error("Expected an unknown cipher suite to be rejected")
+	}
+}
+
+func TestProviderTlsServerNameIsUsedForSni(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	// The certificate of the test server is issued for example.com
+	tlsConfig, err := createProviderTlsConfig(&ProviderConfig{TlsServerName: "example.com"}, rootCAs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "example.com" {
+		t.Errorf("Expected the server name example.com, but got '%s'", body)
+	}
+}
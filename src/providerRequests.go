@@ -0,0 +1,112 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The ways the client authenticates at the token and introspection endpoints. See RFC 6749, section 2.3.1.
+const (
+	clientSecretBasic = "client_secret_basic"
+	clientSecretPost  = "client_secret_post"
+)
+
+func isValidTokenEndpointAuthMethod(method string) bool {
+	switch method {
+	case "", clientSecretBasic, clientSecretPost:
+		return true
+	default:
+		return false
+	}
+}
+
+// getTokenEndpointAuthMethod returns how the client secret is sent. Unless configured, the token endpoint
+// receives it in the body, while the introspection endpoint uses basic auth.
+func (toa *TraefikOidcAuth) getTokenEndpointAuthMethod(defaultMethod string) string {
+	if toa.Config.Provider.TokenEndpointAuthMethod != "" {
+		return toa.Config.Provider.TokenEndpointAuthMethod
+	}
+
+	return defaultMethod
+}
+
+// isPublicClient checks whether the client has no credentials to authenticate at the provider,
+// eg. a single page application or a native app. Such clients must use PKCE.
+func (config *ProviderConfig) isPublicClient() bool {
+	return config.ClientSecret == "" && config.ClientSecretFile == "" && config.ClientJwtPrivateKey == ""
+}
+
+// addAudience requests access tokens for the configured API. Auth0 and Okta custom authorization servers
+// otherwise issue opaque access tokens or tokens for the default audience.
+func (config *ProviderConfig) addAudience(data url.Values) {
+	if config.Audience != "" {
+		data.Set("audience", config.Audience)
+	}
+}
+
+// getDefaultValidAudience returns the audience of the validated tokens. Access tokens requested for an
+// Audience are issued for the API instead of the client.
+func (config *ProviderConfig) getDefaultValidAudience() string {
+	if config.Audience != "" && config.TokenValidation == "AccessToken" {
+		return config.Audience
+	}
+
+	return config.ClientId
+}
+
+// postForm posts the form to an endpoint of the provider, authenticating the client with the given method
+// and adding the configured headers and parameters. It passes the context of the request to the provider.
+// Clients without a secret only identify themselves with the client_id in the body.
+func (toa *TraefikOidcAuth) postForm(ctx context.Context, provider *IdentityProvider, endpoint string, data url.Values, extra *ProviderRequestConfig, authMethod string) (*http.Response, error) {
+	if provider.ClientSecret == "" {
+		data.Set("client_id", provider.ClientId)
+	} else if authMethod == clientSecretPost {
+		data.Set("client_id", provider.ClientId)
+		data.Set("client_secret", provider.ClientSecret)
+	}
+
+	extra.addParameters(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	extra.setHeaders(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if authMethod == clientSecretBasic && provider.ClientSecret != "" {
+		req.SetBasicAuth(provider.ClientId, provider.ClientSecret)
+	}
+
+	return toa.httpClient.Do(req)
+}
+
+// addParameters adds the configured form parameters to a request to the provider.
+// Parameters which are set by the request itself, like the grant_type, are never replaced.
+// May be called on a nil config.
+func (config *ProviderRequestConfig) addParameters(data url.Values) {
+	if config == nil {
+		return
+	}
+
+	for name, value := range config.Parameters {
+		if !data.Has(name) {
+			data.Set(name, value)
+		}
+	}
+}
+
+// setHeaders sets the configured headers on a request to the provider. It must be called before the
+// request sets its own headers, so these can't be replaced. May be called on a nil config.
+func (config *ProviderRequestConfig) setHeaders(req *http.Request) {
+	if config == nil {
+		return
+	}
+
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+}
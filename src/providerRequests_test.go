@@ -0,0 +1,215 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenRequestAddsHeadersAndParameters(t *testing.T) {
+	var received *http.Request
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"new-access-token"}`))
+	})
+	defer server.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = server.URL
+	toa.Config.Provider.TokenRequest = &ProviderRequestConfig{
+		Headers:    map[string]string{"X-API-Key": "secret-key"},
+		Parameters: map[string]string{"audience": "my-api", "grant_type": "password"},
+	}
+
+	if _, err := toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Header.Get("X-API-Key") != "secret-key" {
+		t.Errorf("Expected the X-API-Key header to be sent, but got '%s'", received.Header.Get("X-API-Key"))
+	}
+	if received.PostForm.Get("audience") != "my-api" {
+		t.Errorf("Expected the audience parameter to be sent, but got '%s'", received.PostForm.Get("audience"))
+	}
+	if received.PostForm.Get("grant_type") != "refresh_token" {
+		t.Errorf("Expected the grant_type not to be replaced, but got '%s'", received.PostForm.Get("grant_type"))
+	}
+}
+
+func TestIntrospectionRequestAddsHeadersAndParameters(t *testing.T) {
+	var received *http.Request
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"active":true}`))
+	})
+	defer server.Close()
+
+	toa.DiscoveryDocument.IntrospectionEndpoint = server.URL
+	toa.Config.Provider.IntrospectionRequest = &ProviderRequestConfig{
+		Headers:    map[string]string{"X-Tenant": "acme", "Content-Type": "text/plain"},
+		Parameters: map[string]string{"tenant": "acme"},
+	}
+
+	if ok, _, err := toa.introspectToken(context.Background(), toa.primaryProvider(), "access-token"); !ok {
+		t.Fatal(err)
+	}
+
+	if received.Header.Get("X-Tenant") != "acme" || received.PostForm.Get("tenant") != "acme" {
+		t.Errorf("Expected the tenant to be sent, but got '%s' and '%s'", received.Header.Get("X-Tenant"), received.PostForm.Get("tenant"))
+	}
+	if received.PostForm.Get("token") != "access-token" {
+		t.Errorf("Expected the form to be decodable, but got token '%s'", received.PostForm.Get("token"))
+	}
+}
+
+func TestTokenEndpointAuthMethod(t *testing.T) {
+	tests := []struct {
+		method        string
+		introspection bool
+		expectBasic   bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{clientSecretBasic, false, true},
+		{clientSecretPost, true, false},
+	}
+
+	for _, test := range tests {
+		var received *http.Request
+
+		toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"active":true,"access_token":"new-access-token"}`))
+		})
+
+		toa.DiscoveryDocument.TokenEndpoint = server.URL
+		toa.DiscoveryDocument.IntrospectionEndpoint = server.URL
+		toa.Config.Provider.ClientId = "my-client"
+		toa.Config.Provider.ClientSecret = "my-secret"
+		toa.Config.Provider.TokenEndpointAuthMethod = test.method
+
+		if test.introspection {
+			toa.introspectToken(context.Background(), toa.primaryProvider(), "access-token")
+		} else {
+			toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token")
+		}
+		server.Close()
+
+		username, password, basic := received.BasicAuth()
+		if test.expectBasic && (!basic || username != "my-client" || password != "my-secret") {
+			t.Errorf("%s (introspection: %v): Expected basic auth, but got '%s:%s'", test.method, test.introspection, username, password)
+		}
+		if basic != test.expectBasic {
+			t.Errorf("%s (introspection: %v): Expected basic auth to be %v", test.method, test.introspection, test.expectBasic)
+		}
+
+		if secret := received.PostForm.Get("client_secret"); (secret == "my-secret") == test.expectBasic {
+			t.Errorf("%s (introspection: %v): Expected the secret to be posted only without basic auth, but got '%s'", test.method, test.introspection, secret)
+		}
+	}
+}
+
+func TestPublicClientOnlySendsClientId(t *testing.T) {
+	for _, method := range []string{"", clientSecretBasic, clientSecretPost} {
+		for _, introspection := range []bool{false, true} {
+			var received *http.Request
+
+			toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				received = r
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"active":true,"access_token":"new-access-token"}`))
+			})
+
+			toa.DiscoveryDocument.TokenEndpoint = server.URL
+			toa.DiscoveryDocument.IntrospectionEndpoint = server.URL
+			toa.Config.Provider.ClientId = "my-spa"
+			toa.Config.Provider.TokenEndpointAuthMethod = method
+
+			if introspection {
+				toa.introspectToken(context.Background(), toa.primaryProvider(), "access-token")
+			} else {
+				toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token")
+			}
+			server.Close()
+
+			if _, _, basic := received.BasicAuth(); basic {
+				t.Errorf("%s (introspection: %v): Expected no basic auth for a public client", method, introspection)
+			}
+			if received.PostForm.Get("client_id") != "my-spa" {
+				t.Errorf("%s (introspection: %v): Expected the client_id to be posted, but got '%s'", method, introspection, received.PostForm.Get("client_id"))
+			}
+			if received.PostForm.Has("client_secret") {
+				t.Errorf("%s (introspection: %v): Expected no client_secret to be posted", method, introspection)
+			}
+		}
+	}
+}
+
+func TestAudienceIsRequested(t *testing.T) {
+	var received *http.Request
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"new-access-token"}`))
+	})
+	defer server.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = server.URL
+	toa.Config.Provider.Audience = "https://api.example.com"
+
+	if _, err := toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.PostForm.Get("audience") != "https://api.example.com" {
+		t.Errorf("Expected the audience to be sent to the token endpoint, but got '%s'", received.PostForm.Get("audience"))
+	}
+
+	login := newLoginTest()
+	login.Config.Provider.Audience = "https://api.example.com"
+
+	authorizationUrl, ok := login.createAuthorizationUrl(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	if audience := mustParseQuery(t, authorizationUrl).Get("audience"); audience != "https://api.example.com" {
+		t.Errorf("Expected the audience to be sent to the authorization endpoint, but got '%s'", audience)
+	}
+}
+
+func TestDefaultValidAudience(t *testing.T) {
+	tests := []struct {
+		audience        string
+		tokenValidation string
+		expected        string
+	}{
+		{"", "AccessToken", "my-client"},
+		{"https://api.example.com", "AccessToken", "https://api.example.com"},
+		{"https://api.example.com", "IdToken", "my-client"},
+	}
+
+	for _, test := range tests {
+		config := &ProviderConfig{ClientId: "my-client", Audience: test.audience, TokenValidation: test.tokenValidation}
+
+		if actual := config.getDefaultValidAudience(); actual != test.expected {
+			t.Errorf("%s/%s: Expected '%s', but got '%s'", test.audience, test.tokenValidation, test.expected, actual)
+		}
+	}
+}
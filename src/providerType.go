@@ -0,0 +1,64 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The identity providers with presets, which set the defaults for their peculiarities.
+const (
+	providerTypeGeneric  = "generic"
+	providerTypeKeycloak = "keycloak"
+)
+
+func isValidProviderType(providerType string) bool {
+	switch providerType {
+	case "", providerTypeGeneric, providerTypeKeycloak:
+		return true
+	default:
+		return false
+	}
+}
+
+// The claim which receives the flattened realm- and client roles of Keycloak.
+const keycloakRolesClaim = "roles"
+
+// applyProviderType sets the defaults of the ProviderType. Explicitly configured values are kept.
+func applyProviderType(logger *logging.Logger, config *Config) error {
+	if !isValidProviderType(config.ProviderType) {
+		logger.Log(logging.LevelError, "Invalid ProviderType %s. Must be one of %s or %s.", config.ProviderType, providerTypeGeneric, providerTypeKeycloak)
+		return errors.New("invalid provider type")
+	}
+
+	if config.ProviderType != providerTypeKeycloak {
+		return nil
+	}
+
+	if config.Provider.IdpHintParameter == "" {
+		config.Provider.IdpHintParameter = "kc_idp_hint"
+	}
+
+	for _, mapping := range config.ClaimMappings {
+		if mapping.Name == keycloakRolesClaim {
+			logger.Log(logging.LevelDebug, "A claim mapping for %s is configured. Not flattening the Keycloak roles.", keycloakRolesClaim)
+			return nil
+		}
+	}
+
+	// Keycloak nests the roles by realm and client, which makes them hard to use in assertions and headers.
+	// The mapping runs first, so other mappings can use the flattened roles.
+	rolesMapping := ClaimMappingConfig{
+		Name: keycloakRolesClaim,
+		From: []string{
+			keycloakRolesClaim,
+			"realm_access.roles",
+			fmt.Sprintf("resource_access['%s'].roles", config.Provider.ClientId),
+		},
+	}
+
+	config.ClaimMappings = append([]ClaimMappingConfig{rolesMapping}, config.ClaimMappings...)
+
+	return nil
+}
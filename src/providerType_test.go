@@ -0,0 +1,76 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestKeycloakRolesAreFlattened(t *testing.T) {
+	toa := newTestOidcAuth(&Config{ProviderType: providerTypeKeycloak})
+	toa.Config.Provider.ClientId = "my-app"
+
+	if err := applyProviderType(logging.CreateLogger(logging.LevelError), toa.Config); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseClaimMappings(toa.Config.ClaimMappings); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := toa.mapClaims(map[string]interface{}{
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access", "user"},
+		},
+		"resource_access": map[string]interface{}{
+			"my-app":  map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+			"account": map[string]interface{}{"roles": []interface{}{"manage-account"}},
+		},
+	})
+
+	expected := []interface{}{"offline_access", "user", "admin"}
+	if !reflect.DeepEqual(claims["roles"], expected) {
+		t.Errorf("Expected the roles %v, but got %v", expected, claims["roles"])
+	}
+
+	if toa.Config.Provider.IdpHintParameter != "kc_idp_hint" {
+		t.Errorf("Expected the Keycloak idp hint parameter, but got '%s'", toa.Config.Provider.IdpHintParameter)
+	}
+}
+
+func TestKeycloakKeepsConfiguredRolesMapping(t *testing.T) {
+	config := &Config{
+		ProviderType:  providerTypeKeycloak,
+		Provider:      &ProviderConfig{IdpHintParameter: "idp"},
+		ClaimMappings: []ClaimMappingConfig{{Name: "roles", From: []string{"groups"}}},
+	}
+
+	if err := applyProviderType(logging.CreateLogger(logging.LevelError), config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.ClaimMappings) != 1 || config.ClaimMappings[0].From[0] != "groups" || config.Provider.IdpHintParameter != "idp" {
+		t.Errorf("Expected the configured values to be kept, but got %v and %s", config.ClaimMappings, config.Provider.IdpHintParameter)
+	}
+
+	config.ProviderType = "okta"
+	if err := applyProviderType(logging.CreateLogger(logging.LevelError), config); err == nil {
+		t.Error("Expected an unknown provider type to be rejected")
+	}
+}
+
+func TestIdpHintIsSentToProvider(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.Provider.IdpHintParameter = "kc_idp_hint"
+
+	authorizationUrl, ok := toa.createAuthorizationUrl(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/login?idp_hint=github", nil))
+	if !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	if hint := mustParseQuery(t, authorizationUrl).Get("kc_idp_hint"); hint != "github" {
+		t.Errorf("Expected the idp hint to be sent, but got '%s'", hint)
+	}
+}
@@ -0,0 +1,282 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The delay before the first retry of a provisioning request. It is doubled for every further retry.
+var provisioningRetryDelay = 500 * time.Millisecond
+
+type ProvisioningRequest struct {
+	Id         string                 `json:"id"`
+	Time       string                 `json:"time"`
+	Middleware string                 `json:"middleware"`
+	Subject    string                 `json:"sub"`
+	Claims     map[string]interface{} `json:"claims"`
+}
+
+// Provisioner calls the provisioning endpoint on the first login of a subject, so the upstream application
+// can create the user before its first request. Subjects which have been provisioned are remembered
+// in a seen-set, which is persisted to a file, if configured.
+// All methods may be called on a nil provisioner, in which case nobody is provisioned.
+type Provisioner struct {
+	url        string
+	secret     string
+	headers    map[string]string
+	retries    int
+	middleware string
+	client     *http.Client
+	logger     *logging.Logger
+	clock      utils.Clock
+
+	seen     map[string]struct{}
+	seenFile string
+	lock     sync.Mutex
+	flights  utils.SingleFlight
+}
+
+func CreateProvisioner(logger *logging.Logger, config *ProvisioningConfig, middleware string) (*Provisioner, error) {
+	if config.Secret == "" {
+		return nil, errors.New("provisioning requires a secret to sign the requests")
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("the provisioning timeout must be greater than 0")
+	}
+	if config.Retries < 0 {
+		return nil, errors.New("the provisioning retries must not be negative")
+	}
+
+	provisioner := &Provisioner{
+		url:        config.Url,
+		secret:     config.Secret,
+		headers:    config.Headers,
+		retries:    config.Retries,
+		middleware: middleware,
+		client:     &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		logger:     logger,
+		clock:      utils.SystemClock,
+		seen:       make(map[string]struct{}),
+		seenFile:   config.SeenSubjectsFile,
+	}
+
+	if err := provisioner.loadSeenSubjects(); err != nil {
+		return nil, err
+	}
+
+	return provisioner, nil
+}
+
+// loadSeenSubjects reads the keys of the provisioned subjects, one per line.
+func (provisioner *Provisioner) loadSeenSubjects() error {
+	if provisioner.seenFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(provisioner.seenFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the seen subjects: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			provisioner.seen[key] = struct{}{}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// EnsureProvisioned calls the provisioning endpoint, if the subject hasn't been seen before.
+// Concurrent first logins of the same subject share a single provisioning.
+func (provisioner *Provisioner) EnsureProvisioned(ctx context.Context, claims map[string]interface{}) error {
+	if provisioner == nil {
+		return nil
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return errors.New("the claims don't contain a subject")
+	}
+
+	issuer, _ := claims["iss"].(string)
+	key := provisioner.getSubjectKey(issuer, subject)
+
+	if provisioner.hasSeen(key) {
+		return nil
+	}
+
+	_, err, _ := provisioner.flights.Do(key, func() (interface{}, error) {
+		// Another login may have just provisioned the subject
+		if provisioner.hasSeen(key) {
+			return nil, nil
+		}
+
+		if err := provisioner.provision(ctx, subject, claims); err != nil {
+			return nil, err
+		}
+
+		provisioner.markSeen(key)
+		provisioner.logger.Log(logging.LevelInfo, "Provisioned subject '%s'.", subject)
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// getSubjectKey returns the key of the subject in the seen-set. Subjects are only unique per issuer
+// and aren't stored in plain text.
+func (provisioner *Provisioner) getSubjectKey(issuer string, subject string) string {
+	mac := hmac.New(sha256.New, []byte(provisioner.secret))
+	mac.Write([]byte(issuer))
+	mac.Write([]byte{0})
+	mac.Write([]byte(subject))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (provisioner *Provisioner) hasSeen(key string) bool {
+	provisioner.lock.Lock()
+	defer provisioner.lock.Unlock()
+
+	_, ok := provisioner.seen[key]
+
+	return ok
+}
+
+func (provisioner *Provisioner) markSeen(key string) {
+	provisioner.lock.Lock()
+	defer provisioner.lock.Unlock()
+
+	provisioner.seen[key] = struct{}{}
+
+	if provisioner.seenFile == "" {
+		return
+	}
+
+	// The subject is provisioned anyway, so a failure only results in another call after a restart
+	file, err := os.OpenFile(provisioner.seenFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		provisioner.logger.Log(logging.LevelError, "Failed to persist the provisioned subject: %s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(key + "\n"); err != nil {
+		provisioner.logger.Log(logging.LevelError, "Failed to persist the provisioned subject: %s", err.Error())
+	}
+}
+
+// provision posts the request to the provisioning endpoint. Network errors and server errors are retried
+// with an exponential backoff, while other errors are returned immediately.
+func (provisioner *Provisioner) provision(ctx context.Context, subject string, claims map[string]interface{}) error {
+	request := &ProvisioningRequest{
+		Id:         uuid.New().String(),
+		Time:       provisioner.clock.Now().UTC().Format(time.RFC3339),
+		Middleware: provisioner.middleware,
+		Subject:    subject,
+		Claims:     claims,
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	delay := provisioningRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		retryable, err := provisioner.deliver(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= provisioner.retries {
+			return err
+		}
+
+		provisioner.logger.Log(logging.LevelWarn, "Failed to provision subject '%s': %s. Retrying in %s.", subject, err.Error(), delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay *= 2
+	}
+}
+
+// deliver sends a single provisioning request. It returns whether a failed request may be retried.
+func (provisioner *Provisioner) deliver(ctx context.Context, body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(provisioner.clock.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provisioner.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range provisioner.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookEvent(provisioner.secret, timestamp, body))
+
+	resp, err := provisioner.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return retryable, fmt.Errorf("the provisioning endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+// writeProvisioningError tells the user that the login can't be completed, because the account couldn't be
+// set up in the application. The user isn't marked as seen, so the next login tries again.
+func (toa *TraefikOidcAuth) writeProvisioningError(rw http.ResponseWriter, req *http.Request) {
+	data := make(map[string]interface{})
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.4"
+	data["statusCode"] = http.StatusServiceUnavailable
+	data["statusName"] = "Service Unavailable"
+	data["description"] = "Your account couldn't be set up. Please try to log in again later."
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	page := toa.Config.ErrorPages.LoginFailed
+	if page == nil {
+		page = &errorPages.ErrorPageConfig{}
+	}
+
+	errorPages.WriteError(toa.logger, page, rw, req, data, jsHeaders)
+}
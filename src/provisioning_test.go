@@ -0,0 +1,171 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func newProvisioningTest(t *testing.T, handler http.HandlerFunc, seenSubjectsFile string) (*Provisioner, *httptest.Server) {
+	server := httptest.NewServer(handler)
+
+	provisioner, err := CreateProvisioner(logging.CreateLogger(logging.LevelError), &ProvisioningConfig{
+		Url:              server.URL,
+		Secret:           "provisioning-secret",
+		Timeout:          5,
+		Retries:          2,
+		SeenSubjectsFile: seenSubjectsFile,
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provisioner, server
+}
+
+func TestProvisioningOnlyOnFirstLogin(t *testing.T) {
+	var calls int32
+	var received ProvisioningRequest
+
+	provisioner, server := newProvisioningTest(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+signWebhookEvent("provisioning-secret", r.Header.Get(webhookTimestampHeader), body) {
+			t.Errorf("Expected a valid signature, but got '%s'", r.Header.Get(webhookSignatureHeader))
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}, "")
+	defer server.Close()
+
+	claims := map[string]interface{}{"iss": "https://idp.example.com", "sub": "user-1", "email": "jane@example.com"}
+
+	for i := 0; i < 2; i++ {
+		if err := provisioner.EnsureProvisioned(context.Background(), claims); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected a single provisioning request, but got %d", calls)
+	}
+	if received.Subject != "user-1" || received.Claims["email"] != "jane@example.com" {
+		t.Errorf("Expected the subject and claims to be sent, but got %+v", received)
+	}
+
+	// The same subject of another issuer is another user
+	if err := provisioner.EnsureProvisioned(context.Background(), map[string]interface{}{"iss": "https://other.example.com", "sub": "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the subject of another issuer to be provisioned, but got %d requests", calls)
+	}
+}
+
+func TestProvisioningRetriesServerErrors(t *testing.T) {
+	provisioningRetryDelay = time.Millisecond
+	defer func() { provisioningRetryDelay = 500 * time.Millisecond }()
+
+	var calls int32
+
+	provisioner, server := newProvisioningTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}, "")
+	defer server.Close()
+
+	if err := provisioner.EnsureProvisioned(context.Background(), map[string]interface{}{"sub": "user-1"}); err != nil {
+		t.Fatalf("Expected the provisioning to succeed after retries, but got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, but got %d", calls)
+	}
+}
+
+func TestProvisioningFailures(t *testing.T) {
+	provisioningRetryDelay = time.Millisecond
+	defer func() { provisioningRetryDelay = 500 * time.Millisecond }()
+
+	tests := []struct {
+		status        int
+		expectedCalls int32
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusInternalServerError, 3},
+	}
+
+	for _, test := range tests {
+		var calls int32
+
+		provisioner, server := newProvisioningTest(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(test.status)
+		}, "")
+
+		claims := map[string]interface{}{"sub": "user-1"}
+
+		if err := provisioner.EnsureProvisioned(context.Background(), claims); err == nil {
+			t.Errorf("%d: Expected the provisioning to fail", test.status)
+		}
+		if calls != test.expectedCalls {
+			t.Errorf("%d: Expected %d attempts, but got %d", test.status, test.expectedCalls, calls)
+		}
+
+		// A failed provisioning is tried again on the next login
+		calls = 0
+		provisioner.EnsureProvisioned(context.Background(), claims)
+		if calls == 0 {
+			t.Errorf("%d: Expected the subject not to be marked as seen", test.status)
+		}
+
+		server.Close()
+	}
+}
+
+func TestProvisionedSubjectsArePersisted(t *testing.T) {
+	seenSubjectsFile := filepath.Join(t.TempDir(), "seen")
+
+	var calls int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}
+
+	provisioner, server := newProvisioningTest(t, handler, seenSubjectsFile)
+	defer server.Close()
+
+	if err := provisioner.EnsureProvisioned(context.Background(), map[string]interface{}{"sub": "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, restartedServer := newProvisioningTest(t, handler, seenSubjectsFile)
+	defer restartedServer.Close()
+
+	if err := restarted.EnsureProvisioned(context.Background(), map[string]interface{}{"sub": "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the provisioned subject to be remembered after a restart, but got %d requests", calls)
+	}
+}
+
+func TestProvisioningRequiresSecret(t *testing.T) {
+	_, err := CreateProvisioner(logging.CreateLogger(logging.LevelError), &ProvisioningConfig{Url: "https://app.example.com/provision", Timeout: 5}, "test")
+	if err == nil {
+		t.Error("Expected a provisioning without secret to be rejected")
+	}
+}
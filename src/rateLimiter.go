@@ -0,0 +1,119 @@
+package src
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+type rateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// RateLimiter is a simple token bucket rate limiter keyed by an arbitrary string, eg. the client ip.
+type RateLimiter struct {
+	ratePerSecond float64
+	burst         float64
+	buckets       map[string]*rateLimitBucket
+	lastCleanup   time.Time
+
+	lock sync.Mutex
+}
+
+func CreateRateLimiter(requestsPerMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		ratePerSecond: float64(requestsPerMinute) / 60,
+		burst:         float64(burst),
+		buckets:       make(map[string]*rateLimitBucket),
+		lastCleanup:   time.Now(),
+	}
+}
+
+// Allow consumes a token for the given key. If no token is available,
+// it returns false and the duration after which the next token is available.
+func (limiter *RateLimiter) Allow(key string) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+
+	limiter.cleanup(now)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: limiter.burst, updatedAt: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limiter.ratePerSecond)
+	bucket.updatedAt = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	retryAfter := time.Duration((1 - bucket.tokens) / limiter.ratePerSecond * float64(time.Second))
+
+	return false, retryAfter
+}
+
+// cleanup removes all buckets which are full again, so the map doesn't grow indefinitely.
+func (limiter *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(limiter.lastCleanup) < time.Minute {
+		return
+	}
+
+	limiter.lastCleanup = now
+
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limiter.ratePerSecond >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of tracked clients, including expired ones which haven't been removed yet.
+func (limiter *RateLimiter) Len() int {
+	if limiter == nil {
+		return 0
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	return len(limiter.buckets)
+}
+
+// checkRateLimit returns false and writes a 429 response if the client exceeded the rate limit.
+// The endpoint, eg. login or callback, is used to count the rejected requests.
+func (toa *TraefikOidcAuth) checkRateLimit(rw http.ResponseWriter, req *http.Request, endpoint string) bool {
+	if toa.RateLimiter == nil {
+		return true
+	}
+
+	clientIp := utils.GetClientIp(req)
+
+	allowed, retryAfter := toa.RateLimiter.Allow(clientIp)
+	if allowed {
+		return true
+	}
+
+	toa.logger.Log(logging.LevelWarn, "Rate limit exceeded for client %s on %s.", clientIp, req.URL.Path)
+	toa.Metrics.RecordRateLimited(endpoint)
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+	return false
+}
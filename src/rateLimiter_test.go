@@ -0,0 +1,60 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiterAllowsBurst(t *testing.T) {
+	limiter := CreateRateLimiter(60, 3)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("10.0.0.1"); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	allowed, retryAfter := limiter.Allow("10.0.0.1")
+	if allowed {
+		t.Fatal("Expected request to be rejected after the burst")
+	}
+	if retryAfter <= 0 {
+		t.Errorf("Expected a positive retry-after duration, but got %v", retryAfter)
+	}
+
+	if allowed, _ := limiter.Allow("10.0.0.2"); !allowed {
+		t.Fatal("Expected requests of another client to be allowed")
+	}
+}
+
+func TestCheckRateLimitWritesTooManyRequests(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+	toa.RateLimiter = CreateRateLimiter(1, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/oidc/callback", nil)
+
+	if !toa.checkRateLimit(httptest.NewRecorder(), req, "callback") {
+		t.Fatal("Expected the first request to be allowed")
+	}
+
+	rw := httptest.NewRecorder()
+	if toa.checkRateLimit(rw, req, "callback") {
+		t.Fatal("Expected the second request to be rejected")
+	}
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After to be 60, but got '%s'", rw.Header().Get("Retry-After"))
+	}
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	if !strings.Contains(rw.Body.String(), `traefik_oidc_auth_rate_limited_total{middleware="oidc@file",provider="https://idp.example.com",endpoint="callback"} 1`) {
+		t.Errorf("Expected the rejected request to be counted, but got:\n%s", rw.Body.String())
+	}
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The policies for the redirect uris, which clients pass to the login and logout endpoints.
+const (
+	redirectUriPolicyPatterns     = "Patterns"
+	redirectUriPolicyRelativeOnly = "RelativeOnly"
+	redirectUriPolicySameHost     = "SameHost"
+	redirectUriPolicySameDomain   = "SameDomain"
+)
+
+var errInvalidRedirectUri = errors.New("invalid redirect uri")
+
+func isValidRedirectUriPolicy(policy string) bool {
+	switch policy {
+	case "", redirectUriPolicyPatterns, redirectUriPolicyRelativeOnly, redirectUriPolicySameHost, redirectUriPolicySameDomain:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateRedirectUri checks the redirect uri of the request against the RedirectUriPolicy.
+// By default, the uri has to match one of the patterns. The other policies check the structure
+// of the uri instead, so a too broad pattern can't turn the endpoints into an open redirect.
+func (toa *TraefikOidcAuth) validateRedirectUri(req *http.Request, redirectUri string, patterns []string) (string, error) {
+	if redirectUri == "" {
+		return "", nil
+	}
+
+	switch toa.Config.RedirectUriPolicy {
+	case redirectUriPolicyRelativeOnly:
+		if !isRelativeRedirectUri(redirectUri) {
+			return "", errInvalidRedirectUri
+		}
+		return redirectUri, nil
+	case redirectUriPolicySameHost:
+		if !isRelativeRedirectUri(redirectUri) && !isSameHostRedirectUri(req, redirectUri) {
+			return "", errInvalidRedirectUri
+		}
+		return redirectUri, nil
+	case redirectUriPolicySameDomain:
+		if !isRelativeRedirectUri(redirectUri) && !isSameHostRedirectUri(req, redirectUri) && !isSameDomainRedirectUri(redirectUri, toa.Config.SessionCookie.Domain) {
+			return "", errInvalidRedirectUri
+		}
+		return redirectUri, nil
+	default:
+		return utils.ValidateRedirectUri(redirectUri, patterns)
+	}
+}
+
+// isRelativeRedirectUri checks whether the uri is a path on the current host.
+// Browsers treat //host and /\host as absolute, so these are rejected as well.
+func isRelativeRedirectUri(redirectUri string) bool {
+	if !strings.HasPrefix(redirectUri, "/") || strings.HasPrefix(redirectUri, "//") || strings.ContainsAny(redirectUri, "\\\r\n\t") {
+		return false
+	}
+
+	parsed, err := url.Parse(redirectUri)
+
+	return err == nil && parsed.Scheme == "" && parsed.Host == "" && parsed.User == nil
+}
+
+func isSameHostRedirectUri(req *http.Request, redirectUri string) bool {
+	if strings.ContainsAny(redirectUri, "\\\r\n\t") {
+		return false
+	}
+
+	parsed, err := url.Parse(redirectUri)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User != nil {
+		return false
+	}
+
+	host, err := url.Parse(utils.GetFullHost(req))
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(parsed.Host, host.Host)
+}
+
+// isSameDomainRedirectUri checks whether the uri is on a host, which shares the session cookie,
+// so users are logged in there as well.
+func isSameDomainRedirectUri(redirectUri string, domain string) bool {
+	if strings.ContainsAny(redirectUri, "\\\r\n\t") {
+		return false
+	}
+
+	parsed, err := url.Parse(redirectUri)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User != nil {
+		return false
+	}
+
+	return isHostInCookieDomain(parsed.Host, domain)
+}
@@ -0,0 +1,100 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRelativeOnlyRedirectUriPolicy(t *testing.T) {
+	toa := newTestOidcAuth(&Config{RedirectUriPolicy: redirectUriPolicyRelativeOnly})
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/login", nil)
+
+	tests := map[string]bool{
+		"/dashboard?tab=1":           true,
+		"/":                          true,
+		"https://app.example.com/":   false,
+		"//evil.example.com/":        false,
+		"/\\evil.example.com/":       false,
+		"javascript:alert(1)":        false,
+		"dashboard":                  false,
+		"/dashboard\r\nLocation: x":  false,
+		"https://evil.example.com/x": false,
+	}
+
+	for uri, expected := range tests {
+		_, err := toa.validateRedirectUri(req, uri, []string{"*"})
+		if (err == nil) != expected {
+			t.Errorf("Expected %t for %s", expected, uri)
+		}
+	}
+}
+
+func TestSameHostRedirectUriPolicy(t *testing.T) {
+	toa := newTestOidcAuth(&Config{RedirectUriPolicy: redirectUriPolicySameHost})
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/login", nil)
+
+	tests := map[string]bool{
+		"/dashboard":                         true,
+		"http://app.example.com/dashboard":   true,
+		"http://APP.example.com/":            true,
+		"http://app.example.com.evil.com/":   false,
+		"http://user@app.example.com/":       false,
+		"ftp://app.example.com/":             false,
+		"https://evil.example.com/dashboard": false,
+		"//app.example.com/":                 false,
+	}
+
+	for uri, expected := range tests {
+		_, err := toa.validateRedirectUri(req, uri, nil)
+		if (err == nil) != expected {
+			t.Errorf("Expected %t for %s", expected, uri)
+		}
+	}
+}
+
+func TestSameDomainRedirectUriPolicy(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		RedirectUriPolicy: redirectUriPolicySameDomain,
+		SessionCookie:     &SessionCookieConfig{Domain: ".example.com"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://login.example.com/login", nil)
+
+	tests := map[string]bool{
+		"/dashboard":                         true,
+		"https://sub1.example.com/dashboard": true,
+		"https://example.com/":               true,
+		"https://SUB2.Example.com:8443/":     true,
+		"https://sub1.example.com.evil.com/": false,
+		"https://evilexample.com/":           false,
+		"https://user@sub1.example.com/":     false,
+		"javascript://sub1.example.com/%0a1": false,
+		"//sub1.example.com/":                false,
+	}
+
+	for uri, expected := range tests {
+		_, err := toa.validateRedirectUri(req, uri, nil)
+		if (err == nil) != expected {
+			t.Errorf("Expected %t for %s", expected, uri)
+		}
+	}
+}
+
+func TestRelativeRedirectUriIsUsedAfterLogin(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.RedirectUriPolicy = redirectUriPolicyRelativeOnly
+
+	rw := httptest.NewRecorder()
+	toa.redirectToProvider(rw, httptest.NewRequest(http.MethodGet, "http://app.example.com/login?redirect_uri=/dashboard", nil))
+
+	if rw.Code != http.StatusFound {
+		t.Errorf("Expected a redirect to the provider, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.redirectToProvider(rw, httptest.NewRequest(http.MethodGet, "http://app.example.com/login?redirect_uri=https://app.example.com/dashboard", nil))
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected absolute redirect uris to be rejected, but got %d", rw.Code)
+	}
+}
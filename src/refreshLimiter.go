@@ -0,0 +1,87 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// errRefreshQueueTimeout indicates that a token refresh waited too long for a free slot.
+var errRefreshQueueTimeout = errors.New("timed out waiting for a token refresh slot")
+
+// RefreshLimiter limits the number of concurrent refresh token grants, so the token endpoint of the provider
+// isn't overwhelmed when many sessions expire at the same time, eg. after a maintenance window of the provider.
+// Concurrent refreshes of the same session share a single grant.
+// All methods may be called on a nil limiter, in which case refreshes are never limited.
+type RefreshLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	flights      utils.SingleFlight
+}
+
+func CreateRefreshLimiter(maxConcurrent int, queueTimeout time.Duration) *RefreshLimiter {
+	return &RefreshLimiter{
+		slots:        make(chan struct{}, maxConcurrent),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Do refreshes the tokens of the session using fn, once a slot is free. If the session is already being refreshed,
+// the result of that refresh is returned instead. errRefreshQueueTimeout is returned, if no slot becomes free
+// within the queue timeout.
+func (limiter *RefreshLimiter) Do(ctx context.Context, sessionId string, fn func() (*oidc.OidcTokenResponse, error)) (*oidc.OidcTokenResponse, error) {
+	if limiter == nil {
+		return fn()
+	}
+
+	result, err, _ := limiter.flights.Do(sessionId, func() (interface{}, error) {
+		if err := limiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer limiter.release()
+
+		return fn()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*oidc.OidcTokenResponse), nil
+}
+
+func (limiter *RefreshLimiter) acquire(ctx context.Context) error {
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(limiter.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errRefreshQueueTimeout
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errRefreshQueueTimeout, ctx.Err())
+	}
+}
+
+func (limiter *RefreshLimiter) release() {
+	<-limiter.slots
+}
+
+// Active returns the number of refreshes which are currently running.
+func (limiter *RefreshLimiter) Active() int {
+	if limiter == nil {
+		return 0
+	}
+
+	return len(limiter.slots)
+}
@@ -0,0 +1,136 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestRefreshLimiterLimitsConcurrentRefreshes(t *testing.T) {
+	limiter := CreateRefreshLimiter(2, time.Second)
+
+	var active, maxActive int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := limiter.Do(context.Background(), fmt.Sprintf("session-%d", i), func() (*oidc.OidcTokenResponse, error) {
+				current := atomic.AddInt32(&active, 1)
+				for {
+					observed := atomic.LoadInt32(&maxActive)
+					if current <= observed || atomic.CompareAndSwapInt32(&maxActive, observed, current) {
+						break
+					}
+				}
+
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+
+				return &oidc.OidcTokenResponse{AccessToken: "token"}, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("Expected at most 2 concurrent refreshes, but got %d", maxActive)
+	}
+	if limiter.Active() != 0 {
+		t.Errorf("Expected all slots to be released, but %d are in use", limiter.Active())
+	}
+}
+
+func TestRefreshLimiterSharesRefreshOfSession(t *testing.T) {
+	limiter := CreateRefreshLimiter(1, time.Second)
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]*oidc.OidcTokenResponse, 2)
+
+	refresh := func(i int) {
+		defer wg.Done()
+
+		results[i], _ = limiter.Do(context.Background(), "session", func() (*oidc.OidcTokenResponse, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+
+			return &oidc.OidcTokenResponse{AccessToken: "renewed"}, nil
+		})
+	}
+
+	wg.Add(1)
+	go refresh(0)
+	<-started
+
+	wg.Add(1)
+	go refresh(1)
+
+	// Give the second refresh the time to join the first one
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected a single refresh grant, but got %d", calls)
+	}
+	if results[0] == nil || results[1] == nil || results[1].AccessToken != "renewed" {
+		t.Errorf("Expected both requests to receive the renewed tokens, but got %v", results)
+	}
+}
+
+func TestRefreshLimiterQueueTimeout(t *testing.T) {
+	limiter := CreateRefreshLimiter(1, 20*time.Millisecond)
+
+	release := make(chan struct{})
+	go limiter.Do(context.Background(), "session-1", func() (*oidc.OidcTokenResponse, error) {
+		<-release
+		return &oidc.OidcTokenResponse{}, nil
+	})
+	defer close(release)
+
+	for limiter.Active() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	called := false
+	_, err := limiter.Do(context.Background(), "session-2", func() (*oidc.OidcTokenResponse, error) {
+		called = true
+		return &oidc.OidcTokenResponse{}, nil
+	})
+
+	if !errors.Is(err, errRefreshQueueTimeout) {
+		t.Errorf("Expected the queue timeout, but got %v", err)
+	}
+	if called {
+		t.Error("Expected the refresh not to be executed")
+	}
+}
+
+func TestNilRefreshLimiterDoesNotLimit(t *testing.T) {
+	var limiter *RefreshLimiter
+
+	token, err := limiter.Do(context.Background(), "session", func() (*oidc.OidcTokenResponse, error) {
+		return &oidc.OidcTokenResponse{AccessToken: "token"}, nil
+	})
+
+	if err != nil || token.AccessToken != "token" {
+		t.Errorf("Expected the refresh to be executed, but got %v, %v", token, err)
+	}
+}
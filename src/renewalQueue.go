@@ -0,0 +1,87 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+// RenewalQueue remembers sessions whose token renewal failed, because the provider was unavailable.
+// Their renewal is retried on a later request once the retry interval has passed, instead of on every request.
+// All methods may be called on a nil queue, in which case renewals are never postponed.
+type RenewalQueue struct {
+	retryInterval time.Duration
+	entries       map[string]time.Time
+	lastCleanup   time.Time
+
+	lock sync.Mutex
+}
+
+func CreateRenewalQueue(retryInterval time.Duration) *RenewalQueue {
+	return &RenewalQueue{
+		retryInterval: retryInterval,
+		entries:       make(map[string]time.Time),
+		lastCleanup:   time.Now(),
+	}
+}
+
+// ShouldAttempt returns whether the tokens of the session may be renewed now.
+func (queue *RenewalQueue) ShouldAttempt(sessionId string) bool {
+	if queue == nil {
+		return true
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	nextAttempt, ok := queue.entries[sessionId]
+
+	return !ok || !time.Now().Before(nextAttempt)
+}
+
+// Postpone queues the renewal of the session until the retry interval has passed.
+func (queue *RenewalQueue) Postpone(sessionId string) {
+	if queue == nil {
+		return
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	now := time.Now()
+
+	// Sessions which haven't been seen for a while have probably been closed
+	if now.Sub(queue.lastCleanup) > time.Minute {
+		queue.lastCleanup = now
+
+		for key, nextAttempt := range queue.entries {
+			if now.Sub(nextAttempt) > time.Hour {
+				delete(queue.entries, key)
+			}
+		}
+	}
+
+	queue.entries[sessionId] = now.Add(queue.retryInterval)
+}
+
+// Remove removes the session from the queue after its tokens have been renewed.
+func (queue *RenewalQueue) Remove(sessionId string) {
+	if queue == nil {
+		return
+	}
+
+	queue.lock.Lock()
+	delete(queue.entries, sessionId)
+	queue.lock.Unlock()
+}
+
+// Len returns the number of entries, including expired ones which haven't been removed yet.
+func (queue *RenewalQueue) Len() int {
+	if queue == nil {
+		return 0
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	return len(queue.entries)
+}
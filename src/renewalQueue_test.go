@@ -0,0 +1,89 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func TestRenewalQueuePostponesRenewals(t *testing.T) {
+	queue := CreateRenewalQueue(20 * time.Millisecond)
+
+	if !queue.ShouldAttempt("session") {
+		t.Fatal("Expected a renewal to be attempted for an unknown session")
+	}
+
+	queue.Postpone("session")
+	if queue.ShouldAttempt("session") {
+		t.Error("Expected the renewal to be postponed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !queue.ShouldAttempt("session") {
+		t.Error("Expected the renewal to be retried after the interval")
+	}
+
+	queue.Postpone("session")
+	queue.Remove("session")
+	if !queue.ShouldAttempt("session") {
+		t.Error("Expected a removed session to be renewed")
+	}
+}
+
+func TestStaleSessionIsKeptWhileProviderIsUnavailable(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	toa.Config.Provider.TokenValidation = "IdToken"
+	toa.Config.GracefulDegradation = &GracefulDegradationConfig{Enabled: true, MaxStaleness: 300}
+	toa.DiscoveryDocument.TokenEndpoint = server.URL
+	toa.RenewalQueue = CreateRenewalQueue(time.Minute)
+
+	createToken := func(expiredSince time.Duration) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": "12345",
+			"exp": time.Now().Add(-expiredSince).Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signedToken
+	}
+
+	_, renewalErr := toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token")
+	if !errors.Is(renewalErr, ErrProviderUnavailable) {
+		t.Fatalf("Expected the renewal to fail with an unavailable provider, but got %v", renewalErr)
+	}
+
+	state := &session.SessionState{Id: "session", IdToken: createToken(time.Minute), RefreshToken: "refresh-token"}
+
+	kept, claims, _, err := toa.useStaleSession(context.Background(), toa.primaryProvider(), state, false, nil, renewalErr)
+	if err != nil || kept != state || claims["sub"] != "12345" {
+		t.Errorf("Expected a recently expired session to be kept, but got %v", err)
+	}
+
+	state.IdToken = createToken(time.Hour)
+
+	if _, _, _, err := toa.useStaleSession(context.Background(), toa.primaryProvider(), state, false, nil, renewalErr); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected a session expired longer than MaxStaleness to be rejected, but got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
+)
+
+// checkRequestLimits rejects requests with oversized tokens or cookies before they are parsed or decrypted,
+// so giant forged tokens can't be used to waste CPU. Returns false, if the request has been rejected.
+func (toa *TraefikOidcAuth) checkRequestLimits(rw http.ResponseWriter, req *http.Request, span *tracing.Span, start time.Time) bool {
+	if toa.Config.MaxTokenSize > 0 {
+		if toa.Config.AuthorizationHeader != nil && toa.Config.AuthorizationHeader.Name != "" &&
+			len(req.Header.Get(toa.Config.AuthorizationHeader.Name)) > toa.Config.MaxTokenSize {
+			toa.rejectOversizedRequest(rw, req, span, start, "The token in the AuthorizationHeader", http.StatusRequestHeaderFieldsTooLarge)
+			return false
+		}
+
+		if toa.Config.AuthorizationCookie != nil && toa.Config.AuthorizationCookie.Name != "" {
+			if cookie, err := req.Cookie(toa.Config.AuthorizationCookie.Name); err == nil && len(cookie.Value) > toa.Config.MaxTokenSize {
+				toa.rejectOversizedRequest(rw, req, span, start, "The token in the AuthorizationCookie", http.StatusBadRequest)
+				return false
+			}
+		}
+	}
+
+	if toa.Config.MaxCookieSize > 0 && getCookieSize(req, toa.Config.CookieNamePrefix+".") > toa.Config.MaxCookieSize {
+		toa.rejectOversizedRequest(rw, req, span, start, "The cookies of the middleware", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// getCookieSize returns the total size of the values of all cookies starting with the prefix, including all chunks.
+func getCookieSize(req *http.Request, prefix string) int {
+	size := 0
+
+	for _, cookie := range req.Cookies() {
+		if strings.HasPrefix(cookie.Name, prefix) {
+			size += len(cookie.Value)
+		}
+	}
+
+	return size
+}
+
+func (toa *TraefikOidcAuth) rejectOversizedRequest(rw http.ResponseWriter, req *http.Request, span *tracing.Span, start time.Time, subject string, statusCode int) {
+	toa.logger.Log(logging.LevelWarn, "%s exceeds the maximum size. Rejecting the request.", subject)
+	toa.recordRequestResult(req, span, requestResultUnauthenticated, "too_large", start)
+
+	http.Error(rw, http.StatusText(statusCode), statusCode)
+}
+
+// The reasons why the body of a request to an internal uri could not be read.
+var (
+	errBodyTooLarge  = errors.New("the request body is too large")
+	errBodyTimeout   = errors.New("the request body hasn't been received in time")
+	errBodyMediaType = errors.New("the request body has an unsupported media type")
+)
+
+// readRequestBody reads the body of a request to an internal uri, limited in size and duration, so large or
+// slow bodies can't tie up the handler. The body is buffered, so it can be read again. A maxSize of 0 disables the limit.
+func (toa *TraefikOidcAuth) readRequestBody(rw http.ResponseWriter, req *http.Request, maxSize int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if maxSize > 0 && req.ContentLength > maxSize {
+		return nil, errBodyTooLarge
+	}
+
+	ctx := req.Context()
+
+	if toa.Config.BodyReadTimeout > 0 {
+		timeout := time.Duration(toa.Config.BodyReadTimeout * float64(time.Second))
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// Unblocks a pending read from the connection, if supported by the server
+		controller := http.NewResponseController(rw)
+		if controller.SetReadDeadline(time.Now().Add(timeout)) == nil {
+			defer controller.SetReadDeadline(time.Time{})
+		}
+	}
+
+	reader := io.Reader(req.Body)
+	if maxSize > 0 {
+		reader = io.LimitReader(req.Body, maxSize+1)
+	}
+
+	type readResult struct {
+		body []byte
+		err  error
+	}
+
+	// Without a read deadline, the reading goroutine ends when the server closes the connection
+	done := make(chan readResult, 1)
+	go func() {
+		body, err := io.ReadAll(reader)
+		done <- readResult{body: body, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		if result.err != nil {
+			if errors.Is(result.err, context.DeadlineExceeded) || errors.Is(result.err, os.ErrDeadlineExceeded) {
+				return nil, errBodyTimeout
+			}
+			return nil, result.err
+		}
+		if maxSize > 0 && int64(len(result.body)) > maxSize {
+			return nil, errBodyTooLarge
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(result.body))
+
+		return result.body, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errBodyTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// readFormBody reads and parses an urlencoded form, like the authorization response of the form_post response mode.
+// The parsed values are available using req.PostFormValue.
+func (toa *TraefikOidcAuth) readFormBody(rw http.ResponseWriter, req *http.Request) error {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return errBodyMediaType
+	}
+
+	body, err := toa.readRequestBody(rw, req, int64(toa.Config.MaxBodySize))
+	if err != nil {
+		return err
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+
+	req.PostForm = values
+
+	return nil
+}
+
+// writeBodyError rejects a request whose body couldn't be read.
+func (toa *TraefikOidcAuth) writeBodyError(rw http.ResponseWriter, req *http.Request, err error) {
+	toa.logger.Log(logging.LevelWarn, "Failed to read the body of the request to %s: %s", req.URL.Path, err.Error())
+
+	statusCode := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		statusCode = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errBodyTimeout):
+		statusCode = http.StatusRequestTimeout
+	case errors.Is(err, errBodyMediaType):
+		statusCode = http.StatusUnsupportedMediaType
+	}
+
+	http.Error(rw, http.StatusText(statusCode), statusCode)
+}
@@ -0,0 +1,139 @@
+package src
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOversizedRequestsAreRejected(t *testing.T) {
+	oversized := strings.Repeat("a", 101)
+
+	tests := map[string]struct {
+		prepare  func(req *http.Request)
+		expected int
+	}{
+		"small token": {
+			prepare:  func(req *http.Request) { req.Header.Set("Authorization", "Bearer token") },
+			expected: 0,
+		},
+		"large token in header": {
+			prepare:  func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+oversized) },
+			expected: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		"large token in cookie": {
+			prepare:  func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "access_token", Value: oversized}) },
+			expected: http.StatusBadRequest,
+		},
+		"large chunked session cookie": {
+			prepare: func(req *http.Request) {
+				req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.Chunks", Value: "2"})
+				req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.1", Value: strings.Repeat("a", 150)})
+				req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.2", Value: strings.Repeat("a", 150)})
+			},
+			expected: http.StatusBadRequest,
+		},
+		"large foreign cookie": {
+			prepare:  func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "other", Value: strings.Repeat("a", 500)}) },
+			expected: 0,
+		},
+	}
+
+	for name, test := range tests {
+		toa := newTestOidcAuth(&Config{
+			MaxTokenSize:        100,
+			MaxCookieSize:       250,
+			CookieNamePrefix:    "TraefikOidcAuth",
+			AuthorizationHeader: &AuthorizationHeaderConfig{Name: "Authorization"},
+			AuthorizationCookie: &AuthorizationCookieConfig{Name: "access_token"},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		test.prepare(req)
+		rw := httptest.NewRecorder()
+
+		ok := toa.checkRequestLimits(rw, req, nil, time.Now())
+
+		if test.expected == 0 {
+			if !ok {
+				t.Errorf("Expected %s to be accepted", name)
+			}
+			continue
+		}
+
+		if ok || rw.Code != test.expected {
+			t.Errorf("Expected %s to be rejected with %d, but got %d", name, test.expected, rw.Code)
+		}
+	}
+}
+
+func newFormPostCallbackRequest(body io.Reader, contentType string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/oidc/callback", body)
+	req.Header.Set("Content-Type", contentType)
+
+	return req
+}
+
+func TestFormPostCallbackBodyLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		expected    int
+	}{
+		{"too large", "state=" + strings.Repeat("a", 100), "application/x-www-form-urlencoded", http.StatusRequestEntityTooLarge},
+		{"wrong media type", `{"state":"abc"}`, "application/json", http.StatusUnsupportedMediaType},
+		{"invalid form", "state=%zz", "application/x-www-form-urlencoded", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		toa := newLoginTest()
+		toa.Config.Provider.ResponseMode = responseModeFormPost
+		toa.Config.MaxBodySize = 64
+
+		rw := httptest.NewRecorder()
+		toa.handleCallback(rw, newFormPostCallbackRequest(strings.NewReader(test.body), test.contentType))
+
+		if rw.Code != test.expected {
+			t.Errorf("%s: Expected status %d, but got %d", test.name, test.expected, rw.Code)
+		}
+	}
+}
+
+func TestSlowFormPostCallbackBodyTimesOut(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.Provider.ResponseMode = responseModeFormPost
+	toa.Config.BodyReadTimeout = 0.05
+
+	// The body never arrives
+	body, writer := io.Pipe()
+	defer writer.Close()
+
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	toa.handleCallback(rw, newFormPostCallbackRequest(body, "application/x-www-form-urlencoded"))
+
+	if rw.Code != http.StatusRequestTimeout {
+		t.Errorf("Expected status 408, but got %d", rw.Code)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the handler to return after the timeout, but it took %v", time.Since(start))
+	}
+}
+
+func TestOversizedLoginPostIsRejected(t *testing.T) {
+	toa := newLoginTest()
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"login_hint":"`+strings.Repeat("a", maxLoginBodySize)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+
+	toa.handleLoginPost(rw, req)
+
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// getMissingClaims returns the required claims which are absent or empty.
+func (toa *TraefikOidcAuth) getMissingClaims(claims map[string]interface{}) []string {
+	var missing []string
+
+	for _, name := range toa.Config.Provider.RequiredClaims {
+		if !hasClaimValue(claims[name]) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+func hasClaimValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case []string:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// writeMissingClaimsError tells the user that the login can't be completed, because the identity provider
+// didn't return all required claims. This is a misconfiguration of the provider, which the user can't fix.
+func (toa *TraefikOidcAuth) writeMissingClaimsError(rw http.ResponseWriter, req *http.Request, missingClaims []string) {
+	toa.logger.Log(logging.LevelError, "The identity provider didn't return the required claims %s. Check the scopes and claim configuration of the client.", strings.Join(missingClaims, ", "))
+
+	data := make(map[string]interface{})
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.3"
+	data["statusCode"] = http.StatusBadGateway
+	data["statusName"] = "Bad Gateway"
+	data["description"] = fmt.Sprintf("The identity provider didn't return the claims %s, which are required for the login. Please contact your administrator.", strings.Join(missingClaims, ", "))
+	data["missingClaims"] = missingClaims
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	page := toa.Config.ErrorPages.LoginFailed
+	if page == nil {
+		page = &errorPages.ErrorPageConfig{}
+	}
+
+	errorPages.WriteError(toa.logger, page, rw, req, data, jsHeaders)
+}
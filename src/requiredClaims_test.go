@@ -0,0 +1,66 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGetMissingClaims(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.Config.Provider.RequiredClaims = []string{"sub", "email", "groups", "email_verified"}
+
+	missing := toa.getMissingClaims(map[string]interface{}{
+		"sub":            "12345",
+		"email":          "",
+		"groups":         []interface{}{},
+		"email_verified": false,
+	})
+
+	if strings.Join(missing, ",") != "email,groups" {
+		t.Errorf("Expected email and groups to be missing, but got %v", missing)
+	}
+}
+
+func TestMissingClaimsErrorNamesTheClaims(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback", nil)
+	req.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+
+	toa.writeMissingClaimsError(rw, req, []string{"email", "groups"})
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, but got %d", rw.Code)
+	}
+	if body := rw.Body.String(); !strings.Contains(body, "email, groups") {
+		t.Errorf("Expected the missing claims to be named, but got %s", body)
+	}
+}
+
+func TestHeaderTokenWithoutRequiredClaimsIsInvalid(t *testing.T) {
+	toa, sign, server := newTrustedIssuerTest(t, "my-api")
+	defer server.Close()
+
+	toa.Config.Provider.RequiredClaims = []string{"email"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{
+		"iss": "https://machines.example.com",
+		"aud": "my-api",
+		"sub": "service-account",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+
+	_, _, _, err := toa.getSessionForRequest(req)
+
+	if !errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), "email") {
+		t.Errorf("Expected the token to be invalid because of the missing email claim, but got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+const responseTypeCode = "code"
+
+// The ways the provider returns the authorization response to the callback.
+const (
+	responseModeQuery    = "query"
+	responseModeFormPost = "form_post"
+)
+
+// normalizeResponseType brings the values of the response type into a canonical order, eg. "id_token code"
+// becomes "code id_token". Only the authorization code flow and the hybrid flows are supported, so the
+// response type must contain code. Returns an empty string, if the response type is invalid.
+func normalizeResponseType(responseType string) string {
+	values := map[string]bool{}
+
+	for _, value := range strings.Fields(responseType) {
+		if value != "code" && value != "id_token" && value != "token" {
+			return ""
+		}
+		if values[value] {
+			return ""
+		}
+
+		values[value] = true
+	}
+
+	if !values["code"] {
+		return ""
+	}
+
+	normalized := []string{"code"}
+	if values["id_token"] {
+		normalized = append(normalized, "id_token")
+	}
+	if values["token"] {
+		normalized = append(normalized, "token")
+	}
+
+	return strings.Join(normalized, " ")
+}
+
+func isValidResponseMode(responseMode string) bool {
+	switch responseMode {
+	case "", responseModeQuery, responseModeFormPost:
+		return true
+	default:
+		return false
+	}
+}
+
+// isHybridFlow checks whether the provider returns tokens on the callback in addition to the code.
+func (toa *TraefikOidcAuth) isHybridFlow() bool {
+	return toa.Config.Provider.ResponseType != "" && toa.Config.Provider.ResponseType != responseTypeCode
+}
+
+func (toa *TraefikOidcAuth) getResponseType() string {
+	if toa.Config.Provider.ResponseType == "" {
+		return responseTypeCode
+	}
+
+	return toa.Config.Provider.ResponseType
+}
+
+// getResponseMode returns the configured response mode. Hybrid flows use form_post by default,
+// so the tokens don't end up in the browser history or in access logs.
+func (toa *TraefikOidcAuth) getResponseMode() string {
+	if toa.Config.Provider.ResponseMode != "" {
+		return toa.Config.Provider.ResponseMode
+	}
+	if toa.isHybridFlow() {
+		return responseModeFormPost
+	}
+
+	return responseModeQuery
+}
+
+// getCallbackParameter reads a parameter of the authorization response, which is posted in the body
+// when the form_post response mode is used.
+func (toa *TraefikOidcAuth) getCallbackParameter(req *http.Request, name string) string {
+	if req.Method == http.MethodPost && toa.getResponseMode() == responseModeFormPost {
+		return req.PostFormValue(name)
+	}
+
+	return req.URL.Query().Get(name)
+}
+
+// getCodeVerifierCookieSameSite returns the SameSite mode of the PKCE cookie. Browsers only send cookies
+// with SameSite=None on the cross-site POST of the form_post response mode.
+func (toa *TraefikOidcAuth) getCodeVerifierCookieSameSite() http.SameSite {
+	if toa.Config.PkceCookie != nil && toa.Config.PkceCookie.SameSite != "" {
+		return parseCookieSameSite(toa.Config.PkceCookie.SameSite)
+	}
+	if toa.getResponseMode() == responseModeFormPost {
+		return http.SameSiteNoneMode
+	}
+
+	return http.SameSiteDefaultMode
+}
+
+// validateAuthorizationResponse validates the id token returned on the callback of a hybrid flow.
+// It must be issued for this login and must be bound to the returned code and access token.
+func (toa *TraefikOidcAuth) validateAuthorizationResponse(ctx context.Context, req *http.Request, provider *IdentityProvider, state *oidc.OidcState, authCode string) error {
+	if !toa.isHybridFlow() {
+		return nil
+	}
+
+	idToken := toa.getCallbackParameter(req, "id_token")
+	if idToken == "" {
+		if strings.Contains(toa.getResponseType(), "id_token") {
+			return errors.New("the id_token is missing on the callback")
+		}
+
+		return nil
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(provider.ClientId),
+	}
+	if toa.Config.Provider.ValidateIssuerBool {
+		options = append(options, jwt.WithIssuer(provider.ValidIssuer))
+	}
+
+	_, claims, err := toa.validateJwt(ctx, provider.Jwks, idToken, options)
+	if err != nil {
+		return err
+	}
+
+	if err := validateNonce(claims, state.Nonce); err != nil {
+		return err
+	}
+
+	algorithm := getTokenAlgorithm(idToken)
+
+	if err := validateTokenHash(claims, "c_hash", authCode, algorithm, true); err != nil {
+		return err
+	}
+
+	if accessToken := toa.getCallbackParameter(req, "access_token"); accessToken != "" {
+		if err := validateTokenHash(claims, "at_hash", accessToken, algorithm, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateTokenResponse validates the id token returned by the token endpoint against the nonce of the login.
+// The token itself has been received directly from the provider, so its signature isn't checked here.
+func validateTokenResponse(token *oidc.OidcTokenResponse, state *oidc.OidcState) error {
+	if state.Nonce == "" || token.IdToken == "" {
+		return nil
+	}
+
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token.IdToken, claims); err != nil {
+		return err
+	}
+
+	if err := validateNonce(claims, state.Nonce); err != nil {
+		return err
+	}
+
+	if token.AccessToken != "" {
+		return validateTokenHash(claims, "at_hash", token.AccessToken, getTokenAlgorithm(token.IdToken), false)
+	}
+
+	return nil
+}
+
+func validateNonce(claims map[string]interface{}, expectedNonce string) error {
+	if expectedNonce == "" {
+		return nil
+	}
+
+	nonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(expectedNonce)) != 1 {
+		return errors.New("the nonce of the id_token doesn't match")
+	}
+
+	return nil
+}
+
+// validateTokenHash checks a hash claim like c_hash or at_hash, which binds the value to the id token.
+// See OpenID Connect Core, section 3.3.2.11.
+func validateTokenHash(claims map[string]interface{}, claim string, value string, algorithm string, required bool) error {
+	expectedHash, _ := claims[claim].(string)
+	if expectedHash == "" {
+		if required {
+			return fmt.Errorf("the %s claim is missing in the id_token", claim)
+		}
+
+		return nil
+	}
+
+	actualHash, err := computeTokenHash(value, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(actualHash), []byte(expectedHash)) != 1 {
+		return fmt.Errorf("the %s claim of the id_token doesn't match", claim)
+	}
+
+	return nil
+}
+
+// computeTokenHash hashes the value with the hash function of the signing algorithm and encodes the left half.
+func computeTokenHash(value string, algorithm string) (string, error) {
+	var h hash.Hash
+
+	switch {
+	case strings.HasSuffix(algorithm, "256"):
+		h = sha256.New()
+	case strings.HasSuffix(algorithm, "384"):
+		h = sha512.New384()
+	case strings.HasSuffix(algorithm, "512"), algorithm == "EdDSA":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm '%s' for token hashes", algorithm)
+	}
+
+	h.Write([]byte(value))
+	sum := h.Sum(nil)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+func getTokenAlgorithm(token string) string {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+
+	algorithm, _ := parsed.Header["alg"].(string)
+
+	return algorithm
+}
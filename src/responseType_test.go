@@ -0,0 +1,210 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+func TestNormalizeResponseType(t *testing.T) {
+	tests := []struct {
+		responseType string
+		expected     string
+	}{
+		{"code", "code"},
+		{"id_token code", "code id_token"},
+		{"token  id_token code", "code id_token token"},
+		{"code token", "code token"},
+		{"id_token", ""},
+		{"token", ""},
+		{"code code", ""},
+		{"code none", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if actual := normalizeResponseType(test.responseType); actual != test.expected {
+			t.Errorf("%s: Expected '%s', but got '%s'", test.responseType, test.expected, actual)
+		}
+	}
+}
+
+func TestCodeFlowAuthorizationUrlHasNoNonce(t *testing.T) {
+	toa := newLoginTest()
+
+	authorizationUrl, ok := toa.createAuthorizationUrl(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	query := mustParseQuery(t, authorizationUrl)
+
+	if query.Get("response_type") != "code" {
+		t.Errorf("Expected response_type code, but got '%s'", query.Get("response_type"))
+	}
+	if query.Has("response_mode") || query.Has("nonce") {
+		t.Errorf("Expected no response_mode and nonce, but got %v", query)
+	}
+}
+
+func TestHybridFlowAuthorizationUrlUsesFormPostAndNonce(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.Provider.ResponseType = "code id_token"
+	toa.Config.Provider.UsePkceBool = true
+	toa.Config.SessionCookie = &SessionCookieConfig{}
+
+	rw := httptest.NewRecorder()
+	authorizationUrl, ok := toa.createAuthorizationUrl(rw, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !ok {
+		t.Fatal("Expected an authorization url")
+	}
+
+	query := mustParseQuery(t, authorizationUrl)
+
+	if query.Get("response_type") != "code id_token" {
+		t.Errorf("Expected response_type 'code id_token', but got '%s'", query.Get("response_type"))
+	}
+	if query.Get("response_mode") != "form_post" {
+		t.Errorf("Expected response_mode form_post, but got '%s'", query.Get("response_mode"))
+	}
+
+	state, err := oidc.DecodeState(query.Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("nonce") == "" || query.Get("nonce") != state.Nonce {
+		t.Errorf("Expected the nonce to be sent and stored in the state, but got '%s' and '%s'", query.Get("nonce"), state.Nonce)
+	}
+
+	if cookies := rw.Result().Cookies(); len(cookies) != 1 || cookies[0].SameSite != http.SameSiteNoneMode {
+		t.Errorf("Expected the code verifier cookie to use SameSite=None, but got %v", cookies)
+	}
+}
+
+func TestCallbackReadsFormPostResponse(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.Provider.ResponseType = "code id_token"
+	toa.ConsumedStates = CreateConsumedStateCache()
+
+	state, err := oidc.EncodeState(oidc.NewState("Login", "https://app.example.com/dashboard"), toa.Config.EncryptionKey(), toa.Config.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := url.Values{"error": {"access_denied"}, "state": {state}}
+	req := httptest.NewRequest(http.MethodPost, "/oidc/callback", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.handleCallback(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected the posted error to be shown with status 403, but got %d", rw.Code)
+	}
+}
+
+func TestValidateAuthorizationResponse(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa, server := newGetUserInfoTest(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	toa.Config.Provider.ClientId = "my-client"
+	toa.Config.Provider.ResponseType = "code id_token token"
+
+	codeHash, _ := computeTokenHash("the-code", "RS256")
+	accessTokenHash, _ := computeTokenHash("the-access-token", "RS256")
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":     "12345",
+			"aud":     "my-client",
+			"exp":     time.Now().Add(time.Minute).Unix(),
+			"nonce":   "the-nonce",
+			"c_hash":  codeHash,
+			"at_hash": accessTokenHash,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(claims jwt.MapClaims)
+		valid  bool
+	}{
+		{"valid", func(claims jwt.MapClaims) {}, true},
+		{"wrong nonce", func(claims jwt.MapClaims) { claims["nonce"] = "other" }, false},
+		{"missing c_hash", func(claims jwt.MapClaims) { delete(claims, "c_hash") }, false},
+		{"wrong at_hash", func(claims jwt.MapClaims) { claims["at_hash"] = codeHash }, false},
+		{"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }, false},
+	}
+
+	for _, test := range tests {
+		claims := validClaims()
+		test.modify(claims)
+
+		body := url.Values{"code": {"the-code"}, "id_token": {sign(claims)}, "access_token": {"the-access-token"}}
+		req := httptest.NewRequest(http.MethodPost, "/oidc/callback", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		err := toa.validateAuthorizationResponse(context.Background(), req, toa.primaryProvider(), &oidc.OidcState{Nonce: "the-nonce"}, "the-code")
+
+		if test.valid && err != nil {
+			t.Errorf("%s: Expected the response to be valid, but got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: Expected the response to be rejected", test.name)
+		}
+	}
+}
+
+func TestValidateTokenResponseChecksNonce(t *testing.T) {
+	idToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"nonce": "the-nonce"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := &oidc.OidcTokenResponse{IdToken: idToken}
+
+	if err := validateTokenResponse(token, &oidc.OidcState{Nonce: "the-nonce"}); err != nil {
+		t.Errorf("Expected the nonce to match, but got %v", err)
+	}
+	if err := validateTokenResponse(token, &oidc.OidcState{Nonce: "other"}); err == nil {
+		t.Error("Expected a different nonce to be rejected")
+	}
+	if err := validateTokenResponse(token, &oidc.OidcState{}); err != nil {
+		t.Errorf("Expected logins without nonce to be accepted, but got %v", err)
+	}
+}
+
+func mustParseQuery(t *testing.T, rawUrl string) url.Values {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Query()
+}
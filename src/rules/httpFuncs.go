@@ -2,11 +2,15 @@ package rules
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 var httpFuncs = map[string]func(*requestConditionTree, ...string) error{
@@ -20,6 +24,8 @@ var httpFuncs = map[string]func(*requestConditionTree, ...string) error{
 	"QueryRegexp":  queryRegexpFunc,
 	"Host":         hostFunc,
 	"HostRegexp":   hostRegexpFunc,
+	"Country":      countryFunc,
+	"ClientIP":     clientIpFunc,
 }
 
 func headerFunc(tree *requestConditionTree, values ...string) error {
@@ -35,7 +41,7 @@ func headerFunc(tree *requestConditionTree, values ...string) error {
 
 		matched := h == headerValue
 
-		logger.Log(logging.LevelDebug, "%s Eval rule Header(`%s`, `%s`). Actual value: %s", getMatchedText(matched), headerName, headerValue, h)
+		logger.Log(logging.LevelDebug, "%s Eval rule Header(`%s`, `%s`). Actual value: %s", getMatchedText(matched), headerName, redactHeaderValue(headerName, headerValue), redactHeaderValue(headerName, h))
 
 		return matched
 	}
@@ -61,7 +67,7 @@ func headerRegexpFunc(tree *requestConditionTree, values ...string) error {
 
 		matched := headerRegex.MatchString(h)
 
-		logger.Log(logging.LevelDebug, "%s Eval rule HeaderRegexp(`%s`, `%s`). Actual value: %s", getMatchedText(matched), headerName, headerValueRegex, h)
+		logger.Log(logging.LevelDebug, "%s Eval rule HeaderRegexp(`%s`, `%s`). Actual value: %s", getMatchedText(matched), headerName, headerValueRegex, redactHeaderValue(headerName, h))
 
 		return matched
 	}
@@ -135,18 +141,18 @@ func pathRegexpFunc(tree *requestConditionTree, values ...string) error {
 }
 
 func methodFunc(tree *requestConditionTree, values ...string) error {
-	if len(values) != 1 {
-		return fmt.Errorf("Method-rule requires exactly one argument.")
+	if len(values) == 0 {
+		return fmt.Errorf("Method-rule requires at least one argument.")
 	}
 
-	expectedMethod := values[0]
+	expectedMethods := values
 
 	tree.matcher = func(logger *logging.Logger, request *http.Request) bool {
 		method := request.Method
 
-		matched := method == expectedMethod
+		matched := slices.Contains(expectedMethods, method)
 
-		logger.Log(logging.LevelDebug, "%s Eval rule Method(`%s`). Actual value: %s", getMatchedText(matched), expectedMethod, method)
+		logger.Log(logging.LevelDebug, "%s Eval rule Method(`%s`). Actual value: %s", getMatchedText(matched), strings.Join(expectedMethods, "`, `"), method)
 
 		return matched
 	}
@@ -246,6 +252,105 @@ func hostRegexpFunc(tree *requestConditionTree, values ...string) error {
 	return nil
 }
 
+func countryFunc(tree *requestConditionTree, values ...string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("Country-rule requires at least one argument.")
+	}
+
+	countries := make([]string, len(values))
+	for i, value := range values {
+		countries[i] = strings.ToUpper(value)
+	}
+
+	tree.matcher = func(logger *logging.Logger, request *http.Request) bool {
+		country := geoip.CountryFromContext(request.Context())
+
+		matched := false
+		for _, expectedCountry := range countries {
+			if country == expectedCountry {
+				matched = true
+				break
+			}
+		}
+
+		logger.Log(logging.LevelDebug, "%s Eval rule Country(`%s`). Actual value: %s", getMatchedText(matched), strings.Join(countries, "`, `"), country)
+
+		return matched
+	}
+
+	return nil
+}
+
+// clientIpFunc matches the ip address of the client, which sent the request to traefik, against ip addresses
+// and ranges in CIDR notation. Forwarded headers like X-Forwarded-For are not considered, as they can be spoofed.
+func clientIpFunc(tree *requestConditionTree, values ...string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("ClientIP-rule requires at least one argument.")
+	}
+
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("ClientIP-rule has an invalid ip address %s.", value)
+			}
+
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("ClientIP-rule has an invalid range %s: %w", value, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	tree.matcher = func(logger *logging.Logger, request *http.Request) bool {
+		clientIp := utils.GetClientIp(request)
+		ip := net.ParseIP(clientIp)
+
+		matched := false
+		if ip != nil {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					matched = true
+					break
+				}
+			}
+		}
+
+		logger.Log(logging.LevelDebug, "%s Eval rule ClientIP(`%s`). Actual value: %s", getMatchedText(matched), strings.Join(values, "`, `"), clientIp)
+
+		return matched
+	}
+
+	return nil
+}
+
+// Headers which carry credentials. Their values are never written to the log, not even a prefix.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+}
+
+func redactHeaderValue(headerName string, value string) string {
+	if value == "" || !sensitiveHeaders[http.CanonicalHeaderKey(headerName)] {
+		return value
+	}
+
+	return fmt.Sprintf("[redacted, %d bytes]", len(value))
+}
+
 func getMatchedText(matched bool) string {
 	if matched {
 		return "✅"
@@ -0,0 +1,75 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Presets are rules for common cases, which can be used by name, eg. Preset(`healthchecks`).
+var Presets = map[string]string{
+	// Liveness and readiness probes of load balancers and orchestrators
+	"healthchecks": "Method(`GET`, `HEAD`) && (Path(`/health`) || Path(`/healthz`) || Path(`/livez`) || Path(`/readyz`) || Path(`/ping`))",
+	// Prometheus and other scrapers
+	"metrics": "Method(`GET`) && Path(`/metrics`)",
+	// CORS preflight requests, which browsers send without credentials
+	"preflight": "Method(`OPTIONS`) && HeaderRegexp(`Origin`, `.+`) && HeaderRegexp(`Access-Control-Request-Method`, `.+`)",
+	// Stylesheets, scripts, images and fonts
+	"static_assets": "Method(`GET`, `HEAD`) && PathRegexp(`(?i)\\.(css|js|mjs|map|png|jpe?g|gif|svg|ico|webp|avif|woff2?|ttf|eot)$`)",
+}
+
+// The preset function parses other rules, so it can't be part of the initialization of httpFuncs.
+func init() {
+	httpFuncs["Preset"] = presetFunc
+}
+
+func presetFunc(tree *requestConditionTree, values ...string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("Preset-rule requires at least one argument.")
+	}
+
+	var conditions []*RequestCondition
+	for _, name := range values {
+		rule, ok := Presets[name]
+		if !ok {
+			return fmt.Errorf("Preset-rule has an unknown preset %s. Use one of %s.", name, strings.Join(getPresetNames(), ", "))
+		}
+
+		condition, err := ParseRequestCondition(rule)
+		if err != nil {
+			return fmt.Errorf("invalid preset %s: %w", name, err)
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	tree.matcher = func(logger *logging.Logger, request *http.Request) bool {
+		matched := false
+		for _, condition := range conditions {
+			if condition.Match(logger, request) {
+				matched = true
+				break
+			}
+		}
+
+		logger.Log(logging.LevelDebug, "%s Eval rule Preset(`%s`).", getMatchedText(matched), strings.Join(values, "`, `"))
+
+		return matched
+	}
+
+	return nil
+}
+
+func getPresetNames() []string {
+	var names []string
+	for name := range Presets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/sevensolutions/traefik-oidc-auth/src/geoip"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 )
 
@@ -191,6 +192,30 @@ func TestRequestConditionMethod(t *testing.T) {
 	}
 }
 
+func TestRequestConditionCountry(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rule, err := ParseRequestCondition("Country(`de`, `AT`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://test", nil)
+
+	if rule.Match(logger, request.WithContext(geoip.WithCountry(request.Context(), "AT"))) != true {
+		t.Fail()
+	}
+
+	if rule.Match(logger, request.WithContext(geoip.WithCountry(request.Context(), "US"))) != false {
+		t.Fail()
+	}
+
+	// Requests with an unknown country don't match
+	if rule.Match(logger, request) != false {
+		t.Fail()
+	}
+}
+
 func TestRequestConditionLogicalAnd(t *testing.T) {
 	logger := logging.CreateLogger(logging.LevelDebug)
 
@@ -272,3 +297,142 @@ func TestRequestConditionQueryRegexp(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRequestConditionMultipleMethods(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rule, err := ParseRequestCondition("Method(`GET`, `HEAD`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodHead, "http://test", nil)
+
+	if !rule.Match(logger, request) {
+		t.Error("Expected HEAD to match")
+	}
+
+	request, _ = http.NewRequest(http.MethodPost, "http://test", nil)
+
+	if rule.Match(logger, request) {
+		t.Error("Expected POST not to match")
+	}
+}
+
+func TestRequestConditionClientIP(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rule, err := ParseRequestCondition("Method(`GET`) && Path(`/healthz`) && ClientIP(`10.0.0.0/8`, `192.168.1.5`, `fd00::/8`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		expected   bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"192.168.1.5:1234", true},
+		{"[fd00::1]:1234", true},
+		{"192.168.1.6:1234", false},
+		{"172.18.0.2:1234", false},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest(http.MethodGet, "http://test/healthz", nil)
+		request.RemoteAddr = test.remoteAddr
+		request.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		if actual := rule.Match(logger, request); actual != test.expected {
+			t.Errorf("%s: Expected %t, but got %t", test.remoteAddr, test.expected, actual)
+		}
+	}
+
+	if _, err := ParseRequestCondition("ClientIP(`10.0.0.0/33`)"); err == nil {
+		t.Error("Expected an invalid range to be rejected")
+	}
+	if _, err := ParseRequestCondition("ClientIP(`internal`)"); err == nil {
+		t.Error("Expected an invalid ip address to be rejected")
+	}
+}
+
+func TestRequestConditionPresets(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	tests := []struct {
+		preset   string
+		method   string
+		url      string
+		headers  map[string]string
+		expected bool
+	}{
+		{"healthchecks", http.MethodGet, "http://test/healthz", nil, true},
+		{"healthchecks", http.MethodHead, "http://test/readyz", nil, true},
+		{"healthchecks", http.MethodPost, "http://test/healthz", nil, false},
+		{"healthchecks", http.MethodGet, "http://test/healthz/details", nil, false},
+		{"metrics", http.MethodGet, "http://test/metrics", nil, true},
+		{"metrics", http.MethodGet, "http://test/metrics/internal", nil, false},
+		{"preflight", http.MethodOptions, "http://test/api", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST"}, true},
+		{"preflight", http.MethodOptions, "http://test/api", nil, false},
+		{"static_assets", http.MethodGet, "http://test/assets/app.JS", nil, true},
+		{"static_assets", http.MethodGet, "http://test/fonts/inter.woff2", nil, true},
+		{"static_assets", http.MethodGet, "http://test/api/users", nil, false},
+		{"static_assets", http.MethodPost, "http://test/assets/app.js", nil, false},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRequestCondition("Preset(`" + test.preset + "`)")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, _ := http.NewRequest(test.method, test.url, nil)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+
+		if actual := rule.Match(logger, request); actual != test.expected {
+			t.Errorf("%s %s %s: Expected %t, but got %t", test.preset, test.method, test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestRequestConditionMultiplePresets(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rule, err := ParseRequestCondition("Preset(`healthchecks`, `metrics`) && ClientIP(`10.0.0.0/8`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://test/metrics", nil)
+	request.RemoteAddr = "10.0.0.5:1234"
+
+	if !rule.Match(logger, request) {
+		t.Error("Expected the metrics preset to match")
+	}
+
+	if _, err := ParseRequestCondition("Preset(`unknown`)"); err == nil {
+		t.Error("Expected an unknown preset to be rejected")
+	}
+}
+
+func TestAllPresetsAreValid(t *testing.T) {
+	for name, rule := range Presets {
+		if _, err := ParseRequestCondition(rule); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestRedactHeaderValue(t *testing.T) {
+	if actual := redactHeaderValue("authorization", "Bearer eyJhbGciOi"); actual != "[redacted, 17 bytes]" {
+		t.Errorf("Expected the authorization header to be redacted, but got '%s'", actual)
+	}
+	if actual := redactHeaderValue("Cookie", ""); actual != "" {
+		t.Errorf("Expected an empty value to stay empty, but got '%s'", actual)
+	}
+	if actual := redactHeaderValue("X-Real-Ip", "172.18.0.2"); actual != "172.18.0.2" {
+		t.Errorf("Expected other headers to be logged, but got '%s'", actual)
+	}
+}
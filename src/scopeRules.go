@@ -0,0 +1,186 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// parseScopeRules parses the rules of ScopeRules.
+func parseScopeRules(config *Config) error {
+	for i := range config.ScopeRules {
+		rule := &config.ScopeRules[i]
+
+		rule.Rule = utils.ExpandEnvironmentVariableString(rule.Rule)
+		for j := range rule.Scopes {
+			rule.Scopes[j] = utils.ExpandEnvironmentVariableString(rule.Scopes[j])
+		}
+
+		if len(rule.Scopes) == 0 {
+			return fmt.Errorf("scope rule %d requires at least one scope", i+1)
+		}
+
+		condition, err := rules.ParseRequestCondition(rule.Rule)
+		if err != nil {
+			return fmt.Errorf("invalid scope rule %d: %s", i+1, err.Error())
+		}
+
+		rule.condition = condition
+	}
+
+	return nil
+}
+
+// getRequiredScopes returns the scopes of all rules matching the request.
+func (toa *TraefikOidcAuth) getRequiredScopes(req *http.Request) []string {
+	var scopes []string
+
+	for i := range toa.Config.ScopeRules {
+		rule := &toa.Config.ScopeRules[i]
+
+		if rule.condition != nil && rule.condition.Match(toa.logger.Module(logging.ModuleRules), req) {
+			scopes = mergeScopes(scopes, rule.Scopes)
+		}
+	}
+
+	return scopes
+}
+
+// getGrantedScopes returns the scopes of the session. Sessions which didn't record them have the configured scopes.
+func (toa *TraefikOidcAuth) getGrantedScopes(state *session.SessionState) []string {
+	if len(state.Scopes) > 0 {
+		return state.Scopes
+	}
+
+	return toa.Config.Scopes
+}
+
+// getMissingScopes returns the scopes required for the request, which haven't been granted to the session.
+func (toa *TraefikOidcAuth) getMissingScopes(req *http.Request, state *session.SessionState) []string {
+	if len(toa.Config.ScopeRules) == 0 {
+		return nil
+	}
+
+	granted := toa.getGrantedScopes(state)
+
+	var missing []string
+	for _, scope := range toa.getRequiredScopes(req) {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+
+	return missing
+}
+
+// handleMissingScopes asks the provider for the missing scopes in addition to the ones of the session.
+// Tokens of the AuthorizationHeader or AuthorizationCookie can't be elevated and scopes which have already been
+// denied by the provider aren't requested again, so these requests are rejected instead.
+func (toa *TraefikOidcAuth) handleMissingScopes(rw http.ResponseWriter, req *http.Request, state *session.SessionState, missing []string, claims map[string]interface{}) {
+	alreadyDenied := true
+	for _, scope := range missing {
+		if !slices.Contains(state.DeniedScopes, scope) {
+			alreadyDenied = false
+			break
+		}
+	}
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	if state.Id == "AuthorizationHeader" || state.Id == "AuthorizationCookie" || alreadyDenied ||
+		toa.isApiRequest(req) || utils.IsXHRRequestWithHeaders(req, jsHeaders) {
+		toa.logger.Log(logging.LevelInfo, "The scopes %v are required for %s, but haven't been granted.", missing, req.URL.Path)
+		toa.writeInsufficientScopeError(rw, req, missing, claims)
+		return
+	}
+
+	toa.logger.Log(logging.LevelInfo, "Requesting the additional scopes %v for %s.", missing, req.URL.Path)
+
+	parameters := toa.getLoginParameters(req)
+	parameters.RememberMe = state.RememberMe
+	parameters.scopes = mergeScopes(toa.getGrantedScopes(state), missing)
+
+	toa.redirectToProviderWithParameters(rw, req, parameters)
+}
+
+func (toa *TraefikOidcAuth) writeInsufficientScopeError(rw http.ResponseWriter, req *http.Request, missing []string, claims map[string]interface{}) {
+	data := make(map[string]interface{})
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
+	data["statusCode"] = http.StatusForbidden
+	data["statusName"] = "Forbidden"
+	data["description"] = "This resource requires permissions, which haven't been granted to your session."
+	data["scope"] = strings.Join(missing, " ")
+	data["claims"] = claims
+
+	if toa.isApiRequest(req) {
+		errorPages.WriteBearerError(toa.logger, rw, "insufficient_scope", data)
+		return
+	}
+
+	var jsHeaders map[string][]string
+	if toa.Config.JavaScriptRequestDetection != nil {
+		jsHeaders = toa.Config.JavaScriptRequestDetection.Headers
+	}
+
+	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthorized, rw, req, data, jsHeaders)
+}
+
+// getGrantedTokenScopes returns the scopes granted by the provider. When the token response doesn't contain them,
+// they are the same as the requested ones. See RFC 6749, section 5.1.
+func getGrantedTokenScopes(tokenScope string, requested []string) []string {
+	if tokenScope == "" {
+		return requested
+	}
+
+	return strings.Fields(tokenScope)
+}
+
+// mergeScopes returns the union of both lists, keeping the order.
+func mergeScopes(scopes []string, additional []string) []string {
+	merged := slices.Clone(scopes)
+
+	for _, scope := range additional {
+		if !slices.Contains(merged, scope) {
+			merged = append(merged, scope)
+		}
+	}
+
+	return merged
+}
+
+// recordSessionScopes remembers which scopes have been granted to a new session and which ones have been refused.
+func (toa *TraefikOidcAuth) recordSessionScopes(state *session.SessionState, oidcState *oidc.OidcState, token *oidc.OidcTokenResponse) {
+	if len(toa.Config.ScopeRules) == 0 {
+		return
+	}
+
+	requested := toa.Config.Scopes
+	if len(oidcState.Scopes) > 0 {
+		requested = oidcState.Scopes
+	}
+
+	state.Scopes = getGrantedTokenScopes(token.Scope, requested)
+	state.DeniedScopes = nil
+
+	for _, scope := range requested {
+		if !slices.Contains(state.Scopes, scope) {
+			state.DeniedScopes = append(state.DeniedScopes, scope)
+		}
+	}
+
+	if len(state.DeniedScopes) > 0 {
+		toa.logger.Log(logging.LevelWarn, "The provider refused the scopes %v.", state.DeniedScopes)
+	}
+}
@@ -0,0 +1,109 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func newScopeRulesTest(t *testing.T) *TraefikOidcAuth {
+	toa := newLoginTest()
+	toa.Config.Scopes = []string{"openid", "profile"}
+	toa.Config.ScopeRules = []ScopeRuleConfig{
+		{Rule: "PathPrefix(`/billing`)", Scopes: []string{"billing:read"}},
+		{Rule: "PathPrefix(`/billing`) && Method(`POST`)", Scopes: []string{"billing:write"}},
+	}
+
+	if err := parseScopeRules(toa.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	return toa
+}
+
+func TestMissingScopesOfMatchingRules(t *testing.T) {
+	toa := newScopeRulesTest(t)
+
+	state := &session.SessionState{Scopes: []string{"openid", "profile", "billing:read"}}
+
+	if missing := toa.getMissingScopes(httptest.NewRequest(http.MethodGet, "/billing/invoices", nil), state); len(missing) != 0 {
+		t.Errorf("Expected no missing scopes, but got %v", missing)
+	}
+
+	missing := toa.getMissingScopes(httptest.NewRequest(http.MethodPost, "/billing/invoices", nil), state)
+	if len(missing) != 1 || missing[0] != "billing:write" {
+		t.Errorf("Expected billing:write to be missing, but got %v", missing)
+	}
+
+	// Sessions without recorded scopes have the configured ones
+	missing = toa.getMissingScopes(httptest.NewRequest(http.MethodGet, "/billing", nil), &session.SessionState{})
+	if len(missing) != 1 || missing[0] != "billing:read" {
+		t.Errorf("Expected billing:read to be missing, but got %v", missing)
+	}
+}
+
+func TestMissingScopesAreRequestedFromTheProvider(t *testing.T) {
+	toa := newScopeRulesTest(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/billing/invoices", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+
+	toa.handleMissingScopes(rw, req, &session.SessionState{Id: "session"}, []string{"billing:read"}, nil)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, but got %d", rw.Code)
+	}
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	if scope := location.Query().Get("scope"); scope != "openid profile billing:read" {
+		t.Errorf("Expected the union of the scopes, but got '%s'", scope)
+	}
+
+	state, err := oidc.DecodeState(location.Query().Get("state"), toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(state.Scopes, " ") != "openid profile billing:read" || state.RedirectUrl != "https://app.example.com/billing/invoices" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+}
+
+func TestDeniedScopesAreNotRequestedAgain(t *testing.T) {
+	toa := newScopeRulesTest(t)
+	toa.Config.UnauthorizedBehavior = "Bearer"
+
+	rw := httptest.NewRecorder()
+	toa.handleMissingScopes(rw, httptest.NewRequest(http.MethodGet, "/billing", nil), &session.SessionState{Id: "session", DeniedScopes: []string{"billing:read"}}, []string{"billing:read"}, nil)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", rw.Code)
+	}
+	if challenge := rw.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_scope"`) || !strings.HasSuffix(challenge, `scope="billing:read"`) {
+		t.Errorf("Unexpected challenge: %s", challenge)
+	}
+}
+
+func TestRecordSessionScopes(t *testing.T) {
+	toa := newScopeRulesTest(t)
+
+	state := &session.SessionState{}
+	toa.recordSessionScopes(state, &oidc.OidcState{Scopes: []string{"openid", "profile", "billing:read"}}, &oidc.OidcTokenResponse{Scope: "openid profile"})
+
+	if strings.Join(state.Scopes, " ") != "openid profile" || strings.Join(state.DeniedScopes, " ") != "billing:read" {
+		t.Errorf("Unexpected scopes: %v, denied: %v", state.Scopes, state.DeniedScopes)
+	}
+
+	// Without a scope in the token response, all requested scopes have been granted
+	toa.recordSessionScopes(state, &oidc.OidcState{}, &oidc.OidcTokenResponse{})
+
+	if strings.Join(state.Scopes, " ") != "openid profile" || len(state.DeniedScopes) != 0 {
+		t.Errorf("Unexpected scopes: %v, denied: %v", state.Scopes, state.DeniedScopes)
+	}
+}
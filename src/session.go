@@ -1,18 +1,33 @@
 package src
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+// The reasons why a request could not be authenticated.
+var (
+	errNoSession      = errors.New("no session cookie is present")
+	errInvalidToken   = errors.New("invalid token")
+	errInvalidSession = errors.New("invalid session")
+	// The session of the cookie has been revoked, expired or lost, eg. in a restart.
+	errSessionNotFound = errors.New("session not found")
+)
+
 func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.SessionState, bool, map[string]interface{}, error) {
 	// Use AuthorizationHeader, if present
 	if toa.Config.AuthorizationHeader != nil && toa.Config.AuthorizationHeader.Name != "" {
@@ -23,19 +38,27 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 				authHeader = strings.TrimPrefix(authHeader, "Bearer ")
 			}
 
-			toa.logger.Log(logging.LevelDebug, "Custom AuthorizationHeader is present on the request and will be used.")
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "Custom AuthorizationHeader is present on the request and will be used.")
 
 			session := &session.SessionState{
 				Id:          "AuthorizationHeader",
 				AccessToken: authHeader,
 			}
 
-			ok, claims, err := toa.validateToken(session)
+			ok, claims, err := toa.validateToken(req.Context(), session)
 
 			if ok {
+				if missingClaims := toa.getMissingClaims(claims); len(missingClaims) > 0 {
+					return nil, false, nil, fmt.Errorf("%w: the token from AuthorizationHeader lacks the required claims %s", errInvalidToken, strings.Join(missingClaims, ", "))
+				}
+
 				return session, false, claims, err
 			} else {
-				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationHeader: %s", err.Error())
+				if isCountedTokenFailure(err) {
+					toa.recordAuthenticationFailure(req, lockoutFailureToken, getVerifiedSubject(err))
+				}
+
+				return nil, false, nil, fmt.Errorf("%w: failed to validate token from AuthorizationHeader: %s", errInvalidToken, err.Error())
 			}
 		}
 	}
@@ -45,19 +68,27 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 		authCookie, err := req.Cookie(toa.Config.AuthorizationCookie.Name)
 
 		if authCookie != nil && err == nil && authCookie.Value != "" {
-			toa.logger.Log(logging.LevelDebug, "Custom AuthorizationCookie is present on the request and will be used.")
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "Custom AuthorizationCookie is present on the request and will be used.")
 
 			session := &session.SessionState{
 				Id:          "AuthorizationCookie",
 				AccessToken: authCookie.Value,
 			}
 
-			ok, claims, err := toa.validateToken(session)
+			ok, claims, err := toa.validateToken(req.Context(), session)
 
 			if ok {
+				if missingClaims := toa.getMissingClaims(claims); len(missingClaims) > 0 {
+					return nil, false, nil, fmt.Errorf("%w: the token from AuthorizationCookie lacks the required claims %s", errInvalidToken, strings.Join(missingClaims, ", "))
+				}
+
 				return session, false, claims, err
 			} else {
-				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationCookie: %s", err.Error())
+				if isCountedTokenFailure(err) {
+					toa.recordAuthenticationFailure(req, lockoutFailureToken, getVerifiedSubject(err))
+				}
+
+				return nil, false, nil, fmt.Errorf("%w: failed to validate token from AuthorizationCookie: %s", errInvalidToken, err.Error())
 			}
 		}
 	}
@@ -66,71 +97,150 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 	sessionTicket, err := readChunkedCookie(req, getSessionCookieName(toa.Config))
 
 	if err != nil {
-		return nil, false, nil, fmt.Errorf("unable to read session cookie: %s", strings.TrimLeft(err.Error(), "http: "))
+		return nil, false, nil, fmt.Errorf("%w: unable to read session cookie: %s", errInvalidSession, strings.TrimLeft(err.Error(), "http: "))
 	}
 	if sessionTicket == "" {
-		return nil, false, nil, fmt.Errorf("no session cookie is present")
+		return nil, false, nil, errNoSession
 	}
 
-	session, claims, updatedSession, err := validateSessionTicket(toa, sessionTicket)
+	session, claims, updatedSession, err := validateSessionTicket(toa, req, sessionTicket)
 
 	if err != nil {
-		return nil, false, claims, fmt.Errorf("failed to validate session ticket: %s", err.Error())
+		return nil, false, claims, fmt.Errorf("%w: failed to validate session ticket: %w", errInvalidSession, err)
+	}
+	if session == nil {
+		return nil, false, nil, fmt.Errorf("%w: the session ticket didn't result in a session", errInvalidSession)
 	}
 
-	if toa.logger.MinLevel == logging.LevelDebug {
+	if toa.logger.Module(logging.ModuleSession).IsEnabled(logging.LevelDebug) {
 		tokenExpiresText := ""
 		if session.TokenExpiresIn > 0 {
-			tokenExpiresText = fmt.Sprintf("The IDP token expires in %ds.", int(math.Round(time.Until(session.RefreshedAt.Add(time.Duration(session.TokenExpiresIn)*time.Second)).Seconds())))
+			tokenExpiresText = fmt.Sprintf("The IDP token expires in %ds.", int(math.Round(session.RefreshedAt.Add(time.Duration(session.TokenExpiresIn)*time.Second).Sub(toa.now()).Seconds())))
 		}
 
-		toa.logger.Log(logging.LevelDebug, "A session is present for the request. %s", tokenExpiresText)
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "A session is present for the request. %s", tokenExpiresText)
 	}
 
 	return session, updatedSession != nil, claims, nil
 }
 
-func validateSessionTicket(toa *TraefikOidcAuth, encryptedTicket string) (*session.SessionState, map[string]interface{}, *session.SessionState, error) {
-	plainSessionTicket, err := utils.Decrypt(encryptedTicket, toa.Config.Secret)
+func validateSessionTicket(toa *TraefikOidcAuth, req *http.Request, encryptedTicket string) (*session.SessionState, map[string]interface{}, *session.SessionState, error) {
+	plainSessionTicket, err := utils.DecryptWithSecrets(encryptedTicket, toa.Config.DecryptionKeys())
+	if err != nil {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to decrypt session ticket: %v", err.Error())
+		return nil, nil, nil, err
+	}
+
+	plainSessionTicket, err = decompressSessionTicket(plainSessionTicket)
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Failed to decrypt session ticket: %v", err.Error())
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to decompress session ticket: %v", err.Error())
 		return nil, nil, nil, err
 	}
 
 	session, err := toa.SessionStorage.TryGetSession(plainSessionTicket)
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Reading session failed: %v", err.Error())
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Reading session failed: %v", err.Error())
 		return nil, nil, nil, err
 	}
 	if session == nil {
-		toa.logger.Log(logging.LevelDebug, "No session found")
-		return nil, nil, nil, nil
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "No session found")
+		return nil, nil, nil, errSessionNotFound
+	}
+
+	session.Ticket = plainSessionTicket
+
+	// Verify the binding before anything else, so a stolen cookie can't even be used to renew the tokens
+	err = toa.verifySessionBinding(session, req)
+	if err != nil {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "Rejecting session %s: %s", session.Id, err.Error())
+		return nil, nil, nil, err
 	}
 
-	success, claims, err := toa.validateToken(session)
+	// Sessions are sticky, so the tokens are always renewed at the provider which issued them
+	provider, err := toa.getProvider(req.Context(), session.Provider)
+	if err != nil {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "The identity provider of session %s is not available: %s", session.Id, err.Error())
+		return nil, nil, nil, err
+	}
+
+	tokensMissing := false
+	if session.AccessToken == "" && session.IdToken == "" && session.RefreshToken != "" {
+		// A minimal session cookie. Try to get the tokens from memory, otherwise renew them.
+		tokensMissing = toa.TokenCache == nil || !toa.TokenCache.Restore(session)
+
+		if tokensMissing {
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "Tokens of session %s are not cached. Renewing now...", session.Id)
+		}
+	}
+
+	var success bool
+	var claims map[string]interface{}
+	if !tokensMissing {
+		success, claims, err = toa.validateToken(req.Context(), session)
+	}
+
+	var previousClaims map[string]interface{}
+	if success {
+		previousClaims = claims
+	}
 
 	// Check if the session or IDP token expires soon
 	idpTokenExpiresSoon := false
 	if success {
 		idpTokenExpiresSoon = checkIdpTokenExpiresSoon(toa, session)
+
+		if idpTokenExpiresSoon && toa.isProviderFailOpen() {
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The provider is unavailable. Postponing the renewal of session %s.", session.Id)
+			idpTokenExpiresSoon = false
+		}
 	}
 
 	if !success || err != nil || idpTokenExpiresSoon {
 		if session.RefreshToken != "" {
-			toa.logger.Log(logging.LevelInfo, "Trying to renew tokens...")
+			if !toa.RenewalQueue.ShouldAttempt(session.Id) {
+				toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The renewal of session %s has been postponed, as the provider is unavailable.", session.Id)
+				return toa.useStaleSession(req.Context(), provider, session, success, claims, ErrProviderUnavailable)
+			}
+
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelInfo, "Trying to renew tokens...")
 
-			newTokens, err := toa.renewToken(session.RefreshToken)
+			newTokens, err := toa.RefreshLimiter.Do(req.Context(), session.Id, func() (*oidc.OidcTokenResponse, error) {
+				return toa.renewToken(req.Context(), provider, session.RefreshToken)
+			})
+
+			if errors.Is(err, errRefreshQueueTimeout) {
+				toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "Too many concurrent token refreshes. Postponing the renewal of session %s.", session.Id)
+				if success {
+					return session, claims, nil, nil
+				}
+				if toa.RenewalQueue != nil {
+					return toa.useStaleSession(req.Context(), provider, session, success, claims, err)
+				}
+
+				return nil, nil, nil, err
+			}
+
+			toa.Metrics.RecordTokenRenewal(err == nil)
 
 			if err != nil {
+				toa.recordProviderError(provider, err)
+
+				if toa.RenewalQueue != nil && errors.Is(err, ErrProviderUnavailable) {
+					toa.RenewalQueue.Postpone(session.Id)
+					return toa.useStaleSession(req.Context(), provider, session, success, claims, err)
+				}
+
 				return nil, nil, nil, err
 			}
 
+			toa.RenewalQueue.Remove(session.Id)
+
 			session.AccessToken = newTokens.AccessToken
 
 			if newTokens.RefreshToken != "" {
 				session.RefreshToken = newTokens.RefreshToken
 			} else {
-				toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new RefreshToken. Still keeping the old one.")
+				toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The auth provider didn't return a new RefreshToken. Still keeping the old one.")
 			}
 
 			// We had some problems with some providers which didn't return a new IdToken when renewing the tokens.
@@ -139,24 +249,28 @@ func validateSessionTicket(toa *TraefikOidcAuth, encryptedTicket string) (*sessi
 				session.IdToken = newTokens.IdToken
 			} else {
 				if toa.Config.Provider.TokenValidation == "IdToken" {
-					toa.logger.Log(logging.LevelWarn, "The auth provider didn't return a new IdToken. Still keeping the old one.")
+					toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "The auth provider didn't return a new IdToken. Still keeping the old one.")
 				} else {
-					toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new IdToken. Still keeping the old one.")
+					toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The auth provider didn't return a new IdToken. Still keeping the old one.")
 				}
 			}
 
-			success, claims, err = toa.validateToken(session)
+			success, claims, err = toa.validateToken(req.Context(), session)
 
 			if !success || err != nil {
-				toa.logger.Log(logging.LevelError, "Failed to validate renewed session: %v", err)
+				toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to validate renewed session: %v", err)
 				return nil, nil, session, err
 			}
 
+			if toa.Config.SessionCookie.RegenerateId && claimsChanged(previousClaims, claims) {
+				regenerateSessionId(toa, session)
+			}
+
 			// Update expirations
-			session.RefreshedAt = time.Now()
+			session.RefreshedAt = toa.now()
 			session.TokenExpiresIn = newTokens.ExpiresIn
 
-			toa.logger.Log(logging.LevelInfo, "Successfully renewed session")
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelInfo, "Successfully renewed session")
 
 			return session, claims, session, err
 		} else {
@@ -167,14 +281,49 @@ func validateSessionTicket(toa *TraefikOidcAuth, encryptedTicket string) (*sessi
 	return session, claims, nil, nil
 }
 
+// useStaleSession keeps the session while its tokens can't be renewed, because the provider is unavailable.
+// A session whose token already expired is only kept, if it can still be verified against the cached JWKS
+// and expired less than MaxStaleness ago. Otherwise renewalErr is returned.
+func (toa *TraefikOidcAuth) useStaleSession(ctx context.Context, provider *IdentityProvider, state *session.SessionState, valid bool, claims map[string]interface{}, renewalErr error) (*session.SessionState, map[string]interface{}, *session.SessionState, error) {
+	if valid {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "Failed to renew the tokens of session %s. Keeping the session until the provider is available again.", state.Id)
+		return state, claims, nil, nil
+	}
+
+	var token string
+	switch toa.Config.Provider.TokenValidation {
+	case "AccessToken":
+		token = state.AccessToken
+	case "IdToken":
+		token = state.IdToken
+	}
+
+	// Opaque tokens and introspection always require the provider
+	if token == "" || !isJwt(token) {
+		return nil, nil, nil, renewalErr
+	}
+
+	maxStaleness := time.Duration(toa.Config.GracefulDegradation.MaxStaleness) * time.Second
+
+	ok, staleClaims, err := toa.validateStaleTokenLocally(ctx, provider, token, maxStaleness)
+	if !ok {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelInfo, "The expired token of session %s can't be used anymore: %v", state.Id, err)
+		return nil, nil, nil, renewalErr
+	}
+
+	toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "The token of session %s is expired, but can't be renewed. Keeping the session until the provider is available again.", state.Id)
+
+	return state, staleClaims, nil, nil
+}
+
 func checkIdpTokenExpiresSoon(toa *TraefikOidcAuth, session *session.SessionState) bool {
 	if session.TokenExpiresIn > 0 {
-		pastDuration := time.Since(session.RefreshedAt)
+		pastDuration := toa.now().Sub(session.RefreshedAt)
 
 		halfMaxAge := float64(session.TokenExpiresIn) * toa.Config.Provider.TokenRenewalThreshold
 
 		if pastDuration.Seconds() > halfMaxAge {
-			toa.logger.Log(logging.LevelDebug, "The IDP token reached %d%% of it's expiration. Renewing now...", int32(toa.Config.Provider.TokenRenewalThreshold*100))
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The IDP token reached %d%% of it's expiration. Renewing now...", int32(toa.Config.Provider.TokenRenewalThreshold*100))
 			return true
 		}
 	}
@@ -182,7 +331,7 @@ func checkIdpTokenExpiresSoon(toa *TraefikOidcAuth, session *session.SessionStat
 	return false
 }
 
-func (toa *TraefikOidcAuth) validateToken(session *session.SessionState) (bool, map[string]interface{}, error) {
+func (toa *TraefikOidcAuth) validateToken(ctx context.Context, session *session.SessionState) (bool, map[string]interface{}, error) {
 	var token string
 
 	// Little bit hacky. In case the request contains a custom AuthorizationHeader or Cookie, only AccessToken is used.
@@ -200,23 +349,50 @@ func (toa *TraefikOidcAuth) validateToken(session *session.SessionState) (bool,
 		}
 	}
 
+	// Tokens of additional trusted issuers are always validated locally against the issuer's JWKS.
+	if session.Id == "AuthorizationHeader" {
+		if issuer := toa.findTrustedIssuer(token); issuer != nil {
+			return toa.validateTrustedIssuerToken(ctx, issuer, token)
+		}
+	}
+
+	provider, err := toa.getProvider(ctx, session.Provider)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if session.Id == "AuthorizationHeader" {
+		if toa.Config.Provider.TokenValidation == "Introspection" ||
+			(toa.Config.AuthorizationHeader.IntrospectOpaqueTokens && !isJwt(token)) {
+			if toa.isProviderFailOpen() && isJwt(token) {
+				return toa.validateTokenLocally(ctx, provider, token)
+			}
+
+			return toa.introspectTokenCached(ctx, provider, token)
+		}
+	}
+
 	if toa.Config.Provider.TokenValidation == "Introspection" {
-		return toa.introspectToken(token)
+		if toa.isProviderFailOpen() && isJwt(token) {
+			return toa.validateTokenLocally(ctx, provider, token)
+		}
+
+		return toa.introspectToken(ctx, provider, token)
 	}
 
-	ok, claims, err := toa.validateTokenLocally(token)
+	ok, claims, err := toa.validateTokenLocally(ctx, provider, token)
 
 	if !ok {
 		return ok, claims, err
 	}
 
-	if toa.Config.Provider.UseClaimsFromUserInfoBool {
+	if toa.Config.Provider.UseClaimsFromUserInfoBool && !toa.isProviderFailOpen() {
 		subClaim, ok := claims["sub"].(string)
 		if !ok {
 			return false, nil, fmt.Errorf("failed to fetch UserInfo: 'sub' claim is not a string or missing")
 		}
 
-		userInfoClaims, err := toa.getUserInfo(session.AccessToken, subClaim)
+		userInfoClaims, err := toa.getUserInfo(ctx, provider, session.AccessToken, subClaim)
 		if err != nil {
 			return false, nil, fmt.Errorf("failed to fetch UserInfo: %s", err.Error())
 		}
@@ -228,34 +404,169 @@ func (toa *TraefikOidcAuth) validateToken(session *session.SessionState) (bool,
 }
 
 func (toa *TraefikOidcAuth) storeSessionAndAttachCookie(session *session.SessionState, rw http.ResponseWriter) {
-	sessionTicket, err := toa.SessionStorage.StoreSession(session.Id, session)
+	sessionTicket, err := toa.SessionStorage.StoreSession(session.Id, toa.minimizeSession(session))
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Failed to store session: %s", err.Error())
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to store session: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	toa.logger.Log(logging.LevelDebug, "Session stored. Id %s", session.Id)
+	toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "Session stored. Id %s", session.Id)
+
+	if interval := toa.Config.SessionCookie.MinCookieRefreshInterval; interval > 0 {
+		now := toa.now().Unix()
+
+		// The cookie still carries the same ticket, eg. only the session id when the session is stored in memory
+		if sessionTicket == session.Ticket && now-session.CookieIssuedAt < int64(interval) {
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "The session cookie is unchanged. Not re-issuing it.")
+			return
+		}
+
+		session.CookieIssuedAt = now
+
+		sessionTicket, err = toa.SessionStorage.StoreSession(session.Id, toa.minimizeSession(session))
+		if err != nil {
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to store session: %s", err.Error())
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		session.Ticket = sessionTicket
+	}
+
+	if toa.Config.SessionCookie.Compress {
+		sessionTicket, err = compressSessionTicket(sessionTicket)
+		if err != nil {
+			toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to compress session ticket: %s", err.Error())
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	encryptedSessionTicket, err := utils.Encrypt(sessionTicket, toa.Config.Secret)
+	encryptedSessionTicket, err := utils.EncryptWithCipher(sessionTicket, toa.Config.EncryptionKey(), toa.Config.Cipher)
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Failed to encrypt session ticket: %s", err.Error())
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to encrypt session ticket: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	setChunkedCookies(toa.Config, rw, getSessionCookieName(toa.Config), encryptedSessionTicket)
+	maxAge := toa.Config.SessionCookie.MaxAge
+	if session.RememberMe && toa.Config.RememberMe != nil && toa.Config.RememberMe.Enabled {
+		maxAge = toa.Config.RememberMe.MaxAge
+	}
+
+	err = setChunkedCookiesWithMaxAge(toa.Config, rw, getSessionCookieName(toa.Config), encryptedSessionTicket, maxAge)
+	if err != nil {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelError, "Failed to attach the session cookie: %s. Enable SessionCookie.Compress or SessionCookie.Minimal, or increase SessionCookie.MaxChunks.", err.Error())
+		http.Error(rw, "The session is too large", http.StatusInternalServerError)
+		return
+	}
 }
 
 func createSessionCookie(config *Config) *http.Cookie {
 	return &http.Cookie{
-		Name:     getSessionCookieName(config),
-		Value:    "",
-		Secure:   config.SessionCookie.Secure,
-		HttpOnly: config.SessionCookie.HttpOnly,
-		Path:     config.SessionCookie.Path,
-		Domain:   config.SessionCookie.Domain,
-		SameSite: parseCookieSameSite(config.SessionCookie.SameSite),
-		MaxAge:   config.SessionCookie.MaxAge,
+		Name:        getSessionCookieName(config),
+		Value:       "",
+		Secure:      config.SessionCookie.Secure,
+		HttpOnly:    config.SessionCookie.HttpOnly,
+		Path:        config.SessionCookie.Path,
+		Domain:      config.SessionCookie.Domain,
+		SameSite:    parseCookieSameSite(config.SessionCookie.SameSite),
+		MaxAge:      config.SessionCookie.MaxAge,
+		Partitioned: config.SessionCookie.Partitioned,
 	}
 }
+
+// regenerateSessionId assigns a new id to the session to prevent session fixation.
+func regenerateSessionId(toa *TraefikOidcAuth, state *session.SessionState) {
+	previousId := state.Id
+	state.Id = session.GenerateSessionId()
+
+	// The session is stored under the new id, so the old one must not be usable anymore
+	toa.deleteServerSideSession(previousId)
+
+	// The ids are credentials, so they aren't logged
+	toa.logger.Module(logging.ModuleSession).Log(logging.LevelDebug, "Claims changed after token renewal. Regenerated the session id.")
+	toa.Metrics.RecordSessionRegenerated()
+}
+
+// Claims which change on every token renewal and therefore don't indicate a change of the user's privileges.
+var volatileClaims = map[string]bool{
+	"exp":       true,
+	"iat":       true,
+	"nbf":       true,
+	"jti":       true,
+	"auth_time": true,
+	"at_hash":   true,
+	"c_hash":    true,
+	"sid":       true,
+	"nonce":     true,
+}
+
+// claimsChanged checks whether the claims differ, ignoring volatile claims like exp and iat.
+// If the previous claims are unknown, they are treated as changed.
+func claimsChanged(previous map[string]interface{}, current map[string]interface{}) bool {
+	if previous == nil {
+		return true
+	}
+
+	for key, value := range current {
+		if volatileClaims[key] {
+			continue
+		}
+		if previousValue, ok := previous[key]; !ok || !reflect.DeepEqual(previousValue, value) {
+			return true
+		}
+	}
+
+	for key := range previous {
+		if volatileClaims[key] {
+			continue
+		}
+		if _, ok := current[key]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compressed session tickets are prefixed, so they can be detected when decrypting.
+// An uncompressed ticket is always a JSON object and therefore never starts with this prefix.
+const compressedTicketPrefix = "z:"
+
+func compressSessionTicket(ticket string) (string, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(compressedTicketPrefix)
+
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := writer.Write([]byte(ticket)); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+func decompressSessionTicket(ticket string) (string, error) {
+	compressed, isCompressed := strings.CutPrefix(ticket, compressedTicketPrefix)
+	if !isCompressed {
+		return ticket, nil
+	}
+
+	reader := flate.NewReader(strings.NewReader(compressed))
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decompressed), nil
+}
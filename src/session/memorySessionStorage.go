@@ -0,0 +1,148 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// ServerSideSessionStorage is implemented by storages which keep the sessions on the server,
+// so the sessions of a user can be listed and revoked.
+type ServerSideSessionStorage interface {
+	SessionStorage
+	ListSessions(subject string) []*SessionState
+	DeleteSession(sessionId string)
+}
+
+type memorySessionEntry struct {
+	state     SessionState
+	expiresAt time.Time
+}
+
+// MemorySessionStorage keeps the sessions in memory and only stores their id in the cookie.
+// Sessions which haven't been used for longer than the idle timeout are removed.
+type MemorySessionStorage struct {
+	idleTimeout time.Duration
+	maxSessions int
+	clock       utils.Clock
+
+	entries map[string]*memorySessionEntry
+	lock    sync.Mutex
+}
+
+func CreateMemorySessionStorage(idleTimeout time.Duration, maxSessions int, clock utils.Clock) *MemorySessionStorage {
+	return &MemorySessionStorage{
+		idleTimeout: idleTimeout,
+		maxSessions: maxSessions,
+		clock:       clock,
+		entries:     make(map[string]*memorySessionEntry),
+	}
+}
+
+func (storage *MemorySessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	if sessionId == "" {
+		return "", errors.New("the session has no id")
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	now := storage.clock.Now()
+
+	if _, ok := storage.entries[sessionId]; !ok && storage.maxSessions > 0 && len(storage.entries) >= storage.maxSessions {
+		storage.removeExpired(now)
+
+		if len(storage.entries) >= storage.maxSessions {
+			storage.removeOldest()
+		}
+	}
+
+	storage.entries[sessionId] = &memorySessionEntry{
+		state:     *state,
+		expiresAt: now.Add(storage.idleTimeout),
+	}
+
+	return sessionId, nil
+}
+
+// TryGetSession returns a copy of the session, or nil if it doesn't exist or has been revoked.
+// Every use extends the lifetime of the session by the idle timeout.
+func (storage *MemorySessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	entry, ok := storage.entries[sessionTicket]
+	if !ok {
+		return nil, nil
+	}
+
+	now := storage.clock.Now()
+
+	if now.After(entry.expiresAt) {
+		delete(storage.entries, sessionTicket)
+		return nil, nil
+	}
+
+	entry.expiresAt = now.Add(storage.idleTimeout)
+
+	state := entry.state
+
+	return &state, nil
+}
+
+// ListSessions returns copies of all active sessions of the subject.
+func (storage *MemorySessionStorage) ListSessions(subject string) []*SessionState {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	now := storage.clock.Now()
+	sessions := []*SessionState{}
+
+	for _, entry := range storage.entries {
+		if subject != "" && entry.state.Subject == subject && !now.After(entry.expiresAt) {
+			state := entry.state
+			sessions = append(sessions, &state)
+		}
+	}
+
+	return sessions
+}
+
+func (storage *MemorySessionStorage) DeleteSession(sessionId string) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	delete(storage.entries, sessionId)
+}
+
+// Len returns the number of sessions, including expired ones which haven't been removed yet.
+func (storage *MemorySessionStorage) Len() int {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	return len(storage.entries)
+}
+
+func (storage *MemorySessionStorage) removeExpired(now time.Time) {
+	for id, entry := range storage.entries {
+		if now.After(entry.expiresAt) {
+			delete(storage.entries, id)
+		}
+	}
+}
+
+func (storage *MemorySessionStorage) removeOldest() {
+	oldestId := ""
+	var oldestExpiresAt time.Time
+
+	for id, entry := range storage.entries {
+		if oldestId == "" || entry.expiresAt.Before(oldestExpiresAt) {
+			oldestId = id
+			oldestExpiresAt = entry.expiresAt
+		}
+	}
+
+	delete(storage.entries, oldestId)
+}
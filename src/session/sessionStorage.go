@@ -19,6 +19,30 @@ type SessionState struct {
 	RefreshToken   string    `json:"refresh_token"`
 	IsAuthorized   bool      `json:"is_authorized"`
 	TokenExpiresIn int       `json:"token_expires_in"`
+	ClientIp       string    `json:"client_ip,omitempty"`
+	UserAgentHash  string    `json:"user_agent_hash,omitempty"`
+	RememberMe     bool      `json:"remember_me,omitempty"`
+	// The name of the identity provider which issued the tokens. Empty for the primary provider.
+	Provider string `json:"provider,omitempty"`
+	// The identity of the user who is impersonated by the owner of the session.
+	ImpersonatedUser string `json:"impersonated_user,omitempty"`
+	// When and which version of the terms of use has been accepted.
+	ConsentedAt    int64  `json:"consented_at,omitempty"`
+	ConsentVersion string `json:"consent_version,omitempty"`
+	// The country the session has been created from, if it is bound to it.
+	Country string `json:"country,omitempty"`
+	// The scopes granted by the provider and the ones it refused. Only recorded when ScopeRules are configured.
+	Scopes       []string `json:"scopes,omitempty"`
+	DeniedScopes []string `json:"denied_scopes,omitempty"`
+	// Details about the login, which are only recorded for sessions stored on the server.
+	Subject    string `json:"sub,omitempty"`
+	LoggedInAt int64  `json:"logged_in_at,omitempty"`
+	IpAddress  string `json:"ip_address,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	// When the session cookie has been issued the last time, as unix timestamp.
+	CookieIssuedAt int64 `json:"cookie_issued_at,omitempty"`
+	// The plain ticket of the session cookie the session has been read from.
+	Ticket string `json:"-"`
 }
 
 func GenerateSessionId() string {
@@ -0,0 +1,90 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The network prefix lengths used when binding a session to the client's subnet.
+const (
+	sessionBindingIpv4PrefixLength = 24
+	sessionBindingIpv6PrefixLength = 64
+)
+
+// bindSession records the client's ip and user agent in the session, as configured by SessionBinding.
+func (toa *TraefikOidcAuth) bindSession(state *session.SessionState, req *http.Request) {
+	if toa.Config.SessionBinding == nil {
+		return
+	}
+
+	state.ClientIp = getSessionBindingIp(toa.Config.SessionBinding.ClientIp, req)
+
+	if toa.Config.SessionBinding.UserAgent {
+		state.UserAgentHash = hashUserAgent(req.UserAgent())
+	}
+
+	if toa.Config.SessionBinding.Country {
+		state.Country = toa.getCountry(req)
+	}
+}
+
+// verifySessionBinding checks whether the request comes from the same network and browser the session was created for.
+// Sessions which have been created before binding was enabled are accepted.
+func (toa *TraefikOidcAuth) verifySessionBinding(state *session.SessionState, req *http.Request) error {
+	if toa.Config.SessionBinding == nil {
+		return nil
+	}
+
+	if state.ClientIp != "" {
+		clientIp := getSessionBindingIp(toa.Config.SessionBinding.ClientIp, req)
+		if clientIp != "" && clientIp != state.ClientIp {
+			return errors.New("the session is bound to another client ip")
+		}
+	}
+
+	if state.UserAgentHash != "" && toa.Config.SessionBinding.UserAgent {
+		if hashUserAgent(req.UserAgent()) != state.UserAgentHash {
+			return errors.New("the session is bound to another user agent")
+		}
+	}
+
+	// A change of the country requires a new login, eg. when a session is used from an unusual location
+	if state.Country != "" && toa.Config.SessionBinding.Country {
+		if country := toa.getCountry(req); country != "" && country != state.Country {
+			return errors.New("the session is bound to another country")
+		}
+	}
+
+	return nil
+}
+
+func getSessionBindingIp(mode string, req *http.Request) string {
+	switch mode {
+	case "Exact":
+		return utils.GetClientIp(req)
+	case "Subnet":
+		ip := net.ParseIP(utils.GetClientIp(req))
+		if ip == nil {
+			return ""
+		}
+
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return (&net.IPNet{IP: ipv4.Mask(net.CIDRMask(sessionBindingIpv4PrefixLength, 32)), Mask: net.CIDRMask(sessionBindingIpv4PrefixLength, 32)}).String()
+		}
+
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(sessionBindingIpv6PrefixLength, 128)), Mask: net.CIDRMask(sessionBindingIpv6PrefixLength, 128)}).String()
+	default:
+		return ""
+	}
+}
+
+func hashUserAgent(userAgent string) string {
+	hash := sha256.Sum256([]byte(userAgent))
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
+}
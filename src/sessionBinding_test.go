@@ -0,0 +1,65 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func createBindingRequest(remoteAddr string, userAgent string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("User-Agent", userAgent)
+	return req
+}
+
+func TestSessionBindingSubnet(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		SessionBinding: &SessionBindingConfig{ClientIp: "Subnet", UserAgent: true},
+	})
+
+	state := &session.SessionState{}
+	toa.bindSession(state, createBindingRequest("192.0.2.10:1234", "Firefox"))
+
+	if state.ClientIp != "192.0.2.0/24" {
+		t.Errorf("Expected client ip to be bound to 192.0.2.0/24, but got %s", state.ClientIp)
+	}
+
+	if err := toa.verifySessionBinding(state, createBindingRequest("192.0.2.99:4321", "Firefox")); err != nil {
+		t.Errorf("Expected a request from the same subnet to be accepted, but got %v", err)
+	}
+	if err := toa.verifySessionBinding(state, createBindingRequest("198.51.100.10:1234", "Firefox")); err == nil {
+		t.Error("Expected a request from another subnet to be rejected")
+	}
+	if err := toa.verifySessionBinding(state, createBindingRequest("192.0.2.10:1234", "Chrome")); err == nil {
+		t.Error("Expected a request from another user agent to be rejected")
+	}
+}
+
+func TestSessionBindingExactIpv6(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		SessionBinding: &SessionBindingConfig{ClientIp: "Exact"},
+	})
+
+	state := &session.SessionState{}
+	toa.bindSession(state, createBindingRequest("[2001:db8::1]:1234", "Firefox"))
+
+	if err := toa.verifySessionBinding(state, createBindingRequest("[2001:db8::1]:4321", "Chrome")); err != nil {
+		t.Errorf("Expected the same ip to be accepted, but got %v", err)
+	}
+	if err := toa.verifySessionBinding(state, createBindingRequest("[2001:db8::2]:1234", "Firefox")); err == nil {
+		t.Error("Expected another ip to be rejected")
+	}
+}
+
+func TestSessionBindingAcceptsUnboundSessions(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		SessionBinding: &SessionBindingConfig{ClientIp: "Exact", UserAgent: true},
+	})
+
+	if err := toa.verifySessionBinding(&session.SessionState{}, createBindingRequest("192.0.2.10:1234", "Firefox")); err != nil {
+		t.Errorf("Expected a session without binding to be accepted, but got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The maximum length of the user agent recorded in a session.
+const maxRecordedUserAgentLength = 256
+
+type sessionListEntry struct {
+	Id          string `json:"id"`
+	LoggedInAt  string `json:"logged_in_at,omitempty"`
+	RefreshedAt string `json:"refreshed_at"`
+	IpAddress   string `json:"ip_address,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Current     bool   `json:"current"`
+}
+
+func (toa *TraefikOidcAuth) isSessionManagementRequest(req *http.Request) bool {
+	config := toa.Config.SessionManagement
+
+	return config != nil && config.Enabled && config.Path != "" && req.URL.Path == config.Path
+}
+
+// getServerSideSessionStorage returns the session storage, if it keeps the sessions on the server.
+func (toa *TraefikOidcAuth) getServerSideSessionStorage() (session.ServerSideSessionStorage, bool) {
+	storage, ok := toa.SessionStorage.(session.ServerSideSessionStorage)
+	return storage, ok
+}
+
+// recordSessionDetails remembers who logged in from where, so users can recognize their sessions.
+// As this would only increase the size of cookies, it is only done for sessions stored on the server.
+func (toa *TraefikOidcAuth) recordSessionDetails(state *session.SessionState, req *http.Request, claims map[string]interface{}) {
+	if _, ok := toa.getServerSideSessionStorage(); !ok {
+		return
+	}
+
+	state.Subject, _ = claims["sub"].(string)
+	state.LoggedInAt = toa.now().Unix()
+	state.IpAddress = utils.GetClientIp(req)
+	state.UserAgent = req.UserAgent()
+
+	if len(state.UserAgent) > maxRecordedUserAgentLength {
+		state.UserAgent = state.UserAgent[:maxRecordedUserAgentLength]
+	}
+}
+
+// deleteServerSideSession revokes a session, so its cookie can't be used anymore.
+func (toa *TraefikOidcAuth) deleteServerSideSession(sessionId string) {
+	if storage, ok := toa.getServerSideSessionStorage(); ok {
+		storage.DeleteSession(sessionId)
+	}
+}
+
+// handleSessionManagement lists the sessions of the user on GET and revokes the session with the given id on DELETE.
+func (toa *TraefikOidcAuth) handleSessionManagement(rw http.ResponseWriter, req *http.Request, currentSession *session.SessionState, claims map[string]interface{}) {
+	storage, ok := toa.getServerSideSessionStorage()
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		toa.logger.Log(logging.LevelWarn, "Unable to list the sessions of a user without a sub claim.")
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	sessions := storage.ListSessions(subject)
+
+	switch req.Method {
+	case http.MethodGet:
+		entries := make([]*sessionListEntry, 0, len(sessions))
+		for _, state := range sessions {
+			entries = append(entries, toSessionListEntry(state, currentSession))
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].RefreshedAt > entries[j].RefreshedAt
+		})
+
+		body, _ := json.Marshal(entries)
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+
+		_, _ = rw.Write(body)
+	case http.MethodDelete:
+		publicId := req.URL.Query().Get("id")
+
+		for _, state := range sessions {
+			if publicId != "" && getPublicSessionId(state.Id) == publicId {
+				storage.DeleteSession(state.Id)
+
+				toa.logger.Log(logging.LevelInfo, "Subject '%s' revoked the session %s.", subject, publicId)
+
+				if state.Id == currentSession.Id {
+					clearChunkedCookie(toa.Config, rw, req, getSessionCookieName(toa.Config))
+				}
+
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		http.NotFound(rw, req)
+	default:
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func toSessionListEntry(state *session.SessionState, currentSession *session.SessionState) *sessionListEntry {
+	entry := &sessionListEntry{
+		Id:          getPublicSessionId(state.Id),
+		RefreshedAt: state.RefreshedAt.UTC().Format(time.RFC3339),
+		IpAddress:   state.IpAddress,
+		UserAgent:   state.UserAgent,
+		Country:     state.Country,
+		Current:     state.Id == currentSession.Id,
+	}
+
+	if state.LoggedInAt > 0 {
+		entry.LoggedInAt = time.Unix(state.LoggedInAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	return entry
+}
+
+// getPublicSessionId derives the id shown to the user from the session id, which is never exposed itself,
+// because it is the key of the session in the storage.
+func getPublicSessionId(sessionId string) string {
+	hash := sha256.Sum256([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(hash[:12])
+}
@@ -0,0 +1,186 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func newSessionManagementTest(clock utils.Clock) (*TraefikOidcAuth, *session.MemorySessionStorage) {
+	storage := session.CreateMemorySessionStorage(time.Hour, 0, clock)
+
+	toa := newTestOidcAuth(&Config{
+		SessionManagement: &SessionManagementConfig{Enabled: true, Path: "/oidc/sessions"},
+	})
+	toa.SessionStorage = storage
+	toa.Clock = clock
+
+	return toa, storage
+}
+
+func storeTestSession(t *testing.T, toa *TraefikOidcAuth, subject string, userAgent string) *session.SessionState {
+	state := &session.SessionState{Id: session.GenerateSessionId(), RefreshedAt: toa.now()}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback", nil)
+	req.Header.Set("User-Agent", userAgent)
+	toa.recordSessionDetails(state, req, map[string]interface{}{"sub": subject})
+
+	if _, err := toa.SessionStorage.StoreSession(state.Id, state); err != nil {
+		t.Fatal(err)
+	}
+
+	return state
+}
+
+func TestSessionManagementListsTheSessionsOfTheUser(t *testing.T) {
+	toa, _ := newSessionManagementTest(utils.NewFakeClock(time.Unix(1700000000, 0)))
+
+	current := storeTestSession(t, toa, "alice", "Firefox")
+	storeTestSession(t, toa, "alice", "Chrome")
+	storeTestSession(t, toa, "bob", "Safari")
+
+	rw := httptest.NewRecorder()
+	toa.handleSessionManagement(rw, httptest.NewRequest(http.MethodGet, "/oidc/sessions", nil), current, map[string]interface{}{"sub": "alice"})
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", rw.Code)
+	}
+
+	entries := []*sessionListEntry{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected the two sessions of alice, but got %+v", entries)
+	}
+
+	for _, entry := range entries {
+		if entry.Id == current.Id {
+			t.Error("Expected the session id not to be exposed")
+		}
+		if entry.Current != (entry.UserAgent == "Firefox") {
+			t.Errorf("Expected only the session of the request to be current, but got %+v", entry)
+		}
+		if entry.LoggedInAt != "2023-11-14T22:13:20Z" || entry.IpAddress != "192.0.2.1" {
+			t.Errorf("Unexpected details: %+v", entry)
+		}
+	}
+}
+
+func TestSessionManagementRevokesASession(t *testing.T) {
+	toa, storage := newSessionManagementTest(utils.SystemClock)
+
+	current := storeTestSession(t, toa, "alice", "Firefox")
+	other := storeTestSession(t, toa, "alice", "Chrome")
+	foreign := storeTestSession(t, toa, "bob", "Safari")
+
+	claims := map[string]interface{}{"sub": "alice"}
+
+	// Sessions of other users can't be revoked
+	rw := httptest.NewRecorder()
+	toa.handleSessionManagement(rw, httptest.NewRequest(http.MethodDelete, "/oidc/sessions?id="+getPublicSessionId(foreign.Id), nil), current, claims)
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.handleSessionManagement(rw, httptest.NewRequest(http.MethodDelete, "/oidc/sessions?id="+getPublicSessionId(other.Id), nil), current, claims)
+
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", rw.Code)
+	}
+
+	if state, _ := storage.TryGetSession(other.Id); state != nil {
+		t.Error("Expected the session to be revoked")
+	}
+	if state, _ := storage.TryGetSession(current.Id); state == nil {
+		t.Error("Expected the current session to be kept")
+	}
+	if state, _ := storage.TryGetSession(foreign.Id); state == nil {
+		t.Error("Expected the session of another user to be kept")
+	}
+}
+
+func TestMemorySessionStorageRemovesIdleSessions(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1700000000, 0))
+	storage := session.CreateMemorySessionStorage(time.Hour, 2, clock)
+
+	storage.StoreSession("a", &session.SessionState{Id: "a"})
+	clock.Advance(50 * time.Minute)
+
+	// Using the session extends its lifetime
+	if state, _ := storage.TryGetSession("a"); state == nil {
+		t.Fatal("Expected the session to be found")
+	}
+
+	clock.Advance(50 * time.Minute)
+	if state, _ := storage.TryGetSession("a"); state == nil {
+		t.Fatal("Expected the session to be kept while it is used")
+	}
+
+	clock.Advance(61 * time.Minute)
+	if state, _ := storage.TryGetSession("a"); state != nil {
+		t.Error("Expected the idle session to be removed")
+	}
+
+	storage.StoreSession("b", &session.SessionState{Id: "b"})
+	clock.Advance(time.Minute)
+	storage.StoreSession("c", &session.SessionState{Id: "c"})
+	storage.StoreSession("d", &session.SessionState{Id: "d"})
+
+	if storage.Len() != 2 {
+		t.Errorf("Expected at most 2 sessions, but got %d", storage.Len())
+	}
+	if state, _ := storage.TryGetSession("b"); state != nil {
+		t.Error("Expected the session expiring first to be removed")
+	}
+}
+
+func TestRevokedSessionCookieIsUnauthenticated(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.SessionManagement = &SessionManagementConfig{Enabled: true, Path: "/oidc/sessions"}
+	toa.Config.SessionCookie = &SessionCookieConfig{}
+	toa.SessionStorage = session.CreateMemorySessionStorage(time.Hour, 0, utils.SystemClock)
+
+	current := storeTestSession(t, toa, "alice", "Firefox")
+	other := storeTestSession(t, toa, "alice", "Chrome")
+
+	rw := httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(other, rw)
+	cookies := rw.Result().Cookies()
+
+	rw = httptest.NewRecorder()
+	toa.handleSessionManagement(rw, httptest.NewRequest(http.MethodDelete, "/oidc/sessions?id="+getPublicSessionId(other.Id), nil), current, map[string]interface{}{"sub": "alice"})
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", rw.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the request to be unauthenticated, but got %d", rw.Code)
+	}
+
+	cleared := false
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == getSessionCookieName(toa.Config) && cookie.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("Expected the session cookie to be cleared, but got %v", rw.Result().Cookies())
+	}
+}
@@ -1,11 +1,15 @@
 package src
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 func TestSessionIdpTokenExpiration(t *testing.T) {
@@ -49,3 +53,170 @@ func TestSessionIdpTokenExpiration(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestClaimsChangedIgnoresVolatileClaims(t *testing.T) {
+	previous := map[string]interface{}{
+		"sub":   "alice",
+		"exp":   float64(100),
+		"iat":   float64(50),
+		"roles": []interface{}{"user"},
+	}
+
+	renewed := map[string]interface{}{
+		"sub":   "alice",
+		"exp":   float64(200),
+		"iat":   float64(150),
+		"roles": []interface{}{"user"},
+	}
+
+	if claimsChanged(previous, renewed) {
+		t.Error("Expected claims to be unchanged")
+	}
+
+	elevated := map[string]interface{}{
+		"sub":   "alice",
+		"exp":   float64(200),
+		"roles": []interface{}{"user", "admin"},
+	}
+
+	if !claimsChanged(previous, elevated) {
+		t.Error("Expected claims to be changed")
+	}
+
+	if !claimsChanged(nil, renewed) {
+		t.Error("Expected unknown previous claims to be treated as changed")
+	}
+}
+
+func TestRegenerateSessionIdIsCounted(t *testing.T) {
+	toa := newTestMetricsOidcAuth(t, &MetricsConfig{Enabled: true, Path: "/oidc/metrics"})
+
+	state := &session.SessionState{Id: "previous"}
+	regenerateSessionId(toa, state)
+
+	if state.Id == "" || state.Id == "previous" {
+		t.Errorf("Expected a new session id, but got '%s'", state.Id)
+	}
+
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oidc/metrics", nil))
+
+	if !strings.Contains(rw.Body.String(), `traefik_oidc_auth_session_regenerated_total{middleware="oidc@file",provider="https://idp.example.com"} 1`) {
+		t.Errorf("Expected the regenerated session to be counted, but got:\n%s", rw.Body.String())
+	}
+}
+
+func TestSessionTicketCompressionRoundtrip(t *testing.T) {
+	ticket := `{"id":"abc","access_token":"` + strings.Repeat("eyJhbGciOiJSUzI1NiJ9", 200) + `"}`
+
+	compressed, err := compressSessionTicket(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(ticket) {
+		t.Errorf("Expected compressed ticket to be smaller, but got %d >= %d bytes", len(compressed), len(ticket))
+	}
+
+	decompressed, err := decompressSessionTicket(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed != ticket {
+		t.Error("Expected decompressed ticket to match the original")
+	}
+
+	// Uncompressed tickets are passed through as they are
+	plain, err := decompressSessionTicket(ticket)
+	if err != nil || plain != ticket {
+		t.Errorf("Expected uncompressed ticket to be returned unchanged, but got %v", err)
+	}
+}
+
+func TestSessionIdpTokenExpirationUsesClock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelError),
+		Config: &Config{Provider: &ProviderConfig{TokenRenewalThreshold: 0.5}},
+		Clock:  clock,
+	}
+
+	sessionState := &session.SessionState{
+		RefreshedAt:    clock.Now(),
+		TokenExpiresIn: 60,
+	}
+
+	clock.Advance(29 * time.Second)
+	if checkIdpTokenExpiresSoon(toa, sessionState) {
+		t.Error("Expected the token not to expire soon")
+	}
+
+	clock.Advance(2 * time.Second)
+	if !checkIdpTokenExpiresSoon(toa, sessionState) {
+		t.Error("Expected the token to expire soon")
+	}
+}
+
+func TestUnchangedSessionCookieIsNotReissued(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1700000000, 0))
+
+	toa := newTestOidcAuth(&Config{
+		SessionCookie: &SessionCookieConfig{
+			MinCookieRefreshInterval: 600,
+		},
+	})
+	toa.Clock = clock
+	toa.SessionStorage = session.CreateMemorySessionStorage(time.Hour, 0, clock)
+
+	state := &session.SessionState{Id: "session-1", AccessToken: "access-token"}
+
+	rw := httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(state, rw)
+	if len(rw.Result().Cookies()) != 1 {
+		t.Fatalf("Expected the cookie of a new session to be issued, but got %v", rw.Result().Cookies())
+	}
+
+	// Renewed tokens are only stored in memory, the cookie still carries the session id
+	state.AccessToken = "renewed-access-token"
+	clock.Advance(time.Minute)
+
+	rw = httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(state, rw)
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("Expected the unchanged cookie not to be issued again, but got %v", rw.Result().Cookies())
+	}
+
+	stored, _ := toa.SessionStorage.TryGetSession("session-1")
+	if stored == nil || stored.AccessToken != "renewed-access-token" {
+		t.Errorf("Expected the renewed session to be stored, but got %v", stored)
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	rw = httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(state, rw)
+	if len(rw.Result().Cookies()) != 1 {
+		t.Errorf("Expected the cookie to be issued again after the interval, but got %v", rw.Result().Cookies())
+	}
+}
+
+func TestChangedSessionCookieIsReissued(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		SessionCookie: &SessionCookieConfig{
+			MinCookieRefreshInterval: 600,
+		},
+	})
+	toa.SessionStorage = session.CreateCookieSessionStorage()
+
+	state := &session.SessionState{Id: "session-1", AccessToken: "access-token"}
+
+	toa.storeSessionAndAttachCookie(state, httptest.NewRecorder())
+
+	state.AccessToken = "renewed-access-token"
+
+	rw := httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(state, rw)
+	if len(rw.Result().Cookies()) != 1 {
+		t.Errorf("Expected the changed cookie to be issued, but got %v", rw.Result().Cookies())
+	}
+}
@@ -0,0 +1,96 @@
+package src
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The discovery documents fetched by all instances of the middleware in the process. Traefik creates a new instance
+// for every router using the middleware and on every change of the dynamic configuration, which would otherwise
+// all fetch the same document.
+var sharedDiscoveries = &discoveryCache{documents: map[string]*sharedDiscovery{}}
+
+type discoveryCache struct {
+	lock      sync.Mutex
+	documents map[string]*sharedDiscovery
+	flight    utils.SingleFlight
+}
+
+type sharedDiscovery struct {
+	document  *oidc.OidcDiscovery
+	fetchedAt time.Time
+}
+
+// getOidcDiscovery fetches the discovery document of the provider. With the SharedCache, a document fetched
+// by another instance within the MaxAge is reused.
+func (toa *TraefikOidcAuth) getOidcDiscovery(ctx context.Context, providerUrl *url.URL) (*oidc.OidcDiscovery, error) {
+	if !toa.isSharedCacheEnabled() {
+		return GetOidcDiscovery(ctx, toa.logger, toa.httpClient, providerUrl)
+	}
+
+	key := toa.sharedCacheScope + " " + providerUrl.String()
+	maxAge := time.Duration(toa.Config.SharedCache.MaxAge * float64(time.Second))
+
+	if document := sharedDiscoveries.lookup(key, maxAge, toa.now()); document != nil {
+		toa.logger.Log(logging.LevelDebug, "Using the shared discovery document of %s.", providerUrl.String())
+		return document, nil
+	}
+
+	result, err, _ := sharedDiscoveries.flight.Do(key, func() (interface{}, error) {
+		// Another instance may have just fetched the document
+		if document := sharedDiscoveries.lookup(key, maxAge, toa.now()); document != nil {
+			return document, nil
+		}
+
+		// Other instances share the result, so the discovery isn't cancelled with the request which started it
+		document, err := GetOidcDiscovery(context.WithoutCancel(ctx), toa.logger, toa.httpClient, providerUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		sharedDiscoveries.lock.Lock()
+		sharedDiscoveries.documents[key] = &sharedDiscovery{document: document, fetchedAt: toa.now()}
+		sharedDiscoveries.lock.Unlock()
+
+		return document, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every instance gets its own copy, so it can't affect the others
+	document := *result.(*oidc.OidcDiscovery)
+
+	return &document, nil
+}
+
+func (c *discoveryCache) lookup(key string, maxAge time.Duration, now time.Time) *oidc.OidcDiscovery {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.documents[key]
+	if !ok || now.Sub(entry.fetchedAt) > maxAge {
+		return nil
+	}
+
+	document := *entry.document
+
+	return &document
+}
+
+func (c *discoveryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.documents)
+}
+
+func (toa *TraefikOidcAuth) isSharedCacheEnabled() bool {
+	return toa.Config.SharedCache != nil && toa.Config.SharedCache.Enabled
+}
@@ -0,0 +1,106 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func newSharedCacheTest(server *httptest.Server, enabled bool) *TraefikOidcAuth {
+	return &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelError),
+		httpClient: server.Client(),
+		Config: &Config{
+			SharedCache: &SharedCacheConfig{Enabled: enabled, MaxAge: 300},
+		},
+		sharedCacheScope: getProviderClientFingerprint(&ProviderConfig{}, nil),
+	}
+}
+
+func TestDiscoveryIsSharedBetweenInstances(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"issuer":"https://idp.example.com","jwks_uri":"https://idp.example.com/jwks"}`))
+	}))
+	defer server.Close()
+
+	providerUrl, _ := url.Parse(server.URL)
+
+	first, err := newSharedCacheTest(server, true).getOidcDiscovery(context.Background(), providerUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Issuer = "modified"
+
+	second, err := newSharedCacheTest(server, true).getOidcDiscovery(context.Background(), providerUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected the discovery document to be fetched once, but got %d requests", atomic.LoadInt32(&requests))
+	}
+	if second.Issuer != "https://idp.example.com" {
+		t.Errorf("Expected every instance to get its own copy of the document, but got issuer '%s'", second.Issuer)
+	}
+
+	if _, err := newSharedCacheTest(server, false).getOidcDiscovery(context.Background(), providerUrl); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Expected instances without shared cache to fetch the document, but got %d requests", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestDiscoveryIsOnlySharedWithTheSameClientSettings(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"issuer":"https://idp.example.com","jwks_uri":"https://idp.example.com/jwks"}`))
+	}))
+	defer server.Close()
+
+	providerUrl, _ := url.Parse(server.URL + "/scoped")
+
+	instance := newSharedCacheTest(server, true)
+	if _, err := instance.getOidcDiscovery(context.Background(), providerUrl); err != nil {
+		t.Fatal(err)
+	}
+
+	proxied := newSharedCacheTest(server, true)
+	proxied.sharedCacheScope = getProviderClientFingerprint(&ProviderConfig{HttpsProxy: "http://proxy.example.com:3128"}, nil)
+	if _, err := proxied.getOidcDiscovery(context.Background(), providerUrl); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Expected instances with other proxy settings to fetch their own document, but got %d requests", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestProviderClientFingerprint(t *testing.T) {
+	base := getProviderClientFingerprint(&ProviderConfig{}, nil)
+
+	if getProviderClientFingerprint(&ProviderConfig{ClientId: "other"}, nil) != base {
+		t.Error("Expected settings unrelated to the connection not to change the fingerprint")
+	}
+
+	for name, fingerprint := range map[string]string{
+		"ca bundle":   getProviderClientFingerprint(&ProviderConfig{}, []byte("-----BEGIN CERTIFICATE-----")),
+		"insecure":    getProviderClientFingerprint(&ProviderConfig{InsecureSkipVerifyBool: true}, nil),
+		"server name": getProviderClientFingerprint(&ProviderConfig{TlsServerName: "idp.internal"}, nil),
+		"proxy":       getProviderClientFingerprint(&ProviderConfig{HttpProxy: "http://proxy.example.com:3128"}, nil),
+	} {
+		if fingerprint == base {
+			t.Errorf("Expected the %s to change the fingerprint", name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+// ConsumedStateCache remembers the ids of states which have already been used on a callback.
+type ConsumedStateCache struct {
+	entries     map[string]time.Time
+	lastCleanup time.Time
+
+	lock sync.Mutex
+}
+
+func CreateConsumedStateCache() *ConsumedStateCache {
+	return &ConsumedStateCache{
+		entries:     make(map[string]time.Time),
+		lastCleanup: time.Now(),
+	}
+}
+
+// TryConsume marks the state id as used until expiresAt.
+// It returns false if the id has already been used before.
+func (cache *ConsumedStateCache) TryConsume(id string, expiresAt time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(cache.lastCleanup) > time.Minute {
+		cache.lastCleanup = now
+
+		for key, entryExpiresAt := range cache.entries {
+			if now.After(entryExpiresAt) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+
+	if entryExpiresAt, ok := cache.entries[id]; ok && now.Before(entryExpiresAt) {
+		return false
+	}
+
+	cache.entries[id] = expiresAt
+
+	return true
+}
+
+// Len returns the number of entries, including expired ones which haven't been removed yet.
+func (cache *ConsumedStateCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.entries)
+}
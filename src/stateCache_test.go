@@ -0,0 +1,21 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumedStateCacheRejectsReuse(t *testing.T) {
+	cache := CreateConsumedStateCache()
+	expiresAt := time.Now().Add(time.Minute)
+
+	if !cache.TryConsume("state-1", expiresAt) {
+		t.Fatal("Expected first use of the state to succeed")
+	}
+	if cache.TryConsume("state-1", expiresAt) {
+		t.Fatal("Expected second use of the state to fail")
+	}
+	if !cache.TryConsume("state-2", expiresAt) {
+		t.Fatal("Expected another state to succeed")
+	}
+}
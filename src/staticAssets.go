@@ -0,0 +1,72 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func validateStaticAssetsConfig(logger *logging.Logger, config *StaticAssetsConfig) error {
+	if len(config.Extensions) == 0 && len(config.PathPrefixes) == 0 {
+		logger.Log(logging.LevelError, "StaticAssets requires at least one of Extensions or PathPrefixes.")
+		return errors.New("static assets require extensions or path prefixes")
+	}
+
+	for _, prefix := range config.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			logger.Log(logging.LevelError, "Invalid StaticAssets path prefix %s. Path prefixes must start with /.", prefix)
+			return errors.New("invalid static assets path prefix")
+		}
+	}
+
+	return nil
+}
+
+// isStaticAssetRequest checks whether the request is for a static asset by its extension or path.
+// Paths containing /.. are never matched, as the upstream service may resolve them to other content.
+func (toa *TraefikOidcAuth) isStaticAssetRequest(req *http.Request) bool {
+	config := toa.Config.StaticAssets
+	if config == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+
+	requestPath := req.URL.Path
+
+	if strings.Contains(requestPath, "/..") || strings.Contains(requestPath, "\\") {
+		return false
+	}
+
+	extension := strings.TrimPrefix(path.Ext(requestPath), ".")
+	if extension != "" {
+		for _, expected := range config.Extensions {
+			if strings.EqualFold(extension, strings.TrimPrefix(expected, ".")) {
+				return true
+			}
+		}
+	}
+
+	for _, prefix := range config.PathPrefixes {
+		if strings.HasPrefix(requestPath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasSessionCookie checks whether the browser sent a session cookie, which has been encrypted by the middleware.
+// The cookie is only decrypted, the session isn't loaded. So the cookie of an ended session is still accepted.
+func (toa *TraefikOidcAuth) hasSessionCookie(req *http.Request) bool {
+	value, err := readChunkedCookie(req, getSessionCookieName(toa.Config))
+	if err != nil || value == "" {
+		return false
+	}
+
+	_, err = utils.DecryptWithSecrets(value, toa.Config.DecryptionKeys())
+
+	return err == nil
+}
@@ -0,0 +1,115 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestStaticAssetsAreForwardedWithSessionCookie(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.CookieNamePrefix = "TraefikOidcAuth"
+	toa.Config.StaticAssets = &StaticAssetsConfig{Extensions: []string{"css", ".js"}}
+
+	var forwardedCookies []*http.Cookie
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwardedCookies = req.Cookies()
+	})
+
+	ticket, err := utils.Encrypt("ticket", toa.Config.DecryptionKeys()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/assets/app.js", nil)
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: ticket})
+
+	toa.ServeHTTP(httptest.NewRecorder(), req)
+
+	if forwardedCookies == nil {
+		t.Fatal("Expected the static asset to be forwarded")
+	}
+	if len(forwardedCookies) != 0 {
+		t.Errorf("Expected the session cookie to be removed, but got %v", forwardedCookies)
+	}
+}
+
+func TestStaticAssetsRequireAnEncryptedSessionCookie(t *testing.T) {
+	toa := newLoginTest()
+	toa.Config.CookieNamePrefix = "TraefikOidcAuth"
+	toa.Config.StaticAssets = &StaticAssetsConfig{Extensions: []string{"js"}}
+	toa.Config.SessionCookie = CreateConfig().SessionCookie
+
+	forwarded := false
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/assets/app.js", nil)
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: "x"})
+
+	toa.ServeHTTP(httptest.NewRecorder(), req)
+
+	if forwarded {
+		t.Error("Expected a session cookie with an arbitrary value not to be accepted")
+	}
+}
+
+func TestIsStaticAssetRequest(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		StaticAssets: &StaticAssetsConfig{
+			Extensions:   []string{"css", ".woff2"},
+			PathPrefixes: []string{"/static/"},
+		},
+	})
+
+	tests := []struct {
+		method   string
+		uri      string
+		expected bool
+	}{
+		{http.MethodGet, "/styles/site.css", true},
+		{http.MethodHead, "/fonts/Inter.WOFF2", true},
+		{http.MethodGet, "/static/logo", true},
+		{http.MethodGet, "/api/users", false},
+		{http.MethodGet, "/site.css.php", false},
+		{http.MethodPost, "/styles/site.css", false},
+		{http.MethodGet, "/static/../admin", false},
+		{http.MethodGet, "/static/%2e%2e/admin", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost"+test.uri, nil)
+
+		if actual := toa.isStaticAssetRequest(req); actual != test.expected {
+			t.Errorf("%s %s: Expected %v, but got %v", test.method, test.uri, test.expected, actual)
+		}
+	}
+}
+
+func TestHasSessionCookie(t *testing.T) {
+	toa := newTestOidcAuth(&Config{CookieNamePrefix: "TraefikOidcAuth"})
+
+	req := httptest.NewRequest(http.MethodGet, "/assets/app.js", nil)
+	if toa.hasSessionCookie(req) {
+		t.Error("Expected no session cookie")
+	}
+
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config) + ".Chunks", Value: "2"})
+	ticket, err := utils.Encrypt("ticket", toa.Config.DecryptionKeys()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config) + ".1", Value: ticket[:10]})
+	if toa.hasSessionCookie(req) {
+		t.Error("Expected an incomplete chunked session cookie to be ignored")
+	}
+
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config) + ".2", Value: ticket[10:]})
+	if !toa.hasSessionCookie(req) {
+		t.Error("Expected the chunked session cookie to be present")
+	}
+}
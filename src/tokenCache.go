@@ -0,0 +1,133 @@
+package src
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+const maxTokenCacheEntries = 10000
+
+// Tokens are kept at most this long, when the IDP doesn't tell us when they expire.
+const defaultTokenCacheDuration = 5 * time.Minute
+
+type tokenCacheEntry struct {
+	accessToken string
+	idToken     string
+	expiresAt   time.Time
+}
+
+// TokenCache holds the access- and id tokens of sessions in memory, when the session cookie is
+// configured to only carry the refresh token. See SessionCookieConfig.Minimal.
+type TokenCache struct {
+	entries map[string]*tokenCacheEntry
+	lock    sync.Mutex
+	clock   utils.Clock
+}
+
+func CreateTokenCache(clock utils.Clock) *TokenCache {
+	return &TokenCache{
+		entries: make(map[string]*tokenCacheEntry),
+		clock:   clock,
+	}
+}
+
+func (cache *TokenCache) Set(state *session.SessionState) {
+	ttl := defaultTokenCacheDuration
+	if state.TokenExpiresIn > 0 {
+		ttl = time.Duration(state.TokenExpiresIn) * time.Second
+	}
+
+	expiresAt := state.RefreshedAt.Add(ttl)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if len(cache.entries) >= maxTokenCacheEntries {
+		cache.removeExpired()
+	}
+	if len(cache.entries) >= maxTokenCacheEntries {
+		// Still full, so just start over. Sessions will simply renew their tokens.
+		cache.entries = make(map[string]*tokenCacheEntry)
+	}
+
+	cache.entries[state.Id] = &tokenCacheEntry{
+		accessToken: state.AccessToken,
+		idToken:     state.IdToken,
+		expiresAt:   expiresAt,
+	}
+}
+
+// Restore fills in the tokens of the session, if they are still cached.
+func (cache *TokenCache) Restore(state *session.SessionState) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[state.Id]
+	if !ok {
+		return false
+	}
+
+	if cache.clock.Now().After(entry.expiresAt) {
+		delete(cache.entries, state.Id)
+		return false
+	}
+
+	state.AccessToken = entry.accessToken
+	state.IdToken = entry.idToken
+
+	return true
+}
+
+func (cache *TokenCache) Remove(sessionId string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	delete(cache.entries, sessionId)
+}
+
+// Len returns the number of entries, including expired ones which haven't been removed yet.
+func (cache *TokenCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.entries)
+}
+
+func (cache *TokenCache) removeExpired() {
+	now := cache.clock.Now()
+
+	for key, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// minimizeSession moves the tokens of the session into the token cache and returns a copy of the session
+// which only contains the refresh token, if minimal session cookies are enabled.
+func (toa *TraefikOidcAuth) minimizeSession(state *session.SessionState) *session.SessionState {
+	if !toa.Config.SessionCookie.Minimal || toa.TokenCache == nil {
+		return state
+	}
+
+	if state.RefreshToken == "" {
+		toa.logger.Module(logging.ModuleSession).Log(logging.LevelWarn, "Unable to store a minimal session cookie because the IDP didn't return a refresh token. Storing all tokens in the cookie instead. Make sure to request the offline_access scope.")
+		return state
+	}
+
+	toa.TokenCache.Set(state)
+
+	minimal := *state
+	minimal.AccessToken = ""
+	minimal.IdToken = ""
+
+	return &minimal
+}
@@ -0,0 +1,98 @@
+package src
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestMinimalSessionCookieOnlyContainsRefreshToken(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		SessionCookie: &SessionCookieConfig{
+			Minimal: true,
+		},
+	})
+	toa.SessionStorage = session.CreateCookieSessionStorage()
+	toa.TokenCache = CreateTokenCache(utils.SystemClock)
+
+	state := &session.SessionState{
+		Id:             "session-1",
+		RefreshedAt:    time.Now(),
+		AccessToken:    "access-token",
+		IdToken:        "id-token",
+		RefreshToken:   "refresh-token",
+		TokenExpiresIn: 300,
+	}
+
+	rw := httptest.NewRecorder()
+	toa.storeSessionAndAttachCookie(state, rw)
+
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected exactly one cookie, but got %d", len(cookies))
+	}
+
+	ticket, err := utils.DecryptWithSecrets(cookies[0].Value, toa.Config.DecryptionKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ticket, "access-token") || strings.Contains(ticket, "id-token") {
+		t.Errorf("Expected the cookie not to contain the access- or id token, but got %s", ticket)
+	}
+	if !strings.Contains(ticket, "refresh-token") {
+		t.Errorf("Expected the cookie to contain the refresh token, but got %s", ticket)
+	}
+
+	if state.AccessToken != "access-token" {
+		t.Error("Expected the original session to be left untouched")
+	}
+
+	restored := &session.SessionState{Id: "session-1", RefreshToken: "refresh-token"}
+	if !toa.TokenCache.Restore(restored) {
+		t.Fatal("Expected the tokens to be cached")
+	}
+	if restored.AccessToken != "access-token" || restored.IdToken != "id-token" {
+		t.Errorf("Expected the tokens to be restored, but got %+v", restored)
+	}
+}
+
+func TestTokenCacheExpiresEntries(t *testing.T) {
+	cache := CreateTokenCache(utils.SystemClock)
+
+	cache.Set(&session.SessionState{
+		Id:             "session-1",
+		RefreshedAt:    time.Now().Add(-2 * time.Minute),
+		AccessToken:    "access-token",
+		TokenExpiresIn: 60,
+	})
+
+	if cache.Restore(&session.SessionState{Id: "session-1"}) {
+		t.Error("Expected expired tokens not to be restored")
+	}
+}
+
+func TestTokenCacheUsesClock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	cache := CreateTokenCache(clock)
+
+	cache.Set(&session.SessionState{
+		Id:             "session-1",
+		RefreshedAt:    clock.Now(),
+		AccessToken:    "access-token",
+		TokenExpiresIn: 60,
+	})
+
+	if !cache.Restore(&session.SessionState{Id: "session-1"}) {
+		t.Fatal("Expected the tokens to be cached")
+	}
+
+	clock.Advance(61 * time.Second)
+
+	if cache.Restore(&session.SessionState{Id: "session-1"}) {
+		t.Error("Expected the tokens to expire with the clock")
+	}
+}
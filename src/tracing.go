@@ -0,0 +1,47 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
+)
+
+// providerTracingTransport creates a client span for every request to the identity provider
+// and propagates the trace context to it.
+type providerTracingTransport struct {
+	next http.RoundTripper
+	toa  *TraefikOidcAuth
+}
+
+func (transport *providerTracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only trace provider requests which are part of an incoming request.
+	// Background work like the periodic JWKS reload would otherwise create a new trace each time.
+	if tracing.SpanFromContext(req.Context()) == nil {
+		return transport.next.RoundTrip(req)
+	}
+
+	ctx, span := transport.toa.Tracer.Start(req.Context(), "oidc.provider."+transport.toa.getProviderEndpointName(req.URL), tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+
+	// A RoundTripper must not modify the original request
+	req = req.Clone(ctx)
+	transport.toa.Tracer.Inject(ctx, req.Header)
+
+	resp, err := transport.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return resp, err
+	}
+
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.RecordError(fmt.Errorf("unexpected status code %d", resp.StatusCode))
+	}
+
+	return resp, err
+}
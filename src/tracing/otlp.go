@@ -0,0 +1,284 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The maximum number of spans sent in a single request.
+const otlpMaxBatchSize = 512
+
+// The number of spans which may be queued before new spans are dropped.
+const otlpQueueSize = 2048
+
+// OtlpExporter sends spans to an OpenTelemetry collector using OTLP over HTTP with JSON encoding.
+// Spans are sent in batches and dropped when the queue is full, so ending a span never blocks a request.
+type OtlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	headerFiles map[string]*utils.FileSecret
+	serviceName string
+	httpClient  *http.Client
+
+	spans    chan *Span
+	shutdown chan chan struct{}
+	stopped  chan struct{}
+}
+
+// NormalizeOtlpEndpoint appends the default path for traces, if the endpoint doesn't contain a path, eg. http://collector:4318.
+func NormalizeOtlpEndpoint(endpoint string) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("the OTLP endpoint must be an http or https url")
+	}
+
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = "/v1/traces"
+	}
+
+	return parsed.String(), nil
+}
+
+// CreateOtlpExporter creates an exporter, which sends the headers and the current values of the header files
+// with every request, so the files can be rotated without a restart.
+func CreateOtlpExporter(endpoint string, headers map[string]string, headerFiles map[string]*utils.FileSecret, serviceName string, httpClient *http.Client, flushInterval time.Duration) *OtlpExporter {
+	exporter := &OtlpExporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		headerFiles: headerFiles,
+		serviceName: serviceName,
+		httpClient:  httpClient,
+		spans:       make(chan *Span, otlpQueueSize),
+		shutdown:    make(chan chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go exporter.run(flushInterval)
+
+	return exporter
+}
+
+func (exporter *OtlpExporter) enqueue(span *Span) {
+	if exporter == nil {
+		return
+	}
+
+	select {
+	case exporter.spans <- span:
+	default:
+	}
+}
+
+// Shutdown sends all queued spans and stops the exporter. Spans ended afterwards are dropped.
+// Calling it again after the exporter stopped has no effect.
+func (exporter *OtlpExporter) Shutdown(ctx context.Context) error {
+	if exporter == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+
+	select {
+	case exporter.shutdown <- done:
+	case <-exporter.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (exporter *OtlpExporter) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	defer close(exporter.stopped)
+
+	batch := make([]*Span, 0, otlpMaxBatchSize)
+
+	flush := func() {
+		if len(batch) > 0 {
+			_ = exporter.export(batch)
+			batch = make([]*Span, 0, otlpMaxBatchSize)
+		}
+	}
+
+	for {
+		select {
+		case span := <-exporter.spans:
+			batch = append(batch, span)
+			if len(batch) >= otlpMaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case done := <-exporter.shutdown:
+			for len(exporter.spans) > 0 {
+				batch = append(batch, <-exporter.spans)
+				if len(batch) >= otlpMaxBatchSize {
+					flush()
+				}
+			}
+			flush()
+			close(done)
+			return
+		}
+	}
+}
+
+func (exporter *OtlpExporter) export(spans []*Span) error {
+	body, err := json.Marshal(exporter.buildRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, exporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range exporter.headers {
+		req.Header.Set(name, value)
+	}
+	for name, secret := range exporter.headerFiles {
+		req.Header.Set(name, secret.Value())
+	}
+
+	resp, err := exporter.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the OTLP endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (exporter *OtlpExporter) buildRequest(spans []*Span) *otlpRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+
+	for _, span := range spans {
+		span.lock.Lock()
+
+		otlpSpan := otlpSpan{
+			TraceId:           span.SpanContext.TraceId.String(),
+			SpanId:            span.SpanContext.SpanId.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        toOtlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: span.Status, Message: span.StatusText},
+		}
+		if span.ParentSpanId.IsValid() {
+			otlpSpan.ParentSpanId = span.ParentSpanId.String()
+		}
+
+		span.lock.Unlock()
+
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: toOtlpAttributes(map[string]interface{}{"service.name": exporter.serviceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "traefik-oidc-auth"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func toOtlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keyValues := make([]otlpKeyValue, 0, len(attributes))
+
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+
+		switch v := value.(type) {
+		case string:
+			otlpValue = map[string]interface{}{"stringValue": v}
+		case bool:
+			otlpValue = map[string]interface{}{"boolValue": v}
+		case int:
+			otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			otlpValue = map[string]interface{}{"doubleValue": v}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		keyValues = append(keyValues, otlpKeyValue{Key: key, Value: otlpValue})
+	}
+
+	return keyValues
+}
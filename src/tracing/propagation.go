@@ -0,0 +1,239 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The supported propagation formats.
+const (
+	PropagatorW3C     = "w3c"
+	PropagatorB3      = "b3"
+	PropagatorB3Multi = "b3multi"
+	PropagatorJaeger  = "jaeger"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	b3Header          = "b3"
+	b3TraceIdHeader   = "X-B3-TraceId"
+	b3SpanIdHeader    = "X-B3-SpanId"
+	b3SampledHeader   = "X-B3-Sampled"
+	b3FlagsHeader     = "X-B3-Flags"
+	jaegerHeader      = "uber-trace-id"
+)
+
+// Propagator reads and writes the span context from and to the headers of a request.
+type Propagator interface {
+	Extract(header http.Header) (SpanContext, bool)
+	Inject(sc SpanContext, header http.Header)
+}
+
+// CreatePropagator returns the propagator for one of the supported formats.
+// An empty name selects the W3C trace context.
+func CreatePropagator(name string) (Propagator, error) {
+	switch strings.ToLower(name) {
+	case "", PropagatorW3C:
+		return w3cPropagator{}, nil
+	case PropagatorB3:
+		return b3Propagator{}, nil
+	case PropagatorB3Multi:
+		return b3Propagator{multi: true}, nil
+	case PropagatorJaeger:
+		return jaegerPropagator{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown propagator %q, must be one of %s, %s, %s or %s", name, PropagatorW3C, PropagatorB3, PropagatorB3Multi, PropagatorJaeger)
+}
+
+// HasTraceContext returns whether the headers contain a trace context in any of the supported formats.
+func HasTraceContext(header http.Header) bool {
+	return header.Get(traceparentHeader) != "" ||
+		header.Get(b3Header) != "" ||
+		header.Get(b3TraceIdHeader) != "" ||
+		header.Get(jaegerHeader) != ""
+}
+
+// Extract returns a context carrying the remote span context found in the headers.
+// If the headers don't contain a valid span context, ctx is returned unchanged.
+func (tracer *Tracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+
+	if sc, ok := tracer.propagator.Extract(header); ok {
+		return ContextWithRemoteSpanContext(ctx, sc)
+	}
+
+	return ctx
+}
+
+// Inject writes the headers for the current span of the context.
+// If the context doesn't carry a span, the headers are left untouched.
+func (tracer *Tracer) Inject(ctx context.Context, header http.Header) {
+	if tracer == nil {
+		return
+	}
+
+	if span := SpanFromContext(ctx); span != nil {
+		tracer.propagator.Inject(span.SpanContext, header)
+	}
+}
+
+// w3cPropagator implements the W3C trace context, eg. traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+type w3cPropagator struct{}
+
+func (w3cPropagator) Extract(header http.Header) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header.Get(traceparentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// Version 00 must have exactly 4 parts, future versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	sc := SpanContext{}
+
+	if !decodeHex(parts[1], sc.TraceId[:], false) || !decodeHex(parts[2], sc.SpanId[:], false) {
+		return SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(parts[3], flags[:], false) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, sc.IsValid()
+}
+
+func (w3cPropagator) Inject(sc SpanContext, header http.Header) {
+	header.Set(traceparentHeader, "00-"+sc.TraceId.String()+"-"+sc.SpanId.String()+"-"+sampledFlag(sc, "01", "00"))
+}
+
+// b3Propagator implements the B3 format of zipkin, either as the single b3 header
+// or as multiple X-B3-* headers.
+type b3Propagator struct {
+	multi bool
+}
+
+func (b3Propagator) Extract(header http.Header) (SpanContext, bool) {
+	// The single header takes precedence, as defined by the specification
+	if value := strings.TrimSpace(header.Get(b3Header)); value != "" {
+		// b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}, where the last two parts are optional
+		parts := strings.Split(value, "-")
+		if len(parts) < 2 || len(parts) > 4 {
+			return SpanContext{}, false
+		}
+
+		samplingState := ""
+		if len(parts) > 2 {
+			samplingState = parts[2]
+		}
+
+		return parseB3(parts[0], parts[1], samplingState)
+	}
+
+	samplingState := header.Get(b3SampledHeader)
+	if header.Get(b3FlagsHeader) == "1" {
+		samplingState = "d"
+	}
+
+	return parseB3(header.Get(b3TraceIdHeader), header.Get(b3SpanIdHeader), samplingState)
+}
+
+func (propagator b3Propagator) Inject(sc SpanContext, header http.Header) {
+	if propagator.multi {
+		header.Set(b3TraceIdHeader, sc.TraceId.String())
+		header.Set(b3SpanIdHeader, sc.SpanId.String())
+		header.Set(b3SampledHeader, sampledFlag(sc, "1", "0"))
+		return
+	}
+
+	header.Set(b3Header, sc.TraceId.String()+"-"+sc.SpanId.String()+"-"+sampledFlag(sc, "1", "0"))
+}
+
+func parseB3(traceId string, spanId string, samplingState string) (SpanContext, bool) {
+	sc := SpanContext{}
+
+	// The trace id may either be 64 or 128 bit
+	if len(traceId) != 16 && len(traceId) != 32 {
+		return SpanContext{}, false
+	}
+	if !decodeHex(traceId, sc.TraceId[:], true) || !decodeHex(spanId, sc.SpanId[:], false) {
+		return SpanContext{}, false
+	}
+
+	switch strings.ToLower(samplingState) {
+	case "1", "d", "true":
+		sc.Sampled = true
+	case "", "0", "false":
+		sc.Sampled = false
+	default:
+		return SpanContext{}, false
+	}
+
+	return sc, sc.IsValid()
+}
+
+// jaegerPropagator implements the format of jaeger, eg. uber-trace-id: 4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:1.
+type jaegerPropagator struct{}
+
+func (jaegerPropagator) Extract(header http.Header) (SpanContext, bool) {
+	value, err := url.PathUnescape(strings.TrimSpace(header.Get(jaegerHeader)))
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	// {trace-id}:{span-id}:{parent-span-id}:{flags}, where the ids are not necessarily zero padded
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 || len(parts[0]) > 32 || len(parts[1]) > 16 {
+		return SpanContext{}, false
+	}
+
+	sc := SpanContext{}
+
+	if !decodeHex(parts[0], sc.TraceId[:], true) || !decodeHex(parts[1], sc.SpanId[:], true) {
+		return SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if len(parts[3]) > 2 || !decodeHex(parts[3], flags[:], true) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, sc.IsValid()
+}
+
+func (jaegerPropagator) Inject(sc SpanContext, header http.Header) {
+	header.Set(jaegerHeader, sc.TraceId.String()+":"+sc.SpanId.String()+":0:"+sampledFlag(sc, "1", "0"))
+}
+
+func sampledFlag(sc SpanContext, sampled string, notSampled string) string {
+	if sc.Sampled {
+		return sampled
+	}
+
+	return notSampled
+}
+
+// decodeHex decodes a lowercase hex value into target.
+// When pad is true, shorter values are left-padded with zeros.
+func decodeHex(value string, target []byte, pad bool) bool {
+	length := hex.EncodedLen(len(target))
+
+	if value == "" || len(value) > length || (!pad && len(value) != length) || strings.ToLower(value) != value {
+		return false
+	}
+
+	value = strings.Repeat("0", length-len(value)) + value
+
+	_, err := hex.Decode(target, []byte(value))
+	return err == nil
+}
@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestPropagatorsExtractTraceContext(t *testing.T) {
+	tests := []struct {
+		propagator string
+		headers    map[string]string
+		traceId    string
+		sampled    bool
+	}{
+		{PropagatorW3C, map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{PropagatorW3C, map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}, "4bf92f3577b34da6a3ce929d0e0e4736", false},
+		{PropagatorB3, map[string]string{"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1-05e3ac9a4f6e3b90"}, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{PropagatorB3, map[string]string{"b3": "a3ce929d0e0e4736-00f067aa0ba902b7"}, "0000000000000000a3ce929d0e0e4736", false},
+		{PropagatorB3Multi, map[string]string{"X-B3-TraceId": "4bf92f3577b34da6a3ce929d0e0e4736", "X-B3-SpanId": "00f067aa0ba902b7", "X-B3-Sampled": "1"}, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{PropagatorB3Multi, map[string]string{"X-B3-TraceId": "4bf92f3577b34da6a3ce929d0e0e4736", "X-B3-SpanId": "00f067aa0ba902b7", "X-B3-Flags": "1"}, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{PropagatorJaeger, map[string]string{"uber-trace-id": "4bf92f3577b34da6a3ce929d0e0e4736:f067aa0ba902b7:0:1"}, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{PropagatorJaeger, map[string]string{"uber-trace-id": "a3ce929d0e0e4736%3A00f067aa0ba902b7%3A0%3A0"}, "0000000000000000a3ce929d0e0e4736", false},
+	}
+
+	for _, test := range tests {
+		propagator, err := CreatePropagator(test.propagator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := http.Header{}
+		for name, value := range test.headers {
+			header.Set(name, value)
+		}
+
+		if !HasTraceContext(header) {
+			t.Errorf("%s: Expected %v to contain a trace context", test.propagator, test.headers)
+		}
+
+		sc, ok := propagator.Extract(header)
+		if !ok {
+			t.Errorf("%s: Expected %v to be extracted", test.propagator, test.headers)
+			continue
+		}
+		if sc.TraceId.String() != test.traceId || sc.SpanId.String() != "00f067aa0ba902b7" || sc.Sampled != test.sampled {
+			t.Errorf("%s: Unexpected span context %+v", test.propagator, sc)
+		}
+	}
+}
+
+func TestPropagatorsRejectInvalidTraceContext(t *testing.T) {
+	tests := []struct {
+		propagator string
+		name       string
+		value      string
+	}{
+		{PropagatorW3C, "traceparent", ""},
+		{PropagatorW3C, "traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{PropagatorW3C, "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{PropagatorW3C, "traceparent", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{PropagatorW3C, "traceparent", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{PropagatorB3, "b3", "0"},
+		{PropagatorB3, "b3", "4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-1"},
+		{PropagatorB3, "b3", "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-x"},
+		{PropagatorJaeger, "uber-trace-id", "4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0"},
+		{PropagatorJaeger, "uber-trace-id", "0:00f067aa0ba902b7:0:1"},
+	}
+
+	for _, test := range tests {
+		propagator, _ := CreatePropagator(test.propagator)
+
+		header := http.Header{}
+		header.Set(test.name, test.value)
+
+		if _, ok := propagator.Extract(header); ok {
+			t.Errorf("%s: Expected %q to be rejected", test.propagator, test.value)
+		}
+	}
+}
+
+func TestPropagatorsInjectTraceContext(t *testing.T) {
+	sc := SpanContext{Sampled: true}
+	copy(sc.TraceId[:], []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36})
+	copy(sc.SpanId[:], []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7})
+
+	tests := map[string]map[string]string{
+		PropagatorW3C:     {"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		PropagatorB3:      {"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"},
+		PropagatorB3Multi: {"X-B3-TraceId": "4bf92f3577b34da6a3ce929d0e0e4736", "X-B3-SpanId": "00f067aa0ba902b7", "X-B3-Sampled": "1"},
+		PropagatorJaeger:  {"uber-trace-id": "4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:1"},
+	}
+
+	for name, expected := range tests {
+		propagator, _ := CreatePropagator(name)
+
+		header := http.Header{}
+		propagator.Inject(sc, header)
+
+		for headerName, value := range expected {
+			if header.Get(headerName) != value {
+				t.Errorf("%s: Expected %s to be %q, but got %q", name, headerName, value, header.Get(headerName))
+			}
+		}
+
+		// Round trip
+		if extracted, ok := propagator.Extract(header); !ok || extracted != sc {
+			t.Errorf("%s: Expected %+v, but got %+v", name, sc, extracted)
+		}
+	}
+}
+
+func TestCreatePropagatorRejectsUnknownFormat(t *testing.T) {
+	if _, err := CreatePropagator("xray"); err == nil {
+		t.Error("Expected an error for an unknown propagator")
+	}
+}
+
+func TestTracerContinuesExtractedTrace(t *testing.T) {
+	propagator, _ := CreatePropagator(PropagatorB3)
+	tracer := CreateTracer(0, propagator, nil)
+
+	header := http.Header{}
+	header.Set("b3", "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1")
+
+	ctx, span := tracer.Start(tracer.Extract(context.Background(), header), "oidc.request", SpanKindServer)
+
+	upstream := http.Header{}
+	tracer.Inject(ctx, upstream)
+
+	expected := "4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanContext.SpanId.String() + "-1"
+	if upstream.Get("b3") != expected {
+		t.Errorf("Expected %s, but got %s", expected, upstream.Get("b3"))
+	}
+}
@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type TraceId [16]byte
+type SpanId [8]byte
+
+func (id TraceId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceId) IsValid() bool {
+	return id != TraceId{}
+}
+
+func (id SpanId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanId) IsValid() bool {
+	return id != SpanId{}
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId.IsValid() && sc.SpanId.IsValid()
+}
+
+// The kinds of spans as defined by OTLP.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// The status codes of spans as defined by OTLP.
+const (
+	StatusUnset = 0
+	StatusOk    = 1
+	StatusError = 2
+)
+
+// Span represents a single operation within a trace.
+// All methods may be called on a nil span, in which case nothing is recorded.
+type Span struct {
+	Name         string
+	Kind         int
+	SpanContext  SpanContext
+	ParentSpanId SpanId
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	Status       int
+	StatusText   string
+
+	tracer *Tracer
+	lock   sync.Mutex
+	ended  bool
+}
+
+// SetAttribute sets an attribute of the span. The value should be a string, bool, int, int64 or float64.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.lock.Lock()
+	span.Attributes[key] = value
+	span.lock.Unlock()
+}
+
+// RecordError marks the span as failed. Nil errors are ignored.
+func (span *Span) RecordError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+
+	span.lock.Lock()
+	span.Status = StatusError
+	span.StatusText = err.Error()
+	span.lock.Unlock()
+}
+
+// End ends the span and queues it for export, if it is sampled.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+
+	span.lock.Lock()
+	if span.ended {
+		span.lock.Unlock()
+		return
+	}
+	span.ended = true
+	span.EndTime = time.Now()
+	span.lock.Unlock()
+
+	if span.SpanContext.Sampled {
+		span.tracer.exporter.enqueue(span)
+	}
+}
+
+// TraceId returns the id of the trace as a hex string, or an empty string for a nil span.
+func (span *Span) TraceId() string {
+	if span == nil {
+		return ""
+	}
+
+	return span.SpanContext.TraceId.String()
+}
+
+type spanContextKey struct{}
+type remoteSpanContextKey struct{}
+
+// ContextWithSpan returns a context which carries the span as the parent of new spans.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the current span of the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext returns a context which carries a span context received from another process.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+func remoteSpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+func newTraceId() TraceId {
+	var id TraceId
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanId() SpanId {
+	var id SpanId
+	_, _ = rand.Read(id[:])
+	return id
+}
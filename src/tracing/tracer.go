@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// Tracer creates spans and passes the sampled ones to the exporter.
+// All methods may be called on a nil tracer, in which case no spans are created.
+type Tracer struct {
+	// A value between 0 and 1 defining the ratio of traces to sample, unless the parent decided already.
+	sampleRate float64
+	propagator Propagator
+	exporter   *OtlpExporter
+}
+
+// CreateTracer creates a new tracer. If propagator is nil, the W3C trace context is used.
+func CreateTracer(sampleRate float64, propagator Propagator, exporter *OtlpExporter) *Tracer {
+	if propagator == nil {
+		propagator = w3cPropagator{}
+	}
+
+	return &Tracer{
+		sampleRate: sampleRate,
+		propagator: propagator,
+		exporter:   exporter,
+	}
+}
+
+// Start creates a new span, which is a child of the span or remote span context in ctx.
+// The returned context carries the new span.
+func (tracer *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     tracer,
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.SpanContext.TraceId = parent.SpanContext.TraceId
+		span.SpanContext.Sampled = parent.SpanContext.Sampled
+		span.ParentSpanId = parent.SpanContext.SpanId
+	} else if remote, ok := remoteSpanContextFromContext(ctx); ok && remote.IsValid() {
+		span.SpanContext.TraceId = remote.TraceId
+		span.SpanContext.Sampled = remote.Sampled
+		span.ParentSpanId = remote.SpanId
+	} else {
+		span.SpanContext.TraceId = newTraceId()
+		span.SpanContext.Sampled = tracer.shouldSample(span.SpanContext.TraceId)
+	}
+
+	span.SpanContext.SpanId = newSpanId()
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// shouldSample decides based on the trace id, so all instances make the same decision for a trace.
+func (tracer *Tracer) shouldSample(traceId TraceId) bool {
+	if tracer.sampleRate >= 1 {
+		return true
+	}
+	if tracer.sampleRate <= 0 {
+		return false
+	}
+
+	// Same as OpenTelemetry's TraceIdRatioBased sampler
+	threshold := uint64(tracer.sampleRate * (1 << 63))
+	return binary.BigEndian.Uint64(traceId[8:16])>>1 < threshold
+}
+
+// Shutdown exports all pending spans.
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	if tracer == nil {
+		return nil
+	}
+
+	return tracer.exporter.Shutdown(ctx)
+}
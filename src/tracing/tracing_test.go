@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSpansAreExportedUsingOtlp(t *testing.T) {
+	received := make(chan *otlpRequest, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		request := &otlpRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			t.Errorf("Invalid OTLP request: %s", err.Error())
+		}
+
+		received <- request
+	}))
+	defer server.Close()
+
+	endpoint, err := NormalizeOtlpEndpoint(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := CreateOtlpExporter(endpoint, map[string]string{"X-Api-Key": "secret"}, nil, "oidc", server.Client(), time.Hour)
+	tracer := CreateTracer(1, nil, exporter)
+
+	ctx, parent := tracer.Start(context.Background(), "oidc.request", SpanKindServer)
+	_, child := tracer.Start(ctx, "oidc.token_refresh", SpanKindInternal)
+	child.RecordError(errors.New("refresh failed"))
+	child.End()
+	parent.SetAttribute("http.method", "GET")
+	parent.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-received
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, but got %d", len(spans))
+	}
+	if spans[0].TraceId != spans[1].TraceId || spans[0].ParentSpanId != spans[1].SpanId {
+		t.Errorf("Expected the refresh to be a child of the request, but got %+v", spans)
+	}
+	if spans[0].Status.Code != StatusError || spans[0].Status.Message != "refresh failed" {
+		t.Errorf("Expected the error to be recorded, but got %+v", spans[0].Status)
+	}
+}
+
+func TestSamplingFollowsParentAndRate(t *testing.T) {
+	tracer := CreateTracer(0, nil, nil)
+
+	_, span := tracer.Start(context.Background(), "unsampled", SpanKindServer)
+	if span.SpanContext.Sampled {
+		t.Error("Expected no span to be sampled with a rate of 0")
+	}
+
+	remote := SpanContext{TraceId: newTraceId(), SpanId: newSpanId(), Sampled: true}
+	_, span = tracer.Start(ContextWithRemoteSpanContext(context.Background(), remote), "sampled", SpanKindServer)
+	if !span.SpanContext.Sampled || span.SpanContext.TraceId != remote.TraceId || span.ParentSpanId != remote.SpanId {
+		t.Error("Expected the span to continue the sampled remote trace")
+	}
+
+	var nilTracer *Tracer
+	ctx, nilSpan := nilTracer.Start(context.Background(), "disabled", SpanKindServer)
+	nilSpan.SetAttribute("key", "value")
+	nilSpan.End()
+	if nilSpan != nil || SpanFromContext(ctx) != nil {
+		t.Error("Expected a nil tracer to create no spans")
+	}
+}
+
+func TestShutdownOfStoppedExporter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	exporter := CreateOtlpExporter(server.URL+"/v1/traces", nil, nil, "oidc", server.Client(), time.Hour)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := exporter.Shutdown(ctx)
+		cancel()
+
+		if err != nil {
+			t.Errorf("Expected shutdown %d to succeed, but got %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/tracing"
+)
+
+func TestTraceContextIsPropagatedToUpstream(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.Tracer = tracing.CreateTracer(1, nil, nil)
+	toa.BypassAuthenticationRule, _ = rules.ParseRequestCondition("PathPrefix(`/`)")
+
+	var upstreamTraceparent string
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamTraceparent = req.Header.Get("traceparent")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	toa.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.HasPrefix(upstreamTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(upstreamTraceparent, "00f067aa0ba902b7") {
+		t.Errorf("Expected a child of the incoming trace, but got %q", upstreamTraceparent)
+	}
+}
+
+func TestTraceContextIsPropagatedToProvider(t *testing.T) {
+	var providerTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		providerTraceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	toa := newTestOidcAuth(&Config{})
+	toa.Tracer = tracing.CreateTracer(1, nil, nil)
+	client := &http.Client{Transport: &providerTracingTransport{next: http.DefaultTransport, toa: toa}}
+
+	// Requests outside of a trace are not traced
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+"/token", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if providerTraceparent != "" {
+		t.Errorf("Expected no traceparent, but got %q", providerTraceparent)
+	}
+
+	ctx, span := toa.Tracer.Start(context.Background(), "oidc.request", tracing.SpanKindServer)
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/token", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !strings.HasPrefix(providerTraceparent, "00-"+span.TraceId()+"-") || strings.Contains(providerTraceparent, span.SpanContext.SpanId.String()) {
+		t.Errorf("Expected a client span of the request, but got %q", providerTraceparent)
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Errorf("Expected the original request to be left untouched")
+	}
+}
+
+type exportedSpan struct {
+	Name         string `json:"name"`
+	SpanId       string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// createTestTracer returns a tracer exporting to a fake collector.
+// The returned function shuts down the tracer and returns all exported spans.
+func createTestTracer(t *testing.T) (*tracing.Tracer, func() []exportedSpan) {
+	spans := make([]exportedSpan, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Invalid OTLP request: %s", err.Error())
+		}
+
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	exporter := tracing.CreateOtlpExporter(server.URL+"/v1/traces", nil, nil, "test", server.Client(), time.Hour)
+	tracer := tracing.CreateTracer(1, nil, exporter)
+
+	return tracer, func() []exportedSpan {
+		if err := tracer.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		return spans
+	}
+}
+
+func TestAttachHeadersRecordsSpan(t *testing.T) {
+	toa := newTestOidcAuth(&Config{
+		Headers: []HeaderConfig{
+			{Name: "X-User", Value: "{{ .claims.name }}"},
+			{Name: "X-Broken", Value: "{{ index .claims 1 }}"},
+		},
+	})
+
+	tracer, exportedSpans := createTestTracer(t)
+	toa.Tracer = tracer
+
+	ctx, span := tracer.Start(context.Background(), "oidc.request", tracing.SpanKindServer)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil).WithContext(ctx)
+
+	err := toa.attachHeaders(req, &session.SessionState{}, map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	if req.Header.Get("X-User") != "alice" {
+		t.Errorf("Expected X-User to be alice, but got %s", req.Header.Get("X-User"))
+	}
+
+	spans := exportedSpans()
+	if len(spans) != 2 || spans[0].Name != "oidc.attach_headers" || spans[0].ParentSpanId != spans[1].SpanId {
+		t.Fatalf("Expected an attach_headers span as child of the request, but got %+v", spans)
+	}
+	if spans[0].Status.Code != tracing.StatusError || !strings.Contains(spans[0].Status.Message, "X-Broken") {
+		t.Errorf("Expected the template failure to be recorded, but got %+v", spans[0].Status)
+	}
+}
+
+func TestRenewTokenRecordsSpan(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	toa := newTestOidcAuth(&Config{})
+	toa.httpClient = server.Client()
+	toa.DiscoveryDocument = &oidc.OidcDiscovery{TokenEndpoint: server.URL + "/token"}
+
+	tracer, exportedSpans := createTestTracer(t)
+	toa.Tracer = tracer
+
+	if _, err := toa.renewToken(context.Background(), toa.primaryProvider(), "refresh-token"); err == nil {
+		t.Fatal("Expected the refresh to fail")
+	}
+
+	spans := exportedSpans()
+	if len(spans) != 1 || spans[0].Name != "oidc.token_refresh" || spans[0].Status.Code != tracing.StatusError {
+		t.Errorf("Expected a failed token_refresh span, but got %+v", spans)
+	}
+}
+
+func TestTraceIdIsReturnedToClient(t *testing.T) {
+	toa := newTestOidcAuth(&Config{})
+	toa.Tracer = tracing.CreateTracer(1, nil, nil)
+	toa.BypassAuthenticationRule, _ = rules.ParseRequestCondition("PathPrefix(`/`)")
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Header().Get("X-Trace-Id") != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the trace id, but got %q", rw.Header().Get("X-Trace-Id"))
+	}
+
+	// Without tracing, a random id is generated for every request
+	toa.Tracer = nil
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+
+	if len(rw.Header().Get("X-Trace-Id")) != 32 {
+		t.Errorf("Expected a generated id, but got %q", rw.Header().Get("X-Trace-Id"))
+	}
+}
+
+func TestPendingSpansAreExportedWhenTheMiddlewareIsReplaced(t *testing.T) {
+	exported := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exported <- struct{}{}
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.Tracing.Enabled = true
+	config.Tracing.OtlpEndpoint = server.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := handler.(*TraefikOidcAuth).Tracer.Start(context.Background(), "oidc.request", tracing.SpanKindServer)
+	span.End()
+
+	// Traefik cancels the context of a middleware, which has been replaced by a new configuration
+	cancel()
+
+	select {
+	case <-exported:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the queued span to be exported when the context is cancelled")
+	}
+}
+
+func TestOtlpHeadersAreReadFromFiles(t *testing.T) {
+	received := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Api-Key")
+	}))
+	defer server.Close()
+
+	headerFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(headerFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer, err := createTracer(&TracingConfig{
+		OtlpEndpoint:    server.URL,
+		OtlpHeadersFile: map[string]string{"X-Api-Key": headerFile},
+		SampleRate:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := tracer.Start(context.Background(), "oidc.request", tracing.SpanKindServer)
+	span.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if header := <-received; header != "file-secret" {
+		t.Errorf("Expected the header to be read from the file, but got %q", header)
+	}
+
+	_, err = createTracer(&TracingConfig{
+		OtlpEndpoint:    server.URL,
+		OtlpHeaders:     map[string]string{"X-Api-Key": "secret"},
+		OtlpHeadersFile: map[string]string{"X-Api-Key": headerFile},
+		SampleRate:      1,
+	})
+	if err == nil {
+		t.Error("Expected a header in both OtlpHeaders and OtlpHeadersFile to be rejected")
+	}
+}
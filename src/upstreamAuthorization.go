@@ -0,0 +1,149 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+// The values of UpstreamAuthorization.
+const (
+	upstreamAuthorizationAccessToken = "AccessToken"
+	upstreamAuthorizationIdToken     = "IdToken"
+	upstreamAuthorizationMinted      = "Minted"
+	upstreamAuthorizationNone        = "None"
+)
+
+// normalizeUpstreamAuthorization accepts both, the PascalCase names and the snake_case names, eg. access_token.
+func normalizeUpstreamAuthorization(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	for _, name := range []string{upstreamAuthorizationAccessToken, upstreamAuthorizationIdToken, upstreamAuthorizationMinted, upstreamAuthorizationNone} {
+		if strings.EqualFold(strings.ReplaceAll(value, "_", ""), name) {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid value '%s', must be one of %s, %s, %s or %s", value, upstreamAuthorizationAccessToken, upstreamAuthorizationIdToken, upstreamAuthorizationMinted, upstreamAuthorizationNone)
+}
+
+// TokenMinter issues short-lived JWTs for upstream services, which contain a subset of the user's claims.
+// Upstream services only need to trust the middleware, instead of the identity provider.
+type TokenMinter struct {
+	method   jwt.SigningMethod
+	key      interface{}
+	keyId    string
+	issuer   string
+	audience string
+	lifetime time.Duration
+	claims   []string
+}
+
+func CreateTokenMinter(config *MintedTokenConfig) (*TokenMinter, error) {
+	if config.Lifetime <= 0 {
+		return nil, errors.New("the lifetime must be greater than 0")
+	}
+
+	minter := &TokenMinter{
+		keyId:    config.KeyId,
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		lifetime: time.Duration(config.Lifetime) * time.Second,
+		claims:   config.Claims,
+	}
+
+	switch {
+	case config.PrivateKey != "" && config.SharedSecret != "":
+		return nil, errors.New("you can only use PrivateKey OR SharedSecret, not both")
+	case config.PrivateKey != "":
+		key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(config.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %s", err.Error())
+		}
+
+		minter.method = jwt.SigningMethodRS256
+		minter.key = key
+	case config.SharedSecret != "":
+		if len(config.SharedSecret) < 32 {
+			return nil, errors.New("the shared secret must be at least 32 characters long")
+		}
+
+		minter.method = jwt.SigningMethodHS256
+		minter.key = []byte(config.SharedSecret)
+	default:
+		return nil, errors.New("either a PrivateKey or a SharedSecret is required")
+	}
+
+	return minter, nil
+}
+
+// Mint creates a signed token containing the sub claim and the configured claims of the user.
+func (minter *TokenMinter) Mint(userClaims map[string]interface{}) (string, error) {
+	now := time.Now()
+
+	claims := jwt.MapClaims{
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(minter.lifetime).Unix(),
+		"jti": uuid.New().String(),
+	}
+
+	if sub, ok := userClaims["sub"]; ok {
+		claims["sub"] = sub
+	}
+	for _, name := range minter.claims {
+		if value, ok := userClaims[name]; ok {
+			claims[name] = value
+		}
+	}
+
+	if minter.issuer != "" {
+		claims["iss"] = minter.issuer
+	}
+	if minter.audience != "" {
+		claims["aud"] = minter.audience
+	}
+
+	token := jwt.NewWithClaims(minter.method, claims)
+	if minter.keyId != "" {
+		token.Header["kid"] = minter.keyId
+	}
+
+	return token.SignedString(minter.key)
+}
+
+// setUpstreamAuthorization sets the Authorization header of the upstream request according to UpstreamAuthorization.
+func (toa *TraefikOidcAuth) setUpstreamAuthorization(req *http.Request, session *session.SessionState, claims map[string]interface{}) error {
+	var token string
+
+	switch toa.Config.UpstreamAuthorization {
+	case "":
+		return nil
+	case upstreamAuthorizationAccessToken:
+		token = session.AccessToken
+	case upstreamAuthorizationIdToken:
+		token = session.IdToken
+	case upstreamAuthorizationMinted:
+		minted, err := toa.TokenMinter.Mint(claims)
+		if err != nil {
+			return fmt.Errorf("failed to mint the upstream token: %w", err)
+		}
+		token = minted
+	}
+
+	if token == "" {
+		req.Header.Del("Authorization")
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package src
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func TestUpstreamAuthorizationValues(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"access_token": upstreamAuthorizationAccessToken,
+		"IdToken":      upstreamAuthorizationIdToken,
+		"minted":       upstreamAuthorizationMinted,
+		"None":         upstreamAuthorizationNone,
+	}
+
+	for value, expected := range tests {
+		actual, err := normalizeUpstreamAuthorization(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("Expected '%s' to be normalized to '%s', but got '%s'", value, expected, actual)
+		}
+	}
+
+	if _, err := normalizeUpstreamAuthorization("refresh_token"); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+}
+
+func TestUpstreamAuthorizationHeader(t *testing.T) {
+	state := &session.SessionState{AccessToken: "access-token", IdToken: "id-token"}
+
+	tests := map[string]string{
+		upstreamAuthorizationAccessToken: "Bearer access-token",
+		upstreamAuthorizationIdToken:     "Bearer id-token",
+		upstreamAuthorizationNone:        "",
+		"":                               "Bearer client-token",
+	}
+
+	for mode, expected := range tests {
+		toa := newTestOidcAuth(&Config{UpstreamAuthorization: mode})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer client-token")
+
+		if err := toa.attachHeaders(req, state, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := req.Header.Get("Authorization"); actual != expected {
+			t.Errorf("Expected the header to be '%s' for '%s', but got '%s'", expected, mode, actual)
+		}
+	}
+}
+
+func TestMintedUpstreamTokenWithSharedSecret(t *testing.T) {
+	config := CreateConfig().MintedToken
+	config.SharedSecret = strings.Repeat("s", 32)
+	config.Audience = "backend"
+
+	minter, err := CreateTokenMinter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{UpstreamAuthorization: upstreamAuthorizationMinted})
+	toa.TokenMinter = minter
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	claims := map[string]interface{}{"sub": "12345", "email": "jane@example.com", "secret": "not copied"}
+
+	if err := toa.attachHeaders(req, &session.SessionState{}, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	minted := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, minted, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.SharedSecret), nil
+	}, jwt.WithIssuer("traefik-oidc-auth"), jwt.WithAudience("backend"), jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		t.Fatalf("Expected a valid minted token, but got %s", err.Error())
+	}
+
+	if minted["sub"] != "12345" || minted["email"] != "jane@example.com" {
+		t.Errorf("Expected the configured claims to be copied, but got %v", minted)
+	}
+	if _, ok := minted["secret"]; ok {
+		t.Error("Expected other claims not to be copied")
+	}
+}
+
+func TestMintedUpstreamTokenWithPrivateKey(t *testing.T) {
+	key, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig().MintedToken
+	config.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	config.KeyId = "upstream"
+
+	minter, err := CreateTokenMinter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := minter.Mint(map[string]interface{}{"sub": "12345"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		t.Fatalf("Expected a valid minted token, but got %s", err.Error())
+	}
+
+	if kid := token.Header["kid"]; kid != "upstream" {
+		t.Errorf("Expected the key id to be set, but got %v", kid)
+	}
+}
+
+func TestInvalidMintedTokenConfigurationsAreRejected(t *testing.T) {
+	tests := map[string]*MintedTokenConfig{
+		"missing key":         {Lifetime: 60},
+		"short secret":        {Lifetime: 60, SharedSecret: "secret"},
+		"invalid private key": {Lifetime: 60, PrivateKey: "invalid"},
+		"invalid lifetime":    {SharedSecret: strings.Repeat("s", 32)},
+	}
+
+	for name, config := range tests {
+		if _, err := CreateTokenMinter(config); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time, so expiry can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock returns the actual time.
+var SystemClock Clock = systemClock{}
+
+// FakeClock is a Clock which only moves when it is told to.
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewFakeClock creates a clock which is stopped at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (clock *FakeClock) Advance(duration time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(duration)
+}
+
+// Set moves the clock to the given time.
+func (clock *FakeClock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = now
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockOnlyMovesWhenTold(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Fatalf("Expected %v, but got %v", start, clock.Now())
+	}
+
+	clock.Advance(90 * time.Second)
+	if expected := start.Add(90 * time.Second); !clock.Now().Equal(expected) {
+		t.Errorf("Expected %v, but got %v", expected, clock.Now())
+	}
+
+	clock.Set(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("Expected the clock to be reset to %v, but got %v", start, clock.Now())
+	}
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSecret holds a secret which is read from a file, eg. a mounted Docker or Kubernetes secret.
+// The file is read again whenever it changes, so the secret can be rotated without a restart.
+type FileSecret struct {
+	path    string
+	value   string
+	modTime time.Time
+	lock    sync.Mutex
+}
+
+func LoadFileSecret(path string) (*FileSecret, error) {
+	secret := &FileSecret{path: path}
+
+	if err := secret.read(); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// ReadSecretFile reads the secret from the file. Trailing line breaks are removed.
+func ReadSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimRight(string(content), "\r\n")
+	if value == "" {
+		return "", errors.New("secret file " + path + " is empty")
+	}
+
+	return value, nil
+}
+
+// Value returns the current secret. If the file can't be read anymore, the last known value is returned.
+func (secret *FileSecret) Value() string {
+	secret.lock.Lock()
+	defer secret.lock.Unlock()
+
+	fileInfo, err := os.Stat(secret.path)
+	if err == nil && !fileInfo.ModTime().Equal(secret.modTime) {
+		_ = secret.read()
+	}
+
+	return secret.value
+}
+
+func (secret *FileSecret) read() error {
+	fileInfo, err := os.Stat(secret.path)
+	if err != nil {
+		return err
+	}
+
+	value, err := ReadSecretFile(secret.path)
+	if err != nil {
+		return err
+	}
+
+	secret.value = value
+	secret.modTime = fileInfo.ModTime()
+
+	return nil
+}
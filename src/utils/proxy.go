@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CreateProxyFunc returns the proxy function of a http.Transport using the given settings.
+// The syntax matches the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// If no setting is given, the environment variables are used instead.
+func CreateProxyFunc(httpProxy string, httpsProxy string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if httpProxy == "" && httpsProxy == "" && noProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	httpProxyUrl, err := parseProxyUrl(httpProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	httpsProxyUrl, err := parseProxyUrl(httpsProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	bypass := parseNoProxy(noProxy)
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyUrl := httpProxyUrl
+		if req.URL.Scheme == "https" {
+			proxyUrl = httpsProxyUrl
+		}
+
+		if proxyUrl == nil || bypass.matches(req.URL) {
+			return nil, nil
+		}
+
+		return proxyUrl, nil
+	}, nil
+}
+
+func parseProxyUrl(rawUrl string) (*url.URL, error) {
+	if rawUrl == "" {
+		return nil, nil
+	}
+
+	// Like the environment variables, a proxy may be given without a scheme
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+
+	proxyUrl, err := url.Parse(rawUrl)
+	if err != nil || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url '%s'", rawUrl)
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+		return proxyUrl, nil
+	}
+
+	return nil, fmt.Errorf("unsupported proxy scheme '%s'", proxyUrl.Scheme)
+}
+
+type noProxyList struct {
+	all      bool
+	networks []*net.IPNet
+	ips      []net.IP
+	domains  []noProxyDomain
+}
+
+type noProxyDomain struct {
+	// A leading dot only matches subdomains
+	name string
+	port string
+}
+
+// parseNoProxy parses a comma-separated list of hosts, domains, IPs and CIDR ranges, eg. "localhost,.internal,10.0.0.0/8".
+func parseNoProxy(noProxy string) *noProxyList {
+	list := &noProxyList{}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			list.all = true
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			list.networks = append(list.networks, network)
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			host = entry
+			port = ""
+		}
+
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			list.ips = append(list.ips, ip)
+			continue
+		}
+
+		if strings.HasPrefix(host, "*.") {
+			host = host[1:]
+		}
+
+		list.domains = append(list.domains, noProxyDomain{name: host, port: port})
+	}
+
+	return list
+}
+
+func (list *noProxyList) matches(u *url.URL) bool {
+	if list.all {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range list.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		for _, other := range list.ips {
+			if other.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, domain := range list.domains {
+		if domain.port != "" && domain.port != port {
+			continue
+		}
+
+		if strings.HasPrefix(domain.name, ".") {
+			if strings.HasSuffix(host, domain.name) {
+				return true
+			}
+		} else if host == domain.name || strings.HasSuffix(host, "."+domain.name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateProxyFunc(t *testing.T) {
+	proxy, err := CreateProxyFunc("proxy.internal:3128", "https://secure-proxy.internal:3129", "localhost, .corp.example.com, idp.example.com:8443, 10.0.0.0/8, 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"http://idp.example.com/token":         "http://proxy.internal:3128",
+		"https://idp.example.com/token":        "https://secure-proxy.internal:3129",
+		"https://idp.example.com:8443/token":   "",
+		"https://login.corp.example.com/token": "",
+		"https://corp.example.com/token":       "https://secure-proxy.internal:3129",
+		"http://localhost:8080/token":          "",
+		"http://10.1.2.3/token":                "",
+		"http://192.168.1.10/token":            "",
+		"http://192.168.1.11/token":            "http://proxy.internal:3128",
+	}
+
+	for rawUrl, expected := range tests {
+		req, _ := http.NewRequest(http.MethodGet, rawUrl, nil)
+
+		proxyUrl, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual := ""
+		if proxyUrl != nil {
+			actual = proxyUrl.String()
+		}
+
+		if actual != expected {
+			t.Errorf("%s: Expected proxy '%s', but got '%s'", rawUrl, expected, actual)
+		}
+	}
+}
+
+func TestCreateProxyFuncRejectsInvalidUrl(t *testing.T) {
+	if _, err := CreateProxyFunc("ftp://proxy.internal", "", ""); err == nil {
+		t.Error("Expected an unsupported scheme to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"sync"
+)
+
+// SingleFlight collapses concurrent calls with the same key into a single execution.
+// Callers arriving while a call is in flight wait for it and share its result, including its error.
+// The zero value is ready to use.
+type SingleFlight struct {
+	lock  sync.Mutex
+	calls map[string]*singleFlightCall
+}
+
+type singleFlightCall struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// Do executes fn, unless a call with the same key is already in flight, in which case it waits for its result.
+// The returned bool reports whether the result has been shared with other callers.
+func (g *SingleFlight) Do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	g.lock.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*singleFlightCall)
+	}
+
+	if call, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		<-call.done
+
+		return call.result, call.err, true
+	}
+
+	call := &singleFlightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	// Release the waiting callers even if fn panics
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+
+		close(call.done)
+	}()
+
+	call.result, call.err = fn()
+
+	return call.result, call.err, false
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlightCollapsesConcurrentCalls(t *testing.T) {
+	var flight SingleFlight
+	var executions int32
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+
+	for i := 0; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			results[i], _, _ = flight.Do("key", func() (interface{}, error) {
+				if atomic.AddInt32(&executions, 1) == 1 {
+					close(started)
+				}
+				<-release
+				return "value", nil
+			})
+		}(i)
+	}
+
+	// Give the other callers the chance to join the call in flight
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Callers which arrive after the first call completed start a new call,
+	// so only check that the calls have been collapsed at all.
+	if executions >= int32(len(results)) {
+		t.Errorf("Expected concurrent calls to be collapsed, but got %d executions", executions)
+	}
+	for i, result := range results {
+		if result != "value" {
+			t.Errorf("Expected caller %d to get the result, but got %v", i, result)
+		}
+	}
+}
+
+func TestSingleFlightSharesErrorsAndStartsOver(t *testing.T) {
+	var flight SingleFlight
+
+	_, err, shared := flight.Do("key", func() (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	if err == nil || shared {
+		t.Fatalf("Expected an unshared error, but got %v", err)
+	}
+
+	result, err, _ := flight.Do("key", func() (interface{}, error) {
+		return "value", nil
+	})
+	if err != nil || result != "value" {
+		t.Errorf("Expected a new call after the previous one completed, but got %v", result)
+	}
+}
+
+func TestSingleFlightReleasesWaitersOnPanic(t *testing.T) {
+	var flight SingleFlight
+
+	func() {
+		defer func() { _ = recover() }()
+
+		flight.Do("key", func() (interface{}, error) {
+			panic("failed")
+		})
+	}()
+
+	if _, err, _ := flight.Do("key", func() (interface{}, error) { return nil, nil }); err != nil {
+		t.Error(err)
+	}
+}
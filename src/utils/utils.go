@@ -3,12 +3,15 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"math/big"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -101,6 +104,16 @@ func getSchemeFromRequest(req *http.Request) string {
 	return scheme
 }
 
+// GetClientIp returns the ip address of the client which sent the request.
+func GetClientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
 func FillHostSchemeFromRequest(req *http.Request, u *url.URL) *url.URL {
 	scheme := getSchemeFromRequest(req)
 	host := req.Header.Get("X-Forwarded-Host")
@@ -156,6 +169,34 @@ func ParseInt(s string) (int, error) {
 	return int(v.Int64()), nil
 }
 
+const (
+	CipherAesGcm  = "aes-gcm"
+	CipherXAesGcm = "xaes-256-gcm"
+)
+
+// EncryptWithCipher encrypts the plaintext using the given cipher, which can be one of CipherAesGcm or CipherXAesGcm.
+func EncryptWithCipher(plaintext string, secret string, cipherName string) (string, error) {
+	switch cipherName {
+	case "", CipherAesGcm:
+		return Encrypt(plaintext, secret)
+	case CipherXAesGcm:
+		nonce := make([]byte, xaesNonceSize)
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return "", err
+		}
+
+		ciphertext, err := xaesSeal([]byte(secret), nonce, []byte(plaintext))
+		if err != nil {
+			return "", err
+		}
+
+		return base64.StdEncoding.EncodeToString(ciphertext), nil
+	default:
+		return "", fmt.Errorf("unsupported cipher '%s'", cipherName)
+	}
+}
+
 func Encrypt(plaintext string, secret string) (string, error) {
 	aesCipher, err := aes.NewCipher([]byte(secret))
 	if err != nil {
@@ -208,6 +249,9 @@ func Decrypt(ciphertext string, secret string) (string, error) {
 	// Since we know the ciphertext is actually nonce+ciphertext
 	// And len(nonce) == NonceSize(). We can separate the two.
 	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return "", errors.New("ciphertext is too short")
+	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
 	plaintext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
@@ -319,6 +363,52 @@ func ParseAcceptHeader(raw string) []AcceptType {
 	return acceptTypes
 }
 
+// ParseAcceptLanguage returns the language tags of an Accept-Language header, ordered by their weight.
+func ParseAcceptLanguage(raw string) []string {
+	type weightedLanguage struct {
+		tag    string
+		weight float64
+	}
+
+	var languages []weightedLanguage
+
+	for _, part := range strings.Split(raw, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		weight := 1.0
+
+		if qValue, hasWeight := strings.CutPrefix(strings.TrimSpace(params), "q="); hasWeight {
+			parsed, err := strconv.ParseFloat(qValue, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+
+		if weight <= 0 {
+			continue
+		}
+
+		languages = append(languages, weightedLanguage{tag: tag, weight: weight})
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].weight > languages[j].weight
+	})
+
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.tag
+	}
+
+	return tags
+}
+
 func IsHtmlRequest(req *http.Request) bool {
 	acceptTypes := ParseAcceptHeader(req.Header.Get("Accept"))
 
@@ -384,3 +474,77 @@ func IsXHRRequestWithHeaders(req *http.Request, headers map[string][]string) boo
 
 	return false
 }
+
+// DecryptWithSecrets tries to decrypt the ciphertext with each of the secrets in order.
+// This allows to rotate the secret while still accepting values encrypted with a previous one.
+// Both supported ciphers are tried, so the cipher can be changed without invalidating existing values.
+func DecryptWithSecrets(ciphertext string, secrets []string) (string, error) {
+	err := errors.New("no secret provided")
+
+	for _, secret := range secrets {
+		var plaintext string
+		plaintext, err = Decrypt(ciphertext, secret)
+		if err == nil {
+			return plaintext, nil
+		}
+
+		plaintext, err = decryptXaes(ciphertext, secret)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return "", err
+}
+
+func decryptXaes(ciphertext string, secret string) (string, error) {
+	cipherbytes, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := xaesOpen([]byte(secret), cipherbytes)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+const encryptionKeyInfo = "traefik-oidc-auth encryption key"
+
+// DeriveEncryptionKey returns a 32 byte AES key for the given secret.
+// For backwards compatibility, secrets which are exactly 32 bytes long are used as they are.
+// Any other secret is stretched using HKDF-SHA256 (RFC 5869) with the optional salt.
+func DeriveEncryptionKey(secret string, salt string) string {
+	if len(secret) == 32 {
+		return secret
+	}
+
+	return string(hkdfSha256([]byte(secret), []byte(salt), []byte(encryptionKeyInfo), 32))
+}
+
+func hkdfSha256(secret []byte, salt []byte, info []byte, length int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	// Extract
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	// Expand
+	result := make([]byte, 0, length)
+	var previous []byte
+	for counter := byte(1); len(result) < length; counter++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(previous)
+		expander.Write(info)
+		expander.Write([]byte{counter})
+		previous = expander.Sum(nil)
+		result = append(result, previous...)
+	}
+
+	return result[:length]
+}
@@ -1,8 +1,12 @@
 package utils
 
 import (
+	"encoding/hex"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestChunkString(t *testing.T) {
@@ -55,6 +59,36 @@ func TestDecryptEmptyString(t *testing.T) {
 	}
 }
 
+func TestDecryptWithPreviousSecret(t *testing.T) {
+	previousSecret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	currentSecret := "9Dk2LxQw7vBn4TzR1sYp6HgUe3JcMa8F"
+
+	encrypted, err := Encrypt("hello", previousSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := DecryptWithSecrets(encrypted, []string{currentSecret, previousSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "hello" {
+		t.Errorf("Expected 'hello', but got '%s'", decrypted)
+	}
+
+	_, err = DecryptWithSecrets(encrypted, []string{currentSecret})
+	if err == nil {
+		t.Error("Expected decryption with an unknown secret to fail")
+	}
+}
+
+func TestDecryptTooShortCiphertext(t *testing.T) {
+	_, err := Decrypt("YWJj", "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ")
+	if err == nil {
+		t.Error("Expected an error for a too short ciphertext")
+	}
+}
+
 func TestValidateRedirectUri(t *testing.T) {
 	validUris := []string{
 		"/",
@@ -355,3 +389,151 @@ func TestIsXHRRequestWithHeaders(t *testing.T) {
 		t.Errorf("Expected XHR request with empty headers map (legacy behavior)")
 	}
 }
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tags := ParseAcceptLanguage("fr-CH, fr;q=0.9, en;q=0.8, de;q=0.95, *;q=0.5, it;q=0")
+
+	expected := []string{"fr-CH", "de", "fr", "en"}
+
+	if len(tags) != len(expected) {
+		t.Fatalf("Expected %v, but got %v", expected, tags)
+	}
+
+	for i := range expected {
+		if tags[i] != expected[i] {
+			t.Errorf("Expected %v, but got %v", expected, tags)
+		}
+	}
+
+	if len(ParseAcceptLanguage("")) != 0 {
+		t.Error("Expected no languages for an empty header")
+	}
+}
+
+func TestDeriveEncryptionKey(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	if DeriveEncryptionKey(secret, "") != secret {
+		t.Error("Expected 32 character secrets to be used as they are")
+	}
+
+	passphrase := "correct horse battery staple"
+	key := DeriveEncryptionKey(passphrase, "")
+	if len(key) != 32 {
+		t.Fatalf("Expected a 32 byte key, but got %d bytes", len(key))
+	}
+	if DeriveEncryptionKey(passphrase, "") != key {
+		t.Error("Expected key derivation to be deterministic")
+	}
+	if DeriveEncryptionKey(passphrase, "salt") == key {
+		t.Error("Expected the salt to change the derived key")
+	}
+
+	encrypted, err := Encrypt("hello", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := Decrypt(encrypted, key)
+	if err != nil || decrypted != "hello" {
+		t.Errorf("Expected roundtrip to succeed, but got '%s', %v", decrypted, err)
+	}
+}
+
+func TestHkdfSha256(t *testing.T) {
+	// RFC 5869, Test Case 1
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	actual := hex.EncodeToString(hkdfSha256(ikm, salt, info, 42))
+	if actual != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, actual)
+	}
+}
+
+func TestXaesSeal(t *testing.T) {
+	// Test vector from https://c2sp.org/XAES-256-GCM
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = 0x01
+	}
+
+	ciphertext, err := xaesSeal(key, []byte("ABCDEFGHIJKLMNOPQRSTUVWX"), []byte("XAES-256-GCM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ce546ef63c9cc60765923609b33a9a1974e96e52daf2fcf7075e2271"
+	actual := hex.EncodeToString(ciphertext[xaesNonceSize:])
+	if actual != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, actual)
+	}
+}
+
+func TestDecryptWithSecretsAcceptsBothCiphers(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	for _, cipherName := range []string{CipherAesGcm, CipherXAesGcm} {
+		encrypted, err := EncryptWithCipher("hello", secret, cipherName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decrypted, err := DecryptWithSecrets(encrypted, []string{secret})
+		if err != nil || decrypted != "hello" {
+			t.Errorf("Expected roundtrip with %s to succeed, but got '%s', %v", cipherName, decrypted, err)
+		}
+	}
+
+	if _, err := EncryptWithCipher("hello", secret, "rot13"); err == nil {
+		t.Error("Expected an error for an unsupported cipher")
+	}
+}
+
+func TestFileSecretIsReloadedOnChange(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "client-secret")
+
+	if err := os.WriteFile(filePath, []byte("first-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := LoadFileSecret(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Value() != "first-secret" {
+		t.Errorf("Expected 'first-secret', but got '%s'", secret.Value())
+	}
+
+	if err := os.WriteFile(filePath, []byte("second-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes, even on file systems with a coarse resolution
+	if err := os.Chtimes(filePath, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if secret.Value() != "second-secret" {
+		t.Errorf("Expected 'second-secret', but got '%s'", secret.Value())
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Value() != "second-secret" {
+		t.Error("Expected the last known secret to be kept when the file is missing")
+	}
+}
+
+func TestReadSecretFileRejectsEmptyFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "secret")
+
+	if err := os.WriteFile(filePath, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadSecretFile(filePath); err == nil {
+		t.Error("Expected an error for an empty secret file")
+	}
+}
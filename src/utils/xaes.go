@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// XAES-256-GCM as specified in https://c2sp.org/XAES-256-GCM.
+// It extends AES-256-GCM to 24 byte nonces by deriving a per-nonce key, so random nonces
+// can be used safely for a practically unlimited number of messages.
+
+const xaesNonceSize = 24
+
+func newXaesGcm(key []byte, nonce []byte) (cipher.AEAD, error) {
+	if len(nonce) != xaesNonceSize {
+		return nil, errors.New("invalid XAES-256-GCM nonce size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// K1 is the CMAC subkey of K
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+
+	msb := k1[0] >> 7
+	for i := 0; i < len(k1)-1; i++ {
+		k1[i] = k1[i]<<1 | k1[i+1]>>7
+	}
+	k1[len(k1)-1] <<= 1
+	k1[len(k1)-1] ^= msb * 0x87
+
+	// Derive the per-nonce key by two CMAC invocations over the first half of the nonce
+	derivedKey := make([]byte, 0, 32)
+	for _, counter := range []byte{1, 2} {
+		m := make([]byte, aes.BlockSize)
+		m[1] = counter
+		m[2] = 'X'
+		copy(m[4:], nonce[:12])
+
+		for i := range m {
+			m[i] ^= k1[i]
+		}
+
+		block.Encrypt(m, m)
+		derivedKey = append(derivedKey, m...)
+	}
+
+	derivedBlock, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(derivedBlock)
+}
+
+// xaesSeal encrypts the plaintext and returns nonce+ciphertext.
+func xaesSeal(key []byte, nonce []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newXaesGcm(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(append([]byte{}, nonce...), nonce[12:], plaintext, nil), nil
+}
+
+// xaesOpen decrypts nonce+ciphertext as returned by xaesSeal.
+func xaesOpen(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < xaesNonceSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce := ciphertext[:xaesNonceSize]
+
+	gcm, err := newXaesGcm(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce[12:], ciphertext[xaesNonceSize:], nil)
+}
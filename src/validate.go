@@ -0,0 +1,103 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Validate checks the configuration without starting the middleware, eg. in CI pipelines.
+// When checkProvider is true, the discovery document and the JWKS of the provider are fetched as well.
+// All problems which have been found are returned.
+func Validate(ctx context.Context, config *Config, checkProvider bool) []error {
+	toa, err := createTraefikOidcAuth(ctx, http.NotFoundHandler(), config, "validate-config")
+	if err != nil {
+		return []error{err}
+	}
+
+	var problems []error
+
+	if err := validateHeaderTemplates(config.Headers); err != nil {
+		problems = append(problems, err)
+	}
+
+	problems = append(problems, validateRedirectUriPatterns(toa.logger, "ValidPostLoginRedirectUris", config.ValidPostLoginRedirectUris)...)
+	problems = append(problems, validateRedirectUriPatterns(toa.logger, "ValidPostLogoutRedirectUris", config.ValidPostLogoutRedirectUris)...)
+
+	if checkProvider && toa.ProviderURL != nil {
+		if err := toa.EnsureOidcDiscovery(ctx); err != nil {
+			problems = append(problems, fmt.Errorf("unable to get the discovery document of the provider %s: %s", toa.ProviderURL, err.Error()))
+		} else if err := toa.Jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, false); err != nil {
+			problems = append(problems, fmt.Errorf("unable to load the JWKS of the provider from %s: %s", toa.Jwks.Url, err.Error()))
+		}
+	}
+
+	if checkProvider && toa.SecondaryProvider != nil {
+		if _, err := toa.SecondaryProvider.ensureDiscovery(ctx, toa); err != nil {
+			problems = append(problems, fmt.Errorf("unable to get the discovery document of the secondary provider %s: %s", toa.SecondaryProvider.Url, err.Error()))
+		}
+	}
+
+	return problems
+}
+
+func validateHeaderTemplates(headers []HeaderConfig) error {
+	for _, header := range headers {
+		if _, err := template.New("").Parse(header.Value); err != nil {
+			return fmt.Errorf("invalid template of header %s: %s", header.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateRedirectUriPatterns(logger *logging.Logger, name string, patterns []string) []error {
+	var problems []error
+
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			logger.Log(logging.LevelWarn, "%s contains '*', which allows redirects to any url.", name)
+			continue
+		}
+
+		parsedPattern, err := url.Parse(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid pattern '%s' in %s: %s", pattern, name, err.Error()))
+			continue
+		}
+
+		// Relative patterns, eg. /dashboard, only match paths on the current host, but // would be any host
+		if strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "//") {
+			continue
+		}
+
+		if parsedPattern.Scheme == "" || parsedPattern.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid pattern '%s' in %s: redirect uris must be absolute, eg. https://example.com/*, or a path, eg. /dashboard", pattern, name))
+		}
+	}
+
+	return problems
+}
+
+// LoadConfigFile reads the middleware configuration from a JSON file, using the same structure as the
+// middleware configuration in traefik. Settings which are not present in the file keep their defaults.
+func LoadConfigFile(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := CreateConfig()
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", path, err.Error())
+	}
+
+	return config, nil
+}
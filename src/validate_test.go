@@ -0,0 +1,72 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateReportsInvalidRedirectUris(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.ValidPostLoginRedirectUris = []string{"https://example.com/*", "/dashboard", "example.com/*", "//example.com/*"}
+
+	problems := Validate(context.Background(), config, false)
+
+	if len(problems) != 2 {
+		t.Fatalf("Expected exactly two problems, but got %v", problems)
+	}
+}
+
+func TestValidateReportsInvalidSecret(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Secret = "short"
+
+	if len(Validate(context.Background(), config, false)) == 0 {
+		t.Error("Expected an invalid secret to be reported")
+	}
+}
+
+func TestValidateReportsUnreachableProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Provider.Url = server.URL
+	config.Provider.ClientId = "client"
+
+	if len(Validate(context.Background(), config, true)) != 1 {
+		t.Error("Expected the unreachable provider to be reported")
+	}
+}
+
+func TestValidateReportsInvalidTracing(t *testing.T) {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com"
+	config.Provider.ClientId = "client"
+	config.Tracing.Enabled = true
+	config.Tracing.OtlpEndpoint = "otel-collector:4318"
+
+	if len(Validate(context.Background(), config, false)) == 0 {
+		t.Error("Expected an OTLP endpoint without scheme to be reported")
+	}
+
+	config.Tracing.OtlpEndpoint = "http://otel-collector:4318"
+	config.Tracing.SampleRate = 2
+
+	if len(Validate(context.Background(), config, false)) == 0 {
+		t.Error("Expected an invalid sample rate to be reported")
+	}
+
+	config.Tracing.SampleRate = 1
+	config.Tracing.Propagator = "xray"
+
+	if len(Validate(context.Background(), config, false)) == 0 {
+		t.Error("Expected an unknown propagator to be reported")
+	}
+}
@@ -0,0 +1,6 @@
+package src
+
+// Version is the version of the plugin, which is reported by the build info metric.
+// Traefik interprets the plugin from source, so it can only be set when the plugin is compiled, eg. using
+// -ldflags "-X github.com/sevensolutions/traefik-oidc-auth/src.Version=v1.0.0".
+var Version = "dev"
@@ -0,0 +1,231 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// The security-relevant events which can be sent to the webhook.
+const (
+	webhookEventAuthenticationFailed = "authentication_failed"
+	webhookEventLockout              = "lockout"
+	webhookEventLogout               = "logout"
+	webhookEventProviderFailover     = "provider_failover"
+)
+
+var webhookEvents = []string{webhookEventAuthenticationFailed, webhookEventLockout, webhookEventLogout, webhookEventProviderFailover}
+
+// The headers of the signature. The signature is the hex encoded HMAC-SHA256 of "<timestamp>.<body>",
+// so a receiver can reject old events, which are sent again by an attacker.
+const (
+	webhookSignatureHeader = "X-Oidc-Auth-Signature"
+	webhookTimestampHeader = "X-Oidc-Auth-Timestamp"
+)
+
+// The number of events which may be queued before new events are dropped.
+const webhookQueueSize = 1024
+
+// The delays between the attempts to deliver an event.
+var webhookRetryDelays = []time.Duration{time.Second, 5 * time.Second}
+
+type WebhookEvent struct {
+	Id         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	Time       string                 `json:"time"`
+	Middleware string                 `json:"middleware"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// WebhookEmitter posts security-relevant events to a webhook, eg. of a SIEM. Events are sent in the background
+// and dropped when the queue is full, so a slow receiver never delays a request.
+type WebhookEmitter struct {
+	url        string
+	secret     string
+	headers    map[string]string
+	events     []string
+	middleware string
+	client     *http.Client
+	logger     *logging.Logger
+	clock      utils.Clock
+
+	queue chan *WebhookEvent
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func CreateWebhookEmitter(logger *logging.Logger, config *WebhookConfig, middleware string) (*WebhookEmitter, error) {
+	if config.Secret == "" {
+		return nil, errors.New("the webhook requires a secret to sign the events")
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("the webhook timeout must be greater than 0")
+	}
+
+	events := config.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			return nil, fmt.Errorf("unknown webhook event %s. Must be one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	return &WebhookEmitter{
+		url:        config.Url,
+		secret:     config.Secret,
+		headers:    config.Headers,
+		events:     events,
+		middleware: middleware,
+		client:     &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		logger:     logger,
+		clock:      utils.SystemClock,
+		queue:      make(chan *WebhookEvent, webhookQueueSize),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}, nil
+}
+
+// Emit queues the event, if the webhook is enabled and subscribed to the type.
+func (emitter *WebhookEmitter) Emit(eventType string, data map[string]interface{}) {
+	if emitter == nil || !slices.Contains(emitter.events, eventType) {
+		return
+	}
+
+	event := &WebhookEvent{
+		Id:         uuid.New().String(),
+		Type:       eventType,
+		Time:       emitter.clock.Now().UTC().Format(time.RFC3339),
+		Middleware: emitter.middleware,
+		Data:       data,
+	}
+
+	select {
+	case emitter.queue <- event:
+	default:
+		emitter.logger.Log(logging.LevelWarn, "The webhook queue is full. Dropping the %s event.", eventType)
+	}
+}
+
+// run delivers the queued events until the emitter is shut down.
+func (emitter *WebhookEmitter) run() {
+	defer close(emitter.stopped)
+
+	for {
+		select {
+		case event := <-emitter.queue:
+			emitter.deliverWithRetries(event)
+		case <-emitter.stop:
+			// The remaining events are only tried once, so the shutdown isn't delayed by the retries
+			for len(emitter.queue) > 0 {
+				event := <-emitter.queue
+				if err := emitter.deliver(event); err != nil {
+					emitter.logFailedDelivery(event, err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Shutdown sends the queued events and stops the emitter, which must have been started using run.
+// Events emitted afterwards are dropped once the queue is full.
+func (emitter *WebhookEmitter) Shutdown(ctx context.Context) error {
+	if emitter == nil {
+		return nil
+	}
+
+	emitter.stopOnce.Do(func() { close(emitter.stop) })
+
+	select {
+	case <-emitter.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (emitter *WebhookEmitter) deliverWithRetries(event *WebhookEvent) {
+	err := emitter.deliver(event)
+
+	for _, delay := range webhookRetryDelays {
+		if err == nil {
+			break
+		}
+
+		// A shutdown skips the delay, so the event still gets its last attempt
+		select {
+		case <-time.After(delay):
+		case <-emitter.stop:
+		}
+		err = emitter.deliver(event)
+	}
+
+	if err != nil {
+		emitter.logFailedDelivery(event, err)
+	}
+}
+
+func (emitter *WebhookEmitter) logFailedDelivery(event *WebhookEvent, err error) {
+	emitter.logger.Log(logging.LevelError, "Failed to send the %s event %s to the webhook: %s", event.Type, event.Id, err.Error())
+}
+
+func (emitter *WebhookEmitter) deliver(event *WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(emitter.clock.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, emitter.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range emitter.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookEvent(emitter.secret, timestamp, body))
+
+	resp, err := emitter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func signWebhookEvent(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
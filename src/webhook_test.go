@@ -0,0 +1,129 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func TestWebhookEventsAreSigned(t *testing.T) {
+	var received WebhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		expected := "sha256=" + signWebhookEvent("webhook-secret", req.Header.Get(webhookTimestampHeader), body)
+		if req.Header.Get(webhookSignatureHeader) != expected {
+			t.Errorf("Expected the signature %s, but got %s", expected, req.Header.Get(webhookSignatureHeader))
+		}
+		if req.Header.Get("X-Api-Key") != "key" {
+			t.Errorf("Expected the configured headers to be sent, but got %v", req.Header)
+		}
+
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	emitter, err := CreateWebhookEmitter(logging.CreateLogger(logging.LevelError), &WebhookConfig{
+		Url:     server.URL,
+		Secret:  "webhook-secret",
+		Headers: map[string]string{"X-Api-Key": "key"},
+		Timeout: 5,
+	}, "oidc-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emitter.Emit(webhookEventProviderFailover, map[string]interface{}{"provider": providerSecondary})
+
+	if err := emitter.deliver(<-emitter.queue); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Type != webhookEventProviderFailover || received.Middleware != "oidc-auth" || received.Id == "" || received.Data["provider"] != providerSecondary {
+		t.Errorf("Unexpected event %+v", received)
+	}
+}
+
+func TestWebhookOnlySendsSubscribedEvents(t *testing.T) {
+	emitter, err := CreateWebhookEmitter(logging.CreateLogger(logging.LevelError), &WebhookConfig{
+		Url:     "http://localhost",
+		Secret:  "webhook-secret",
+		Events:  []string{webhookEventLockout},
+		Timeout: 5,
+	}, "oidc-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := newTestOidcAuth(&Config{Lockout: &LockoutConfig{MaxFailures: 2, Duration: 600}})
+	toa.Lockout = CreateLockout(2, time.Minute, 10*time.Minute, utils.SystemClock)
+	toa.Webhook = emitter
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	toa.recordAuthenticationFailure(req, lockoutFailureToken, "")
+	toa.recordAuthenticationFailure(req, lockoutFailureToken, "")
+
+	if len(emitter.queue) != 1 {
+		t.Fatalf("Expected only the lockout event to be queued, but got %d events", len(emitter.queue))
+	}
+
+	event := <-emitter.queue
+	if event.Type != webhookEventLockout || event.Data["key"] != lockoutKeyIp {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestInvalidWebhookIsRejected(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelError)
+
+	if _, err := CreateWebhookEmitter(logger, &WebhookConfig{Url: "http://localhost", Timeout: 5}, "test"); err == nil {
+		t.Error("Expected a webhook without secret to be rejected")
+	}
+	if _, err := CreateWebhookEmitter(logger, &WebhookConfig{Url: "http://localhost", Secret: "secret", Events: []string{"login"}, Timeout: 5}, "test"); err == nil {
+		t.Error("Expected an unknown event to be rejected")
+	}
+}
+
+func TestWebhookSendsQueuedEventsOnShutdown(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var event WebhookEvent
+		body, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &event)
+
+		received <- event.Type
+	}))
+	defer server.Close()
+
+	emitter, err := CreateWebhookEmitter(logging.CreateLogger(logging.LevelError), &WebhookConfig{
+		Url:     server.URL,
+		Secret:  "webhook-secret",
+		Timeout: 5,
+	}, "oidc-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go emitter.run()
+
+	emitter.Emit(webhookEventLogout, nil)
+	emitter.Emit(webhookEventLockout, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := emitter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 2 {
+		t.Errorf("Expected both queued events to be sent, but got %d", len(received))
+	}
+}
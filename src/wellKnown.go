@@ -0,0 +1,26 @@
+package src
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+const wellKnownPathPrefix = "/.well-known/"
+
+// isWellKnownRequest checks whether the request is for one of the well-known uris (RFC 8615), like ACME HTTP-01
+// challenges, security.txt or apple-app-site-association. Paths which leave the directory, eg. using
+// /.well-known/../admin, are never matched, as the upstream service may resolve them.
+func (toa *TraefikOidcAuth) isWellKnownRequest(req *http.Request) bool {
+	if !toa.Config.BypassWellKnownPaths {
+		return false
+	}
+
+	requestPath := req.URL.Path
+
+	if !strings.HasPrefix(requestPath, wellKnownPathPrefix) || strings.Contains(requestPath, "/..") || strings.Contains(requestPath, "\\") {
+		return false
+	}
+
+	return strings.HasPrefix(path.Clean(requestPath), wellKnownPathPrefix)
+}
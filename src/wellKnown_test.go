@@ -0,0 +1,51 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWellKnownRequestsAreForwarded(t *testing.T) {
+	toa := newTestOidcAuth(&Config{BypassWellKnownPaths: true})
+
+	forwarded := false
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+	})
+
+	toa.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/acme-challenge/token", nil))
+
+	if !forwarded {
+		t.Error("Expected the ACME challenge to be forwarded without authentication")
+	}
+}
+
+func TestIsWellKnownRequest(t *testing.T) {
+	toa := newTestOidcAuth(&Config{BypassWellKnownPaths: true})
+
+	tests := map[string]bool{
+		"/.well-known/acme-challenge/token":       true,
+		"/.well-known/security.txt":               true,
+		"/.well-known/apple-app-site-association": true,
+		"/.well-known":                            false,
+		"/.well-known-secrets/file":               false,
+		"/admin/.well-known/security.txt":         false,
+		"/.well-known/../admin":                   false,
+		"/.well-known/%2e%2e/admin":               false,
+		"/.well-known/..%2fadmin":                 false,
+	}
+
+	for uri, expected := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+uri, nil)
+
+		if actual := toa.isWellKnownRequest(req); actual != expected {
+			t.Errorf("%s: Expected %v, but got %v", uri, expected, actual)
+		}
+	}
+
+	toa.Config.BypassWellKnownPaths = false
+	if toa.isWellKnownRequest(httptest.NewRequest(http.MethodGet, "/.well-known/security.txt", nil)) {
+		t.Error("Expected well-known paths to require authentication by default")
+	}
+}